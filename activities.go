@@ -0,0 +1,490 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type Activity struct {
+	Id               string            `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId           string            `json:"userId" oas:"description: db oid of the owning User"`
+	WorkoutId        string            `json:"workoutId" oas:"description: db oid of the Workout created from the activity"`
+	Format           string            `json:"format" oas:"$ref: ActivityFormat"`
+	FileHash         string            `json:"fileHash" oas:"description: SHA-256 (hex) of the uploaded file - uploading the same file again does not create another activity"`
+	Sport            string            `json:"sport" oas:"$ref: Sport"`
+	StartTime        time.Time         `json:"startTime" oas:"description: when the activity started"`
+	Duration         float64           `json:"duration" oas:"description: moving time in seconds (the timer time of the device - or computed from the track)"`
+	ElapsedTime      float64           `json:"elapsedTime" oas:"description: seconds from start to finish (including pauses)"`
+	Distance         *float64          `json:"distance,omitempty" oas:"description: distance in metres (miles in imperial units)"`
+	AverageHeartRate *int              `json:"averageHeartRate,omitempty" oas:"description: mean heart rate in beats per minute"`
+	MaxHeartRate     *int              `json:"maxHeartRate,omitempty" oas:"description: highest heart rate in beats per minute"`
+	ElevationGain    *float64          `json:"elevationGain,omitempty" oas:"description: total climb in metres (from the track elevations)"`
+	Laps             []ActivityLap     `json:"laps" oas:"description: the laps in order"`
+	HeartRate        []HeartRateSample `json:"heartRate,omitempty" oas:"description: the recorded heart rate samples in time order (left out of lists)"`
+	Track            []TrackSegment    `json:"track,omitempty" oas:"description: the recorded GPS track (left out of lists - see also the workout track.gpx and track.geojson)"`
+	// notes are the notes of the file (for the workout)
+	notes string
+}
+
+type ActivityLap struct {
+	StartTime        time.Time `json:"startTime" oas:"description: when the lap started"`
+	Duration         float64   `json:"duration" oas:"description: moving (timer) time of the lap in seconds"`
+	Distance         *float64  `json:"distance,omitempty" oas:"description: distance of the lap in metres (miles in imperial units)"`
+	AverageHeartRate *int      `json:"averageHeartRate,omitempty" oas:"description: mean heart rate of the lap in beats per minute"`
+	MaxHeartRate     *int      `json:"maxHeartRate,omitempty" oas:"description: highest heart rate of the lap in beats per minute"`
+}
+
+type HeartRateSample struct {
+	Offset float64 `json:"offset" oas:"description: seconds since the start of the activity"`
+	Bpm    int     `json:"bpm" oas:"description: heart rate in beats per minute"`
+}
+
+const (
+	activityFormatFit = "fit"
+	activityFormatTcx = "tcx"
+	sportOther        = "other"
+	// maxActivitySize is the largest activity file that can be uploaded (TCX files of long rides run to tens of MB)
+	maxActivitySize = 32 << 20
+)
+
+// ActivityFormats are the formats of activity files
+var ActivityFormats = []string{activityFormatFit, activityFormatGpx, activityFormatTcx}
+
+// Sports are the sports of activities
+var Sports = []string{"cycling", "hiking", sportOther, "rowing", "running", "swimming", "walking"}
+
+// sportExercises are the catalogue exercises that the workouts of activities are recorded as (by sport)
+var sportExercises = map[string]string{
+	"cycling":  "Cycling",
+	"hiking":   "Walking",
+	"rowing":   "Rowing Machine",
+	"running":  "Running",
+	"swimming": "Swimming",
+	"walking":  "Walking",
+}
+
+// ActivitiesPath is the activities uploaded by a User (nested under the user path)
+var ActivitiesPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getActivities,
+			OperationId: "listActivities",
+			Description: "The activities (without their heart rate samples and tracks)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: activityListing.queryParams(
+				unitsParam,
+				chioas.QueryParam{
+					Name:        "from",
+					Description: "Only activities starting at or after this date-time (or date)",
+					Example:     "2024-07-01T00:00:00Z",
+				},
+				chioas.QueryParam{
+					Name:        "to",
+					Description: "Only activities starting before this date-time (or date)",
+					Example:     "2024-08-01T00:00:00Z",
+				},
+			),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of Activities",
+					IsArray:     true,
+					SchemaRef:   "Activity",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postActivity,
+			OperationId: "uploadActivity",
+			Description: "Uploads a FIT, TCX or GPX 1.1 activity file (the format is detected from the content) - creating a Workout from it. The distance, elevation gain and moving time are computed from the GPS track when the file does not give them. Uploading a file that was already uploaded returns the existing activity (200)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: chioas.QueryParams{unitsParam},
+			Request: &chioas.Request{
+				Description: "The activity file",
+				Required:    true,
+				ContentType: "application/vnd.ant.fit",
+				Schema:      &chioas.Schema{Type: "string", Format: "binary"},
+				AlternativeContentTypes: chioas.ContentTypes{
+					"application/vnd.garmin.tcx+xml": {Schema: &chioas.Schema{Type: "string"}},
+					contentTypeGpx:                   {Schema: &chioas.Schema{Type: "string"}},
+				},
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created Activity",
+					SchemaRef:   "Activity",
+				},
+				http.StatusOK: {
+					Description: "The Activity the file was already uploaded as",
+					SchemaRef:   "Activity",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{activityId}": {
+			PathParams: chioas.PathParams{
+				"activityId": {
+					Description: "Activity db oid",
+					Example:     "66971add3abcef545e644011",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getActivity,
+					OperationId: "getActivity",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Activity",
+							SchemaRef:   "Activity",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteActivity,
+					OperationId: "deleteActivity",
+					Description: "Deletes the activity and its Workout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Activity deleted",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var ActivitySchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Activity",
+		Description: "A recorded activity uploaded from a device - the detail of a Workout",
+		Comment:     chioas.SourceComment(),
+	}).Must(Activity{}),
+	(&chioas.Schema{
+		Name:        "ActivityLap",
+		Description: "A lap of an Activity",
+		Comment:     chioas.SourceComment(),
+	}).Must(ActivityLap{}),
+	(&chioas.Schema{
+		Name:        "HeartRateSample",
+		Description: "A heart rate sample of an Activity",
+		Comment:     chioas.SourceComment(),
+	}).Must(HeartRateSample{}),
+	enumSchema("ActivityFormat", "Format of an uploaded activity file", ActivityFormats),
+	enumSchema("Sport", "Sport of an activity", Sports),
+}
+
+var activityListing = listing[Activity]{
+	id: func(a Activity) string { return a.Id },
+	fields: sortFields[Activity]{
+		"_id":       func(a Activity) string { return a.Id },
+		"startTime": func(a Activity) string { return sortKeyTime(a.StartTime) },
+	},
+	defaultSort: "-startTime",
+}
+
+// activities is the store used by the activity handlers (replaced by a file-backed store in main)
+var activities = NewMemoryActivityStore()
+
+func getActivities(writer http.ResponseWriter, request *http.Request) {
+	filter := ActivityFilter{UserId: chi.URLParam(request, "id")}
+	_, err := users.Get(request.Context(), filter.UserId)
+	if err == nil {
+		filter.From, err = queryTime(request, "from")
+	}
+	if err == nil {
+		filter.To, err = queryTime(request, "to")
+	}
+	var result []Activity
+	if err == nil {
+		result, err = activities.List(request.Context(), filter)
+	}
+	if err == nil {
+		result, err = activityListing.paginate(writer, request, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().activities(result)
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postActivity(writer http.ResponseWriter, request *http.Request) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxActivitySize))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeError(writer, request, newProblem(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", mbe.Limit))
+		} else {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		}
+		return
+	}
+	sum := sha256.Sum256(data)
+	fileHash := hex.EncodeToString(sum[:])
+	if existing, err := uploadedActivity(request.Context(), user.Id, fileHash); err != nil || existing != nil {
+		if err != nil {
+			writeError(writer, request, err)
+		} else {
+			writer.Header().Set("Location", request.URL.Path+"/"+existing.Id)
+			unitsFrom(request.Context()).out().activity(existing)
+			writeJson(writer, request, http.StatusOK, existing)
+		}
+		return
+	}
+	var activity Activity
+	switch {
+	case isFit(data):
+		activity, err = parseFit(data)
+	case isTcx(data):
+		activity, err = parseTcx(data)
+	case isGpx(data):
+		activity, err = parseGpx(data)
+	default:
+		err = errors.New("not a FIT, TCX or GPX file")
+	}
+	if err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "invalid activity file: %s", err.Error()))
+		return
+	}
+	activity.UserId, activity.FileHash = user.Id, fileHash
+	workout, err := activityWorkout(request.Context(), activity)
+	if err == nil {
+		err = checkWorkout(request.Context(), &workout)
+	}
+	if err == nil {
+		workout, err = workouts.Create(request.Context(), workout)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	activity.WorkoutId = workout.Id
+	if activity, err = activities.Create(request.Context(), activity); err != nil {
+		// the workout is only wanted with its activity
+		if dErr := workouts.Delete(request.Context(), workout.Id); dErr != nil {
+			loggerFrom(request.Context()).Error("deleting workout of failed upload", "workoutId", workout.Id, "error", dErr)
+		}
+		if errors.Is(err, ErrConflict) {
+			// uploaded concurrently
+			if existing, _ := uploadedActivity(request.Context(), user.Id, fileHash); existing != nil {
+				writer.Header().Set("Location", request.URL.Path+"/"+existing.Id)
+				unitsFrom(request.Context()).out().activity(existing)
+				writeJson(writer, request, http.StatusOK, existing)
+				return
+			}
+		}
+		writeError(writer, request, err)
+		return
+	}
+	updateRecords(request.Context(), user.Id)
+	writer.Header().Set("Location", request.URL.Path+"/"+activity.Id)
+	unitsFrom(request.Context()).out().activity(&activity)
+	writeJson(writer, request, http.StatusCreated, activity)
+}
+
+// uploadedActivity is the activity a user already uploaded a file as (or nil)
+func uploadedActivity(ctx context.Context, userId string, fileHash string) (*Activity, error) {
+	existing, err := activities.List(ctx, ActivityFilter{UserId: userId, FileHash: fileHash})
+	if err != nil || len(existing) == 0 {
+		return nil, err
+	}
+	activity, err := activities.Get(ctx, existing[0].Id)
+	if err != nil {
+		return nil, err
+	}
+	return &activity, nil
+}
+
+func getActivity(writer http.ResponseWriter, request *http.Request) {
+	activity, err := userActivity(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().activity(&activity)
+	writeJson(writer, request, http.StatusOK, activity)
+}
+
+func deleteActivity(writer http.ResponseWriter, request *http.Request) {
+	activity, err := userActivity(request)
+	if err == nil {
+		err = activities.Delete(request.Context(), activity.Id)
+	}
+	if err == nil {
+		if err = workouts.Delete(request.Context(), activity.WorkoutId); errors.Is(err, ErrNotFound) {
+			err = nil
+		}
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	updateRecords(request.Context(), activity.UserId)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// userActivity gets the activity of the request path - which must be of the user of the path
+func userActivity(request *http.Request) (Activity, error) {
+	id := chi.URLParam(request, "activityId")
+	activity, err := activities.Get(request.Context(), id)
+	if err == nil && activity.UserId != chi.URLParam(request, "id") {
+		err = fmt.Errorf("activities %q %w", id, ErrNotFound)
+	}
+	return activity, err
+}
+
+// activityWorkout is the Workout recording an activity - as a single set of the sport's catalogue
+// exercise (with the moving time and distance) so that it counts towards analytics and records
+func activityWorkout(ctx context.Context, activity Activity) (Workout, error) {
+	end := activity.StartTime.Add(time.Duration(activity.ElapsedTime * float64(time.Second)))
+	workout := Workout{
+		UserId:    activity.UserId,
+		StartTime: activity.StartTime,
+		EndTime:   &end,
+		Notes:     clipRunes(activity.notes, 2000),
+		Exercises: []WorkoutExercise{},
+	}
+	name, ok := sportExercises[activity.Sport]
+	if !ok {
+		return workout, nil
+	}
+	candidates, err := exercises.List(ctx, ExerciseFilter{NamePrefix: name})
+	if err != nil {
+		return workout, err
+	}
+	for _, e := range candidates {
+		if e.UserId == "" && e.Name == name {
+			duration := math.Round(activity.Duration)
+			set := WorkoutSet{Duration: &duration}
+			if activity.Distance != nil {
+				distance := roundRecord(*activity.Distance)
+				set.Distance = &distance
+			}
+			workout.Exercises = append(workout.Exercises, WorkoutExercise{ExerciseId: e.Id, Sets: []WorkoutSet{set}})
+			break
+		}
+	}
+	return workout, nil
+}
+
+// activityPoint is a point recorded in an activity file
+type activityPoint struct {
+	time      time.Time
+	heartRate *int
+	distance  *float64
+	// segment is the index of the track segment of a position
+	segment   int
+	position  bool
+	lat, lon  float64
+	elevation *float64
+}
+
+// fromPoints sets the heart rate samples and the track from the points recorded in the file - and
+// any totals that the file didn't give (the distance and moving time from the track if need be)
+func (a *Activity) fromPoints(points []activityPoint) error {
+	slices.SortStableFunc(points, func(x, y activityPoint) int {
+		if x.segment != y.segment {
+			return x.segment - y.segment
+		}
+		return x.time.Compare(y.time)
+	})
+	if a.StartTime.IsZero() {
+		if len(points) == 0 {
+			return errors.New("activity has no start time")
+		}
+		a.StartTime = points[0].time
+		for _, p := range points {
+			if p.time.Before(a.StartTime) {
+				a.StartTime = p.time
+			}
+		}
+	}
+	a.HeartRate = []HeartRateSample{}
+	total, highest := 0, 0
+	var last time.Time
+	segment := -1
+	for _, p := range points {
+		if p.time.After(last) {
+			last = p.time
+		}
+		if p.position {
+			if p.segment != segment {
+				a.Track = append(a.Track, TrackSegment{Points: []TrackPoint{}})
+				segment = p.segment
+			}
+			seg := &a.Track[len(a.Track)-1]
+			seg.Points = append(seg.Points, TrackPoint{
+				Lat:       math.Round(p.lat*1e7) / 1e7,
+				Lon:       math.Round(p.lon*1e7) / 1e7,
+				Elevation: p.elevation,
+				Offset:    p.time.Sub(a.StartTime).Seconds(),
+			})
+		}
+		if p.heartRate == nil || p.time.Before(a.StartTime) {
+			continue
+		}
+		a.HeartRate = append(a.HeartRate, HeartRateSample{Offset: p.time.Sub(a.StartTime).Seconds(), Bpm: *p.heartRate})
+		total += *p.heartRate
+		highest = max(highest, *p.heartRate)
+	}
+	if len(a.HeartRate) > 0 {
+		if a.AverageHeartRate == nil {
+			average := int(math.Round(float64(total) / float64(len(a.HeartRate))))
+			a.AverageHeartRate = &average
+		}
+		if a.MaxHeartRate == nil {
+			a.MaxHeartRate = &highest
+		}
+	}
+	if len(points) > 0 && a.ElapsedTime == 0 {
+		a.ElapsedTime = last.Sub(a.StartTime).Seconds()
+	}
+	if a.Distance == nil {
+		for i := len(points) - 1; i >= 0; i-- {
+			if points[i].distance != nil {
+				d := *points[i].distance
+				a.Distance = &d
+				break
+			}
+		}
+	}
+	if len(a.Track) > 0 {
+		distance, gain, moving := trackStats(a.Track)
+		if a.Distance == nil {
+			distance = math.Round(distance*10) / 10
+			a.Distance = &distance
+		}
+		if gain != nil {
+			*gain = math.Round(*gain*10) / 10
+			a.ElevationGain = gain
+		}
+		if a.Duration == 0 {
+			a.Duration = moving
+		}
+	}
+	if a.Duration == 0 {
+		a.Duration = a.ElapsedTime
+	}
+	a.ElapsedTime = max(a.ElapsedTime, a.Duration)
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ActivityStore is the persistence interface for activities uploaded from devices
+//
+// An activity holds the recorded detail (laps and samples) of a Workout - kept apart from the workout
+// so that listing workouts doesn't carry the samples. The samples (HeartRate and Track) are in turn
+// kept apart from the activity summaries - so only Get loads them
+type ActivityStore interface {
+	// List lists activities without their samples
+	List(ctx context.Context, filter ActivityFilter) ([]Activity, error)
+	// Get gets an activity with its samples
+	Get(ctx context.Context, id string) (Activity, error)
+	// Create creates an activity - failing with ErrConflict if the user already uploaded the same file
+	Create(ctx context.Context, activity Activity) (Activity, error)
+	Delete(ctx context.Context, id string) error
+	// DeleteWorkoutActivities deletes the activities of a workout (e.g. when the workout is deleted)
+	DeleteWorkoutActivities(ctx context.Context, workoutId string) error
+	// DeleteUserActivities deletes all of a user's activities (e.g. when the user is deleted)
+	DeleteUserActivities(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// ActivityFilter filters listed activities - zero value fields are not filtered on
+type ActivityFilter struct {
+	UserId    string
+	WorkoutId string
+	FileHash  string
+	// From is the inclusive lower bound of the activity start time
+	From time.Time
+	// To is the exclusive upper bound of the activity start time
+	To time.Time
+}
+
+func (f ActivityFilter) matches(a Activity) bool {
+	return (f.UserId == "" || a.UserId == f.UserId) &&
+		(f.WorkoutId == "" || a.WorkoutId == f.WorkoutId) &&
+		(f.FileHash == "" || a.FileHash == f.FileHash) &&
+		(f.From.IsZero() || !a.StartTime.Before(f.From)) &&
+		(f.To.IsZero() || a.StartTime.Before(f.To))
+}
+
+// activitySamples are the recorded samples of an activity - a document per activity
+type activitySamples struct {
+	HeartRate []HeartRateSample `json:"heartRate,omitempty"`
+	Track     []TrackSegment    `json:"track,omitempty"`
+}
+
+const activitySamplesName = "activity-samples"
+
+// NewMemoryActivityStore creates an ActivityStore that is held in memory only
+func NewMemoryActivityStore() ActivityStore {
+	return &activityStore{
+		items:   newMemoryCollection[Activity]("activities", activityId),
+		samples: newMemoryDocuments[activitySamples](activitySamplesName),
+	}
+}
+
+// OpenFileActivityStore opens (or creates) a file-backed ActivityStore in the given directory
+//
+// The samples of each activity are in a file of their own (in the activity-samples sub-directory)
+func OpenFileActivityStore(dir string) (ActivityStore, error) {
+	c, err := openFileCollection[Activity](dir, "activities", activityId)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := openFileDocuments[activitySamples](dir, activitySamplesName)
+	if err != nil {
+		return nil, err
+	}
+	return &activityStore{items: c, samples: samples}, nil
+}
+
+func activityId(a *Activity) *string {
+	return &a.Id
+}
+
+type activityStore struct {
+	items   *collection[Activity]
+	samples *documents[activitySamples]
+}
+
+func (s *activityStore) List(ctx context.Context, filter ActivityFilter) ([]Activity, error) {
+	return s.items.list(ctx, filter.matches)
+}
+
+func (s *activityStore) Get(ctx context.Context, id string) (Activity, error) {
+	activity, err := s.items.get(ctx, id)
+	if err != nil {
+		return activity, err
+	}
+	// an activity without samples has no document
+	samples, err := s.samples.get(ctx, id)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return activity, err
+	}
+	activity.HeartRate, activity.Track = samples.HeartRate, samples.Track
+	return activity, nil
+}
+
+func (s *activityStore) Create(ctx context.Context, activity Activity) (Activity, error) {
+	summary := activity
+	summary.HeartRate, summary.Track = nil, nil
+	created, err := s.items.create(ctx, summary, func(existing Activity) error {
+		if existing.UserId == activity.UserId && existing.FileHash == activity.FileHash {
+			return fmt.Errorf("file was already uploaded as activity %q: %w", existing.Id, ErrConflict)
+		}
+		return nil
+	})
+	if err != nil {
+		return activity, err
+	}
+	activity.Id = created.Id
+	if len(activity.HeartRate) > 0 || len(activity.Track) > 0 {
+		if err = s.samples.put(ctx, activity.Id, activitySamples{HeartRate: activity.HeartRate, Track: activity.Track}); err != nil {
+			// the activity is only wanted with its samples
+			return activity, errors.Join(err, s.items.delete(ctx, activity.Id))
+		}
+	}
+	return activity, nil
+}
+
+func (s *activityStore) Delete(ctx context.Context, id string) error {
+	if err := s.items.delete(ctx, id); err != nil {
+		return err
+	}
+	return s.samples.delete(ctx, id)
+}
+
+func (s *activityStore) DeleteWorkoutActivities(ctx context.Context, workoutId string) error {
+	return s.deleteWhere(ctx, func(existing Activity) bool {
+		return existing.WorkoutId == workoutId
+	})
+}
+
+func (s *activityStore) DeleteUserActivities(ctx context.Context, userId string) error {
+	return s.deleteWhere(ctx, func(existing Activity) bool {
+		return existing.UserId == userId
+	})
+}
+
+// deleteWhere deletes the matching activities and then their samples
+func (s *activityStore) deleteWhere(ctx context.Context, match func(Activity) bool) error {
+	var ids []string
+	if _, err := s.items.deleteWhere(ctx, func(existing Activity) bool {
+		if match(existing) {
+			ids = append(ids, existing.Id)
+			return true
+		}
+		return false
+	}); err != nil {
+		return err
+	}
+	return s.samples.delete(ctx, ids...)
+}
+
+func (s *activityStore) Ping(ctx context.Context) error {
+	return s.items.ping(ctx)
+}
+
+func (s *activityStore) Close() error {
+	return errors.Join(s.items.close(), s.samples.close())
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileActivityStoreSamples(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := OpenFileActivityStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := s.Create(ctx, Activity{
+		UserId:    "000000000000000000000001",
+		FileHash:  "abc",
+		StartTime: time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC),
+		HeartRate: []HeartRateSample{{Offset: 0, Bpm: 120}, {Offset: 5, Bpm: 125}},
+		Track:     []TrackSegment{{Points: []TrackPoint{{Lat: 54.46, Lon: -3.09}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(a.HeartRate) != 2 || len(a.Track) != 1 {
+		t.Errorf("created %+v without its samples", a)
+	}
+	// the collection holds the summaries only
+	if data, err := os.ReadFile(filepath.Join(dir, "activities.json")); err != nil || strings.Contains(string(data), "bpm") {
+		t.Errorf("activities.json %s %v", data, err)
+	}
+	samplesFile := filepath.Join(dir, activitySamplesName, a.Id+".json")
+	if _, err = os.Stat(samplesFile); err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.List(ctx, ActivityFilter{}); err != nil || len(list) != 1 || list[0].HeartRate != nil || list[0].Track != nil {
+		t.Errorf("list %+v %v", list, err)
+	}
+
+	_ = s.Close()
+	if s, err = OpenFileActivityStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(ctx, a.Id); err != nil || len(got.HeartRate) != 2 || got.HeartRate[1].Bpm != 125 || len(got.Track) != 1 {
+		t.Errorf("reopened %+v %v", got, err)
+	}
+	if _, err = s.Create(ctx, Activity{UserId: a.UserId, FileHash: "abc"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("create of an uploaded file: %v, want ErrConflict", err)
+	}
+	if err = s.DeleteUserActivities(ctx, a.UserId); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(samplesFile); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("samples of a deleted activity: %v", err)
+	}
+}
+
+func TestMigrateActivitySamples(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	old := `[
+  {"_id": "000000000000000000000010", "userId": "000000000000000000000001", "laps": [], "heartRate": [{"offset": 0, "bpm": 140}], "track": [{"points": [{"lat": 1, "lon": 2, "offset": 0}]}]},
+  {"_id": "000000000000000000000011", "userId": "000000000000000000000001", "laps": []}
+]`
+	if err := os.WriteFile(filepath.Join(dir, "activities.json"), []byte(old), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate(dir); err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenFileActivityStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, err := s.List(ctx, ActivityFilter{}); err != nil || len(list) != 2 || list[0].HeartRate != nil || list[0].Track != nil {
+		t.Errorf("list %+v %v", list, err)
+	}
+	if got, err := s.Get(ctx, "000000000000000000000010"); err != nil || len(got.HeartRate) != 1 || got.HeartRate[0].Bpm != 140 || len(got.Track) != 1 {
+		t.Errorf("migrated %+v %v", got, err)
+	}
+	if got, err := s.Get(ctx, "000000000000000000000011"); err != nil || got.HeartRate != nil {
+		t.Errorf("migrated without samples %+v %v", got, err)
+	}
+}
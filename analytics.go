@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type VolumeBucket struct {
+	Start   time.Time      `json:"start" oas:"description: start of the bucket (inclusive)"`
+	End     time.Time      `json:"end" oas:"description: end of the bucket (exclusive)"`
+	Muscles []MuscleVolume `json:"muscles" oas:"description: volume per muscle group trained in the bucket (ordered by muscle group)"`
+}
+
+type MuscleVolume struct {
+	MuscleGroup string  `json:"muscleGroup" oas:"$ref: MuscleGroup"`
+	Tonnage     float64 `json:"tonnage" oas:"description: total of reps x weight in kg (lb in imperial units)"`
+	Sets        int     `json:"sets" oas:"description: number of sets"`
+}
+
+type FrequencyBucket struct {
+	Start        time.Time `json:"start" oas:"description: start of the bucket (inclusive)"`
+	End          time.Time `json:"end" oas:"description: end of the bucket (exclusive)"`
+	Sessions     int       `json:"sessions" oas:"description: number of workouts started in the bucket"`
+	TrainingDays int       `json:"trainingDays" oas:"description: number of distinct days with a workout"`
+	Duration     float64   `json:"duration" oas:"description: total seconds of the finished workouts"`
+}
+
+type RpeBucket struct {
+	Start      time.Time `json:"start" oas:"description: start of the bucket (inclusive)"`
+	End        time.Time `json:"end" oas:"description: end of the bucket (exclusive)"`
+	AverageRpe *float64  `json:"averageRpe,omitempty" oas:"description: mean RPE of the rated sets (absent when no sets were rated)"`
+	RatedSets  int       `json:"ratedSets" oas:"description: number of sets with an RPE"`
+}
+
+type E1rmBucket struct {
+	Start     time.Time `json:"start" oas:"description: start of the bucket (inclusive)"`
+	End       time.Time `json:"end" oas:"description: end of the bucket (exclusive)"`
+	E1rm      *float64  `json:"e1rm,omitempty" oas:"description: best estimated 1 rep max in kg - lb in imperial units (absent when the exercise was not performed)"`
+	WorkoutId string    `json:"workoutId,omitempty" oas:"description: db oid of the Workout of the best estimate"`
+}
+
+const (
+	bucketWeek          = "week"
+	bucketMonth         = "month"
+	e1rmFormulaEpley    = "epley"
+	e1rmFormulaBrzycki  = "brzycki"
+	maxAnalyticsBuckets = 366
+)
+
+// BucketSizes are the sizes of analytics buckets
+var BucketSizes = []string{bucketMonth, bucketWeek}
+
+var analyticsParams = []chioas.QueryParam{
+	{
+		Name:        "bucket",
+		Description: "Size of each bucket (weeks start on Monday)",
+		Schema: &chioas.Schema{
+			Type:    "string",
+			Default: bucketWeek,
+			Enum:    []any{bucketMonth, bucketWeek},
+		},
+	},
+	{
+		Name:        "from",
+		Description: "Start of the range as a date-time or date (widened to the start of its bucket - defaults to 12 buckets before to)",
+		Example:     "2024-07-01",
+	},
+	{
+		Name:        "to",
+		Description: "End of the range (exclusive) as a date-time or date (widened to the end of its bucket - defaults to now)",
+		Example:     "2024-10-01",
+	},
+	{
+		Name:        "tz",
+		Description: "IANA time zone that buckets and days are aligned to (defaults to UTC)",
+		Example:     "Europe/London",
+	},
+}
+
+var analyticsAccess = allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true})
+
+var AnalyticsPath = chioas.Path{
+	Paths: chioas.Paths{
+		"/volume": {
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getVolumeAnalytics,
+					OperationId: "getVolumeAnalytics",
+					Description: "Tonnage and sets per muscle group - sets count towards the primary muscles of the exercise (and optionally the secondary muscles)",
+					Extensions:  analyticsAccess,
+					QueryParams: append(slices.Clone(analyticsParams), unitsParam, chioas.QueryParam{
+						Name:        "secondary",
+						Description: "Also count sets towards the secondary muscles of the exercise",
+						Schema: &chioas.Schema{
+							Type:    "boolean",
+							Default: false,
+						},
+					}),
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Volume per bucket",
+							IsArray:     true,
+							SchemaRef:   "VolumeBucket",
+						},
+					},
+				},
+			},
+		},
+		"/frequency": {
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getFrequencyAnalytics,
+					OperationId: "getFrequencyAnalytics",
+					Description: "Session frequency",
+					Extensions:  analyticsAccess,
+					QueryParams: analyticsParams,
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Frequency per bucket",
+							IsArray:     true,
+							SchemaRef:   "FrequencyBucket",
+						},
+					},
+				},
+			},
+		},
+		"/rpe": {
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getRpeAnalytics,
+					OperationId: "getRpeAnalytics",
+					Description: "Average RPE of the rated sets",
+					Extensions:  analyticsAccess,
+					QueryParams: append(slices.Clone(analyticsParams), chioas.QueryParam{
+						Name:        "exerciseId",
+						Description: "Only sets of this Exercise db oid",
+					}),
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Average RPE per bucket",
+							IsArray:     true,
+							SchemaRef:   "RpeBucket",
+						},
+					},
+				},
+			},
+		},
+		"/e1rm": {
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getE1rmAnalytics,
+					OperationId: "getE1rmAnalytics",
+					Description: "Trend of the best estimated 1 rep max of an exercise (from sets of up to 12 reps)",
+					Extensions:  analyticsAccess,
+					QueryParams: append(slices.Clone(analyticsParams), unitsParam,
+						chioas.QueryParam{
+							Name:        "exerciseId",
+							Description: "The Exercise db oid",
+							Required:    true,
+						},
+						chioas.QueryParam{
+							Name:        "formula",
+							Description: "Formula used to estimate the 1 rep max",
+							Schema: &chioas.Schema{
+								Type:    "string",
+								Default: e1rmFormulaEpley,
+								Enum:    []any{e1rmFormulaBrzycki, e1rmFormulaEpley},
+							},
+						},
+					),
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Estimated 1 rep max per bucket",
+							IsArray:     true,
+							SchemaRef:   "E1rmBucket",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var AnalyticsSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "VolumeBucket",
+		Description: "Training volume per muscle group in a bucket of time",
+		Comment:     chioas.SourceComment(),
+	}).Must(VolumeBucket{}),
+	(&chioas.Schema{
+		Name:        "FrequencyBucket",
+		Description: "Session frequency in a bucket of time",
+		Comment:     chioas.SourceComment(),
+	}).Must(FrequencyBucket{}),
+	(&chioas.Schema{
+		Name:        "RpeBucket",
+		Description: "Average RPE in a bucket of time",
+		Comment:     chioas.SourceComment(),
+	}).Must(RpeBucket{}),
+	(&chioas.Schema{
+		Name:        "E1rmBucket",
+		Description: "Best estimated 1 rep max of an exercise in a bucket of time",
+		Comment:     chioas.SourceComment(),
+	}).Must(E1rmBucket{}),
+}
+
+// bucketRange is the time range of an analytics bucket
+type bucketRange struct {
+	start time.Time
+	end   time.Time
+}
+
+// analyticsQuery is the user and bucketed range of an analytics request
+type analyticsQuery struct {
+	userId  string
+	loc     *time.Location
+	buckets []bucketRange
+}
+
+// parseAnalyticsQuery reads the bucket, from, to and tz params - the range is widened to whole buckets
+func parseAnalyticsQuery(request *http.Request) (q analyticsQuery, err error) {
+	q.userId = chi.URLParam(request, "id")
+	if _, err = users.Get(request.Context(), q.userId); err != nil {
+		return q, err
+	}
+	params := request.URL.Query()
+	q.loc = time.UTC
+	if tz := params.Get("tz"); tz != "" {
+		if q.loc, err = time.LoadLocation(tz); err != nil {
+			return q, newProblem(http.StatusBadRequest, "query param \"tz\" is not a known time zone")
+		}
+	}
+	size := params.Get("bucket")
+	if size == "" {
+		size = bucketWeek
+	} else if !slices.Contains(BucketSizes, size) {
+		return q, newProblem(http.StatusBadRequest, "query param \"bucket\" must be one of: month, week")
+	}
+	next := func(t time.Time) time.Time {
+		if size == bucketMonth {
+			return t.AddDate(0, 1, 0)
+		}
+		return t.AddDate(0, 0, 7)
+	}
+	from, err := queryTime(request, "from")
+	if err != nil {
+		return q, err
+	}
+	to, err := queryTime(request, "to")
+	if err != nil {
+		return q, err
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		if size == bucketMonth {
+			from = to.AddDate(0, -12, 0)
+		} else {
+			from = to.AddDate(0, 0, -7*12)
+		}
+	}
+	if !from.Before(to) {
+		return q, newProblem(http.StatusBadRequest, "query param \"from\" must be before \"to\"")
+	}
+	for start := bucketStart(from, size, q.loc); start.Before(to); start = next(start) {
+		if len(q.buckets) == maxAnalyticsBuckets {
+			return q, newProblem(http.StatusBadRequest, "range must not span more than %d buckets", maxAnalyticsBuckets)
+		}
+		q.buckets = append(q.buckets, bucketRange{start: start, end: next(start)})
+	}
+	return q, nil
+}
+
+// bucketStart is the start of the week (Monday) or month containing t in the location
+func bucketStart(t time.Time, size string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	if size == bucketMonth {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, loc)
+	}
+	daysSinceMonday := (int(t.Weekday()) + 6) % 7
+	return time.Date(t.Year(), t.Month(), t.Day()-daysSinceMonday, 0, 0, 0, 0, loc)
+}
+
+// workouts lists the user's workouts in the range of the buckets
+func (q analyticsQuery) workouts(ctx context.Context) ([]Workout, error) {
+	return workouts.List(ctx, WorkoutFilter{
+		UserId: q.userId,
+		From:   q.buckets[0].start,
+		To:     q.buckets[len(q.buckets)-1].end,
+	})
+}
+
+// bucketOf is the index of the bucket containing t (or -1)
+func (q analyticsQuery) bucketOf(t time.Time) int {
+	i, found := slices.BinarySearchFunc(q.buckets, t, func(b bucketRange, t time.Time) int {
+		switch {
+		case t.Before(b.start):
+			return 1
+		case !t.Before(b.end):
+			return -1
+		}
+		return 0
+	})
+	if !found {
+		return -1
+	}
+	return i
+}
+
+func getVolumeAnalytics(writer http.ResponseWriter, request *http.Request) {
+	q, err := parseAnalyticsQuery(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	secondary := request.URL.Query().Get("secondary") == "true"
+	ws, err := q.workouts(request.Context())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	lookup := exerciseLookup(request.Context())
+	volumes := make([]map[string]*MuscleVolume, len(q.buckets))
+	for _, w := range ws {
+		i := q.bucketOf(w.StartTime)
+		if i < 0 {
+			continue
+		}
+		if volumes[i] == nil {
+			volumes[i] = map[string]*MuscleVolume{}
+		}
+		for _, we := range w.Exercises {
+			e, err := lookup(we.ExerciseId)
+			if err != nil {
+				writeError(writer, request, err)
+				return
+			} else if e == nil {
+				continue
+			}
+			muscles := e.PrimaryMuscles
+			if secondary {
+				muscles = append(slices.Clone(muscles), e.SecondaryMuscles...)
+				slices.Sort(muscles)
+				muscles = slices.Compact(muscles)
+			}
+			for _, m := range muscles {
+				mv, ok := volumes[i][m]
+				if !ok {
+					mv = &MuscleVolume{MuscleGroup: m}
+					volumes[i][m] = mv
+				}
+				for _, set := range we.Sets {
+					mv.Sets++
+					if set.Reps != nil && set.Weight != nil {
+						mv.Tonnage += float64(*set.Reps) * *set.Weight
+					}
+				}
+			}
+		}
+	}
+	scale := unitsFrom(request.Context()).out()
+	result := make([]VolumeBucket, len(q.buckets))
+	for i, b := range q.buckets {
+		result[i] = VolumeBucket{Start: b.start, End: b.end, Muscles: []MuscleVolume{}}
+		for _, m := range sortedKeys(volumes[i]) {
+			if mv := volumes[i][m]; mv.Sets > 0 {
+				mv.Tonnage = roundRecord(mv.Tonnage * scale.weight)
+				result[i].Muscles = append(result[i].Muscles, *mv)
+			}
+		}
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func getFrequencyAnalytics(writer http.ResponseWriter, request *http.Request) {
+	q, err := parseAnalyticsQuery(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	ws, err := q.workouts(request.Context())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result := make([]FrequencyBucket, len(q.buckets))
+	days := make([]map[string]bool, len(q.buckets))
+	for i, b := range q.buckets {
+		result[i] = FrequencyBucket{Start: b.start, End: b.end}
+		days[i] = map[string]bool{}
+	}
+	for _, w := range ws {
+		if i := q.bucketOf(w.StartTime); i >= 0 {
+			result[i].Sessions++
+			days[i][w.StartTime.In(q.loc).Format(time.DateOnly)] = true
+			if w.EndTime != nil {
+				result[i].Duration += w.EndTime.Sub(w.StartTime).Seconds()
+			}
+		}
+	}
+	for i := range result {
+		result[i].TrainingDays = len(days[i])
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func getRpeAnalytics(writer http.ResponseWriter, request *http.Request) {
+	q, err := parseAnalyticsQuery(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	exerciseId := request.URL.Query().Get("exerciseId")
+	ws, err := q.workouts(request.Context())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result := make([]RpeBucket, len(q.buckets))
+	totals := make([]float64, len(q.buckets))
+	for i, b := range q.buckets {
+		result[i] = RpeBucket{Start: b.start, End: b.end}
+	}
+	for _, w := range ws {
+		i := q.bucketOf(w.StartTime)
+		if i < 0 {
+			continue
+		}
+		for _, we := range w.Exercises {
+			if exerciseId != "" && we.ExerciseId != exerciseId {
+				continue
+			}
+			for _, set := range we.Sets {
+				if set.RPE != nil {
+					result[i].RatedSets++
+					totals[i] += *set.RPE
+				}
+			}
+		}
+	}
+	for i := range result {
+		if result[i].RatedSets > 0 {
+			avg := math.Round(totals[i]/float64(result[i].RatedSets)*10) / 10
+			result[i].AverageRpe = &avg
+		}
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func getE1rmAnalytics(writer http.ResponseWriter, request *http.Request) {
+	q, err := parseAnalyticsQuery(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	params := request.URL.Query()
+	exerciseId := params.Get("exerciseId")
+	if exerciseId == "" {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"exerciseId\" is required"))
+		return
+	}
+	estimate := Epley
+	switch params.Get("formula") {
+	case e1rmFormulaEpley, "":
+	case e1rmFormulaBrzycki:
+		estimate = Brzycki
+	default:
+		writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"formula\" must be one of: brzycki, epley"))
+		return
+	}
+	ws, err := q.workouts(request.Context())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result := make([]E1rmBucket, len(q.buckets))
+	for i, b := range q.buckets {
+		result[i] = E1rmBucket{Start: b.start, End: b.end}
+	}
+	for _, w := range ws {
+		i := q.bucketOf(w.StartTime)
+		if i < 0 {
+			continue
+		}
+		for _, we := range w.Exercises {
+			if we.ExerciseId != exerciseId {
+				continue
+			}
+			for _, set := range we.Sets {
+				if set.Reps == nil || set.Weight == nil || *set.Reps < 1 || *set.Reps > maxRepsForE1rm || *set.Weight <= 0 {
+					continue
+				}
+				if v := roundRecord(estimate(*set.Weight, *set.Reps)); result[i].E1rm == nil || v > *result[i].E1rm {
+					result[i].E1rm, result[i].WorkoutId = &v, w.Id
+				}
+			}
+		}
+	}
+	scale := unitsFrom(request.Context()).out()
+	for i := range result {
+		result[i].E1rm = scale.scaled(result[i].E1rm, scale.weight)
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+// exerciseLookup returns a func getting exercises by id (each fetched once) - deleted exercises are nil
+func exerciseLookup(ctx context.Context) func(id string) (*Exercise, error) {
+	cache := map[string]*Exercise{}
+	return func(id string) (*Exercise, error) {
+		if e, ok := cache[id]; ok {
+			return e, nil
+		}
+		e, err := exercises.Get(ctx, id)
+		if errors.Is(err, ErrNotFound) {
+			cache[id] = nil
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		cache[id] = &e
+		return &e, nil
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Registration struct {
+	Username string `json:"username" oas:"description: specific indexed username, required, minLength: 3, maxLength: 32, pattern: '^[a-zA-Z0-9_.-]+$'"`
+	Name     string `json:"name" oas:"description: Persons name to use, maxLength: 100"`
+	Password string `json:"password" oas:"description: password (bcrypt limits passwords to 72 bytes), required, minLength: 8, maxLength: 72"`
+}
+
+type Login struct {
+	Username string `json:"username" oas:"description: username to log in as, required"`
+	Password string `json:"password" oas:"description: password, required"`
+}
+
+type RefreshToken struct {
+	RefreshToken string `json:"refreshToken" oas:"description: refresh token from a previous register/login/refresh, required"`
+}
+
+type Tokens struct {
+	AccessToken  string `json:"accessToken" oas:"description: bearer token to send in the Authorization header"`
+	TokenType    string `json:"tokenType" oas:"description: always Bearer"`
+	ExpiresIn    int    `json:"expiresIn" oas:"description: seconds until the access token expires"`
+	RefreshToken string `json:"refreshToken" oas:"description: single use token for POST /auth/refresh (rotated on each refresh)"`
+	User         User   `json:"user" oas:"$ref: User"`
+}
+
+const (
+	bearerAuth = "bearerAuth"
+	// maxPasswordBytes is the bcrypt limit on passwords (the schema maxLength counts characters)
+	maxPasswordBytes = 72
+)
+
+var AuthSecuritySchemes = chioas.SecuritySchemes{
+	{
+		Name:        bearerAuth,
+		Description: "Access token from /auth/register, /auth/login or /auth/refresh",
+		Type:        "http",
+		Scheme:      "bearer",
+		Additional:  chioas.AdditionalOasProperties{"bearerFormat": "JWT"},
+	},
+}
+
+var AuthPath = chioas.Path{
+	Paths: chioas.Paths{
+		"/register": {
+			Methods: chioas.Methods{
+				http.MethodPost: {
+					Handler:          postRegister,
+					OperationId:      "register",
+					OptionalSecurity: true,
+					Request: &chioas.Request{
+						Required:  true,
+						SchemaRef: "Registration",
+					},
+					Responses: chioas.Responses{
+						http.StatusCreated: {
+							Description: "Registered User and tokens",
+							SchemaRef:   "Tokens",
+						},
+					},
+				},
+			},
+		},
+		"/login": {
+			Methods: chioas.Methods{
+				http.MethodPost: {
+					Handler:          postLogin,
+					OperationId:      "login",
+					OptionalSecurity: true,
+					Request: &chioas.Request{
+						Required:  true,
+						SchemaRef: "Login",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Tokens",
+							SchemaRef:   "Tokens",
+						},
+					},
+				},
+			},
+		},
+		"/refresh": {
+			Methods: chioas.Methods{
+				http.MethodPost: {
+					Handler:          postRefresh,
+					OperationId:      "refreshTokens",
+					OptionalSecurity: true,
+					Description:      "Exchanges a refresh token for new tokens - the refresh token is single use (re-use revokes all the User's sessions)",
+					Request: &chioas.Request{
+						Required:  true,
+						SchemaRef: "RefreshToken",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Tokens",
+							SchemaRef:   "Tokens",
+						},
+					},
+				},
+			},
+		},
+		"/logout": {
+			Methods: chioas.Methods{
+				http.MethodPost: {
+					Handler:          postLogout,
+					OperationId:      "logout",
+					OptionalSecurity: true,
+					Description:      "Revokes the refresh token (access tokens remain valid until they expire)",
+					Request: &chioas.Request{
+						Required:  true,
+						SchemaRef: "RefreshToken",
+					},
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Logged out",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var AuthSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Registration",
+		Description: "A new User registration",
+		Comment:     chioas.SourceComment(),
+	}).Must(Registration{}),
+	(&chioas.Schema{
+		Name:        "Login",
+		Description: "Login credentials",
+		Comment:     chioas.SourceComment(),
+	}).Must(Login{}),
+	(&chioas.Schema{
+		Name:        "RefreshToken",
+		Description: "A refresh token",
+		Comment:     chioas.SourceComment(),
+	}).Must(RefreshToken{}),
+	(&chioas.Schema{
+		Name:        "Tokens",
+		Description: "Issued access and refresh tokens",
+		Comment:     chioas.SourceComment(),
+	}).Must(Tokens{}),
+}
+
+// auth is the store used by the auth handlers (replaced by a file-backed store in main)
+var auth = NewMemoryAuthStore()
+
+// signer signs and verifies tokens (main replaces it with one using the configured secret)
+var signer = newTokenSigner(nil)
+
+// bootstrapAdmin gives the configured admin username the admin role - only an account that is already
+// registered is promoted, never one registering later, so that whoever registers the name first (on an open
+// registration endpoint) can't become admin
+func bootstrapAdmin(ctx context.Context, username string) error {
+	if username == "" {
+		all, err := users.List(ctx, UserFilter{})
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(all, func(u User) bool { return slices.Contains(u.Roles, roleAdmin) }) {
+			slog.Warn("there is no admin - configure an admin username to bootstrap one")
+		}
+		return nil
+	}
+	user, err := users.GetByUsername(ctx, username)
+	if errors.Is(err, ErrNotFound) {
+		slog.Warn("the configured admin isn't registered - register them, then restart to give them the admin role", "username", username)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !slices.Contains(user.Roles, roleAdmin) {
+		user.Roles = append(user.Roles, roleAdmin)
+		if _, err = users.Update(ctx, user); err != nil {
+			return err
+		}
+		slog.Info("gave the admin role", "username", user.Username, "userId", user.Id)
+	}
+	return nil
+}
+
+// dummyPasswordHash is compared against for unknown usernames, so login timing doesn't reveal which usernames exist
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func postRegister(writer http.ResponseWriter, request *http.Request) {
+	var reg Registration
+	if err := decodeJson(request, &reg); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if err := checkRegistration(reg); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(reg.Password), bcrypt.DefaultCost)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user := User{Username: reg.Username, Name: reg.Name, Roles: []string{roleAthlete}, Coaches: []string{}}
+	user, err = users.Create(request.Context(), user)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if err = auth.PutCredential(request.Context(), Credential{UserId: user.Id, PasswordHash: string(hash)}); err != nil {
+		_ = users.Delete(request.Context(), user.Id)
+		writeError(writer, request, err)
+		return
+	}
+	result, err := issueTokens(request.Context(), user)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", "/users/"+user.Id)
+	writeJson(writer, request, http.StatusCreated, result)
+}
+
+// checkRegistration performs the checks that can't be expressed in the Registration schema
+func checkRegistration(reg Registration) error {
+	if len(reg.Password) > maxPasswordBytes {
+		p := newProblem(http.StatusUnprocessableEntity, "registration failed validation")
+		p.Errors = []FieldError{{Path: "password", Message: fmt.Sprintf("must not be longer than %d bytes", maxPasswordBytes)}}
+		return p
+	}
+	return nil
+}
+
+func postLogin(writer http.ResponseWriter, request *http.Request) {
+	var login Login
+	if err := decodeJson(request, &login); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user, err := users.GetByUsername(request.Context(), login.Username)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		writeError(writer, request, err)
+		return
+	}
+	hash := dummyPasswordHash
+	if err == nil {
+		if credential, cErr := auth.GetCredential(request.Context(), user.Id); cErr == nil {
+			hash = []byte(credential.PasswordHash)
+		} else if !errors.Is(cErr, ErrNotFound) {
+			writeError(writer, request, cErr)
+			return
+		} else {
+			err = cErr
+		}
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(login.Password)) != nil || err != nil {
+		writeUnauthorized(writer, request, "invalid username or password")
+		return
+	}
+	result, err := issueTokens(request.Context(), user)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postRefresh(writer http.ResponseWriter, request *http.Request) {
+	var rt RefreshToken
+	if err := decodeJson(request, &rt); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	claims, err := signer.verify(rt.RefreshToken, tokenTypeRefresh)
+	if err != nil {
+		writeUnauthorized(writer, request, err.Error())
+		return
+	}
+	ctx := request.Context()
+	session, err := auth.GetSession(ctx, claims.Id)
+	if errors.Is(err, ErrNotFound) || (err == nil && session.UserId != claims.Subject) {
+		// a validly signed refresh token whose session is gone has already been used (or revoked) -
+		// assume it was stolen and revoke every session of the user
+		if err = auth.DeleteUserSessions(ctx, claims.Subject); err != nil {
+			writeError(writer, request, err)
+			return
+		}
+		writeUnauthorized(writer, request, "refresh token has been revoked")
+		return
+	} else if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if err = auth.DeleteSession(ctx, session.Id); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user, err := users.Get(ctx, session.UserId)
+	if errors.Is(err, ErrNotFound) {
+		writeUnauthorized(writer, request, "user no longer exists")
+		return
+	} else if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result, err := issueTokens(ctx, user)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postLogout(writer http.ResponseWriter, request *http.Request) {
+	var rt RefreshToken
+	if err := decodeJson(request, &rt); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	claims, err := signer.verify(rt.RefreshToken, tokenTypeRefresh)
+	if errors.Is(err, errExpiredToken) {
+		// nothing to revoke
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	} else if err != nil {
+		writeUnauthorized(writer, request, err.Error())
+		return
+	}
+	if err = auth.DeleteSession(request.Context(), claims.Id); err != nil && !errors.Is(err, ErrNotFound) {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// issueTokens creates a new refresh token session for the user and signs the token pair
+func issueTokens(ctx context.Context, user User) (Tokens, error) {
+	now := time.Now()
+	session, err := auth.CreateSession(ctx, Session{UserId: user.Id, ExpiresAt: now.Add(signer.refreshTTL)})
+	if err != nil {
+		return Tokens{}, err
+	}
+	result := Tokens{
+		TokenType: "Bearer",
+		ExpiresIn: int(signer.accessTTL.Seconds()),
+		User:      user,
+	}
+	if result.AccessToken, err = signer.sign(tokenClaims{
+		Subject:   user.Id,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(signer.accessTTL).Unix(),
+		Type:      tokenTypeAccess,
+	}); err != nil {
+		return result, err
+	}
+	result.RefreshToken, err = signer.sign(tokenClaims{
+		Subject:   user.Id,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: session.ExpiresAt.Unix(),
+		Id:        session.Id,
+		Type:      tokenTypeRefresh,
+	})
+	return result, err
+}
+
+// Caller is the authenticated user making a request
+type Caller struct {
+	User User
+}
+
+type callerKey struct{}
+
+// callerFrom returns the authenticated caller of the request (if any)
+func callerFrom(ctx context.Context) (Caller, bool) {
+	c, ok := ctx.Value(callerKey{}).(Caller)
+	return c, ok
+}
+
+// authenticate is middleware that resolves the caller from a bearer access token
+//
+// Requests without an Authorization header continue anonymously (methods that need a caller
+// are guarded by the handlerBuilder) - but a presented token that is invalid is always rejected
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		hdr := request.Header.Get("Authorization")
+		if hdr == "" {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		scheme, token, _ := strings.Cut(hdr, " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			writeUnauthorized(writer, request, "Authorization header must be a Bearer token")
+			return
+		}
+		claims, err := signer.verify(strings.TrimSpace(token), tokenTypeAccess)
+		if err != nil {
+			writeUnauthorized(writer, request, err.Error())
+			return
+		}
+		user, err := users.Get(request.Context(), claims.Subject)
+		if errors.Is(err, ErrNotFound) {
+			writeUnauthorized(writer, request, "user no longer exists")
+			return
+		} else if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+		setLogUserId(request.Context(), user.Id)
+		ctx := context.WithValue(request.Context(), callerKey{}, Caller{User: user})
+		next.ServeHTTP(writer, request.WithContext(ctx))
+	})
+}
+
+// requireCaller guards a handler so that it is only called for authenticated requests
+func requireCaller(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if _, ok := callerFrom(request.Context()); !ok {
+			writeUnauthorized(writer, request, "authentication required")
+			return
+		}
+		next(writer, request)
+	}
+}
+
+func writeUnauthorized(writer http.ResponseWriter, request *http.Request, detail string) {
+	writer.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="workyapi", error="invalid_token", error_description=%q`, detail))
+	writeError(writer, request, newProblem(http.StatusUnauthorized, "%s", detail))
+}
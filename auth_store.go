@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// AuthStore is the persistence interface for user credentials, refresh token sessions and calendar feed tokens
+type AuthStore interface {
+	GetCredential(ctx context.Context, userId string) (Credential, error)
+	PutCredential(ctx context.Context, credential Credential) error
+	DeleteCredential(ctx context.Context, userId string) error
+	CreateSession(ctx context.Context, session Session) (Session, error)
+	GetSession(ctx context.Context, id string) (Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	// DeleteUserSessions deletes all of a user's sessions (e.g. on password change)
+	DeleteUserSessions(ctx context.Context, userId string) error
+	GetCalendarToken(ctx context.Context, userId string) (CalendarToken, error)
+	PutCalendarToken(ctx context.Context, token CalendarToken) error
+	DeleteCalendarToken(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// Credential is a user's login credential - kept out of User so that it can never be served
+type Credential struct {
+	UserId       string `json:"userId"`
+	PasswordHash string `json:"passwordHash"`
+}
+
+// Session is an issued refresh token (identified by the token's jti) - deleting it revokes the token
+type Session struct {
+	Id        string    `json:"_id"`
+	UserId    string    `json:"userId"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CalendarToken is the (hashed) token granting read access to a user's calendar feed
+type CalendarToken struct {
+	UserId    string    `json:"userId"`
+	TokenHash string    `json:"tokenHash"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// NewMemoryAuthStore creates an AuthStore that is held in memory only
+func NewMemoryAuthStore() AuthStore {
+	return &authStore{
+		credentials: newMemoryCollection[Credential]("credentials", credentialId),
+		sessions:    newMemoryCollection[Session]("sessions", sessionId),
+		calendar:    newMemoryCollection[CalendarToken]("calendar_tokens", calendarTokenId),
+	}
+}
+
+// OpenFileAuthStore opens (or creates) a file-backed AuthStore in the given directory
+func OpenFileAuthStore(dir string) (AuthStore, error) {
+	credentials, err := openFileCollection[Credential](dir, "credentials", credentialId)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := openFileCollection[Session](dir, "sessions", sessionId)
+	if err != nil {
+		return nil, err
+	}
+	calendar, err := openFileCollection[CalendarToken](dir, "calendar_tokens", calendarTokenId)
+	if err != nil {
+		return nil, err
+	}
+	return &authStore{credentials: credentials, sessions: sessions, calendar: calendar}, nil
+}
+
+func credentialId(c *Credential) *string {
+	return &c.UserId
+}
+
+func sessionId(s *Session) *string {
+	return &s.Id
+}
+
+func calendarTokenId(t *CalendarToken) *string {
+	return &t.UserId
+}
+
+type authStore struct {
+	credentials *collection[Credential]
+	sessions    *collection[Session]
+	calendar    *collection[CalendarToken]
+}
+
+func (s *authStore) GetCredential(ctx context.Context, userId string) (Credential, error) {
+	return s.credentials.get(ctx, userId)
+}
+
+func (s *authStore) PutCredential(ctx context.Context, credential Credential) error {
+	return s.credentials.put(ctx, credential)
+}
+
+func (s *authStore) DeleteCredential(ctx context.Context, userId string) error {
+	return s.credentials.delete(ctx, userId)
+}
+
+func (s *authStore) CreateSession(ctx context.Context, session Session) (Session, error) {
+	now := time.Now()
+	if _, err := s.sessions.deleteWhere(ctx, func(existing Session) bool {
+		return existing.ExpiresAt.Before(now)
+	}); err != nil {
+		return session, err
+	}
+	return s.sessions.create(ctx, session, nil)
+}
+
+func (s *authStore) GetSession(ctx context.Context, id string) (Session, error) {
+	session, err := s.sessions.get(ctx, id)
+	if err == nil && session.ExpiresAt.Before(time.Now()) {
+		return session, s.sessions.notFound(id)
+	}
+	return session, err
+}
+
+func (s *authStore) DeleteSession(ctx context.Context, id string) error {
+	return s.sessions.delete(ctx, id)
+}
+
+func (s *authStore) DeleteUserSessions(ctx context.Context, userId string) error {
+	_, err := s.sessions.deleteWhere(ctx, func(existing Session) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *authStore) GetCalendarToken(ctx context.Context, userId string) (CalendarToken, error) {
+	return s.calendar.get(ctx, userId)
+}
+
+func (s *authStore) PutCalendarToken(ctx context.Context, token CalendarToken) error {
+	return s.calendar.put(ctx, token)
+}
+
+func (s *authStore) DeleteCalendarToken(ctx context.Context, userId string) error {
+	return s.calendar.delete(ctx, userId)
+}
+
+func (s *authStore) Ping(ctx context.Context) error {
+	return errors.Join(s.credentials.ping(ctx), s.sessions.ping(ctx), s.calendar.ping(ctx))
+}
+
+func (s *authStore) Close() error {
+	return errors.Join(s.credentials.close(), s.sessions.close(), s.calendar.close())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenSigner(t *testing.T) {
+	s := newTokenSigner([]byte("test secret"))
+	now := time.Now()
+	valid := tokenClaims{Subject: "u1", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), Type: tokenTypeAccess}
+	token, err := s.sign(valid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := s.verify(token, tokenTypeAccess); err != nil || claims != valid {
+		t.Errorf("verified %+v %v", claims, err)
+	}
+	expired := valid
+	expired.ExpiresAt = now.Add(-time.Second).Unix()
+	expiredToken, _ := s.sign(expired)
+	noSubject := valid
+	noSubject.Subject = ""
+	noSubjectToken, _ := s.sign(noSubject)
+	otherSecret, _ := newTokenSigner([]byte("other secret")).sign(valid)
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + strings.Split(noSubjectToken, ".")[1] + "." + parts[2]
+	for name, tc := range map[string]struct {
+		token     string
+		tokenType string
+		want      error
+	}{
+		"expired":      {expiredToken, tokenTypeAccess, errExpiredToken},
+		"wrong type":   {token, tokenTypeRefresh, errInvalidToken},
+		"no subject":   {noSubjectToken, tokenTypeAccess, errInvalidToken},
+		"other secret": {otherSecret, tokenTypeAccess, errInvalidToken},
+		"tampered":     {tampered, tokenTypeAccess, errInvalidToken},
+		"alg none":     {"eyJhbGciOiJub25lIiwidHlwIjoiSldUIn0." + parts[1] + ".", tokenTypeAccess, errInvalidToken},
+		"not a jwt":    {"not.a.jwt", tokenTypeAccess, errInvalidToken},
+		"empty":        {"", tokenTypeAccess, errInvalidToken},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.verify(tc.token, tc.tokenType); !errors.Is(err, tc.want) {
+				t.Errorf("error %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRefreshReuse(t *testing.T) {
+	user, _ := testUser(t, "refresh")
+	first, err := issueTokens(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh := func(token string) (int, Tokens) {
+		got := call(t, http.MethodPost, "/auth/refresh", "", `{"refreshToken":"`+token+`"}`)
+		var tokens Tokens
+		_ = json.Unmarshal(got.Body.Bytes(), &tokens)
+		return got.Code, tokens
+	}
+	code, second := refresh(first.RefreshToken)
+	if code != http.StatusOK || second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh responded %d", code)
+	}
+	// the rotated out token is presented again - so both it and the token it was rotated to are revoked
+	if code, _ = refresh(first.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("reused refresh token responded %d, want 401", code)
+	}
+	if code, _ = refresh(second.RefreshToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh after reuse responded %d, want 401", code)
+	}
+	if code, _ = refresh(second.AccessToken); code != http.StatusUnauthorized {
+		t.Errorf("refresh with an access token responded %d, want 401", code)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	// bcrypt only uses the first 72 bytes - so longer passwords (in bytes, not characters) are refused
+	for name, tc := range map[string]struct {
+		password string
+		want     int
+	}{
+		"72 bytes":      {strings.Repeat("a", 72), http.StatusCreated},
+		"73 bytes":      {strings.Repeat("a", 73), http.StatusUnprocessableEntity},
+		"72 characters": {strings.Repeat("é", 72), http.StatusUnprocessableEntity},
+		"36 characters": {strings.Repeat("é", 36), http.StatusCreated},
+		"too short":     {"short", http.StatusUnprocessableEntity},
+	} {
+		t.Run(name, func(t *testing.T) {
+			username := "register_" + newObjectId()[16:]
+			got := call(t, http.MethodPost, "/auth/register", "", `{"username":"`+username+`","password":"`+tc.password+`"}`)
+			if got.Code != tc.want {
+				t.Fatalf("register responded %d, want %d: %s", got.Code, tc.want, got.Body)
+			}
+			if tc.want != http.StatusCreated {
+				return
+			}
+			login := call(t, http.MethodPost, "/auth/login", "", `{"username":"`+username+`","password":"`+tc.password+`"}`)
+			if login.Code != http.StatusOK {
+				t.Errorf("login responded %d", login.Code)
+			}
+		})
+	}
+}
+
+func TestBootstrapAdmin(t *testing.T) {
+	ctx := context.Background()
+	username := "admin_" + newObjectId()[16:]
+	if err := bootstrapAdmin(ctx, username); err != nil {
+		t.Fatal(err)
+	}
+	// registering the configured admin username doesn't make them admin
+	got := call(t, http.MethodPost, "/auth/register", "", `{"username":"`+username+`","password":"password1"}`)
+	var tokens Tokens
+	if err := json.Unmarshal(got.Body.Bytes(), &tokens); got.Code != http.StatusCreated || err != nil {
+		t.Fatalf("register responded %d: %s", got.Code, got.Body)
+	}
+	if slices.Contains(tokens.User.Roles, roleAdmin) {
+		t.Errorf("registered the admin username with roles %v", tokens.User.Roles)
+	}
+	// ...they are promoted at the next startup
+	if err := bootstrapAdmin(ctx, username); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := users.Get(ctx, tokens.User.Id); err != nil || !slices.Contains(user.Roles, roleAdmin) {
+		t.Errorf("after bootstrap roles %v %v", user.Roles, err)
+	}
+}
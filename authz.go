@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	roleAdmin   = "admin"
+	roleCoach   = "coach"
+	roleAthlete = "athlete"
+)
+
+var Roles = []string{roleAdmin, roleAthlete, roleCoach}
+
+// accessExtension is the method Extensions key under which its access rule is declared
+const accessExtension = "x-access"
+
+// access is a declarative authorization rule for a method
+//
+// Rules are declared in the method's Extensions (see allow) - so the same declaration is
+// enforced by the handlerBuilder and documented in the spec. A caller is granted access if:
+//   - they have any of the Roles, or
+//   - they are the User that Owner resolves the request to, or
+//   - Coach is set and they are a coach of that User, or
+//   - Shared is set and the request is not for any particular User
+type access struct {
+	Roles []string `yaml:"roles,omitempty"`
+	// Owner names the ownerResolvers entry that finds the User owning the requested resource
+	Owner  string `yaml:"owner,omitempty"`
+	Coach  bool   `yaml:"coach,omitempty"`
+	Shared bool   `yaml:"shared,omitempty"`
+}
+
+// allow declares the access rule for a method
+func allow(a access) chioas.Extensions {
+	return chioas.Extensions{accessExtension: a}
+}
+
+// ownerResolver resolves the db oid of the User owning the requested resource
+//
+// An empty id means the request is not for any particular User (e.g. a catalogue exercise or library program)
+type ownerResolver func(request *http.Request) (string, error)
+
+const (
+	ownerPathUser     = "path:user"
+	ownerPathWorkout  = "path:workout"
+	ownerPathExercise = "path:exercise"
+	ownerPathTemplate = "path:template"
+	ownerPathProgram  = "path:program"
+	ownerQueryUserId  = "query:userId"
+	ownerBodyUserId   = "body:userId"
+)
+
+var ownerResolvers = map[string]ownerResolver{
+	ownerPathUser: func(request *http.Request) (string, error) {
+		return chi.URLParam(request, "id"), nil
+	},
+	ownerPathWorkout: func(request *http.Request) (string, error) {
+		w, err := workouts.Get(request.Context(), chi.URLParam(request, "id"))
+		return w.UserId, err
+	},
+	ownerPathExercise: func(request *http.Request) (string, error) {
+		e, err := exercises.Get(request.Context(), chi.URLParam(request, "id"))
+		return e.UserId, err
+	},
+	ownerPathTemplate: func(request *http.Request) (string, error) {
+		t, err := templates.Get(request.Context(), chi.URLParam(request, "id"))
+		return t.UserId, err
+	},
+	ownerPathProgram: func(request *http.Request) (string, error) {
+		p, err := programs.Get(request.Context(), chi.URLParam(request, "id"))
+		return p.UserId, err
+	},
+	ownerQueryUserId: func(request *http.Request) (string, error) {
+		return request.URL.Query().Get("userId"), nil
+	},
+	ownerBodyUserId: func(request *http.Request) (string, error) {
+		// (the body is read before it is validated - so a body over the limit is rejected here, rather than
+		// failing to find the owner in it)
+		body, err := io.ReadAll(io.LimitReader(request.Body, maxRequestBodySize+1))
+		if err != nil {
+			return "", newProblem(http.StatusBadRequest, "%s", err.Error())
+		} else if len(body) > maxRequestBodySize {
+			return "", newProblem(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", maxRequestBodySize)
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		var v struct {
+			UserId string `json:"userId"`
+		}
+		_ = json.Unmarshal(body, &v)
+		return v.UserId, nil
+	},
+}
+
+// accessOf returns the access rule declared for a method (if any)
+func accessOf(mdef chioas.Method) (access, bool, error) {
+	v, ok := mdef.Extensions[accessExtension]
+	if !ok {
+		return access{}, false, nil
+	}
+	a, ok := v.(access)
+	if !ok {
+		return a, false, fmt.Errorf("%s extension must be an access rule", accessExtension)
+	}
+	if a.Owner != "" {
+		if _, ok = ownerResolvers[a.Owner]; !ok {
+			return a, false, fmt.Errorf("unknown %s owner %q", accessExtension, a.Owner)
+		}
+	}
+	return a, true, nil
+}
+
+// authorize guards a handler with the access rule - responding with a 403 problem to callers not granted access
+func (a access) authorize(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		caller, _ := callerFrom(request.Context())
+		if caller.hasRole(a.Roles...) {
+			next(writer, request)
+			return
+		}
+		if a.Owner != "" {
+			owner, err := ownerResolvers[a.Owner](request)
+			if err != nil {
+				writeError(writer, request, err)
+				return
+			}
+			if ok, err := a.grants(request, caller, owner); err != nil {
+				writeError(writer, request, err)
+				return
+			} else if ok {
+				next(writer, request)
+				return
+			}
+		}
+		writeError(writer, request, newProblem(http.StatusForbidden, "%s %s requires %s", request.Method, request.URL.Path, a))
+	}
+}
+
+func (a access) grants(request *http.Request, caller Caller, owner string) (bool, error) {
+	switch {
+	case owner == "":
+		return a.Shared, nil
+	case owner == caller.User.Id:
+		return true, nil
+	case a.Coach && caller.hasRole(roleCoach):
+		u, err := users.Get(request.Context(), owner)
+		if errors.Is(err, ErrNotFound) {
+			// nobody coaches a user that doesn't exist
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return slices.Contains(u.Coaches, caller.User.Id), nil
+	}
+	return false, nil
+}
+
+// String describes who the rule grants access to (used in 403 problem details)
+func (a access) String() string {
+	who := make([]string, 0, len(a.Roles)+3)
+	for _, r := range a.Roles {
+		who = append(who, "role "+r)
+	}
+	if a.Owner != "" {
+		who = append(who, "the owning user")
+		if a.Coach {
+			who = append(who, "a coach of the owning user")
+		}
+	}
+	if len(who) == 0 {
+		return "nobody"
+	}
+	return strings.Join(who, " or ")
+}
+
+func (c Caller) hasRole(roles ...string) bool {
+	for _, r := range roles {
+		if slices.Contains(c.User.Roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyAccessSecurity sets the Security of every method with an access rule, so the
+// spec shows which methods are restricted to (some) bearer authenticated callers
+func applyAccessSecurity(d *chioas.Definition) {
+	d.Methods = methodsWithAccessSecurity(d.Methods)
+	applyPathsAccessSecurity(d.Paths)
+}
+
+func applyPathsAccessSecurity(paths chioas.Paths) {
+	for p, pDef := range paths {
+		pDef.Methods = methodsWithAccessSecurity(pDef.Methods)
+		applyPathsAccessSecurity(pDef.Paths)
+		paths[p] = pDef
+	}
+}
+
+func methodsWithAccessSecurity(methods chioas.Methods) chioas.Methods {
+	for m, mDef := range methods {
+		if _, ok := mDef.Extensions[accessExtension]; ok && len(mDef.Security) == 0 {
+			mDef.Security = chioas.SecuritySchemes{{Name: bearerAuth}}
+			methods[m] = mDef
+		}
+	}
+	return methods
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAccess(t *testing.T) {
+	ctx := context.Background()
+	athlete, athleteToken := testUser(t, "access_athlete", roleAthlete)
+	coach, coachToken := testUser(t, "access_coach", roleCoach)
+	_, otherCoachToken := testUser(t, "access_other_coach", roleCoach)
+	_, otherToken := testUser(t, "access_other", roleAthlete)
+	_, adminToken := testUser(t, "access_admin", roleAdmin)
+	athlete.Coaches = []string{coach.Id}
+	if _, err := users.Update(ctx, athlete); err != nil {
+		t.Fatal(err)
+	}
+	workout, err := workouts.Create(ctx, Workout{UserId: athlete.Id, StartTime: time.Now(), Exercises: []WorkoutExercise{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const missing = "0000000000000000000000ff"
+	for name, tc := range map[string]struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		"owner":                       {http.MethodGet, "/users/" + athlete.Id + "/records", athleteToken, http.StatusOK},
+		"coach":                       {http.MethodGet, "/users/" + athlete.Id + "/records", coachToken, http.StatusOK},
+		"admin":                       {http.MethodGet, "/users/" + athlete.Id + "/records", adminToken, http.StatusOK},
+		"other coach":                 {http.MethodGet, "/users/" + athlete.Id + "/records", otherCoachToken, http.StatusForbidden},
+		"other athlete":               {http.MethodGet, "/users/" + athlete.Id + "/records", otherToken, http.StatusForbidden},
+		"anonymous":                   {http.MethodGet, "/users/" + athlete.Id + "/records", "", http.StatusUnauthorized},
+		"owner of workout":            {http.MethodGet, "/workouts/" + workout.Id, athleteToken, http.StatusOK},
+		"coach of workout owner":      {http.MethodGet, "/workouts/" + workout.Id, coachToken, http.StatusOK},
+		"other athlete of workout":    {http.MethodGet, "/workouts/" + workout.Id, otherToken, http.StatusForbidden},
+		"coach of a missing user":     {http.MethodGet, "/users/" + missing + "/records", coachToken, http.StatusForbidden},
+		"admin of a missing user":     {http.MethodGet, "/users/" + missing + "/records", adminToken, http.StatusNotFound},
+		"missing workout":             {http.MethodGet, "/workouts/" + missing, athleteToken, http.StatusNotFound},
+		"coach only rule for a coach": {http.MethodDelete, "/users/" + athlete.Id + "/calendar-token", coachToken, http.StatusForbidden},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := call(t, tc.method, tc.path, tc.token, ""); got.Code != tc.want {
+				t.Errorf("%s %s responded %d, want %d: %s", tc.method, tc.path, got.Code, tc.want, got.Body)
+			}
+		})
+	}
+}
+
+func TestCheckUserCoaches(t *testing.T) {
+	ctx := context.Background()
+	coach, _ := testUser(t, "coaches_coach", roleCoach)
+	gone, _ := testUser(t, "coaches_gone", roleCoach)
+	notCoach, _ := testUser(t, "coaches_not", roleAthlete)
+	athlete, token := testUser(t, "coaches_athlete", roleAthlete)
+	athlete.Coaches = []string{coach.Id, gone.Id}
+	if _, err := users.Update(ctx, athlete); err != nil {
+		t.Fatal(err)
+	}
+	// a listed coach stopping coaching (or being deleted) doesn't stop the athlete updating themselves
+	coach.Roles = []string{roleAthlete}
+	if _, err := users.Update(ctx, coach); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Delete(ctx, gone.Id); err != nil {
+		t.Fatal(err)
+	}
+	if got := call(t, http.MethodPatch, "/users/"+athlete.Id, token, `{"name":"Renamed"}`, contentTypeMergePatch); got.Code != http.StatusOK {
+		t.Errorf("patch responded %d: %s", got.Code, got.Body)
+	}
+	// but added coaches are checked
+	for _, id := range []string{notCoach.Id, "0000000000000000000000ff", athlete.Id} {
+		body := `{"coaches":["` + coach.Id + `","` + id + `"]}`
+		if got := call(t, http.MethodPatch, "/users/"+athlete.Id, token, body, contentTypeMergePatch); got.Code != http.StatusUnprocessableEntity {
+			t.Errorf("patch adding coach %s responded %d, want 422: %s", id, got.Code, got.Body)
+		}
+	}
+}
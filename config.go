@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the server configuration
+//
+// Each setting is taken from (in increasing precedence) the defaults, the config file,
+// WORKY_* environment variables and command line flags
+type Config struct {
+	// Listen is the address to listen on
+	Listen string    `yaml:"listen" toml:"listen"`
+	TLS    TLSConfig `yaml:"tls" toml:"tls"`
+	// Timeouts are the http server timeouts
+	Timeouts TimeoutsConfig `yaml:"timeouts" toml:"timeouts"`
+	// DataDir is the directory the file-backed stores are kept in
+	DataDir string `yaml:"dataDir" toml:"dataDir"`
+	// ServeDocs serves the OAS spec and docs ui at /docs
+	ServeDocs bool `yaml:"serveDocs" toml:"serveDocs"`
+	// LogLevel is debug, info, warn or error
+	LogLevel string `yaml:"logLevel" toml:"logLevel"`
+	// LogFormat is json or text
+	LogFormat string `yaml:"logFormat" toml:"logFormat"`
+	// CORSOrigins are the origins allowed to make cross-origin requests ("*" allows any)
+	CORSOrigins []string      `yaml:"corsOrigins" toml:"corsOrigins"`
+	Tracing     TracingConfig `yaml:"tracing" toml:"tracing"`
+	// AdminUsername is the user given the admin role at startup (registering the username never grants it)
+	AdminUsername string `yaml:"adminUsername" toml:"adminUsername"`
+	// TokenSecret signs access and refresh tokens (random if empty - so tokens won't survive a restart)
+	TokenSecret string `yaml:"tokenSecret" toml:"tokenSecret"`
+}
+
+// TLSConfig is the certificate and key to serve https with (http is served if both are empty)
+type TLSConfig struct {
+	CertFile string `yaml:"certFile" toml:"certFile"`
+	KeyFile  string `yaml:"keyFile" toml:"keyFile"`
+}
+
+// TimeoutsConfig are the http server timeouts (durations such as "30s")
+type TimeoutsConfig struct {
+	// ReadHeader is how long a client may take to send the request headers
+	ReadHeader time.Duration `yaml:"readHeader" toml:"readHeader"`
+	// Read is how long a client may take to send the whole request
+	Read time.Duration `yaml:"read" toml:"read"`
+	// Write is how long a request may take from the end of its headers to the end of the response
+	Write time.Duration `yaml:"write" toml:"write"`
+	// Idle is how long a keep-alive connection may wait for its next request
+	Idle time.Duration `yaml:"idle" toml:"idle"`
+	// Shutdown is how long in-flight requests are given to finish on SIGINT/SIGTERM
+	Shutdown time.Duration `yaml:"shutdown" toml:"shutdown"`
+}
+
+// TracingConfig is where trace spans are exported to
+type TracingConfig struct {
+	// Exporter is none, stdout or otlp
+	Exporter string `yaml:"exporter" toml:"exporter"`
+	// Endpoint is the OTLP/HTTP traces url of the collector (for the otlp exporter)
+	Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+	ServiceName string `yaml:"serviceName" toml:"serviceName"`
+}
+
+const envPrefix = "WORKY_"
+
+const (
+	logFormatJson = "json"
+	logFormatText = "text"
+)
+
+func defaultConfig() Config {
+	return Config{
+		Listen:      ":3009",
+		DataDir:     "data",
+		ServeDocs:   true,
+		LogLevel:    "info",
+		LogFormat:   logFormatJson,
+		CORSOrigins: []string{},
+		Tracing: TracingConfig{
+			Exporter:    traceExporterNone,
+			Endpoint:    "http://localhost:4318/v1/traces",
+			ServiceName: "workyapi",
+		},
+		Timeouts: TimeoutsConfig{
+			ReadHeader: 5 * time.Second,
+			Read:       30 * time.Second,
+			Write:      60 * time.Second,
+			Idle:       120 * time.Second,
+			Shutdown:   20 * time.Second,
+		},
+	}
+}
+
+// loadConfig loads the config from the command line args (and the config file and environment)
+//
+// printOnly is set when the --print-config flag asks for the effective config to be printed instead of serving
+func loadConfig(args []string, getenv func(string) string) (cfg Config, printOnly bool, err error) {
+	cfg = defaultConfig()
+	fs := flag.NewFlagSet("workyapi", flag.ContinueOnError)
+	configFile := fs.String("config", getenv(envPrefix+"CONFIG"), "config file (.yaml, .yml or .toml)")
+	flags := Config{}
+	fs.StringVar(&flags.Listen, "listen", "", "address to listen on")
+	fs.StringVar(&flags.TLS.CertFile, "tls-cert", "", "TLS certificate file")
+	fs.StringVar(&flags.TLS.KeyFile, "tls-key", "", "TLS key file")
+	fs.StringVar(&flags.DataDir, "data-dir", "", "directory for stored data")
+	fs.BoolVar(&flags.ServeDocs, "serve-docs", false, "serve the api docs at /docs")
+	fs.StringVar(&flags.LogLevel, "log-level", "", "log level (debug, info, warn or error)")
+	fs.DurationVar(&flags.Timeouts.Shutdown, "shutdown-timeout", 0, "how long in-flight requests are given to finish on shutdown")
+	fs.StringVar(&flags.LogFormat, "log-format", "", "log format (json or text)")
+	fs.StringVar(&flags.Tracing.Exporter, "tracing-exporter", "", "trace exporter (none, stdout or otlp)")
+	fs.StringVar(&flags.AdminUsername, "admin-username", "", "username of the user given the admin role")
+	corsOrigins := fs.String("cors-origins", "", "comma separated origins allowed cross-origin requests")
+	fs.BoolVar(&printOnly, "print-config", false, "print the effective config (as yaml) and exit")
+	if err = fs.Parse(args); err != nil {
+		return
+	} else if fs.NArg() > 0 {
+		return cfg, false, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *configFile != "" {
+		if err = cfg.loadFile(*configFile); err != nil {
+			return
+		}
+	}
+	if err = cfg.loadEnv(getenv); err != nil {
+		return
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen = flags.Listen
+		case "tls-cert":
+			cfg.TLS.CertFile = flags.TLS.CertFile
+		case "tls-key":
+			cfg.TLS.KeyFile = flags.TLS.KeyFile
+		case "data-dir":
+			cfg.DataDir = flags.DataDir
+		case "serve-docs":
+			cfg.ServeDocs = flags.ServeDocs
+		case "log-level":
+			cfg.LogLevel = flags.LogLevel
+		case "log-format":
+			cfg.LogFormat = flags.LogFormat
+		case "shutdown-timeout":
+			cfg.Timeouts.Shutdown = flags.Timeouts.Shutdown
+		case "tracing-exporter":
+			cfg.Tracing.Exporter = flags.Tracing.Exporter
+		case "admin-username":
+			cfg.AdminUsername = flags.AdminUsername
+		case "cors-origins":
+			cfg.CORSOrigins = splitList(*corsOrigins)
+		}
+	})
+	return cfg, printOnly, cfg.validate()
+}
+
+func (c *Config) loadFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("config file %s: %w", name, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(data), c)
+		if err != nil {
+			return fmt.Errorf("config file %s: %w", name, err)
+		} else if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("config file %s: unknown setting %q", name, undecoded[0].String())
+		}
+	default:
+		return fmt.Errorf("config file %s: unknown format (use .yaml, .yml or .toml)", name)
+	}
+	return nil
+}
+
+func (c *Config) loadEnv(getenv func(string) string) error {
+	setString := func(name string, v *string) {
+		if s := getenv(envPrefix + name); s != "" {
+			*v = s
+		}
+	}
+	setString("LISTEN", &c.Listen)
+	setString("TLS_CERT_FILE", &c.TLS.CertFile)
+	setString("TLS_KEY_FILE", &c.TLS.KeyFile)
+	setString("DATA_DIR", &c.DataDir)
+	setString("LOG_LEVEL", &c.LogLevel)
+	setString("LOG_FORMAT", &c.LogFormat)
+	setString("TOKEN_SECRET", &c.TokenSecret)
+	setString("ADMIN_USERNAME", &c.AdminUsername)
+	setString("TRACING_EXPORTER", &c.Tracing.Exporter)
+	setString("TRACING_ENDPOINT", &c.Tracing.Endpoint)
+	setString("TRACING_SERVICE_NAME", &c.Tracing.ServiceName)
+	for name, v := range map[string]*time.Duration{
+		"READ_HEADER_TIMEOUT": &c.Timeouts.ReadHeader,
+		"READ_TIMEOUT":        &c.Timeouts.Read,
+		"WRITE_TIMEOUT":       &c.Timeouts.Write,
+		"IDLE_TIMEOUT":        &c.Timeouts.Idle,
+		"SHUTDOWN_TIMEOUT":    &c.Timeouts.Shutdown,
+	} {
+		if s := getenv(envPrefix + name); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("%s%s: %w", envPrefix, name, err)
+			}
+			*v = d
+		}
+	}
+	if s := getenv(envPrefix + "SERVE_DOCS"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%sSERVE_DOCS: %w", envPrefix, err)
+		}
+		c.ServeDocs = b
+	}
+	if s := getenv(envPrefix + "CORS_ORIGINS"); s != "" {
+		c.CORSOrigins = splitList(s)
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.Listen == "" {
+		return errors.New("config: listen address is required")
+	} else if c.DataDir == "" {
+		return errors.New("config: data dir is required")
+	} else if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("config: tls needs both a cert file and a key file")
+	}
+	if c.Timeouts.ReadHeader < 0 || c.Timeouts.Read < 0 || c.Timeouts.Write < 0 || c.Timeouts.Idle < 0 || c.Timeouts.Shutdown < 0 {
+		return errors.New("config: timeouts must not be negative")
+	}
+	if c.LogFormat != logFormatJson && c.LogFormat != logFormatText {
+		return fmt.Errorf("config: log format must be %s or %s", logFormatJson, logFormatText)
+	}
+	switch c.Tracing.Exporter {
+	case traceExporterNone, traceExporterStdout, traceExporterOtlp:
+	default:
+		return fmt.Errorf("config: unknown tracing exporter %q", c.Tracing.Exporter)
+	}
+	if _, err := c.level(); err != nil {
+		return fmt.Errorf("config: log level: %w", err)
+	}
+	if c.CORSOrigins == nil {
+		c.CORSOrigins = []string{}
+	}
+	return nil
+}
+
+func (c *Config) level() (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(c.LogLevel))
+	return l, err
+}
+
+// print writes the config as yaml (with the token secret redacted)
+func (c Config) print(w io.Writer) error {
+	if c.TokenSecret != "" {
+		c.TokenSecret = "(redacted)"
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func splitList(s string) []string {
+	result := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(file, []byte(`listen: ":4000"
+dataDir: file-data
+logLevel: warn
+corsOrigins: [https://file.example]
+adminUsername: file-admin
+timeouts:
+  shutdown: 5s
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		envPrefix + "CONFIG":           file,
+		envPrefix + "DATA_DIR":         "env-data",
+		envPrefix + "LOG_LEVEL":        "debug",
+		envPrefix + "SHUTDOWN_TIMEOUT": "7s",
+	}
+	getenv := func(name string) string { return env[name] }
+
+	cfg, printOnly, err := loadConfig([]string{"--data-dir", "flag-data", "--cors-origins", "https://a.example, https://b.example"}, getenv)
+	if err != nil || printOnly {
+		t.Fatal(printOnly, err)
+	}
+	// flags beat env beats the file beats the defaults
+	for name, got := range map[string][2]any{
+		"default":           {cfg.LogFormat, logFormatJson},
+		"file":              {cfg.Listen, ":4000"},
+		"file not in env":   {cfg.AdminUsername, "file-admin"},
+		"env over file":     {cfg.LogLevel, "debug"},
+		"env duration":      {cfg.Timeouts.Shutdown, 7 * time.Second},
+		"default duration":  {cfg.Timeouts.Read, 30 * time.Second},
+		"flag over env":     {cfg.DataDir, "flag-data"},
+		"flag list":         {strings.Join(cfg.CORSOrigins, " "), "https://a.example https://b.example"},
+		"unset bool":        {cfg.ServeDocs, true},
+		"unset flag string": {cfg.Tracing.ServiceName, "workyapi"},
+	} {
+		if got[0] != got[1] {
+			t.Errorf("%s %v, want %v", name, got[0], got[1])
+		}
+	}
+	// a flag that is given wins even when it is the zero value
+	if cfg, _, _ = loadConfig([]string{"--serve-docs=false"}, getenv); cfg.ServeDocs {
+		t.Errorf("serve docs flag of false ignored")
+	}
+	if cfg, _, _ = loadConfig(nil, func(string) string { return "" }); !slices.Equal(cfg.CORSOrigins, []string{}) || cfg.DataDir != "data" {
+		t.Errorf("defaults %+v", cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	unknownYaml := write("unknown.yaml", "listen: \":1\"\nlisten_address: \":2\"\n")
+	unknownToml := write("unknown.toml", "listen = \":1\"\nlistenAddress = \":2\"\n")
+	ini := write("config.ini", "listen=:1\n")
+	for name, tc := range map[string]struct {
+		args []string
+		env  map[string]string
+	}{
+		"unknown yaml setting": {[]string{"--config", unknownYaml}, nil},
+		"unknown toml setting": {[]string{"--config", unknownToml}, nil},
+		"unknown file format":  {[]string{"--config", ini}, nil},
+		"missing file":         {[]string{"--config", filepath.Join(dir, "missing.yaml")}, nil},
+		"unknown flag":         {[]string{"--listen-on", ":1"}, nil},
+		"extra argument":       {[]string{"serve"}, nil},
+		"bad env duration":     {nil, map[string]string{envPrefix + "READ_TIMEOUT": "soon"}},
+		"bad env bool":         {nil, map[string]string{envPrefix + "SERVE_DOCS": "maybe"}},
+		"negative timeout":     {[]string{"--shutdown-timeout", "-1s"}, nil},
+		"tls cert without key": {[]string{"--tls-cert", "cert.pem"}, nil},
+		"unknown log level":    {[]string{"--log-level", "loud"}, nil},
+		"unknown log format":   {[]string{"--log-format", "xml"}, nil},
+		"unknown exporter":     {[]string{"--tracing-exporter", "carrier-pigeon"}, nil},
+	} {
+		if _, _, err := loadConfig(tc.args, func(name string) string { return tc.env[name] }); err == nil {
+			t.Errorf("%s loaded", name)
+		}
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	env := map[string]string{envPrefix + "TOKEN_SECRET": "very-secret-value"}
+	cfg, printOnly, err := loadConfig([]string{"--print-config"}, func(name string) string { return env[name] })
+	if err != nil || !printOnly {
+		t.Fatal(printOnly, err)
+	}
+	var buf bytes.Buffer
+	if err = cfg.print(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "very-secret-value") || !strings.Contains(buf.String(), "(redacted)") {
+		t.Errorf("printed config:\n%s", buf.String())
+	}
+	// printing doesn't redact the config in use
+	if cfg.TokenSecret != "very-secret-value" {
+		t.Errorf("token secret %q", cfg.TokenSecret)
+	}
+	// the printed config loads back as a config file
+	file := filepath.Join(t.TempDir(), "printed.yaml")
+	if err = os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = loadConfig([]string{"--config", file}, func(string) string { return "" }); err != nil {
+		t.Errorf("loading printed config %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	corsAllowMethods  = strings.Join([]string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}, ", ")
+	corsAllowHeaders  = "Authorization, Content-Type, traceparent, Units, X-Request-Id"
+	corsExposeHeaders = "Link, Location, traceresponse, Units, X-Request-Id, X-Total-Count"
+)
+
+// corsMiddleware allows cross-origin requests from the given origins ("*" allows any origin)
+//
+// Preflight (OPTIONS) requests from allowed origins are answered directly
+func corsMiddleware(origins []string) func(http.Handler) http.Handler {
+	anyOrigin := slices.Contains(origins, "*")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			origin := request.Header.Get("Origin")
+			if origin == "" || !(anyOrigin || slices.Contains(origins, origin)) {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			hdr := writer.Header()
+			hdr.Add("Vary", "Origin")
+			hdr.Set("Access-Control-Allow-Origin", origin)
+			if request.Method == http.MethodOptions && request.Header.Get("Access-Control-Request-Method") != "" {
+				hdr.Add("Vary", "Access-Control-Request-Method")
+				hdr.Add("Vary", "Access-Control-Request-Headers")
+				hdr.Set("Access-Control-Allow-Methods", corsAllowMethods)
+				hdr.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				hdr.Set("Access-Control-Max-Age", "600")
+				writer.WriteHeader(http.StatusNoContent)
+				return
+			}
+			hdr.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			next.ServeHTTP(writer, request)
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCorsHeaders(t *testing.T) {
+	handler := corsMiddleware([]string{"https://app.example"})(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	preflight := httptest.NewRequest(http.MethodOptions, "/workouts", nil)
+	preflight.Header.Set("Origin", "https://app.example")
+	preflight.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, preflight)
+	// browsers match the allowed headers case-insensitively
+	allowed := strings.ToLower(rec.Header().Get("Access-Control-Allow-Headers"))
+	for _, h := range []string{"Authorization", "Content-Type", "traceparent", headerUnits} {
+		if !strings.Contains(allowed, strings.ToLower(h)) {
+			t.Errorf("header %q is not allowed", h)
+		}
+	}
+	request := httptest.NewRequest(http.MethodGet, "/workouts", nil)
+	request.Header.Set("Origin", "https://app.example")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, request)
+	exposed := strings.ToLower(rec.Header().Get("Access-Control-Expose-Headers"))
+	for _, h := range []string{"Link", "Location", headerUnits, "X-Request-Id", "X-Total-Count"} {
+		if !strings.Contains(exposed, strings.ToLower(h)) {
+			t.Errorf("header %q is not exposed", h)
+		}
+	}
+	request.Header.Set("Origin", "https://other.example")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, request)
+	if rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origin allowed")
+	}
+}
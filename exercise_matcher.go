@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+const (
+	// minMatchScore is the lowest score at which a name is taken to be an exercise
+	minMatchScore = 0.6
+	// minSuggestionScore is the lowest score at which an unmatched name is given a suggestion
+	minSuggestionScore = 0.4
+)
+
+// matchTokenSynonyms expands abbreviations and run-together words used by other apps
+var matchTokenSynonyms = map[string][]string{
+	"bb":     {"barbell"},
+	"chinup": {"chin", "up"},
+	"db":     {"dumbbell"},
+	"kb":     {"kettlebell"},
+	"ohp":    {"overhead", "press"},
+	"pullup": {"pull", "up"},
+	"pushup": {"push", "up"},
+	"rdl":    {"romanian", "deadlift"},
+	"situp":  {"sit", "up"},
+}
+
+// exerciseMatcher matches free text exercise names (e.g. from another app's export) to the
+// exercises a user may use - the user's custom exercises and the catalogue
+//
+// Names are compared as sets of normalized words (Dice coefficient - with words a typo apart counting
+// as the same). A parenthesised qualifier - as in "Bench Press (Dumbbell)" - is compared with the
+// exercise's equipment as well as its name
+type exerciseMatcher struct {
+	candidates []matchCandidate
+	cache      map[string]exerciseMatch
+}
+
+type matchCandidate struct {
+	exercise  Exercise
+	name      []string
+	equipment []string
+}
+
+// exerciseMatch is the result of matching a name - exercise is nil when nothing scored highly enough
+type exerciseMatch struct {
+	exercise   *Exercise
+	score      float64
+	suggestion *Exercise
+}
+
+func newExerciseMatcher(ctx context.Context, userId string) (*exerciseMatcher, error) {
+	list, err := exercises.List(ctx, ExerciseFilter{UserId: userId})
+	if err != nil {
+		return nil, err
+	}
+	m := &exerciseMatcher{cache: map[string]exerciseMatch{}}
+	// custom exercises first - so they win ties with the catalogue
+	for _, custom := range []bool{true, false} {
+		for _, e := range list {
+			if (e.UserId != "") == custom {
+				name, _ := matchTokens(e.Name)
+				m.candidates = append(m.candidates, matchCandidate{
+					exercise:  e,
+					name:      name,
+					equipment: equipmentTokens(e.Equipment),
+				})
+			}
+		}
+	}
+	return m, nil
+}
+
+func (m *exerciseMatcher) match(name string) exerciseMatch {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if r, ok := m.cache[key]; ok {
+		return r
+	}
+	words, qualifier := matchTokens(name)
+	query := uniqueTokens(append(words, qualifier...))
+	var best *matchCandidate
+	bestScore := 0.0
+	for i := range m.candidates {
+		c := &m.candidates[i]
+		var score float64
+		if strings.EqualFold(c.exercise.Name, strings.TrimSpace(name)) {
+			score = 1
+		} else if len(qualifier) > 0 {
+			score = diceScore(query, uniqueTokens(append(append([]string{}, c.name...), c.equipment...)))
+		} else {
+			score = diceScore(query, c.name)
+		}
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+	r := exerciseMatch{score: bestScore}
+	if best != nil && bestScore >= minMatchScore {
+		r.exercise = &best.exercise
+	} else if best != nil && bestScore >= minSuggestionScore {
+		r.suggestion = &best.exercise
+	}
+	m.cache[key] = r
+	return r
+}
+
+// matchTokens splits a name into its normalized words - and the words of any parenthesised qualifiers
+func matchTokens(name string) (words []string, qualifier []string) {
+	var outer, inner strings.Builder
+	depth := 0
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r == '(' || r == '[':
+			depth++
+			inner.WriteRune(' ')
+		case (r == ')' || r == ']') && depth > 0:
+			depth--
+			inner.WriteRune(' ')
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			if r == '\'' {
+				// "farmer's" is "farmers"
+				continue
+			}
+			if depth > 0 {
+				inner.WriteRune(' ')
+			} else {
+				outer.WriteRune(' ')
+			}
+		case depth > 0:
+			inner.WriteRune(r)
+		default:
+			outer.WriteRune(r)
+		}
+	}
+	return normalizeTokens(strings.Fields(outer.String())), normalizeTokens(strings.Fields(inner.String()))
+}
+
+func normalizeTokens(words []string) []string {
+	result := make([]string, 0, len(words))
+	for _, w := range words {
+		if expanded, ok := matchTokenSynonyms[w]; ok {
+			result = append(result, expanded...)
+			continue
+		}
+		// crude singular - "curls" is "curl" (but "press" stays "press")
+		if len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") {
+			w = w[:len(w)-1]
+		}
+		result = append(result, w)
+	}
+	return result
+}
+
+// equipmentTokens are the words of an equipment type (no words for none or other)
+func equipmentTokens(equipment string) []string {
+	if equipment == "none" || equipment == "other" || equipment == "" {
+		return nil
+	}
+	return strings.Fields(strings.ReplaceAll(equipment, "_", " "))
+}
+
+func uniqueTokens(tokens []string) []string {
+	result := make([]string, 0, len(tokens))
+	seen := map[string]bool{}
+	for _, t := range tokens {
+		if !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// diceScore is the Dice coefficient of two sets of words (0 to 1) - words a typo apart are the same
+func diceScore(a []string, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	used := make([]bool, len(b))
+	matched := 0
+	for _, x := range a {
+		for i, y := range b {
+			if !used[i] && tokensAlike(x, y) {
+				used[i] = true
+				matched++
+				break
+			}
+		}
+	}
+	return float64(2*matched) / float64(len(a)+len(b))
+}
+
+// tokensAlike is whether two words are the same - allowing a single typo in longer words
+func tokensAlike(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	return len(a) >= 5 && len(b) >= 5 && levenshtein(a, b) <= 1
+}
+
+// levenshtein is the edit distance between two strings (in runes)
+func levenshtein(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ExerciseStore is the persistence interface for exercises
+//
+// The store serves the built-in (read-only) catalogue together with users' custom exercises
+type ExerciseStore interface {
+	List(ctx context.Context, filter ExerciseFilter) ([]Exercise, error)
+	Get(ctx context.Context, id string) (Exercise, error)
+	Create(ctx context.Context, exercise Exercise) (Exercise, error)
+	Update(ctx context.Context, exercise Exercise) (Exercise, error)
+	Delete(ctx context.Context, id string) error
+	// DeleteUserExercises deletes all of a user's custom exercises (e.g. when the user is deleted)
+	DeleteUserExercises(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// ExerciseFilter filters listed exercises - zero value fields are not filtered on
+type ExerciseFilter struct {
+	// UserId includes the user's custom exercises (the catalogue is always included)
+	UserId string
+	// NamePrefix matches (case-insensitively) the start of the name or of any word in the name
+	NamePrefix  string
+	MuscleGroup string
+	Equipment   string
+}
+
+func (f ExerciseFilter) matches(e Exercise) bool {
+	return (e.UserId == "" || e.UserId == f.UserId) &&
+		(f.NamePrefix == "" || namePrefixMatches(e.Name, f.NamePrefix)) &&
+		(f.MuscleGroup == "" || slices.Contains(e.PrimaryMuscles, f.MuscleGroup) || slices.Contains(e.SecondaryMuscles, f.MuscleGroup)) &&
+		(f.Equipment == "" || e.Equipment == f.Equipment)
+}
+
+func namePrefixMatches(name string, prefix string) bool {
+	name, prefix = strings.ToLower(name), strings.ToLower(prefix)
+	if strings.HasPrefix(name, prefix) {
+		return true
+	}
+	for _, word := range strings.Fields(name) {
+		if strings.HasPrefix(word, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+//go:embed exercise_catalogue.json
+var exerciseCatalogueData []byte
+
+// exerciseCatalogue is the built-in exercises (by id), loaded from the embedded catalogue file
+var exerciseCatalogue = func() map[string]Exercise {
+	var items []Exercise
+	if err := json.Unmarshal(exerciseCatalogueData, &items); err != nil {
+		panic(fmt.Errorf("loading exercise catalogue: %w", err))
+	}
+	result := make(map[string]Exercise, len(items))
+	for _, item := range items {
+		result[item.Id] = item
+	}
+	return result
+}()
+
+// NewMemoryExerciseStore creates an ExerciseStore whose custom exercises are held in memory only
+func NewMemoryExerciseStore() ExerciseStore {
+	return &exerciseStore{custom: newMemoryCollection[Exercise]("exercises", exerciseId)}
+}
+
+// OpenFileExerciseStore opens (or creates) an ExerciseStore with custom exercises stored in the given directory
+func OpenFileExerciseStore(dir string) (ExerciseStore, error) {
+	c, err := openFileCollection[Exercise](dir, "exercises", exerciseId)
+	if err != nil {
+		return nil, err
+	}
+	return &exerciseStore{custom: c}, nil
+}
+
+func exerciseId(e *Exercise) *string {
+	return &e.Id
+}
+
+type exerciseStore struct {
+	custom *collection[Exercise]
+}
+
+func (s *exerciseStore) List(ctx context.Context, filter ExerciseFilter) ([]Exercise, error) {
+	result, err := s.custom.list(ctx, filter.matches)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range exerciseCatalogue {
+		if filter.matches(e) {
+			result = append(result, e)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+func (s *exerciseStore) Get(ctx context.Context, id string) (Exercise, error) {
+	if e, ok := exerciseCatalogue[id]; ok {
+		return e, nil
+	}
+	return s.custom.get(ctx, id)
+}
+
+func (s *exerciseStore) Create(ctx context.Context, exercise Exercise) (Exercise, error) {
+	if err := catalogueNameUnused(exercise.Name); err != nil {
+		return exercise, err
+	}
+	return s.custom.create(ctx, exercise, uniqueExerciseName(exercise))
+}
+
+func (s *exerciseStore) Update(ctx context.Context, exercise Exercise) (Exercise, error) {
+	if err := catalogueReadOnly(exercise.Id); err != nil {
+		return exercise, err
+	} else if err = catalogueNameUnused(exercise.Name); err != nil {
+		return exercise, err
+	}
+	return s.custom.update(ctx, exercise, uniqueExerciseName(exercise))
+}
+
+func (s *exerciseStore) Delete(ctx context.Context, id string) error {
+	if err := catalogueReadOnly(id); err != nil {
+		return err
+	}
+	return s.custom.delete(ctx, id)
+}
+
+func catalogueReadOnly(id string) error {
+	if _, ok := exerciseCatalogue[id]; ok {
+		return fmt.Errorf("exercise %q is part of the built-in catalogue and cannot be changed: %w", id, ErrConflict)
+	}
+	return nil
+}
+
+// catalogueNameUnused checks that a custom exercise doesn't shadow a catalogue exercise
+func catalogueNameUnused(name string) error {
+	for _, e := range exerciseCatalogue {
+		if strings.EqualFold(e.Name, name) {
+			return fmt.Errorf("exercise %q is already in the catalogue: %w", name, ErrConflict)
+		}
+	}
+	return nil
+}
+
+// uniqueExerciseName checks that a user's custom exercise names are unique
+func uniqueExerciseName(exercise Exercise) func(Exercise) error {
+	return func(existing Exercise) error {
+		if existing.UserId == exercise.UserId && strings.EqualFold(existing.Name, exercise.Name) {
+			return fmt.Errorf("exercise %q already exists: %w", exercise.Name, ErrConflict)
+		}
+		return nil
+	}
+}
+
+func (s *exerciseStore) DeleteUserExercises(ctx context.Context, userId string) error {
+	_, err := s.custom.deleteWhere(ctx, func(existing Exercise) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *exerciseStore) Ping(ctx context.Context) error {
+	return s.custom.ping(ctx)
+}
+
+func (s *exerciseStore) Close() error {
+	return s.custom.close()
+}
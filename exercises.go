@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type Exercise struct {
+	Id               string   `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	Name             string   `json:"name" oas:"description: name of the exercise, required, minLength: 1, maxLength: 100"`
+	PrimaryMuscles   []string `json:"primaryMuscles" oas:"$ref: MuscleGroup, type: array, required"`
+	SecondaryMuscles []string `json:"secondaryMuscles" oas:"$ref: MuscleGroup, type: array"`
+	Equipment        string   `json:"equipment" oas:"$ref: Equipment, required"`
+	MovementPattern  string   `json:"movementPattern" oas:"$ref: MovementPattern, required"`
+	UnitType         string   `json:"unitType" oas:"$ref: UnitType, required"`
+	UserId           string   `json:"userId,omitempty" oas:"description: db oid of the User owning a custom exercise (absent for catalogue exercises), pattern: '^[0-9a-f]{24}$'"`
+}
+
+var MuscleGroups = []string{
+	"abductors", "abs", "adductors", "biceps", "calves", "chest", "forearms", "full_body", "glutes",
+	"hamstrings", "lats", "lower_back", "neck", "obliques", "quadriceps", "shoulders", "traps",
+	"triceps", "upper_back",
+}
+
+var EquipmentTypes = []string{
+	"band", "barbell", "bodyweight", "cable", "dumbbell", "ez_bar", "kettlebell", "machine", "none",
+	"other", "smith_machine", "trap_bar",
+}
+
+var MovementPatterns = []string{
+	"carry", "hinge", "horizontal_pull", "horizontal_push", "isolation", "locomotion", "lunge",
+	"rotation", "squat", "vertical_pull", "vertical_push",
+}
+
+// UnitTypes are what is recorded for each set of an exercise
+var UnitTypes = []string{
+	"distance_duration", "duration", "reps", "weight_duration", "weight_reps",
+}
+
+var ExercisePath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getExercises,
+			OperationId: "listExercises",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerQueryUserId, Coach: true, Shared: true}),
+			QueryParams: exerciseListing.queryParams(
+				chioas.QueryParam{
+					Name:        "name",
+					Description: "Only exercises whose name (or any word in the name) starts with this prefix (case-insensitive)",
+					Example:     "squ",
+				},
+				chioas.QueryParam{
+					Name:        "muscleGroup",
+					Description: "Only exercises working this muscle group (primary or secondary)",
+					SchemaRef:   "MuscleGroup",
+				},
+				chioas.QueryParam{
+					Name:        "equipment",
+					Description: "Only exercises using this equipment",
+					SchemaRef:   "Equipment",
+				},
+				chioas.QueryParam{
+					Name:        "userId",
+					Description: "Include the custom exercises of this User db oid (the catalogue is always included)",
+				},
+			),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of Exercises",
+					IsArray:     true,
+					SchemaRef:   "Exercise",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postExercise,
+			OperationId: "createExercise",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerBodyUserId, Coach: true}),
+			Request: &chioas.Request{
+				Description: "Custom Exercise to create (userId is required, any _id is ignored)",
+				Required:    true,
+				SchemaRef:   "Exercise",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created Exercise",
+					SchemaRef:   "Exercise",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{id}": {
+			PathParams: chioas.PathParams{
+				"id": {
+					Description: "Exercise db oid",
+					Example:     "000000000000000000000001",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getExercise,
+					OperationId: "getExercise",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathExercise, Coach: true, Shared: true}),
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Exercise",
+							SchemaRef:   "Exercise",
+						},
+					},
+				},
+				http.MethodPut: {
+					Handler:     putExercise,
+					OperationId: "replaceExercise",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathExercise, Coach: true}),
+					Description: "Catalogue exercises cannot be replaced (409)",
+					Request: &chioas.Request{
+						Description: "Replacement custom Exercise (any _id and userId are ignored)",
+						Required:    true,
+						SchemaRef:   "Exercise",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Exercise",
+							SchemaRef:   "Exercise",
+						},
+					},
+				},
+				http.MethodPatch: {
+					Handler:     patchExercise,
+					OperationId: "updateExercise",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathExercise, Coach: true}),
+					Description: "Catalogue exercises cannot be patched (409)",
+					Request: &chioas.Request{
+						Description: "JSON Merge Patch (RFC 7396) to apply to the custom Exercise",
+						Required:    true,
+						ContentType: contentTypeMergePatch,
+						SchemaRef:   "Exercise",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Exercise",
+							SchemaRef:   "Exercise",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteExercise,
+					OperationId: "deleteExercise",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathExercise, Coach: true}),
+					Description: "Catalogue exercises - and custom exercises still used by workouts, templates, programs or enrolments - cannot be deleted (409)",
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Exercise deleted",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var ExerciseSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Exercise",
+		Description: "An Exercise - either from the built-in catalogue or a User's custom exercise",
+		Comment:     chioas.SourceComment(),
+	}).Must(Exercise{}),
+	enumSchema("MuscleGroup", "A muscle group", MuscleGroups),
+	enumSchema("Equipment", "Equipment used by an exercise", EquipmentTypes),
+	enumSchema("MovementPattern", "Movement pattern of an exercise", MovementPatterns),
+	enumSchema("UnitType", "What is recorded for each set of an exercise", UnitTypes),
+}
+
+func enumSchema(name string, description string, values []string) chioas.Schema {
+	enum := make([]any, len(values))
+	for i, v := range values {
+		enum[i] = v
+	}
+	return chioas.Schema{
+		Name:        name,
+		Description: description,
+		Type:        "string",
+		Enum:        enum,
+	}
+}
+
+var exerciseListing = listing[Exercise]{
+	id: func(e Exercise) string { return e.Id },
+	fields: sortFields[Exercise]{
+		"_id":  func(e Exercise) string { return e.Id },
+		"name": func(e Exercise) string { return strings.ToLower(e.Name) },
+	},
+	defaultSort: "name",
+}
+
+// exercises is the store used by the exercise handlers (replaced by a file-backed store in main)
+var exercises = NewMemoryExerciseStore()
+
+func getExercises(writer http.ResponseWriter, request *http.Request) {
+	q := request.URL.Query()
+	result, err := exercises.List(request.Context(), ExerciseFilter{
+		UserId:      q.Get("userId"),
+		NamePrefix:  q.Get("name"),
+		MuscleGroup: q.Get("muscleGroup"),
+		Equipment:   q.Get("equipment"),
+	})
+	if err == nil {
+		result, err = exerciseListing.paginate(writer, request, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postExercise(writer http.ResponseWriter, request *http.Request) {
+	var exercise Exercise
+	if err := decodeJson(request, &exercise); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if err := checkExercise(request.Context(), &exercise); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	exercise, err := exercises.Create(request.Context(), exercise)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+exercise.Id)
+	writeJson(writer, request, http.StatusCreated, exercise)
+}
+
+func getExercise(writer http.ResponseWriter, request *http.Request) {
+	exercise, err := exercises.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, exercise)
+}
+
+func putExercise(writer http.ResponseWriter, request *http.Request) {
+	existing, err := exercises.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var exercise Exercise
+	if err = decodeJson(request, &exercise); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	exercise.Id, exercise.UserId = existing.Id, existing.UserId
+	if err = checkExercise(request.Context(), &exercise); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if exercise, err = exercises.Update(request.Context(), exercise); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, exercise)
+}
+
+func patchExercise(writer http.ResponseWriter, request *http.Request) {
+	existing, err := exercises.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		return
+	}
+	exercise := existing
+	if err = applyMergePatch(&exercise, patch); err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "invalid merge patch: %s", err.Error()))
+		return
+	}
+	exercise.Id, exercise.UserId = existing.Id, existing.UserId
+	if err = checkExercise(request.Context(), &exercise); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if exercise, err = exercises.Update(request.Context(), exercise); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, exercise)
+}
+
+func deleteExercise(writer http.ResponseWriter, request *http.Request) {
+	id := chi.URLParam(request, "id")
+	exercise, err := exercises.Get(request.Context(), id)
+	if err == nil && exercise.UserId != "" {
+		err = exerciseUnused(request.Context(), exercise)
+	}
+	if err == nil {
+		err = exercises.Delete(request.Context(), id)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// exerciseUnused checks that none of the owner's workouts, templates, programs or enrolments use a custom
+// exercise (they may only use their owner's custom exercises) - as they would then fail validation
+func exerciseUnused(ctx context.Context, exercise Exercise) error {
+	inUse := func(what string, id string) error {
+		return fmt.Errorf("exercise %q is used by %s %q: %w", exercise.Id, what, id, ErrConflict)
+	}
+	ws, err := workouts.List(ctx, WorkoutFilter{UserId: exercise.UserId})
+	if err != nil {
+		return err
+	}
+	for _, w := range ws {
+		if slices.ContainsFunc(w.Exercises, func(we WorkoutExercise) bool { return we.ExerciseId == exercise.Id }) {
+			return inUse("workout", w.Id)
+		}
+	}
+	ts, err := templates.List(ctx, TemplateFilter{UserId: exercise.UserId})
+	if err != nil {
+		return err
+	}
+	for _, t := range ts {
+		if slices.ContainsFunc(t.Exercises, func(te TemplateExercise) bool { return te.ExerciseId == exercise.Id }) {
+			return inUse("template", t.Id)
+		}
+	}
+	ps, err := programs.List(ctx, ProgramFilter{UserId: exercise.UserId})
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		if slices.ContainsFunc(p.Progression, func(r ProgressionRule) bool { return r.ExerciseId == exercise.Id }) {
+			return inUse("program", p.Id)
+		}
+	}
+	es, err := programs.ListEnrolments(ctx, EnrolmentFilter{UserId: exercise.UserId})
+	if err != nil {
+		return err
+	}
+	for _, e := range es {
+		if slices.ContainsFunc(e.OneRepMaxes, func(orm OneRepMax) bool { return orm.ExerciseId == exercise.Id }) {
+			return inUse("enrolment", e.Id)
+		}
+	}
+	return nil
+}
+
+// checkExercise performs the checks that can't be expressed in the Exercise schema (and normalizes absent lists)
+func checkExercise(ctx context.Context, exercise *Exercise) error {
+	if exercise.SecondaryMuscles == nil {
+		exercise.SecondaryMuscles = []string{}
+	}
+	errs := make([]FieldError, 0)
+	if exercise.UserId == "" {
+		errs = append(errs, FieldError{Path: "userId", Message: "is required for custom exercises"})
+	} else if _, err := users.Get(ctx, exercise.UserId); errors.Is(err, ErrNotFound) {
+		errs = append(errs, FieldError{Path: "userId", Message: "user does not exist"})
+	} else if err != nil {
+		return err
+	}
+	if len(exercise.PrimaryMuscles) == 0 {
+		errs = append(errs, FieldError{Path: "primaryMuscles", Message: "must have at least 1 items"})
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "exercise failed validation")
+		p.Errors = errs
+		return p
+	}
+	return nil
+}
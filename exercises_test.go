@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestDeleteExerciseInUse(t *testing.T) {
+	user, token := testUser(t, "exercise_owner", roleAthlete)
+	created := call(t, http.MethodPost, "/exercises", token, `{"userId":"`+user.Id+`","name":"Zercher Squat `+newObjectId()[16:]+`","primaryMuscles":["quadriceps"],"equipment":"barbell","movementPattern":"squat","unitType":"weight_reps"}`)
+	if created.Code != http.StatusCreated {
+		t.Fatalf("post exercise responded %d: %s", created.Code, created.Body)
+	}
+	var exercise Exercise
+	_ = json.Unmarshal(created.Body.Bytes(), &exercise)
+	uses := map[string]string{
+		"/workouts":  `{"userId":"` + user.Id + `","startTime":"2024-01-02T10:00:00Z","exercises":[{"exerciseId":"` + exercise.Id + `","sets":[{"reps":5,"weight":60}]}]}`,
+		"/templates": `{"userId":"` + user.Id + `","name":"Zerchers","exercises":[{"exerciseId":"` + exercise.Id + `","sets":[{"reps":5}]}]}`,
+	}
+	for path, body := range uses {
+		used := call(t, http.MethodPost, path, token, body)
+		if used.Code != http.StatusCreated {
+			t.Fatalf("post %s responded %d: %s", path, used.Code, used.Body)
+		}
+		if got := call(t, http.MethodDelete, "/exercises/"+exercise.Id, token, ""); got.Code != http.StatusConflict {
+			t.Errorf("delete of an exercise used by %s responded %d, want 409", path, got.Code)
+		}
+		if got := call(t, http.MethodDelete, used.Header().Get("Location"), token, ""); got.Code != http.StatusNoContent {
+			t.Fatalf("delete of %s responded %d: %s", used.Header().Get("Location"), got.Code, got.Body)
+		}
+	}
+	if got := call(t, http.MethodDelete, "/exercises/"+exercise.Id, token, ""); got.Code != http.StatusNoContent {
+		t.Errorf("delete of an unused exercise responded %d: %s", got.Code, got.Body)
+	}
+	_, adminToken := testUser(t, "exercise_admin", roleAdmin)
+	if got := call(t, http.MethodDelete, "/exercises/000000000000000000000001", adminToken, ""); got.Code != http.StatusConflict {
+		t.Errorf("delete of a catalogue exercise responded %d, want 409", got.Code)
+	}
+}
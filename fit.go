@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// fitEpoch is the origin of FIT timestamps (which are seconds since it)
+var fitEpoch = time.Date(1989, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// FIT global message numbers (of the messages that are read)
+const (
+	fitMesgSession = 18
+	fitMesgLap     = 19
+	fitMesgRecord  = 20
+)
+
+// FIT field numbers (of the fields that are read)
+const (
+	fitFieldTimestamp = 253
+	// session and lap
+	fitFieldStartTime        = 2
+	fitFieldTotalElapsedTime = 7
+	fitFieldTotalTimerTime   = 8
+	fitFieldTotalDistance    = 9
+	fitFieldSessionSport     = 5
+	fitFieldSessionAvgHr     = 16
+	fitFieldSessionMaxHr     = 17
+	fitFieldLapAvgHr         = 15
+	fitFieldLapMaxHr         = 16
+	// record
+	fitFieldPositionLat      = 0
+	fitFieldPositionLong     = 1
+	fitFieldAltitude         = 2
+	fitFieldHeartRate        = 3
+	fitFieldDistance         = 5
+	fitFieldEnhancedAltitude = 78
+)
+
+// fitSports are the FIT sport enum values of the sports we know (others are "other")
+var fitSports = map[float64]string{1: "running", 2: "cycling", 5: "swimming", 11: "walking", 15: "rowing", 17: "hiking"}
+
+// fitBaseTypes are the sizes and invalid values of the FIT base types (by base type number)
+var fitBaseTypes = map[byte]struct {
+	size    int
+	signed  bool
+	float   bool
+	invalid uint64
+}{
+	0x00: {1, false, false, 0xFF},               // enum
+	0x01: {1, true, false, 0x7F},                // sint8
+	0x02: {1, false, false, 0xFF},               // uint8
+	0x83: {2, true, false, 0x7FFF},              // sint16
+	0x84: {2, false, false, 0xFFFF},             // uint16
+	0x85: {4, true, false, 0x7FFFFFFF},          // sint32
+	0x86: {4, false, false, 0xFFFFFFFF},         // uint32
+	0x88: {4, false, true, 0xFFFFFFFF},          // float32
+	0x89: {8, false, true, 0xFFFFFFFFFFFFFFFF},  // float64
+	0x0A: {1, false, false, 0x00},               // uint8z
+	0x8B: {2, false, false, 0x0000},             // uint16z
+	0x8C: {4, false, false, 0x00000000},         // uint32z
+	0x8E: {8, true, false, 0x7FFFFFFFFFFFFFFF},  // sint64
+	0x8F: {8, false, false, 0xFFFFFFFFFFFFFFFF}, // uint64
+	0x90: {8, false, false, 0x0000000000000000}, // uint64z
+}
+
+type fitFieldDef struct {
+	num      byte
+	size     int
+	baseType byte
+}
+
+type fitDefinition struct {
+	global    uint16
+	order     binary.ByteOrder
+	fields    []fitFieldDef
+	extraSize int
+}
+
+// fitMessage is a decoded data message - with its single valued fields by field number (invalid
+// values, strings and arrays are left out)
+type fitMessage struct {
+	global uint16
+	fields map[byte]float64
+}
+
+func (m fitMessage) value(num byte) (float64, bool) {
+	v, ok := m.fields[num]
+	return v, ok
+}
+
+func (m fitMessage) time(num byte) (time.Time, bool) {
+	v, ok := m.fields[num]
+	if !ok {
+		return time.Time{}, false
+	}
+	return fitEpoch.Add(time.Duration(v) * time.Second), true
+}
+
+// isFit is whether data looks like a FIT file (by its header)
+func isFit(data []byte) bool {
+	return len(data) >= 12 && string(data[8:12]) == ".FIT"
+}
+
+// decodeFit decodes the data messages of a FIT file that are of the given global message numbers
+//
+// The file CRC is checked - and a file that ends early is an error
+func decodeFit(data []byte, globals ...uint16) ([]fitMessage, error) {
+	if !isFit(data) {
+		return nil, errors.New("not a FIT file")
+	}
+	headerSize := int(data[0])
+	if headerSize < 12 || headerSize > len(data) {
+		return nil, errors.New("invalid FIT header")
+	}
+	end := headerSize + int(binary.LittleEndian.Uint32(data[4:8]))
+	if end+2 > len(data) {
+		return nil, errors.New("FIT file is truncated")
+	}
+	if fitCrc(data[:end]) != binary.LittleEndian.Uint16(data[end:end+2]) {
+		return nil, errors.New("FIT file CRC does not match")
+	}
+	wanted := map[uint16]bool{}
+	for _, g := range globals {
+		wanted[g] = true
+	}
+	definitions := map[byte]*fitDefinition{}
+	var messages []fitMessage
+	var lastTimestamp uint32
+	pos := headerSize
+	need := func(n int) error {
+		if pos+n > end {
+			return errors.New("FIT file is truncated")
+		}
+		return nil
+	}
+	for pos < end {
+		header := data[pos]
+		pos++
+		switch {
+		case header&0x80 != 0:
+			// compressed timestamp data message
+			def := definitions[(header>>5)&0x03]
+			if def == nil {
+				return nil, fmt.Errorf("FIT data message at %d has no definition", pos-1)
+			}
+			offset := uint32(header & 0x1F)
+			lastTimestamp += (offset - lastTimestamp&0x1F) & 0x1F
+			m, err := readFitMessage(data[pos:end], def, wanted[def.global])
+			if err != nil {
+				return nil, err
+			}
+			pos += m.size
+			if wanted[def.global] {
+				m.fields[fitFieldTimestamp] = float64(lastTimestamp)
+				messages = append(messages, m.fitMessage)
+			}
+		case header&0x40 != 0:
+			// definition message
+			if err := need(5); err != nil {
+				return nil, err
+			}
+			def := &fitDefinition{order: binary.LittleEndian}
+			if data[pos+1] == 1 {
+				def.order = binary.BigEndian
+			}
+			def.global = def.order.Uint16(data[pos+2 : pos+4])
+			count := int(data[pos+4])
+			pos += 5
+			if err := need(3 * count); err != nil {
+				return nil, err
+			}
+			for i := 0; i < count; i++ {
+				def.fields = append(def.fields, fitFieldDef{num: data[pos], size: int(data[pos+1]), baseType: data[pos+2]})
+				pos += 3
+			}
+			if header&0x20 != 0 {
+				// developer fields - skipped
+				if err := need(1); err != nil {
+					return nil, err
+				}
+				devCount := int(data[pos])
+				pos++
+				if err := need(3 * devCount); err != nil {
+					return nil, err
+				}
+				for i := 0; i < devCount; i++ {
+					def.extraSize += int(data[pos+1])
+					pos += 3
+				}
+			}
+			definitions[header&0x0F] = def
+		default:
+			def := definitions[header&0x0F]
+			if def == nil {
+				return nil, fmt.Errorf("FIT data message at %d has no definition", pos-1)
+			}
+			m, err := readFitMessage(data[pos:end], def, true)
+			if err != nil {
+				return nil, err
+			}
+			pos += m.size
+			if ts, ok := m.fields[fitFieldTimestamp]; ok {
+				lastTimestamp = uint32(ts)
+			}
+			if wanted[def.global] {
+				messages = append(messages, m.fitMessage)
+			}
+		}
+	}
+	return messages, nil
+}
+
+type sizedFitMessage struct {
+	fitMessage
+	size int
+}
+
+func readFitMessage(data []byte, def *fitDefinition, decode bool) (sizedFitMessage, error) {
+	m := sizedFitMessage{fitMessage: fitMessage{global: def.global, fields: map[byte]float64{}}}
+	for _, f := range def.fields {
+		if m.size+f.size > len(data) {
+			return m, errors.New("FIT file is truncated")
+		}
+		raw := data[m.size : m.size+f.size]
+		m.size += f.size
+		bt, ok := fitBaseTypes[f.baseType]
+		if !decode || !ok || bt.size != f.size {
+			continue
+		}
+		var u uint64
+		switch bt.size {
+		case 1:
+			u = uint64(raw[0])
+		case 2:
+			u = uint64(def.order.Uint16(raw))
+		case 4:
+			u = uint64(def.order.Uint32(raw))
+		case 8:
+			u = def.order.Uint64(raw)
+		}
+		if u == bt.invalid {
+			continue
+		}
+		switch {
+		case bt.float && bt.size == 4:
+			m.fields[f.num] = float64(math.Float32frombits(uint32(u)))
+		case bt.float:
+			m.fields[f.num] = math.Float64frombits(u)
+		case bt.signed:
+			// sign extend
+			shift := 64 - 8*bt.size
+			m.fields[f.num] = float64(int64(u<<shift) >> shift)
+		default:
+			m.fields[f.num] = float64(u)
+		}
+	}
+	m.size += def.extraSize
+	if m.size > len(data) {
+		return m, errors.New("FIT file is truncated")
+	}
+	return m, nil
+}
+
+var fitCrcTable = [16]uint16{
+	0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+	0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+}
+
+// fitCrc is the FIT CRC-16 of data
+func fitCrc(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		tmp := fitCrcTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCrcTable[b&0xF]
+		tmp = fitCrcTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCrcTable[(b>>4)&0xF]
+	}
+	return crc
+}
+
+// parseFit parses a FIT activity file
+//
+// The totals come from the session messages when there are any (otherwise from the laps - and
+// failing that from the records)
+func parseFit(data []byte) (Activity, error) {
+	messages, err := decodeFit(data, fitMesgSession, fitMesgLap, fitMesgRecord)
+	if err != nil {
+		return Activity{}, err
+	}
+	a := Activity{Format: activityFormatFit, Sport: sportOther, Laps: []ActivityLap{}}
+	var sessions, laps []fitMessage
+	var points []activityPoint
+	for _, m := range messages {
+		switch m.global {
+		case fitMesgSession:
+			sessions = append(sessions, m)
+		case fitMesgLap:
+			laps = append(laps, m)
+		case fitMesgRecord:
+			t, ok := m.time(fitFieldTimestamp)
+			if !ok {
+				continue
+			}
+			p := activityPoint{time: t}
+			if v, ok := m.value(fitFieldHeartRate); ok {
+				bpm := int(v)
+				p.heartRate = &bpm
+			}
+			if v, ok := m.value(fitFieldDistance); ok {
+				d := v / 100
+				p.distance = &d
+			}
+			lat, latOk := m.value(fitFieldPositionLat)
+			lon, lonOk := m.value(fitFieldPositionLong)
+			if latOk && lonOk {
+				// positions are in semicircles (2^31 to 180 degrees)
+				p.position, p.lat, p.lon = true, lat*180/(1<<31), lon*180/(1<<31)
+				if !validPosition(p.lat, p.lon) {
+					return Activity{}, fmt.Errorf("FIT record position (%g, %g) is out of range", p.lat, p.lon)
+				}
+			}
+			alt, ok := m.value(fitFieldEnhancedAltitude)
+			if !ok {
+				alt, ok = m.value(fitFieldAltitude)
+			}
+			if ok {
+				// altitudes are in fifths of a metre above 500m below sea level
+				e := alt/5 - 500
+				p.elevation = &e
+			}
+			points = append(points, p)
+		}
+	}
+	totals := sessions
+	if len(totals) == 0 {
+		totals = laps
+	}
+	for i, s := range totals {
+		if i == 0 {
+			if t, ok := s.time(fitFieldStartTime); ok {
+				a.StartTime = t
+			}
+			if s.global == fitMesgSession {
+				if sport, ok := s.value(fitFieldSessionSport); ok && fitSports[sport] != "" {
+					a.Sport = fitSports[sport]
+				}
+			}
+		}
+		if v, ok := s.value(fitFieldTotalTimerTime); ok {
+			a.Duration += v / 1000
+		}
+		if v, ok := s.value(fitFieldTotalElapsedTime); ok {
+			a.ElapsedTime += v / 1000
+		}
+		if v, ok := s.value(fitFieldTotalDistance); ok {
+			d := v / 100
+			if a.Distance != nil {
+				d += *a.Distance
+			}
+			a.Distance = &d
+		}
+	}
+	for _, l := range laps {
+		lap := ActivityLap{}
+		lap.StartTime, _ = l.time(fitFieldStartTime)
+		if v, ok := l.value(fitFieldTotalTimerTime); ok {
+			lap.Duration = v / 1000
+		}
+		if v, ok := l.value(fitFieldTotalDistance); ok {
+			d := v / 100
+			lap.Distance = &d
+		}
+		if v, ok := l.value(fitFieldLapAvgHr); ok {
+			hr := int(v)
+			lap.AverageHeartRate = &hr
+		}
+		if v, ok := l.value(fitFieldLapMaxHr); ok {
+			hr := int(v)
+			lap.MaxHeartRate = &hr
+		}
+		a.Laps = append(a.Laps, lap)
+	}
+	if len(sessions) == 1 {
+		if v, ok := sessions[0].value(fitFieldSessionAvgHr); ok {
+			hr := int(v)
+			a.AverageHeartRate = &hr
+		}
+		if v, ok := sessions[0].value(fitFieldSessionMaxHr); ok {
+			hr := int(v)
+			a.MaxHeartRate = &hr
+		}
+	}
+	if err = a.fromPoints(points); err != nil {
+		return Activity{}, err
+	}
+	return a, nil
+}
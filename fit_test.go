@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseFit(t *testing.T) {
+	a, err := parseFit(readFixture(t, "run.fit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 5, 4, 7, 0, 0, 0, time.UTC); !a.StartTime.Equal(want) {
+		t.Errorf("start time %v, want %v", a.StartTime, want)
+	}
+	if a.Format != activityFormatFit || a.Sport != "running" {
+		t.Errorf("format %q sport %q, want fit running", a.Format, a.Sport)
+	}
+	if a.Duration != 600 || a.ElapsedTime != 600 {
+		t.Errorf("duration %v elapsed %v, want 600 600", a.Duration, a.ElapsedTime)
+	}
+	if a.Distance == nil || *a.Distance != 1800 {
+		t.Errorf("distance %v, want 1800", a.Distance)
+	}
+	if len(a.Laps) != 2 {
+		t.Fatalf("%d laps, want 2", len(a.Laps))
+	}
+	for i, want := range []struct {
+		start    time.Time
+		avg, max int
+	}{
+		{time.Date(2024, 5, 4, 7, 0, 0, 0, time.UTC), 131, 142},
+		{time.Date(2024, 5, 4, 7, 5, 0, 0, time.UTC), 154, 165},
+	} {
+		lap := a.Laps[i]
+		if !lap.StartTime.Equal(want.start) || lap.Duration != 300 || lap.Distance == nil || *lap.Distance != 900 {
+			t.Errorf("lap %d started %v for %vs and %v m", i, lap.StartTime, lap.Duration, lap.Distance)
+		}
+		if lap.AverageHeartRate == nil || *lap.AverageHeartRate != want.avg || lap.MaxHeartRate == nil || *lap.MaxHeartRate != want.max {
+			t.Errorf("lap %d heart rate %v/%v, want %d/%d", i, lap.AverageHeartRate, lap.MaxHeartRate, want.avg, want.max)
+		}
+	}
+	if len(a.HeartRate) != 120 {
+		t.Fatalf("%d heart rate samples, want 120", len(a.HeartRate))
+	}
+	if first, last := a.HeartRate[0], a.HeartRate[len(a.HeartRate)-1]; first != (HeartRateSample{Offset: 0, Bpm: 120}) || last != (HeartRateSample{Offset: 600, Bpm: 165}) {
+		t.Errorf("heart rate samples from %v to %v", first, last)
+	}
+	if a.AverageHeartRate == nil || *a.AverageHeartRate != 142 || a.MaxHeartRate == nil || *a.MaxHeartRate != 165 {
+		t.Errorf("heart rate %v/%v, want 142/165", a.AverageHeartRate, a.MaxHeartRate)
+	}
+	if len(a.Track) != 0 {
+		t.Errorf("%d track segments, want none (the run has no positions)", len(a.Track))
+	}
+}
+
+func TestDecodeFitRejects(t *testing.T) {
+	data := readFixture(t, "run.fit")
+	badCrc := append([]byte(nil), data...)
+	badCrc[len(badCrc)-1] ^= 0xFF
+	badHeader := append([]byte(nil), data...)
+	badHeader[0] = 10
+	for name, tc := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"not FIT":        {[]byte("<gpx></gpx>"), "not a FIT file"},
+		"invalid header": {badHeader, "invalid FIT header"},
+		"truncated":      {data[:len(data)-10], "truncated"},
+		"bad CRC":        {badCrc, "CRC does not match"},
+		"changed data":   {append(append([]byte(nil), data[:40]...), append([]byte{data[40] ^ 1}, data[41:]...)...), "CRC does not match"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeFit(tc.data, fitMesgRecord); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+// TestDecodeFitTruncatedRecords cuts the records of the fixture short at every byte - with the header
+// size and CRC fixed up, so the cut gets past the file checks to the bounds checks of the records
+func TestDecodeFitTruncatedRecords(t *testing.T) {
+	data := readFixture(t, "run.fit")
+	headerSize := int(data[0])
+	end := headerSize + int(binary.LittleEndian.Uint32(data[4:8]))
+	truncated := 0
+	for cut := headerSize + 1; cut < end; cut++ {
+		file := append([]byte(nil), data[:cut]...)
+		binary.LittleEndian.PutUint32(file[4:8], uint32(cut-headerSize))
+		file = binary.LittleEndian.AppendUint16(file, fitCrc(file))
+		_, err := decodeFit(file, fitMesgSession, fitMesgLap, fitMesgRecord)
+		if err != nil && strings.Contains(err.Error(), "truncated") {
+			truncated++
+		} else if err != nil {
+			t.Errorf("cut at %d: %v", cut, err)
+		}
+	}
+	if truncated == 0 {
+		t.Error("no cut was reported as truncated")
+	}
+}
@@ -3,8 +3,11 @@ module workyapi
 go 1.22.3
 
 require (
+	github.com/BurntSushi/toml v1.4.0
 	github.com/go-andiamo/chioas v1.16.3
 	github.com/go-chi/chi/v5 v5.1.0
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -12,5 +15,4 @@ require (
 	github.com/go-andiamo/urit v1.2.1 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	golang.org/x/exp v0.0.0-20230626212559-97b1e661b5df // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
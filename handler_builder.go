@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"net/http"
+)
+
+// handlerBuilder is the chioas.MethodHandlerBuilder for the api
+//
+// It wraps each method handler so that the caller is granted the method's access rule (if any),
+// that request bodies are validated against the schema documented by the method's Request - and,
+// unless the method has OptionalSecurity, that there is an authenticated caller.
+// The request's trace span is named for the method's operationId
+type handlerBuilder struct {
+	validator *schemaValidator
+}
+
+func newHandlerBuilder(schemas chioas.Schemas) *handlerBuilder {
+	return &handlerBuilder{validator: newSchemaValidator(schemas)}
+}
+
+func (b *handlerBuilder) BuildHandler(path string, method string, mdef chioas.Method, thisApi any) (http.HandlerFunc, error) {
+	var handler http.HandlerFunc
+	switch hf := mdef.Handler.(type) {
+	case http.HandlerFunc:
+		handler = hf
+	case func(http.ResponseWriter, *http.Request):
+		handler = hf
+	default:
+		return nil, fmt.Errorf("invalid handler type (path: %s, method: %s)", path, method)
+	}
+	if mdef.Request != nil && mdef.Request.SchemaRef != "" {
+		handler = b.validator.middleware(mdef.Request, handler)
+	}
+	// access is checked before the body is validated - so callers that are denied learn nothing of the schema
+	if a, ok, err := accessOf(mdef); err != nil {
+		return nil, fmt.Errorf("%w (path: %s, method: %s)", err, path, method)
+	} else if ok {
+		handler = a.authorize(handler)
+	}
+	if !mdef.OptionalSecurity {
+		handler = requireCaller(handler)
+	}
+	operationId := mdef.OperationId
+	if operationId == "" {
+		operationId = method + " " + path
+	}
+	handler = traceOperation(operationId, handler)
+	return handler, nil
+}
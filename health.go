@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-andiamo/chioas"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// Health is the response of the health and readiness probes
+type Health struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Version is the build information of the running server
+type Version struct {
+	Module      string    `json:"module"`
+	Version     string    `json:"version"`
+	GoVersion   string    `json:"goVersion"`
+	VcsRevision string    `json:"vcsRevision,omitempty"`
+	VcsTime     string    `json:"vcsTime,omitempty"`
+	VcsModified bool      `json:"vcsModified,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	Uptime      float64   `json:"uptime"`
+}
+
+// HealthzPath is the liveness probe (for load balancers and orchestrators) - hidden from the spec
+var HealthzPath = chioas.Path{
+	HideDocs: true,
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:          getHealthz,
+			OperationId:      "healthz",
+			OptionalSecurity: true,
+		},
+	},
+}
+
+// ReadyzPath is the readiness probe - hidden from the spec
+var ReadyzPath = chioas.Path{
+	HideDocs: true,
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:          getReadyz,
+			OperationId:      "readyz",
+			OptionalSecurity: true,
+		},
+	},
+}
+
+// VersionPath serves the build info - hidden from the spec
+var VersionPath = chioas.Path{
+	HideDocs: true,
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:          getVersion,
+			OperationId:      "version",
+			OptionalSecurity: true,
+		},
+	},
+}
+
+var startedAt = time.Now()
+
+// readyTimeout bounds how long the readiness checks may take
+const readyTimeout = 2 * time.Second
+
+// getHealthz is the liveness probe - the process is serving requests
+func getHealthz(writer http.ResponseWriter, request *http.Request) {
+	writeJson(writer, request, http.StatusOK, Health{Status: "ok"})
+}
+
+// getReadyz is the readiness probe - the stores are usable and the data dir has no pending migrations
+func getReadyz(writer http.ResponseWriter, request *http.Request) {
+	ctx, cancel := context.WithTimeout(request.Context(), readyTimeout)
+	defer cancel()
+	result := Health{Status: "ok", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			result.Status = "unavailable"
+			result.Checks[name] = err.Error()
+		} else {
+			result.Checks[name] = "ok"
+		}
+	}
+	check("store", errors.Join(users.Ping(ctx), workouts.Ping(ctx), exercises.Ping(ctx), auth.Ping(ctx), records.Ping(ctx), templates.Ping(ctx), programs.Ping(ctx), schedule.Ping(ctx), activities.Ping(ctx), measurements.Ping(ctx)))
+	if storeDir != "" {
+		pending, err := pendingMigrations(storeDir)
+		if err == nil && len(pending) > 0 {
+			err = errors.New("pending: " + strings.Join(pending, ", "))
+		}
+		check("migrations", err)
+	}
+	status := http.StatusOK
+	if result.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writer.Header().Set("Cache-Control", "no-store")
+	writeJson(writer, request, status, result)
+}
+
+func getVersion(writer http.ResponseWriter, request *http.Request) {
+	result := Version{
+		StartedAt: startedAt.UTC(),
+		Uptime:    time.Since(startedAt).Seconds(),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		result.Module, result.Version, result.GoVersion = info.Main.Path, info.Main.Version, info.GoVersion
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				result.VcsRevision = s.Value
+			case "vcs.time":
+				result.VcsTime = s.Value
+			case "vcs.modified":
+				result.VcsModified = s.Value == "true"
+			}
+		}
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const contentTypeCalendar = "text/calendar; charset=utf-8"
+
+const (
+	icsDate      = "20060102"
+	icsLocalTime = "20060102T150405"
+	icsUtcTime   = "20060102T150405Z"
+	// icsLineOctets is the maximum length of a content line (longer lines are folded)
+	icsLineOctets = 75
+)
+
+// icsWriter writes RFC 5545 content lines - CRLF terminated and folded at 75 octets
+type icsWriter struct {
+	buf bytes.Buffer
+}
+
+// line writes a content line - name may include params (e.g. "DTSTART;VALUE=DATE")
+func (w *icsWriter) line(name string, value string) {
+	l := name + ":" + value
+	for width := icsLineOctets; len(l) > width; width = icsLineOctets - 1 {
+		// fold without splitting a UTF-8 sequence
+		cut := width
+		for cut > 0 && !utf8.RuneStart(l[cut]) {
+			cut--
+		}
+		w.buf.WriteString(l[:cut] + "\r\n ")
+		l = l[cut:]
+	}
+	w.buf.WriteString(l + "\r\n")
+}
+
+// icsText escapes a TEXT value
+func icsText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// icsOffset formats a UTC offset (in seconds) as a UTC-OFFSET value
+func icsOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	v := fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset/60%60)
+	if offset%60 != 0 {
+		v += fmt.Sprintf("%02d", offset%60)
+	}
+	return v
+}
+
+// scheduleCalendar renders scheduled workouts as an iCalendar (RFC 5545) feed
+//
+// Sessions with a startTime in a time zone other than UTC are written with a TZID (and a VTIMEZONE
+// covering the years of the feed) - so recurring sessions keep their local time across DST changes
+func scheduleCalendar(ctx context.Context, items []ScheduledWorkout, now time.Time) ([]byte, error) {
+	lookup := exerciseLookup(ctx)
+	describe := func(templateId string) (name string, exerciseLines []string, err error) {
+		t, err := templates.Get(ctx, templateId)
+		if err != nil {
+			// a deleted template is just left out of the event
+			return "", nil, nil
+		}
+		for _, te := range t.Exercises {
+			e, err := lookup(te.ExerciseId)
+			if err != nil {
+				return "", nil, err
+			} else if e != nil {
+				exerciseLines = append(exerciseLines, fmt.Sprintf("%s: %d sets", e.Name, len(te.Sets)))
+			}
+		}
+		return t.Name, exerciseLines, nil
+	}
+	// the years each time zone must cover
+	zoneYears := map[string][2]int{}
+	for _, s := range items {
+		if s.StartTime == "" || s.TimeZone == "" || s.TimeZone == "UTC" {
+			continue
+		}
+		first, _ := time.Parse(time.DateOnly, s.Date)
+		last := max(now.Year()+1, first.Year())
+		if s.Recurrence != nil && s.Recurrence.Until != "" {
+			until, _ := time.Parse(time.DateOnly, s.Recurrence.Until)
+			last = max(last, until.Year())
+		}
+		if years, ok := zoneYears[s.TimeZone]; ok {
+			zoneYears[s.TimeZone] = [2]int{min(years[0], first.Year()), max(years[1], last)}
+		} else {
+			zoneYears[s.TimeZone] = [2]int{first.Year(), last}
+		}
+	}
+	w := &icsWriter{}
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", "-//workyapi//Scheduled Workouts//EN")
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", "Workouts")
+	for _, tz := range sortedKeys(zoneYears) {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, err
+		}
+		writeVTimezone(w, loc, zoneYears[tz][0], zoneYears[tz][1])
+	}
+	stamp := now.UTC().Format(icsUtcTime)
+	for _, s := range items {
+		summary, description := s.Title, s.Notes
+		if s.TemplateId != "" {
+			name, exerciseLines, err := describe(s.TemplateId)
+			if err != nil {
+				return nil, err
+			}
+			if summary == "" {
+				summary = name
+			}
+			if len(exerciseLines) > 0 {
+				description = strings.TrimSpace(description + "\n\n" + strings.Join(exerciseLines, "\n"))
+			}
+		}
+		if summary == "" {
+			summary = "Workout"
+		}
+		writeVEvent(w, s, summary, description, stamp)
+	}
+	w.line("END", "VCALENDAR")
+	return w.buf.Bytes(), nil
+}
+
+func writeVEvent(w *icsWriter, s ScheduledWorkout, summary string, description string, stamp string) {
+	date, _ := time.Parse(time.DateOnly, s.Date)
+	// dateTime formats the value of an occurrence on the date (DTSTART and EXDATE must agree)
+	var dtParams string
+	var dateTime func(d time.Time) string
+	loc := time.UTC
+	if s.TimeZone != "" {
+		loc, _ = time.LoadLocation(s.TimeZone)
+	}
+	timed := s.StartTime != ""
+	var hour, minute int
+	if timed {
+		_, _ = fmt.Sscanf(s.StartTime, "%d:%d", &hour, &minute)
+	}
+	switch {
+	case !timed:
+		dtParams = ";VALUE=DATE"
+		dateTime = func(d time.Time) string { return d.Format(icsDate) }
+	case loc == time.UTC:
+		dateTime = func(d time.Time) string {
+			return time.Date(d.Year(), d.Month(), d.Day(), hour, minute, 0, 0, time.UTC).Format(icsUtcTime)
+		}
+	default:
+		dtParams = ";TZID=" + loc.String()
+		dateTime = func(d time.Time) string {
+			return time.Date(d.Year(), d.Month(), d.Day(), hour, minute, 0, 0, loc).Format(icsLocalTime)
+		}
+	}
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", s.Id+"@workyapi")
+	w.line("DTSTAMP", stamp)
+	w.line("DTSTART"+dtParams, dateTime(date))
+	if timed {
+		w.line("DURATION", fmt.Sprintf("PT%dM", s.Duration))
+	} else {
+		w.line("DTEND"+dtParams, date.AddDate(0, 0, 1).Format(icsDate))
+	}
+	if r := s.Recurrence; r != nil {
+		rule := "FREQ=" + strings.ToUpper(r.Frequency)
+		if r.Interval > 1 {
+			rule += fmt.Sprintf(";INTERVAL=%d", r.Interval)
+		}
+		if len(r.Weekdays) > 0 {
+			rule += ";BYDAY=" + strings.Join(r.Weekdays, ",")
+		}
+		if r.Count != nil {
+			rule += fmt.Sprintf(";COUNT=%d", *r.Count)
+		} else if r.Until != "" {
+			until, _ := time.Parse(time.DateOnly, r.Until)
+			if timed {
+				// UNTIL must be UTC when DTSTART has a time - the end of the until date is inclusive
+				rule += ";UNTIL=" + time.Date(until.Year(), until.Month(), until.Day(), 23, 59, 59, 0, loc).UTC().Format(icsUtcTime)
+			} else {
+				rule += ";UNTIL=" + until.Format(icsDate)
+			}
+		}
+		w.line("RRULE", rule)
+		for _, d := range s.SkippedDates {
+			skipped, _ := time.Parse(time.DateOnly, d)
+			w.line("EXDATE"+dtParams, dateTime(skipped))
+		}
+	}
+	w.line("SUMMARY", icsText(summary))
+	if description != "" {
+		w.line("DESCRIPTION", icsText(description))
+	}
+	if s.Status == scheduleStatusSkipped {
+		w.line("STATUS", "CANCELLED")
+	} else {
+		w.line("STATUS", "CONFIRMED")
+	}
+	w.line("CATEGORIES", strings.ToUpper(s.Status))
+	w.line("END", "VEVENT")
+}
+
+// writeVTimezone writes the VTIMEZONE of a location - with an observance for each of its zone
+// periods from the start of fromYear to the end of toYear
+func writeVTimezone(w *icsWriter, loc *time.Location, fromYear int, toYear int) {
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", loc.String())
+	t := time.Date(fromYear, 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(toYear+1, 1, 1, 0, 0, 0, 0, loc)
+	for {
+		name, offset := t.Zone()
+		start, next := t.ZoneBounds()
+		from := offset
+		if start.IsZero() || start.Before(time.Date(fromYear, 1, 1, 0, 0, 0, 0, loc)) {
+			start = t
+		} else {
+			_, from = start.Add(-time.Second).Zone()
+		}
+		kind := "STANDARD"
+		if t.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		w.line("BEGIN", kind)
+		// DTSTART is the local time of the transition in the offset being changed from
+		w.line("DTSTART", start.In(time.FixedZone("", from)).Format(icsLocalTime))
+		w.line("TZOFFSETFROM", icsOffset(from))
+		w.line("TZOFFSETTO", icsOffset(offset))
+		w.line("TZNAME", icsText(name))
+		w.line("END", kind)
+		if next.IsZero() || !next.Before(end) {
+			break
+		}
+		t = next
+	}
+	w.line("END", "VTIMEZONE")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestScheduleCalendar(t *testing.T) {
+	now := time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC)
+	for name, s := range map[string]ScheduledWorkout{
+		"all_day": {
+			Id:     "000000000000000000000a01",
+			Date:   "2024-03-09",
+			Title:  "Long run; easy, slow",
+			Notes:  `Keep it conversational \ no watch` + "\n" + strings.TrimSpace(strings.Repeat("Ünïcödé ", 12)),
+			Status: scheduleStatusPlanned,
+		},
+		"utc": {
+			Id:        "000000000000000000000a02",
+			Date:      "2024-02-01",
+			StartTime: "07:00",
+			Duration:  45,
+			Status:    scheduleStatusSkipped,
+			Recurrence: &Recurrence{
+				Frequency: "daily",
+				Interval:  2,
+				Until:     "2024-02-29",
+			},
+			SkippedDates: []string{},
+		},
+		"tzid_recurring": {
+			Id:        "000000000000000000000a03",
+			Date:      "2024-03-04",
+			StartTime: "18:30",
+			Duration:  90,
+			TimeZone:  "Europe/London",
+			Title:     "Lifting",
+			Status:    scheduleStatusPlanned,
+			Recurrence: &Recurrence{
+				Frequency: "weekly",
+				Weekdays:  []string{"MO", "WE"},
+				Until:     "2024-04-30",
+			},
+			// the first occurrence after the change to BST
+			SkippedDates: []string{"2024-04-01"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := scheduleCalendar(context.Background(), []ScheduledWorkout{s}, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := bytes.ReplaceAll(readFixture(t, "calendar_"+name+".ics"), []byte("\n"), []byte("\r\n"))
+			if !bytes.Equal(got, want) {
+				t.Errorf("calendar:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestIcsLineFolding(t *testing.T) {
+	for _, value := range []string{
+		strings.Repeat("a", 200),
+		strings.Repeat("é", 100),
+		strings.Repeat("€", 100),
+		strings.Repeat("a", 72) + "😀" + strings.Repeat("b", 80),
+	} {
+		w := &icsWriter{}
+		w.line("DESCRIPTION", value)
+		content := strings.TrimSuffix(w.buf.String(), "\r\n")
+		for _, l := range strings.Split(content, "\r\n") {
+			if len(l) > icsLineOctets || !utf8.ValidString(l) {
+				t.Errorf("line of %d octets (valid utf-8 %v)", len(l), utf8.ValidString(l))
+			}
+		}
+		// unfolding is removing each CRLF followed by a space
+		if unfolded := strings.ReplaceAll(content, "\r\n ", ""); unfolded != "DESCRIPTION:"+value {
+			t.Errorf("unfolded to %q", unfolded)
+		}
+	}
+}
+
+func TestIcsText(t *testing.T) {
+	if got, want := icsText("a\\b;c,d\r\ne\nf:g"), `a\\b\;c\,d\ne\nf:g`; got != want {
+		t.Errorf("escaped %q, want %q", got, want)
+	}
+}
+
+func TestCalendarToken(t *testing.T) {
+	user, token := testUser(t, "calendar")
+	other, otherToken := testUser(t, "calendar_other")
+	feed := "/users/" + user.Id + "/calendar.ics"
+	createFeed := func(user User, token string) CalendarFeed {
+		t.Helper()
+		got := call(t, http.MethodPost, "/users/"+user.Id+"/calendar-token", token, "")
+		var f CalendarFeed
+		if err := json.Unmarshal(got.Body.Bytes(), &f); got.Code != http.StatusCreated || err != nil {
+			t.Fatalf("create token responded %d: %s", got.Code, got.Body)
+		}
+		return f
+	}
+	if got := call(t, http.MethodGet, feed+"?token=anything", "", ""); got.Code != http.StatusForbidden {
+		t.Errorf("feed without a token created responded %d, want 403", got.Code)
+	}
+	href := createFeed(user, token).Href
+	if got := call(t, http.MethodGet, href, "", ""); got.Code != http.StatusOK || got.Header().Get("Content-Type") != contentTypeCalendar {
+		t.Errorf("feed responded %d %q", got.Code, got.Header().Get("Content-Type"))
+	}
+	// the token is of the user - not of any user
+	otherFeed := createFeed(other, otherToken)
+	for name, path := range map[string]string{
+		"missing token":       feed,
+		"wrong token":         feed + "?token=wrong",
+		"other user token":    feed + "?token=" + otherFeed.Token,
+		"unknown user":        "/users/0000000000000000000000ff/calendar.ics?token=wrong",
+		"token of other feed": strings.Replace(href, user.Id, other.Id, 1),
+	} {
+		if got := call(t, http.MethodGet, path, "", ""); got.Code != http.StatusForbidden {
+			t.Errorf("%s responded %d, want 403", name, got.Code)
+		}
+	}
+	// a new token revokes the previous one
+	createFeed(user, token)
+	if got := call(t, http.MethodGet, href, "", ""); got.Code != http.StatusForbidden {
+		t.Errorf("revoked token responded %d, want 403", got.Code)
+	}
+}
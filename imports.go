@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type ImportReport struct {
+	Format     string          `json:"format" oas:"$ref: ImportFormat"`
+	DryRun     bool            `json:"dryRun" oas:"description: whether the workouts were only checked (and not created)"`
+	Workouts   int             `json:"workouts" oas:"description: number of workouts imported"`
+	Sets       int             `json:"sets" oas:"description: number of sets imported"`
+	Duplicates int             `json:"duplicates" oas:"description: number of workouts skipped as the User already has a workout starting at the same time"`
+	WorkoutIds []string        `json:"workoutIds" oas:"description: db oids of the imported Workouts (empty for a dry run), type: array, itemType: string"`
+	Matches    []ExerciseMatch `json:"matches" oas:"description: how the exercise names were matched to exercises"`
+	Unmatched  []UnmatchedRow  `json:"unmatched" oas:"description: the rows that were not imported"`
+}
+
+type ExerciseMatch struct {
+	Name         string  `json:"name" oas:"description: the exercise name in the CSV"`
+	ExerciseId   string  `json:"exerciseId" oas:"description: db oid of the matched Exercise"`
+	ExerciseName string  `json:"exerciseName" oas:"description: name of the matched Exercise"`
+	Score        float64 `json:"score" oas:"description: how closely the names matched (0 to 1)"`
+	Rows         int     `json:"rows" oas:"description: number of rows with the name"`
+}
+
+type UnmatchedRow struct {
+	Row                   int    `json:"row" oas:"description: line number of the row in the CSV (the header is line 1)"`
+	Name                  string `json:"name,omitempty" oas:"description: the exercise name of the row"`
+	Reason                string `json:"reason" oas:"description: why the row was not imported"`
+	SuggestedExerciseId   string `json:"suggestedExerciseId,omitempty" oas:"description: db oid of the closest Exercise (when not close enough to be matched)"`
+	SuggestedExerciseName string `json:"suggestedExerciseName,omitempty" oas:"description: name of the closest Exercise"`
+}
+
+// maxImportSize is the largest CSV that can be imported (exports of years of workouts are a few MB)
+const maxImportSize = 16 << 20
+
+// ImportsPath imports workouts from CSV (nested under the user path)
+var ImportsPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodPost: {
+			Handler:     postImport,
+			OperationId: "importWorkouts",
+			Description: "Imports workouts from a CSV export of Strong or Hevy (or of this api) - exercise names are matched to the catalogue and the User's custom exercises. Rows that can't be matched are reported rather than failing the import",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: chioas.QueryParams{
+				{
+					Name:        "format",
+					Description: "The CSV layout (detected from the header by default)",
+					SchemaRef:   "ImportFormat",
+				},
+				{
+					Name:        "weightUnit",
+					Description: "Unit of the weights in a Strong export without a Weight Unit column",
+					Schema: &chioas.Schema{
+						Type:    "string",
+						Default: "kg",
+						Enum:    []any{"kg", "lb"},
+					},
+				},
+				{
+					Name:        "distanceUnit",
+					Description: "Unit of the distances in a Strong export without a Distance Unit column",
+					Schema: &chioas.Schema{
+						Type:    "string",
+						Default: "km",
+						Enum:    []any{"km", "mi"},
+					},
+				},
+				{
+					Name:        "tz",
+					Description: "IANA time zone of the (local) workout times in Strong and Hevy exports (defaults to UTC)",
+					Example:     "Europe/London",
+				},
+				{
+					Name:        "dryRun",
+					Description: "Only report what would be imported",
+					Schema: &chioas.Schema{
+						Type:    "boolean",
+						Default: false,
+					},
+				},
+			},
+			Request: &chioas.Request{
+				Description: "The CSV export",
+				Required:    true,
+				ContentType: "text/csv",
+				Schema:      &chioas.Schema{Type: "string"},
+			},
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "What was imported",
+					SchemaRef:   "ImportReport",
+				},
+			},
+		},
+	},
+}
+
+// ExportsPath exports workouts (nested under the user path)
+var ExportsPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getExport,
+			OperationId: "exportWorkouts",
+			Description: "Exports the workouts as CSV - with a row per set - that can be imported again",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: chioas.QueryParams{
+				{
+					Name:        "format",
+					Description: "The export format",
+					Schema: &chioas.Schema{
+						Type:    "string",
+						Default: "csv",
+						Enum:    []any{"csv"},
+					},
+				},
+				{
+					Name:        "from",
+					Description: "Only workouts starting at or after this date-time (or date)",
+					Example:     "2024-07-01T00:00:00Z",
+				},
+				{
+					Name:        "to",
+					Description: "Only workouts starting before this date-time (or date)",
+					Example:     "2024-08-01T00:00:00Z",
+				},
+			},
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "The workouts as CSV",
+					ContentType: contentTypeCsv,
+					Schema:      &chioas.Schema{Type: "string"},
+				},
+			},
+		},
+	},
+}
+
+var ImportSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "ImportReport",
+		Description: "The outcome of a CSV import",
+		Comment:     chioas.SourceComment(),
+	}).Must(ImportReport{}),
+	(&chioas.Schema{
+		Name:        "ExerciseMatch",
+		Description: "An exercise name of an import matched to an Exercise",
+		Comment:     chioas.SourceComment(),
+	}).Must(ExerciseMatch{}),
+	(&chioas.Schema{
+		Name:        "UnmatchedRow",
+		Description: "A row of an import that was not imported",
+		Comment:     chioas.SourceComment(),
+	}).Must(UnmatchedRow{}),
+	enumSchema("ImportFormat", "Layout of an imported CSV (workyapi is the export of this api)", ImportFormats),
+}
+
+func postImport(writer http.ResponseWriter, request *http.Request) {
+	userId := chi.URLParam(request, "id")
+	if _, err := users.Get(request.Context(), userId); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	opts, dryRun, err := parseImportOptions(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxImportSize))
+	if err != nil {
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			writeError(writer, request, newProblem(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", mbe.Limit))
+		} else {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		}
+		return
+	}
+	report, err := importWorkouts(request.Context(), userId, data, opts, dryRun)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, report)
+}
+
+func parseImportOptions(request *http.Request) (opts importOptions, dryRun bool, err error) {
+	params := request.URL.Query()
+	opts.loc = time.UTC
+	if opts.format = params.Get("format"); opts.format != "" && !slices.Contains(ImportFormats, opts.format) {
+		return opts, false, newProblem(http.StatusBadRequest, "query param \"format\" must be one of: %s", strings.Join(ImportFormats, ", "))
+	}
+	switch params.Get("weightUnit") {
+	case "", "kg":
+	case "lb":
+		opts.weightLb = true
+	default:
+		return opts, false, newProblem(http.StatusBadRequest, "query param \"weightUnit\" must be one of: kg, lb")
+	}
+	switch params.Get("distanceUnit") {
+	case "", "km":
+	case "mi":
+		opts.distMile = true
+	default:
+		return opts, false, newProblem(http.StatusBadRequest, "query param \"distanceUnit\" must be one of: km, mi")
+	}
+	if tz := params.Get("tz"); tz != "" {
+		if opts.loc, err = time.LoadLocation(tz); err != nil {
+			return opts, false, newProblem(http.StatusBadRequest, "query param \"tz\" is not a known time zone")
+		}
+	}
+	return opts, params.Get("dryRun") == "true", nil
+}
+
+// importWorkouts creates the workouts of a CSV import for a user
+//
+// Workouts the user already has (by start time) are skipped - so an export can be imported again
+// without doubling up
+func importWorkouts(ctx context.Context, userId string, data []byte, opts importOptions, dryRun bool) (ImportReport, error) {
+	format, rows, rowErrs, err := readWorkoutCsv(data, opts)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	report := ImportReport{
+		Format:     format,
+		DryRun:     dryRun,
+		WorkoutIds: []string{},
+		Matches:    []ExerciseMatch{},
+		Unmatched:  []UnmatchedRow{},
+	}
+	for _, re := range rowErrs {
+		report.Unmatched = append(report.Unmatched, UnmatchedRow{Row: re.line, Name: re.name, Reason: re.reason})
+	}
+	matcher, err := newExerciseMatcher(ctx, userId)
+	if err != nil {
+		return report, err
+	}
+	matchIndex := map[string]int{}
+	// resolve finds the exercise of a row - by id (for our own exports) or by name
+	resolve := func(row importRow) (string, error) {
+		if row.exerciseId != "" {
+			if e, err := exercises.Get(ctx, row.exerciseId); err == nil && (e.UserId == "" || e.UserId == userId) {
+				return e.Id, nil
+			} else if err != nil && !errors.Is(err, ErrNotFound) {
+				return "", err
+			}
+		}
+		m := matcher.match(row.exerciseName)
+		if m.exercise == nil {
+			unmatched := UnmatchedRow{Row: row.line, Name: row.exerciseName, Reason: "no exercise matches the name"}
+			if m.suggestion != nil {
+				unmatched.SuggestedExerciseId, unmatched.SuggestedExerciseName = m.suggestion.Id, m.suggestion.Name
+			}
+			report.Unmatched = append(report.Unmatched, unmatched)
+			return "", nil
+		}
+		if i, ok := matchIndex[row.exerciseName]; ok {
+			report.Matches[i].Rows++
+		} else {
+			matchIndex[row.exerciseName] = len(report.Matches)
+			report.Matches = append(report.Matches, ExerciseMatch{
+				Name:         row.exerciseName,
+				ExerciseId:   m.exercise.Id,
+				ExerciseName: m.exercise.Name,
+				Score:        math.Round(m.score*100) / 100,
+				Rows:         1,
+			})
+		}
+		return m.exercise.Id, nil
+	}
+	// group the rows into workouts (by workout key) and exercises (by consecutive exercise key)
+	var imported []*Workout
+	exerciseKeys := map[*Workout][]string{}
+	byKey := map[string]*Workout{}
+	for _, row := range rows {
+		exerciseId := ""
+		if row.exerciseKey != "" {
+			if exerciseId, err = resolve(row); err != nil {
+				return report, err
+			} else if exerciseId == "" {
+				continue
+			}
+		}
+		w, ok := byKey[row.workoutKey]
+		if !ok {
+			w = &Workout{
+				UserId:    userId,
+				StartTime: row.start,
+				EndTime:   row.end,
+				Notes:     clipRunes(row.workoutNotes, 2000),
+				Exercises: []WorkoutExercise{},
+			}
+			byKey[row.workoutKey] = w
+			imported = append(imported, w)
+		}
+		if row.exerciseKey == "" {
+			continue
+		}
+		keys := exerciseKeys[w]
+		if len(keys) == 0 || keys[len(keys)-1] != row.exerciseKey {
+			exerciseKeys[w] = append(keys, row.exerciseKey)
+			w.Exercises = append(w.Exercises, WorkoutExercise{ExerciseId: exerciseId, Sets: []WorkoutSet{}})
+		}
+		we := &w.Exercises[len(w.Exercises)-1]
+		if row.exerciseNotes != "" && !strings.Contains(we.Notes, row.exerciseNotes) {
+			we.Notes = clipRunes(joinNotes(we.Notes, row.exerciseNotes), 1000)
+		}
+		if row.set != nil {
+			we.Sets = append(we.Sets, *row.set)
+		}
+	}
+	existing, err := workouts.List(ctx, WorkoutFilter{UserId: userId})
+	if err != nil {
+		return report, err
+	}
+	starts := map[int64]bool{}
+	for _, w := range existing {
+		starts[w.StartTime.UnixNano()] = true
+	}
+	// every workout is checked before any is created - so a failed import saves nothing
+	toCreate := make([]*Workout, 0, len(imported))
+	for _, w := range imported {
+		if starts[w.StartTime.UnixNano()] {
+			report.Duplicates++
+			continue
+		}
+		starts[w.StartTime.UnixNano()] = true
+		if err = checkWorkout(ctx, w); err != nil {
+			return report, err
+		}
+		toCreate = append(toCreate, w)
+		report.Workouts++
+		for _, we := range w.Exercises {
+			report.Sets += len(we.Sets)
+		}
+	}
+	if !dryRun {
+		for _, w := range toCreate {
+			created, cErr := workouts.Create(ctx, *w)
+			if cErr != nil {
+				err = cErr
+				break
+			}
+			report.WorkoutIds = append(report.WorkoutIds, created.Id)
+		}
+		if len(report.WorkoutIds) > 0 {
+			updateRecords(ctx, userId)
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	slices.SortStableFunc(report.Unmatched, func(a, b UnmatchedRow) int {
+		return a.Row - b.Row
+	})
+	return report, nil
+}
+
+// clipRunes shortens s to at most n runes
+func clipRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+func getExport(writer http.ResponseWriter, request *http.Request) {
+	userId := chi.URLParam(request, "id")
+	if _, err := users.Get(request.Context(), userId); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if format := request.URL.Query().Get("format"); format != "" && format != "csv" {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"format\" must be one of: csv"))
+		return
+	}
+	from, err := queryTime(request, "from")
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	to, err := queryTime(request, "to")
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	items, err := workouts.List(request.Context(), WorkoutFilter{UserId: userId, From: from, To: to})
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	slices.SortStableFunc(items, func(a, b Workout) int {
+		return a.StartTime.Compare(b.StartTime)
+	})
+	lookup := exerciseLookup(request.Context())
+	var buf bytes.Buffer
+	err = writeWorkoutCsv(&buf, items, func(id string) (string, error) {
+		e, err := lookup(id)
+		if e == nil || err != nil {
+			return "", err
+		}
+		return e.Name, nil
+	})
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", contentTypeCsv)
+	writer.Header().Set("Content-Disposition", `attachment; filename="workouts.csv"`)
+	writer.WriteHeader(http.StatusOK)
+	if _, err = writer.Write(buf.Bytes()); err != nil {
+		loggerFrom(request.Context()).Warn("writing response", "error", err)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// sortFields are the sortable fields of a resource, by query param name
+//
+// Each returns a string key whose lexical order is the field order (see sortKeyTime and sortKeyNumber)
+type sortFields[T any] map[string]func(T) string
+
+// listing describes how a collection resource is paginated and sorted
+type listing[T any] struct {
+	id          func(T) string
+	fields      sortFields[T]
+	defaultSort string
+}
+
+// pageCursor is the decoded form of the opaque cursor query param
+type pageCursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	Id   string `json:"i"`
+	Prev bool   `json:"p,omitempty"`
+}
+
+// queryParams are the chioas.QueryParams documenting pagination and sorting (plus any resource filters)
+func (l listing[T]) queryParams(filters ...chioas.QueryParam) chioas.QueryParams {
+	sorts := make([]string, 0, len(l.fields)*2)
+	for name := range l.fields {
+		sorts = append(sorts, name, "-"+name)
+	}
+	sort.Strings(sorts)
+	enum := make([]any, len(sorts))
+	for i, s := range sorts {
+		enum[i] = s
+	}
+	return append(filters,
+		chioas.QueryParam{
+			Name:        "limit",
+			Description: fmt.Sprintf("Maximum number of items to return (1 to %d)", maxPageLimit),
+			Schema: &chioas.Schema{
+				Type:    "integer",
+				Default: defaultPageLimit,
+			},
+		},
+		chioas.QueryParam{
+			Name:        "cursor",
+			Description: "Opaque cursor from a previous response's Link header (rel=next or rel=prev)",
+		},
+		chioas.QueryParam{
+			Name:        "sort",
+			Description: "Field to sort by (prefix with - for descending)",
+			Schema: &chioas.Schema{
+				Type:    "string",
+				Default: l.defaultSort,
+				Enum:    enum,
+			},
+		},
+	)
+}
+
+// paginate sorts the items and returns the page selected by the request's limit, cursor and sort params
+//
+// Link headers (rel=next and rel=prev) and an X-Total-Count header are set on the response
+func (l listing[T]) paginate(writer http.ResponseWriter, request *http.Request, items []T) ([]T, error) {
+	q := request.URL.Query()
+	limit := defaultPageLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageLimit {
+			return nil, newProblem(http.StatusBadRequest, "query param \"limit\" must be an integer from 1 to %d", maxPageLimit)
+		}
+	}
+	sortBy := q.Get("sort")
+	if sortBy == "" {
+		sortBy = l.defaultSort
+	}
+	keyFn, ok := l.fields[strings.TrimPrefix(sortBy, "-")]
+	if !ok {
+		return nil, newProblem(http.StatusBadRequest, "query param \"sort\" cannot sort by %q", sortBy)
+	}
+	var cursor *pageCursor
+	if v := q.Get("cursor"); v != "" {
+		if cursor = decodeCursor(v); cursor == nil || cursor.Sort != sortBy {
+			return nil, newProblem(http.StatusBadRequest, "query param \"cursor\" is invalid for this request")
+		}
+	}
+	desc := strings.HasPrefix(sortBy, "-")
+	keys := make([]string, len(items))
+	ids := make([]string, len(items))
+	idx := make([]int, len(items))
+	for i, item := range items {
+		keys[i], ids[i], idx[i] = keyFn(item), l.id(item), i
+	}
+	less := func(ka, ia, kb, ib string) bool {
+		if ka != kb {
+			return (ka < kb) != desc
+		} else if ia != ib {
+			return (ia < ib) != desc
+		}
+		return false
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return less(keys[idx[i]], ids[idx[i]], keys[idx[j]], ids[idx[j]])
+	})
+	start, end := 0, len(idx)
+	if cursor != nil {
+		if cursor.Prev {
+			// page ends just before the cursor item
+			end = sort.Search(len(idx), func(i int) bool {
+				return !less(keys[idx[i]], ids[idx[i]], cursor.Key, cursor.Id)
+			})
+			start = max(0, end-limit)
+		} else {
+			// page starts just after the cursor item
+			start = sort.Search(len(idx), func(i int) bool {
+				return less(cursor.Key, cursor.Id, keys[idx[i]], ids[idx[i]])
+			})
+		}
+	}
+	end = min(end, start+limit)
+	page := make([]T, 0, end-start)
+	for _, i := range idx[start:end] {
+		page = append(page, items[i])
+	}
+	links := make([]string, 0, 2)
+	if end < len(idx) && end > start {
+		last := idx[end-1]
+		links = append(links, pageLink(request, pageCursor{Sort: sortBy, Key: keys[last], Id: ids[last]}, "next"))
+	}
+	if start > 0 && end > start {
+		first := idx[start]
+		links = append(links, pageLink(request, pageCursor{Sort: sortBy, Key: keys[first], Id: ids[first], Prev: true}, "prev"))
+	}
+	if len(links) > 0 {
+		writer.Header().Set("Link", strings.Join(links, ", "))
+	}
+	writer.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+	return page, nil
+}
+
+func pageLink(request *http.Request, cursor pageCursor, rel string) string {
+	data, _ := json.Marshal(cursor)
+	u := *request.URL
+	q := u.Query()
+	q.Set("cursor", base64.RawURLEncoding.EncodeToString(data))
+	q.Set("sort", cursor.Sort)
+	u.RawQuery = q.Encode()
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+}
+
+func decodeCursor(v string) *pageCursor {
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil
+	}
+	var c pageCursor
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil
+	}
+	return &c
+}
+
+// sortKeyTime is a sort key for a time (fixed width UTC, so lexical order is time order)
+func sortKeyTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// sortKeyNumber is a sort key for a (non-negative) number (zero padded, so lexical order is numeric order)
+func sortKeyNumber(f float64) string {
+	return fmt.Sprintf("%020.6f", f)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type listed struct {
+	id    string
+	score float64
+}
+
+var testListing = listing[listed]{
+	id: func(l listed) string { return l.id },
+	fields: sortFields[listed]{
+		"score": func(l listed) string { return sortKeyNumber(l.score) },
+	},
+	defaultSort: "score",
+}
+
+var linkPattern = regexp.MustCompile(`<([^>]+)>; rel="(next|prev)"`)
+
+// page requests a page of the items - returning its ids and links by rel
+func page(t *testing.T, items []listed, target string) ([]string, map[string]string, *httptest.ResponseRecorder) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	got, err := testListing.paginate(rec, httptest.NewRequest(http.MethodGet, target, nil), items)
+	if err != nil {
+		t.Fatalf("paginate %s %v", target, err)
+	}
+	ids := make([]string, len(got))
+	for i, l := range got {
+		ids[i] = l.id
+	}
+	links := map[string]string{}
+	for _, m := range linkPattern.FindAllStringSubmatch(rec.Header().Get("Link"), -1) {
+		links[m[2]] = m[1]
+	}
+	return ids, links, rec
+}
+
+func TestPaginate(t *testing.T) {
+	// scores tie in pairs - so the id orders items of the same score
+	var items []listed
+	for i := 9; i >= 0; i-- {
+		items = append(items, listed{id: fmt.Sprintf("id%02d", i), score: float64(i / 2)})
+	}
+	ascending := []string{"id00", "id01", "id02", "id03", "id04", "id05", "id06", "id07", "id08", "id09"}
+	for _, sortBy := range []string{"score", "-score"} {
+		want := slices.Clone(ascending)
+		if sortBy == "-score" {
+			slices.Reverse(want)
+		}
+		// forward through the pages with the next links...
+		var all []string
+		var pages []string
+		target := "/things?filter=x&limit=3&sort=" + url.QueryEscape(sortBy)
+		for target != "" {
+			ids, links, rec := page(t, items, target)
+			if rec.Header().Get("X-Total-Count") != "10" {
+				t.Errorf("X-Total-Count %q", rec.Header().Get("X-Total-Count"))
+			}
+			if u, _ := url.Parse(target); u.Query().Get("filter") != "x" || u.Query().Get("limit") != "3" {
+				t.Errorf("link %s dropped query params", target)
+			}
+			if (len(all) == 0) != (links["prev"] == "") {
+				t.Errorf("page %d prev link %q", len(pages), links["prev"])
+			}
+			all = append(all, ids...)
+			pages = append(pages, target)
+			target = links["next"]
+		}
+		if !slices.Equal(all, want) || len(pages) != 4 {
+			t.Fatalf("%s pages %v over %d pages, want %v", sortBy, all, len(pages), want)
+		}
+		// ...and back with the prev links
+		var back []string
+		_, links, _ := page(t, items, pages[len(pages)-1])
+		for target = links["prev"]; target != ""; target = links["prev"] {
+			var ids []string
+			ids, links, _ = page(t, items, target)
+			back = append(ids, back...)
+		}
+		if !slices.Equal(back, want[:9]) {
+			t.Errorf("%s back %v, want %v", sortBy, back, want[:9])
+		}
+	}
+	if ids, links, _ := page(t, items, "/things"); len(ids) != 10 || len(links) != 0 {
+		t.Errorf("default page %v links %v", ids, links)
+	}
+	if ids, links, rec := page(t, nil, "/things"); len(ids) != 0 || len(links) != 0 || rec.Header().Get("X-Total-Count") != "0" {
+		t.Errorf("empty page %v links %v", ids, links)
+	}
+	// a cursor item that has since been deleted still positions the page
+	_, links, _ := page(t, items, "/things?limit=3")
+	without := slices.DeleteFunc(slices.Clone(items), func(l listed) bool { return l.id == "id02" })
+	if ids, _, _ := page(t, without, links["next"]); !slices.Equal(ids, []string{"id03", "id04", "id05"}) {
+		t.Errorf("page after deleted cursor item %v", ids)
+	}
+}
+
+func TestPaginateInvalid(t *testing.T) {
+	_, links, _ := page(t, []listed{{"a", 1}, {"b", 2}}, "/things?limit=1")
+	next, _ := url.Parse(links["next"])
+	otherSort := next.Query()
+	otherSort.Set("sort", "-score")
+	for name, target := range map[string]string{
+		"limit 0":                "/things?limit=0",
+		"limit too high":         fmt.Sprintf("/things?limit=%d", maxPageLimit+1),
+		"limit not a number":     "/things?limit=ten",
+		"unknown sort":           "/things?sort=name",
+		"garbled cursor":         "/things?cursor=not-base64!",
+		"cursor not json":        "/things?cursor=bm90IGpzb24",
+		"cursor of another sort": "/things?" + otherSort.Encode(),
+	} {
+		_, err := testListing.paginate(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil), nil)
+		if p := asProblem(err); err == nil || p.Status != http.StatusBadRequest || !strings.Contains(p.Detail, "query param") {
+			t.Errorf("%s error %v, want a 400 problem", name, err)
+		}
+	}
+}
+
+func TestSortKeys(t *testing.T) {
+	numbers := []float64{0, 0.5, 2, 10, 100.25, 99999}
+	for i := 1; i < len(numbers); i++ {
+		if sortKeyNumber(numbers[i-1]) >= sortKeyNumber(numbers[i]) {
+			t.Errorf("key of %v not before key of %v", numbers[i-1], numbers[i])
+		}
+	}
+	// times order by instant - whatever their zone
+	utc := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	earlier := utc.Add(-time.Nanosecond).In(time.FixedZone("", 10*3600))
+	if sortKeyTime(earlier) >= sortKeyTime(utc) || sortKeyTime(utc.In(time.FixedZone("", -5*3600))) != sortKeyTime(utc) {
+		t.Errorf("time keys %s %s", sortKeyTime(earlier), sortKeyTime(utc))
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+type HeartRateSettings struct {
+	MaxHeartRate     int       `json:"maxHeartRate" oas:"description: maximum heart rate in beats per minute, required, minimum: 100, maximum: 240"`
+	RestingHeartRate int       `json:"restingHeartRate" oas:"description: resting heart rate in beats per minute, required, minimum: 25, maximum: 120"`
+	Zones            []float64 `json:"zones,omitempty" oas:"description: lower bounds of the zones as fractions of the heart rate reserve (Karvonen) in ascending order - defaults to 0.5 0.6 0.7 0.8 0.9 (five zones), type: array, itemType: number"`
+}
+
+type HeartRateZone struct {
+	Zone    int     `json:"zone" oas:"description: zone number (1 is the easiest)"`
+	MinBpm  int     `json:"minBpm" oas:"description: lowest heart rate of the zone in beats per minute"`
+	MaxBpm  int     `json:"maxBpm" oas:"description: heart rate in beats per minute where the next zone starts (the max heart rate for the top zone)"`
+	Seconds float64 `json:"seconds" oas:"description: time spent in the zone in seconds"`
+}
+
+type WorkoutHeartRate struct {
+	WorkoutId        string          `json:"workoutId" oas:"description: db oid of the Workout"`
+	ActivityId       string          `json:"activityId" oas:"description: db oid of the Activity the heart rate was recorded by"`
+	AverageHeartRate *int            `json:"averageHeartRate,omitempty" oas:"description: mean heart rate in beats per minute"`
+	MaxHeartRate     *int            `json:"maxHeartRate,omitempty" oas:"description: highest heart rate in beats per minute"`
+	Trimp            float64         `json:"trimp" oas:"description: training impulse (Banister TRIMP) of the workout"`
+	BelowZones       float64         `json:"belowZones" oas:"description: seconds spent below zone 1"`
+	Zones            []HeartRateZone `json:"zones" oas:"description: time in each zone (empty when only the average heart rate was recorded)"`
+}
+
+type LoadDay struct {
+	Date        string   `json:"date" oas:"description: the day (in the requested time zone), format: date"`
+	Load        float64  `json:"load" oas:"description: total TRIMP of the workouts started on the day"`
+	AcuteLoad   float64  `json:"acuteLoad" oas:"description: mean daily load of the 7 days up to and including the day"`
+	ChronicLoad float64  `json:"chronicLoad" oas:"description: mean daily load of the 28 days up to and including the day"`
+	Ratio       *float64 `json:"ratio,omitempty" oas:"description: acute to chronic workload ratio (absent until there are 28 days of heart rate history - or while the chronic load is 0)"`
+	Risk        string   `json:"risk,omitempty" oas:"$ref: LoadRisk"`
+}
+
+const (
+	// acuteDays and chronicDays are the rolling windows of the acute:chronic workload ratio
+	acuteDays   = 7
+	chronicDays = 28
+	maxLoadDays = 366
+	// maxHeartRateGap is the longest gap between heart rate samples that is counted (longer gaps are pauses)
+	maxHeartRateGap = 2 * time.Minute
+	// trimpWeightingMale and trimpWeightingFemale are the Banister TRIMP weightings (male is used when the sex is not known)
+	trimpWeightingMale   = 1.92
+	trimpWeightingFemale = 1.67
+	loadRiskLow          = "low"
+	loadRiskOptimal      = "optimal"
+	loadRiskHigh         = "high"
+	loadRiskSpike        = "spike"
+)
+
+// defaultHeartRateZones are the lower bounds of the zones as fractions of heart rate reserve
+var defaultHeartRateZones = []float64{0.5, 0.6, 0.7, 0.8, 0.9}
+
+// LoadRisks are the risk bands of the acute:chronic workload ratio
+var LoadRisks = []string{loadRiskHigh, loadRiskLow, loadRiskOptimal, loadRiskSpike}
+
+// WorkoutHeartRatePath is the heart rate zones and TRIMP of a Workout uploaded as an activity (nested under the workout path)
+var WorkoutHeartRatePath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getWorkoutHeartRate,
+			OperationId: "getWorkoutHeartRate",
+			Description: "Time in heart rate zones and training impulse - zones are the Karvonen zones of the users heartRate settings (404 when the workout has no heart rate - 409 when the user has no heartRate settings)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathWorkout, Coach: true}),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "Heart rate of the workout",
+					SchemaRef:   "WorkoutHeartRate",
+				},
+			},
+		},
+	},
+}
+
+var LoadPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getLoad,
+			OperationId: "getLoad",
+			Description: "Daily training load (TRIMP of the workouts with heart rate) with the acute (7 day) and chronic (28 day) loads and their ratio - a ratio above 1.5 is a spike that risks overtraining (409 when the user has no heartRate settings)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: chioas.QueryParams{
+				{
+					Name:        "from",
+					Description: "First day as a date-time or date (defaults to 12 weeks before to)",
+					Example:     "2024-07-01",
+				},
+				{
+					Name:        "to",
+					Description: "End of the range (exclusive) as a date-time or date (defaults to now)",
+					Example:     "2024-10-01",
+				},
+				{
+					Name:        "tz",
+					Description: "IANA time zone that days are aligned to (defaults to UTC)",
+					Example:     "Europe/London",
+				},
+			},
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "Load per day",
+					IsArray:     true,
+					SchemaRef:   "LoadDay",
+				},
+			},
+		},
+	},
+}
+
+var LoadSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "HeartRateSettings",
+		Description: "Heart rate settings of a User (for heart rate zones and training load)",
+		Comment:     chioas.SourceComment(),
+	}).Must(HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50, Zones: defaultHeartRateZones}),
+	(&chioas.Schema{
+		Name:        "HeartRateZone",
+		Description: "Time spent in a heart rate zone",
+		Comment:     chioas.SourceComment(),
+	}).Must(HeartRateZone{}),
+	(&chioas.Schema{
+		Name:        "WorkoutHeartRate",
+		Description: "Heart rate zones and training impulse of a Workout",
+		Comment:     chioas.SourceComment(),
+	}).Must(WorkoutHeartRate{}),
+	(&chioas.Schema{
+		Name:        "LoadDay",
+		Description: "Training load of a day",
+		Comment:     chioas.SourceComment(),
+	}).Must(LoadDay{}),
+	enumSchema("LoadRisk", "Risk band of an acute:chronic workload ratio (low: below 0.8 - optimal: up to 1.3 - high: up to 1.5 - spike: above 1.5)", LoadRisks),
+}
+
+// check checks what can't be expressed in the HeartRateSettings schema
+func (s *HeartRateSettings) check() (errs []FieldError) {
+	if s.RestingHeartRate >= s.MaxHeartRate {
+		errs = append(errs, FieldError{Path: "heartRate.restingHeartRate", Message: "must be less than maxHeartRate"})
+	}
+	for i, z := range s.Zones {
+		if z <= 0 || z >= 1 {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("heartRate.zones[%d]", i), Message: "must be greater than 0 and less than 1"})
+		} else if i > 0 && z <= s.Zones[i-1] {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("heartRate.zones[%d]", i), Message: "must be greater than the previous zone"})
+		}
+	}
+	return errs
+}
+
+// heartRateZones are the Karvonen zones of a user
+type heartRateZones struct {
+	max  int
+	rest int
+	// starts are the lowest bpm of each zone
+	starts    []int
+	weighting float64
+}
+
+// userHeartRateZones are the zones of a user - failing with a conflict when the user has no heart rate settings
+func userHeartRateZones(user User) (heartRateZones, error) {
+	s := user.HeartRate
+	if s == nil {
+		return heartRateZones{}, newProblem(http.StatusConflict, "user %q has no heartRate settings", user.Id)
+	}
+	z := heartRateZones{max: s.MaxHeartRate, rest: s.RestingHeartRate, weighting: trimpWeightingMale}
+	if user.Sex == sexFemale {
+		z.weighting = trimpWeightingFemale
+	}
+	bounds := s.Zones
+	if len(bounds) == 0 {
+		bounds = defaultHeartRateZones
+	}
+	for _, b := range bounds {
+		z.starts = append(z.starts, z.rest+int(math.Round(b*float64(z.max-z.rest))))
+	}
+	return z, nil
+}
+
+// zone is the zone of a heart rate (0 is below zone 1)
+func (z heartRateZones) zone(bpm int) int {
+	i, found := slices.BinarySearch(z.starts, bpm)
+	if found {
+		return i + 1
+	}
+	return i
+}
+
+// trimp is the Banister training impulse of minutes at a heart rate
+func (z heartRateZones) trimp(bpm int, minutes float64) float64 {
+	reserve := min(max(float64(bpm-z.rest)/float64(z.max-z.rest), 0), 1)
+	return minutes * reserve * 0.64 * math.Exp(z.weighting*reserve)
+}
+
+// heartRateOf computes the time in zones and TRIMP of an activity
+//
+// Each sample counts until the next sample (gaps longer than maxHeartRateGap are pauses) - an activity with
+// only an average heart rate counts its duration at the average
+func (z heartRateZones) heartRateOf(a Activity) WorkoutHeartRate {
+	result := WorkoutHeartRate{
+		WorkoutId:        a.WorkoutId,
+		ActivityId:       a.Id,
+		AverageHeartRate: a.AverageHeartRate,
+		MaxHeartRate:     a.MaxHeartRate,
+		Zones:            []HeartRateZone{},
+	}
+	if len(a.HeartRate) == 0 {
+		if a.AverageHeartRate != nil {
+			result.Trimp = math.Round(z.trimp(*a.AverageHeartRate, a.Duration/60)*10) / 10
+		}
+		return result
+	}
+	seconds := make([]float64, len(z.starts)+1)
+	for i, s := range a.HeartRate[:len(a.HeartRate)-1] {
+		dt := a.HeartRate[i+1].Offset - s.Offset
+		if dt <= 0 || dt > maxHeartRateGap.Seconds() {
+			continue
+		}
+		seconds[z.zone(s.Bpm)] += dt
+		result.Trimp += z.trimp(s.Bpm, dt/60)
+	}
+	result.Trimp = math.Round(result.Trimp*10) / 10
+	result.BelowZones = seconds[0]
+	for i, start := range z.starts {
+		zone := HeartRateZone{Zone: i + 1, MinBpm: start, MaxBpm: z.max, Seconds: seconds[i+1]}
+		if i+1 < len(z.starts) {
+			zone.MaxBpm = z.starts[i+1]
+		}
+		result.Zones = append(result.Zones, zone)
+	}
+	return result
+}
+
+// hasHeartRate is whether an activity recorded heart rate (listed activities have an average heart
+// rate if they have heart rate samples)
+func hasHeartRate(a Activity) bool {
+	return len(a.HeartRate) > 0 || a.AverageHeartRate != nil
+}
+
+func getWorkoutHeartRate(writer http.ResponseWriter, request *http.Request) {
+	id := chi.URLParam(request, "id")
+	w, err := workouts.Get(request.Context(), id)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user, err := users.Get(request.Context(), w.UserId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	list, err := activities.List(request.Context(), ActivityFilter{WorkoutId: id})
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	i := slices.IndexFunc(list, hasHeartRate)
+	if i < 0 {
+		writeError(writer, request, fmt.Errorf("heart rate of workout %q %w", id, ErrNotFound))
+		return
+	}
+	z, err := userHeartRateZones(user)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	a, err := activities.Get(request.Context(), list[i].Id)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, z.heartRateOf(a))
+}
+
+func getLoad(writer http.ResponseWriter, request *http.Request) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	loc := time.UTC
+	if tz := request.URL.Query().Get("tz"); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"tz\" is not a known time zone"))
+			return
+		}
+	}
+	from, err := queryTime(request, "from")
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	to, err := queryTime(request, "to")
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.AddDate(0, 0, -7*12)
+	}
+	if !from.Before(to) {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"from\" must be before \"to\""))
+		return
+	}
+	var days []time.Time
+	for day := dayStart(from, loc); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if len(days) == maxLoadDays {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "range must not span more than %d days", maxLoadDays))
+			return
+		}
+		days = append(days, day)
+	}
+	z, err := userHeartRateZones(user)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	// the chronic window of the first day reaches back before the range
+	first := days[0].AddDate(0, 0, 1-chronicDays)
+	list, err := activities.List(request.Context(), ActivityFilter{UserId: user.Id, To: days[len(days)-1].AddDate(0, 0, 1)})
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var history time.Time
+	loads := make([]float64, chronicDays-1+len(days))
+	for _, a := range list {
+		if !hasHeartRate(a) {
+			continue
+		}
+		start := dayStart(a.StartTime, loc)
+		if history.IsZero() || start.Before(history) {
+			history = start
+		}
+		if i := daysBetween(first, start); i >= 0 && i < len(loads) {
+			// only the activities within the range (and its chronic window) are loaded with their samples
+			if a, err = activities.Get(request.Context(), a.Id); err != nil {
+				writeError(writer, request, err)
+				return
+			}
+			loads[i] += z.heartRateOf(a).Trimp
+		}
+	}
+	writeJson(writer, request, http.StatusOK, loadDays(days, loads, history))
+}
+
+// loadDays rolls the acute and chronic windows over the daily loads - loads has a load for each of the
+// chronicDays-1 days before the days and then for each of the days, and history is the first day with heart rate
+func loadDays(days []time.Time, loads []float64, history time.Time) []LoadDay {
+	result := make([]LoadDay, len(days))
+	var acute, chronic float64
+	for i := range loads {
+		acute += loads[i]
+		chronic += loads[i]
+		if i >= acuteDays {
+			acute -= loads[i-acuteDays]
+		}
+		if i >= chronicDays {
+			chronic -= loads[i-chronicDays]
+		}
+		j := i - (chronicDays - 1)
+		if j < 0 {
+			continue
+		}
+		day := LoadDay{
+			Date:        days[j].Format(time.DateOnly),
+			Load:        math.Round(loads[i]*10) / 10,
+			AcuteLoad:   math.Round(acute/acuteDays*10) / 10,
+			ChronicLoad: math.Round(chronic/chronicDays*10) / 10,
+		}
+		if !history.IsZero() && daysBetween(history, days[j]) >= chronicDays-1 && day.ChronicLoad > 0 {
+			ratio := math.Round(acute/acuteDays/(chronic/chronicDays)*100) / 100
+			day.Ratio, day.Risk = &ratio, loadRisk(ratio)
+		}
+		result[j] = day
+	}
+	return result
+}
+
+// dayStart is the start of the day containing t in the location
+func dayStart(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// daysBetween is the number of calendar days from one day start to another
+func daysBetween(from time.Time, to time.Time) int {
+	// rounding copes with days that are not 24 hours (daylight saving changes)
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
+
+// loadRisk is the risk band of an acute:chronic workload ratio
+func loadRisk(ratio float64) string {
+	switch {
+	case ratio < 0.8:
+		return loadRiskLow
+	case ratio <= 1.3:
+		return loadRiskOptimal
+	case ratio <= 1.5:
+		return loadRiskHigh
+	}
+	return loadRiskSpike
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUserHeartRateZones(t *testing.T) {
+	if _, err := userHeartRateZones(User{Id: "u1"}); err == nil {
+		t.Errorf("zones without heart rate settings")
+	}
+	for name, tc := range map[string]struct {
+		settings HeartRateSettings
+		sex      string
+		want     []int
+		weight   float64
+	}{
+		"default zones":    {HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50}, "", []int{120, 134, 148, 162, 176}, trimpWeightingMale},
+		"configured zones": {HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50, Zones: []float64{0.6, 0.8}}, sexMale, []int{134, 162}, trimpWeightingMale},
+		"rounded bpm":      {HeartRateSettings{MaxHeartRate: 185, RestingHeartRate: 62, Zones: []float64{0.55}}, "", []int{130}, trimpWeightingMale},
+		"female weighting": {HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50}, sexFemale, []int{120, 134, 148, 162, 176}, trimpWeightingFemale},
+	} {
+		t.Run(name, func(t *testing.T) {
+			z, err := userHeartRateZones(User{HeartRate: &tc.settings, Sex: tc.sex})
+			if err != nil || !slices.Equal(z.starts, tc.want) || z.weighting != tc.weight {
+				t.Errorf("zones %v weighting %v %v, want %v %v", z.starts, z.weighting, err, tc.want, tc.weight)
+			}
+		})
+	}
+}
+
+func TestHeartRateZone(t *testing.T) {
+	z, _ := userHeartRateZones(User{HeartRate: &HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50}})
+	// a heart rate at exactly the start of a zone is in that zone
+	for bpm, want := range map[int]int{40: 0, 119: 0, 120: 1, 133: 1, 134: 2, 148: 3, 175: 4, 176: 5, 190: 5, 210: 5} {
+		if got := z.zone(bpm); got != want {
+			t.Errorf("%d bpm in zone %d, want %d", bpm, got, want)
+		}
+	}
+}
+
+func TestTrimp(t *testing.T) {
+	male, _ := userHeartRateZones(User{HeartRate: &HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50}})
+	female, _ := userHeartRateZones(User{HeartRate: &HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50}, Sex: sexFemale})
+	for _, tc := range []struct {
+		z       heartRateZones
+		bpm     int
+		minutes float64
+		want    float64
+	}{
+		{male, 120, 1, 0.8357},
+		{male, 120, 60, 50.1446},
+		{female, 120, 60, 44.2524},
+		{male, 190, 1, 4.3654},
+		// the heart rate reserve is clamped to 0 to 1
+		{male, 200, 1, 4.3654},
+		{male, 40, 10, 0},
+	} {
+		if got := tc.z.trimp(tc.bpm, tc.minutes); math.Abs(got-tc.want) > 0.0001 {
+			t.Errorf("trimp of %v minutes at %d (weighting %v) %v, want %v", tc.minutes, tc.bpm, tc.z.weighting, got, tc.want)
+		}
+	}
+}
+
+func TestHeartRateOf(t *testing.T) {
+	z, _ := userHeartRateZones(User{HeartRate: &HeartRateSettings{MaxHeartRate: 190, RestingHeartRate: 50}})
+	got := z.heartRateOf(Activity{Id: "a1", WorkoutId: "w1", HeartRate: []HeartRateSample{
+		{Offset: 0, Bpm: 120},
+		{Offset: 60, Bpm: 150},
+		// 3 minutes without a sample is a pause - the sample before it doesn't count
+		{Offset: 240, Bpm: 150},
+		{Offset: 300, Bpm: 100},
+		{Offset: 300, Bpm: 100},
+		// the last sample has no duration
+		{Offset: 360, Bpm: 190},
+	}})
+	if got.WorkoutId != "w1" || got.ActivityId != "a1" || got.Trimp != 3.1 || got.BelowZones != 60 {
+		t.Errorf("trimp %v below %v", got.Trimp, got.BelowZones)
+	}
+	want := []HeartRateZone{
+		{Zone: 1, MinBpm: 120, MaxBpm: 134, Seconds: 60},
+		{Zone: 2, MinBpm: 134, MaxBpm: 148},
+		{Zone: 3, MinBpm: 148, MaxBpm: 162, Seconds: 60},
+		{Zone: 4, MinBpm: 162, MaxBpm: 176},
+		{Zone: 5, MinBpm: 176, MaxBpm: 190},
+	}
+	if !slices.Equal(got.Zones, want) {
+		t.Errorf("zones %v, want %v", got.Zones, want)
+	}
+	// a gap of exactly the maximum still counts
+	got = z.heartRateOf(Activity{HeartRate: []HeartRateSample{{Offset: 0, Bpm: 150}, {Offset: maxHeartRateGap.Seconds(), Bpm: 150}}})
+	if got.Zones[2].Seconds != maxHeartRateGap.Seconds() {
+		t.Errorf("zone 3 %vs, want %vs", got.Zones[2].Seconds, maxHeartRateGap.Seconds())
+	}
+	// only an average is counted for the duration
+	got = z.heartRateOf(Activity{AverageHeartRate: ptr(120), Duration: 3600})
+	if got.Trimp != 50.1 || len(got.Zones) != 0 {
+		t.Errorf("average only trimp %v zones %v", got.Trimp, got.Zones)
+	}
+}
+
+func TestLoadDays(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	days := make([]time.Time, 30)
+	for i := range days {
+		days[i] = start.AddDate(0, 0, i)
+	}
+	longAgo := start.AddDate(-1, 0, 0)
+	// loads are indexed from the start of the chronic window of the first day
+	loadsOf := func(load func(i int) float64) []float64 {
+		loads := make([]float64, chronicDays-1+len(days))
+		for i := range loads {
+			loads[i] = load(i - (chronicDays - 1))
+		}
+		return loads
+	}
+
+	steady := loadDays(days, loadsOf(func(int) float64 { return 10 }), longAgo)
+	if d := steady[0]; d.Date != "2024-01-01" || d.Load != 10 || d.AcuteLoad != 10 || d.ChronicLoad != 10 || d.Ratio == nil || *d.Ratio != 1 || d.Risk != loadRiskOptimal {
+		t.Errorf("steady day %+v", d)
+	}
+
+	// the ratio needs 28 days of history
+	recent := loadDays(days, loadsOf(func(int) float64 { return 10 }), start)
+	for j, d := range recent {
+		if (d.Ratio != nil) != (j >= chronicDays-1) {
+			t.Errorf("day %d with %d days of history has ratio %v", j, j+1, d.Ratio)
+		}
+	}
+
+	// a single load is in the acute window for 7 days and the chronic window for 28
+	single := loadDays(days, loadsOf(func(i int) float64 {
+		if i == 0 {
+			return 70
+		}
+		return 0
+	}), longAgo)
+	for j, want := range map[int][2]float64{0: {10, 2.5}, 6: {10, 2.5}, 7: {0, 2.5}, 27: {0, 2.5}, 28: {0, 0}} {
+		if d := single[j]; d.AcuteLoad != want[0] || d.ChronicLoad != want[1] {
+			t.Errorf("day %d acute %v chronic %v, want %v", j, d.AcuteLoad, d.ChronicLoad, want)
+		}
+	}
+	if d := single[0]; d.Ratio == nil || *d.Ratio != 4 || d.Risk != loadRiskSpike {
+		t.Errorf("spike day %+v", d)
+	}
+	if d := single[7]; d.Ratio == nil || *d.Ratio != 0 || d.Risk != loadRiskLow {
+		t.Errorf("week after spike %+v", d)
+	}
+	// no ratio while the chronic load is 0
+	if d := single[28]; d.Ratio != nil {
+		t.Errorf("ratio %v without a chronic load", *d.Ratio)
+	}
+}
+
+func TestLoadRisk(t *testing.T) {
+	for ratio, want := range map[float64]string{0: loadRiskLow, 0.79: loadRiskLow, 0.8: loadRiskOptimal, 1.3: loadRiskOptimal, 1.31: loadRiskHigh, 1.5: loadRiskHigh, 1.51: loadRiskSpike} {
+		if got := loadRisk(ratio); got != want {
+			t.Errorf("ratio %v risk %q, want %q", ratio, got, want)
+		}
+	}
+}
+
+func TestDaysBetween(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		from time.Time
+		to   time.Time
+		want int
+	}{
+		{time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 29, 0, 0, 0, 0, time.UTC), 28},
+		{time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), -1},
+		// a 23 hour day
+		{time.Date(2024, 3, 31, 0, 0, 0, 0, london), time.Date(2024, 4, 1, 0, 0, 0, 0, london), 1},
+		{time.Date(2024, 3, 4, 0, 0, 0, 0, london), time.Date(2024, 4, 1, 0, 0, 0, 0, london), 28},
+		// a 25 hour day
+		{time.Date(2024, 10, 27, 0, 0, 0, 0, london), time.Date(2024, 10, 28, 0, 0, 0, 0, london), 1},
+		{time.Date(2024, 10, 1, 0, 0, 0, 0, london), time.Date(2024, 10, 29, 0, 0, 0, 0, london), 28},
+	} {
+		if got := daysBetween(tc.from, tc.to); got != tc.want {
+			t.Errorf("days from %v to %v %d, want %d", tc.from, tc.to, got, tc.want)
+		}
+	}
+	// activities late on a DST day still fall on that day
+	if got := dayStart(time.Date(2024, 3, 31, 23, 30, 0, 0, time.UTC), london); !got.Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, london)) {
+		t.Errorf("day start %v", got)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// newLogHandler creates the slog.Handler for the configured log format and level
+func newLogHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == logFormatText {
+		return slog.NewTextHandler(w, opts)
+	}
+	return slog.NewJSONHandler(w, opts)
+}
+
+// requestLog is the per-request logging state - put into the request context by accessLog
+// (before routing) so that later middleware and handlers can add to the access log entry
+type requestLog struct {
+	logger *slog.Logger
+	userId string
+}
+
+type requestLogKey struct{}
+
+// loggerFrom returns the logger for the request context (with the request id) - or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.logger
+	}
+	return slog.Default()
+}
+
+// setLogUserId records the authenticated user of the request, for the access log
+func setLogUserId(ctx context.Context, userId string) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.userId = userId
+		rl.logger = rl.logger.With("userId", userId)
+	}
+}
+
+// accessLog is middleware that logs a structured entry for every request
+//
+// It must follow middleware.RequestID - the request id is echoed in the X-Request-Id
+// response header and added to the logger that loggerFrom returns for the request
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		reqId := middleware.GetReqID(request.Context())
+		if reqId != "" {
+			writer.Header().Set(middleware.RequestIDHeader, reqId)
+		}
+		logger := slog.Default().With("requestId", reqId)
+		if span := spanFrom(request.Context()); span != nil {
+			logger = logger.With("traceId", span.TraceId)
+		}
+		rl := &requestLog{logger: logger}
+		ww := middleware.NewWrapResponseWriter(writer, request.ProtoMajor)
+		next.ServeHTTP(ww, request.WithContext(context.WithValue(request.Context(), requestLogKey{}, rl)))
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", request.Method),
+			slog.String("route", routePattern(request)),
+			slog.String("path", request.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Float64("latencyMs", float64(time.Since(start).Microseconds())/1000),
+			slog.String("requestId", reqId),
+		}
+		if span := spanFrom(request.Context()); span != nil {
+			attrs = append(attrs, slog.String("traceId", span.TraceId))
+		}
+		if rl.userId != "" {
+			attrs = append(attrs, slog.String("userId", rl.userId))
+		}
+		slog.Default().LogAttrs(request.Context(), level, "request", attrs...)
+	})
+}
+
+// routePattern is the chi route pattern that matched the request (e.g. /users/{id})
+func routePattern(request *http.Request) string {
+	if rctx := chi.RouteContext(request.Context()); rctx != nil {
+		if p := rctx.RoutePattern(); p != "" {
+			return p
+		}
+	}
+	return "unmatched"
+}
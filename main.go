@@ -1,7 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/go-andiamo/chioas"
 	"github.com/go-chi/chi/v5"
@@ -9,26 +19,209 @@ import (
 )
 
 func main() {
+	cfg, printOnly, err := loadConfig(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatalf("loading config: %v", err)
+	}
+	if printOnly {
+		if err = cfg.print(os.Stdout); err != nil {
+			log.Fatalf("printing config: %v", err)
+		}
+		return
+	}
+	level, _ := cfg.level()
+	slog.SetDefault(slog.New(newLogHandler(os.Stderr, cfg.LogFormat, level)))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err = run(ctx, cfg); err != nil {
+		stop()
+		slog.Error("exiting", "error", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the api until ctx is done (or serving fails) - then drains in-flight
+// requests (within the configured shutdown timeout) and closes the stores
+func run(ctx context.Context, cfg Config) error {
+	if cfg.TokenSecret != "" {
+		signer = newTokenSigner([]byte(cfg.TokenSecret))
+	} else {
+		slog.Warn("no token secret configured - issued tokens will not survive a restart")
+	}
+	exporter, err := newSpanExporter(cfg.Tracing, os.Stdout)
+	if err != nil {
+		return err
+	}
+	spanExporter = exporter
+	if err = openStores(cfg.DataDir); err != nil {
+		return fmt.Errorf("opening stores: %w", err)
+	}
+	if err = bootstrapAdmin(ctx, cfg.AdminUsername); err != nil {
+		return errors.Join(fmt.Errorf("bootstrapping the admin: %w", err), closeStores())
+	}
+	handler, err := newRouter(cfg)
+	if err != nil {
+		return errors.Join(fmt.Errorf("setting up routes: %w", err), closeStores())
+	}
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return errors.Join(fmt.Errorf("listening: %w", err), closeStores())
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Timeouts.ReadHeader,
+		ReadTimeout:       cfg.Timeouts.Read,
+		WriteTimeout:      cfg.Timeouts.Write,
+		IdleTimeout:       cfg.Timeouts.Idle,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	served := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", listener.Addr().String(), "tls", cfg.TLS.CertFile != "")
+		if cfg.TLS.CertFile != "" {
+			served <- server.ServeTLS(listener, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			served <- server.Serve(listener)
+		}
+	}()
+	select {
+	case err = <-served:
+		return errors.Join(fmt.Errorf("serving: %w", err), closeStores())
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down", "timeout", cfg.Timeouts.Shutdown.String())
+	sctx, cancel := context.WithTimeout(context.Background(), cfg.Timeouts.Shutdown)
+	defer cancel()
+	if err = server.Shutdown(sctx); err != nil {
+		slog.Warn("in-flight requests did not finish before the shutdown timeout", "error", err)
+		_ = server.Close()
+	}
+	if err = spanExporter.Shutdown(sctx); err != nil {
+		slog.Warn("spans were not exported before the shutdown timeout", "error", err)
+	}
+	if err = closeStores(); err != nil {
+		return fmt.Errorf("closing stores: %w", err)
+	}
+	slog.Info("shut down")
+	return nil
+}
+
+func newRouter(cfg Config) (http.Handler, error) {
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-	if err := workyApi.SetupRoutes(r, workyApi); err != nil {
-		panic(err)
+	r.Use(middleware.RequestID, traceRequests, accessLog, recordMetrics, recoverProblems)
+	if len(cfg.CORSOrigins) > 0 {
+		r.Use(corsMiddleware(cfg.CORSOrigins))
 	}
-	_ = http.ListenAndServe(":3009", r)
+	r.NotFound(notFound)
+	r.MethodNotAllowed(methodNotAllowed)
+	workyApi.DocOptions.ServeDocs = cfg.ServeDocs
+	applyDefaultResponses(&workyApi)
+	applyAccessSecurity(&workyApi)
+	return r, workyApi.SetupRoutes(r, workyApi)
 }
 
-var allSchemas = UserSchemas // this will be changed to 'append' on second list
+// storeDir is the data dir of the file-backed stores (empty while the stores are in memory)
+var storeDir string
+
+// openStores migrates the data in dir and replaces the default in-memory stores with file-backed stores in dir
+//
+// If a store fails to open, the stores already opened are closed
+func openStores(dir string) (err error) {
+	if err = migrate(dir); err != nil {
+		return err
+	}
+	storeDir = dir
+	var opened []interface{ Close() error }
+	defer func() {
+		if err != nil {
+			for _, s := range opened {
+				err = errors.Join(err, s.Close())
+			}
+		}
+	}()
+	if users, err = OpenFileUserStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, users)
+	if workouts, err = OpenFileWorkoutStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, workouts)
+	if exercises, err = OpenFileExerciseStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, exercises)
+	if auth, err = OpenFileAuthStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, auth)
+	if records, err = OpenFileRecordStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, records)
+	if templates, err = OpenFileTemplateStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, templates)
+	if programs, err = OpenFileProgramStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, programs)
+	if schedule, err = OpenFileScheduleStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, schedule)
+	if activities, err = OpenFileActivityStore(dir); err != nil {
+		return err
+	}
+	opened = append(opened, activities)
+	if measurements, err = OpenFileMeasurementStore(dir); err != nil {
+		return err
+	}
+	return nil
+}
+
+// closeStores closes all the stores
+func closeStores() error {
+	return errors.Join(users.Close(), workouts.Close(), exercises.Close(), auth.Close(), records.Close(), templates.Close(), programs.Close(), schedule.Close(), activities.Close(), measurements.Close())
+}
+
+var allSchemas = concatSchemas(UserSchemas, WorkoutSchemas, RecordSchemas, AnalyticsSchemas, ExerciseSchemas, TemplateSchemas, ProgramSchemas, ScheduleSchemas, ImportSchemas, ActivitySchemas, TrackSchemas, LoadSchemas, MeasurementSchemas, UnitSchemas, AuthSchemas, ProblemSchemas)
+
+func concatSchemas(schemas ...[]chioas.Schema) (result []chioas.Schema) {
+	for _, s := range schemas {
+		result = append(result, s...)
+	}
+	return
+}
 
 var workyApi = chioas.Definition{
 	AutoHeadMethods: true,
 	DocOptions: chioas.DocOptions{
-		ServeDocs:       true,
-		HideHeadMethods: true,
+		ServeDocs:        true,
+		HideHeadMethods:  true,
+		DefaultResponses: problemDefaultResponses,
 	},
 	Paths: chioas.Paths{
-		"/users": UserPath,
+		"/users":     UserPath,
+		"/workouts":  WorkoutPath,
+		"/exercises": ExercisePath,
+		"/templates": TemplatePath,
+		"/programs":  ProgramPath,
+		"/auth":      AuthPath,
+		"/healthz":   HealthzPath,
+		"/readyz":    ReadyzPath,
+		"/version":   VersionPath,
+		"/metrics":   MetricsPath,
 	},
+	Middlewares: chi.Middlewares{authenticate, resolveUnits},
+	Security:    chioas.SecuritySchemes{{Name: bearerAuth}},
 	Components: &chioas.Components{
-		Schemas: allSchemas,
+		Schemas:         allSchemas,
+		Responses:       ProblemResponses,
+		SecuritySchemes: AuthSecuritySchemes,
 	},
+	MethodHandlerBuilder: newHandlerBuilder(allSchemas),
 }
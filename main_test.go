@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	testRouterOnce    sync.Once
+	testRouterHandler http.Handler
+	testRouterErr     error
+)
+
+// testRouter is the api router over the default (in-memory) stores - set up once, as the routes
+// are set up from the shared api definition
+func testRouter(t *testing.T) http.Handler {
+	testRouterOnce.Do(func() {
+		cfg := defaultConfig()
+		cfg.ServeDocs = false
+		testRouterHandler, testRouterErr = newRouter(cfg)
+	})
+	if testRouterErr != nil {
+		t.Fatal(testRouterErr)
+	}
+	return testRouterHandler
+}
+
+// testUser creates a user with the roles (and a unique username from the prefix) and returns them with an access token
+func testUser(t *testing.T, prefix string, roles ...string) (User, string) {
+	t.Helper()
+	ctx := context.Background()
+	user, err := users.Create(ctx, User{Username: prefix + "_" + newObjectId()[16:], Roles: roles, Coaches: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := issueTokens(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, tokens.AccessToken
+}
+
+// call makes a request of the test router - body (if not empty) is sent as json (or as contentType)
+func call(t *testing.T, method string, path string, token string, body string, contentType ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		request.Header.Set("Content-Type", "application/json")
+		if len(contentType) > 0 {
+			request.Header.Set("Content-Type", contentType[0])
+		}
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	testRouter(t).ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestOpenStoresFailure(t *testing.T) {
+	// the in-memory stores the other tests use are put back afterwards
+	saved := []any{users, workouts, exercises, auth, records, templates, programs, schedule, activities, measurements, storeDir}
+	t.Cleanup(func() {
+		users, workouts, exercises, auth, records = saved[0].(UserStore), saved[1].(WorkoutStore), saved[2].(ExerciseStore), saved[3].(AuthStore), saved[4].(RecordStore)
+		templates, programs, schedule, activities, measurements = saved[5].(TemplateStore), saved[6].(ProgramStore), saved[7].(ScheduleStore), saved[8].(ActivityStore), saved[9].(MeasurementStore)
+		storeDir = saved[10].(string)
+	})
+	dir := t.TempDir()
+	if err := openStores(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := closeStores(); err != nil {
+		t.Fatal(err)
+	}
+	// the last store opened fails - after all the others have opened
+	if err := os.WriteFile(filepath.Join(dir, "measurements.json"), []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := openStores(dir); err == nil {
+		t.Fatal("opened stores with a corrupt collection")
+	}
+	ctx := context.Background()
+	if _, err := users.Create(ctx, User{Username: "after_failure", Roles: []string{}, Coaches: []string{}}); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("user create after a failed open %v, want %v", err, ErrStoreClosed)
+	}
+	if err := activities.Close(); err != nil {
+		t.Errorf("closing activities again %v", err)
+	}
+	if _, err := activities.Create(ctx, Activity{UserId: "u1"}); !errors.Is(err, ErrStoreClosed) {
+		t.Errorf("activity create after a failed open %v, want %v", err, ErrStoreClosed)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// MeasurementStore is the persistence interface for body measurements
+type MeasurementStore interface {
+	List(ctx context.Context, filter MeasurementFilter) ([]Measurement, error)
+	Get(ctx context.Context, id string) (Measurement, error)
+	Create(ctx context.Context, measurement Measurement) (Measurement, error)
+	Update(ctx context.Context, measurement Measurement) (Measurement, error)
+	Delete(ctx context.Context, id string) error
+	// DeleteUserMeasurements deletes all of a user's measurements (e.g. when the user is deleted)
+	DeleteUserMeasurements(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// MeasurementFilter filters listed measurements - zero value fields are not filtered on
+type MeasurementFilter struct {
+	UserId string
+	Kind   string
+	// From is the inclusive lower bound of the measurement time
+	From time.Time
+	// To is the exclusive upper bound of the measurement time
+	To time.Time
+}
+
+func (f MeasurementFilter) matches(m Measurement) bool {
+	return (f.UserId == "" || m.UserId == f.UserId) &&
+		(f.Kind == "" || m.Kind == f.Kind) &&
+		(f.From.IsZero() || !m.MeasuredAt.Before(f.From)) &&
+		(f.To.IsZero() || m.MeasuredAt.Before(f.To))
+}
+
+// NewMemoryMeasurementStore creates a MeasurementStore that is held in memory only
+func NewMemoryMeasurementStore() MeasurementStore {
+	return &measurementStore{items: newMemoryCollection[Measurement]("measurements", measurementId)}
+}
+
+// OpenFileMeasurementStore opens (or creates) a file-backed MeasurementStore in the given directory
+func OpenFileMeasurementStore(dir string) (MeasurementStore, error) {
+	c, err := openFileCollection[Measurement](dir, "measurements", measurementId)
+	if err != nil {
+		return nil, err
+	}
+	return &measurementStore{items: c}, nil
+}
+
+func measurementId(m *Measurement) *string {
+	return &m.Id
+}
+
+type measurementStore struct {
+	items *collection[Measurement]
+}
+
+func (s *measurementStore) List(ctx context.Context, filter MeasurementFilter) ([]Measurement, error) {
+	return s.items.list(ctx, filter.matches)
+}
+
+func (s *measurementStore) Get(ctx context.Context, id string) (Measurement, error) {
+	return s.items.get(ctx, id)
+}
+
+func (s *measurementStore) Create(ctx context.Context, measurement Measurement) (Measurement, error) {
+	return s.items.create(ctx, measurement, nil)
+}
+
+func (s *measurementStore) Update(ctx context.Context, measurement Measurement) (Measurement, error) {
+	return s.items.update(ctx, measurement, nil)
+}
+
+func (s *measurementStore) Delete(ctx context.Context, id string) error {
+	return s.items.delete(ctx, id)
+}
+
+func (s *measurementStore) DeleteUserMeasurements(ctx context.Context, userId string) error {
+	_, err := s.items.deleteWhere(ctx, func(existing Measurement) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *measurementStore) Ping(ctx context.Context) error {
+	return s.items.ping(ctx)
+}
+
+func (s *measurementStore) Close() error {
+	return s.items.close()
+}
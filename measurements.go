@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type Measurement struct {
+	Id            string    `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId        string    `json:"userId" oas:"description: db oid of the User (from the path - ignored on input)"`
+	Kind          string    `json:"kind" oas:"$ref: MeasurementKind, required"`
+	MeasuredAt    time.Time `json:"measuredAt" oas:"description: when the measurement was taken, required"`
+	Value         float64   `json:"value" oas:"description: the measured value in the unit, required, minimum: 0, exclusiveMinimum: true"`
+	Unit          string    `json:"unit,omitempty" oas:"$ref: MeasurementUnit, description: unit of the value (defaults to the unit of the kind in the request units)"`
+	Notes         string    `json:"notes,omitempty" oas:"description: free text notes, maxLength: 2000"`
+	MovingAverage *float64  `json:"movingAverage,omitempty" oas:"description: mean value of the measurements of the kind in the window up to and including this one (in lists only - ignored on input)"`
+}
+
+const (
+	measurementBodyweight = "bodyweight"
+	measurementBodyFat    = "body_fat"
+	unitKg                = "kg"
+	unitLb                = "lb"
+	unitCm                = "cm"
+	unitIn                = "in"
+	unitPercent           = "percent"
+	cmPerInch             = 2.54
+	defaultAverageWindow  = 7
+	maxAverageWindow      = 90
+)
+
+// MeasurementKinds are the kinds of body measurement (the others are circumferences)
+var MeasurementKinds = []string{
+	measurementBodyFat, measurementBodyweight, "calf", "chest", "forearm", "hips", "neck", "shoulders", "thigh", "upper_arm", "waist",
+}
+
+// MeasurementUnits are the units of body measurements
+var MeasurementUnits = []string{unitCm, unitIn, unitKg, unitLb, unitPercent}
+
+var measurementAccess = allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true})
+
+var MeasurementsPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getMeasurements,
+			OperationId: "listMeasurements",
+			Extensions:  measurementAccess,
+			QueryParams: measurementListing.queryParams(
+				unitsParam,
+				chioas.QueryParam{
+					Name:        "kind",
+					Description: "Only measurements of this kind",
+					SchemaRef:   "MeasurementKind",
+				},
+				chioas.QueryParam{
+					Name:        "from",
+					Description: "Only measurements taken at or after this date-time (or date)",
+					Example:     "2024-07-01T00:00:00Z",
+				},
+				chioas.QueryParam{
+					Name:        "to",
+					Description: "Only measurements taken before this date-time (or date)",
+					Example:     "2024-08-01T00:00:00Z",
+				},
+				chioas.QueryParam{
+					Name:        "window",
+					Description: "Days of the moving average of each measurement (measurements before from still count towards it)",
+					Schema: &chioas.Schema{
+						Type:    "integer",
+						Default: defaultAverageWindow,
+					},
+				},
+			),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of Measurements",
+					IsArray:     true,
+					SchemaRef:   "Measurement",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postMeasurement,
+			OperationId: "createMeasurement",
+			Extensions:  measurementAccess,
+			QueryParams: chioas.QueryParams{unitsParam},
+			Request: &chioas.Request{
+				Description: "Measurement to create (any _id and userId are ignored - values in lb or in are stored in kg or cm)",
+				Required:    true,
+				SchemaRef:   "Measurement",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created Measurement",
+					SchemaRef:   "Measurement",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{measurementId}": {
+			PathParams: chioas.PathParams{
+				"measurementId": {
+					Description: "Measurement db oid",
+					Example:     "66971add3abcef545e644020",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getMeasurement,
+					OperationId: "getMeasurement",
+					Extensions:  measurementAccess,
+					QueryParams: chioas.QueryParams{unitsParam},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Measurement",
+							SchemaRef:   "Measurement",
+						},
+					},
+				},
+				http.MethodPut: {
+					Handler:     putMeasurement,
+					OperationId: "replaceMeasurement",
+					Extensions:  measurementAccess,
+					QueryParams: chioas.QueryParams{unitsParam},
+					Request: &chioas.Request{
+						Description: "Replacement Measurement (any _id and userId are ignored)",
+						Required:    true,
+						SchemaRef:   "Measurement",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Measurement",
+							SchemaRef:   "Measurement",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteMeasurement,
+					OperationId: "deleteMeasurement",
+					Extensions:  measurementAccess,
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Measurement deleted",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var MeasurementSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Measurement",
+		Description: "A body measurement of a User - bodyweight in kg (or lb) - body_fat in percent - circumferences in cm (or in)",
+		Comment:     chioas.SourceComment(),
+	}).Must(Measurement{
+		Id:         "66971add3abcef545e644020",
+		UserId:     "66971add3abcef545e64400b",
+		Kind:       measurementBodyweight,
+		MeasuredAt: time.Date(2024, 7, 1, 7, 30, 0, 0, time.UTC),
+		Value:      82.4,
+		Unit:       unitKg,
+	}),
+	enumSchema("MeasurementKind", "A kind of body measurement (the kinds other than bodyweight and body_fat are circumferences)", MeasurementKinds),
+	enumSchema("MeasurementUnit", "Unit of a body measurement (defaults to kg for bodyweight - percent for body_fat - cm for circumferences)", MeasurementUnits),
+}
+
+var measurementListing = listing[Measurement]{
+	id: func(m Measurement) string { return m.Id },
+	fields: sortFields[Measurement]{
+		"_id":        func(m Measurement) string { return m.Id },
+		"measuredAt": func(m Measurement) string { return sortKeyTime(m.MeasuredAt) },
+	},
+	defaultSort: "-measuredAt",
+}
+
+// measurements is the store used by the measurement handlers (replaced by a file-backed store in main)
+var measurements = NewMemoryMeasurementStore()
+
+func getMeasurements(writer http.ResponseWriter, request *http.Request) {
+	userId := chi.URLParam(request, "id")
+	if _, err := users.Get(request.Context(), userId); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	q := request.URL.Query()
+	window := defaultAverageWindow
+	if v := q.Get("window"); v != "" {
+		var err error
+		if window, err = strconv.Atoi(v); err != nil || window < 1 || window > maxAverageWindow {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"window\" must be an integer from 1 to %d", maxAverageWindow))
+			return
+		}
+	}
+	from, err := queryTime(request, "from")
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	to, err := queryTime(request, "to")
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	// earlier measurements count towards the moving averages - so the range is only applied afterwards
+	all, err := measurements.List(request.Context(), MeasurementFilter{UserId: userId, Kind: q.Get("kind"), To: to})
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	movingAverages(all, time.Duration(window)*24*time.Hour)
+	result := slices.DeleteFunc(all, func(m Measurement) bool {
+		return m.MeasuredAt.Before(from)
+	})
+	if result, err = measurementListing.paginate(writer, request, result); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).measurements(result)
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postMeasurement(writer http.ResponseWriter, request *http.Request) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var measurement Measurement
+	if err = decodeJson(request, &measurement); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	measurement.UserId = user.Id
+	if err = checkMeasurement(&measurement, unitsFrom(request.Context())); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if measurement, err = measurements.Create(request.Context(), measurement); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+measurement.Id)
+	unitsFrom(request.Context()).measurement(&measurement)
+	writeJson(writer, request, http.StatusCreated, measurement)
+}
+
+func getMeasurement(writer http.ResponseWriter, request *http.Request) {
+	measurement, err := userMeasurement(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).measurement(&measurement)
+	writeJson(writer, request, http.StatusOK, measurement)
+}
+
+func putMeasurement(writer http.ResponseWriter, request *http.Request) {
+	existing, err := userMeasurement(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var measurement Measurement
+	if err = decodeJson(request, &measurement); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	measurement.Id, measurement.UserId = existing.Id, existing.UserId
+	if err = checkMeasurement(&measurement, unitsFrom(request.Context())); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if measurement, err = measurements.Update(request.Context(), measurement); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).measurement(&measurement)
+	writeJson(writer, request, http.StatusOK, measurement)
+}
+
+func deleteMeasurement(writer http.ResponseWriter, request *http.Request) {
+	measurement, err := userMeasurement(request)
+	if err == nil {
+		err = measurements.Delete(request.Context(), measurement.Id)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// userMeasurement gets the path measurement - which must be of the path user
+func userMeasurement(request *http.Request) (Measurement, error) {
+	id := chi.URLParam(request, "measurementId")
+	measurement, err := measurements.Get(request.Context(), id)
+	if err == nil && measurement.UserId != chi.URLParam(request, "id") {
+		err = fmt.Errorf("measurement %q %w", id, ErrNotFound)
+	}
+	return measurement, err
+}
+
+// measurementUnits are the units each kind of measurement may be in (the first is the stored unit)
+func measurementUnits(kind string) []string {
+	switch kind {
+	case measurementBodyweight:
+		return []string{unitKg, unitLb}
+	case measurementBodyFat:
+		return []string{unitPercent}
+	}
+	return []string{unitCm, unitIn}
+}
+
+// checkMeasurement performs the checks that can't be expressed in the Measurement schema - and converts
+// the value to the stored unit of its kind (a missing unit is that of the kind in the request units)
+func checkMeasurement(measurement *Measurement, u units) error {
+	measurement.MovingAverage = nil
+	units := measurementUnits(measurement.Kind)
+	if measurement.Unit == "" {
+		measurement.Unit = u.measurementUnit(measurement.Kind)
+	}
+	errs := make([]FieldError, 0)
+	if !slices.Contains(units, measurement.Unit) {
+		errs = append(errs, FieldError{Path: "unit", Message: fmt.Sprintf("must be %s for %s", orList(units), measurement.Kind)})
+	} else if measurement.Kind == measurementBodyFat && measurement.Value >= 100 {
+		errs = append(errs, FieldError{Path: "value", Message: "must be less than 100"})
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "measurement failed validation")
+		p.Errors = errs
+		return p
+	}
+	switch measurement.Unit {
+	case unitLb:
+		measurement.Value = roundStored(measurement.Value * kgPerLb)
+	case unitIn:
+		measurement.Value = roundStored(measurement.Value * cmPerInch)
+	}
+	measurement.Unit = units[0]
+	return nil
+}
+
+// orList lists alternatives (e.g. "kg or lb")
+func orList(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return fmt.Sprintf("%s or %s", values[0], values[1])
+}
+
+// movingAverages sets the moving average of each measurement - the mean of the measurements of the same
+// kind taken in the window up to and including it
+func movingAverages(ms []Measurement, window time.Duration) {
+	byKind := map[string][]int{}
+	for i, m := range ms {
+		byKind[m.Kind] = append(byKind[m.Kind], i)
+	}
+	for _, indices := range byKind {
+		sort.SliceStable(indices, func(i, j int) bool {
+			return ms[indices[i]].MeasuredAt.Before(ms[indices[j]].MeasuredAt)
+		})
+		start, total := 0, 0.0
+		for end, i := range indices {
+			total += ms[i].Value
+			for !ms[indices[start]].MeasuredAt.After(ms[i].MeasuredAt.Add(-window)) {
+				total -= ms[indices[start]].Value
+				start++
+			}
+			avg := math.Round(total/float64(end-start+1)*100) / 100
+			ms[i].MovingAverage = &avg
+		}
+	}
+}
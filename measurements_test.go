@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMovingAverages(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC).AddDate(0, 0, d) }
+	ms := []Measurement{
+		{Kind: measurementBodyweight, MeasuredAt: day(7), Value: 84},
+		{Kind: measurementBodyweight, MeasuredAt: day(0), Value: 80},
+		{Kind: "waist", MeasuredAt: day(1), Value: 90},
+		{Kind: measurementBodyweight, MeasuredAt: day(3), Value: 82},
+		{Kind: measurementBodyweight, MeasuredAt: day(7).Add(-time.Second), Value: 83},
+		{Kind: measurementBodyweight, MeasuredAt: day(20), Value: 79},
+	}
+	movingAverages(ms, 7*24*time.Hour)
+	// a measurement exactly the window before is out of the window - one a second later is in it
+	for i, want := range []float64{83, 80, 90, 81, 81.67, 79} {
+		if got := ms[i].MovingAverage; got == nil || *got != want {
+			t.Errorf("measurement %d moving average %v, want %v", i, deref(got), want)
+		}
+	}
+}
+
+func TestCheckMeasurement(t *testing.T) {
+	for name, tc := range map[string]struct {
+		measurement Measurement
+		u           units
+		want        float64
+		wantErr     bool
+	}{
+		"kg":                        {Measurement{Kind: measurementBodyweight, Value: 80}, metricUnits, 80, false},
+		"lb":                        {Measurement{Kind: measurementBodyweight, Value: 180, Unit: unitLb}, metricUnits, 81.6466, false},
+		"imperial default lb":       {Measurement{Kind: measurementBodyweight, Value: 180}, imperialUnits, 81.6466, false},
+		"imperial with kg":          {Measurement{Kind: measurementBodyweight, Value: 80, Unit: unitKg}, imperialUnits, 80, false},
+		"in":                        {Measurement{Kind: "waist", Value: 32.5, Unit: unitIn}, metricUnits, 82.55, false},
+		"imperial default in":       {Measurement{Kind: "waist", Value: 32.5}, imperialUnits, 82.55, false},
+		"body fat":                  {Measurement{Kind: measurementBodyFat, Value: 15}, imperialUnits, 15, false},
+		"body fat of 100":           {Measurement{Kind: measurementBodyFat, Value: 100}, metricUnits, 0, true},
+		"circumference in kg":       {Measurement{Kind: "waist", Value: 80, Unit: unitKg}, metricUnits, 0, true},
+		"bodyweight in cm":          {Measurement{Kind: measurementBodyweight, Value: 80, Unit: unitCm}, metricUnits, 0, true},
+		"body fat in a weight unit": {Measurement{Kind: measurementBodyFat, Value: 15, Unit: unitLb}, metricUnits, 0, true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			m := tc.measurement
+			m.MovingAverage = ptr(1.0)
+			err := checkMeasurement(&m, tc.u)
+			var p *Problem
+			if tc.wantErr {
+				if !errors.As(err, &p) || len(p.Errors) != 1 {
+					t.Errorf("error %v, want a validation problem", err)
+				}
+				return
+			}
+			if err != nil || m.Value != tc.want || m.Unit != measurementUnits(m.Kind)[0] || m.MovingAverage != nil {
+				t.Errorf("value %v %s (average %v) %v, want %v", m.Value, m.Unit, m.MovingAverage, err, tc.want)
+			}
+		})
+	}
+	// what is stored converts back to what was sent
+	m := Measurement{Kind: measurementBodyweight, Value: 180.4}
+	_ = checkMeasurement(&m, imperialUnits)
+	imperialUnits.measurement(&m)
+	if m.Value != 180.4 || m.Unit != unitLb {
+		t.Errorf("round trip to %v %s", m.Value, m.Unit)
+	}
+}
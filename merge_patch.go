@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+const contentTypeMergePatch = "application/merge-patch+json"
+
+// applyMergePatch applies a JSON Merge Patch (RFC 7396) to target (a ptr to the resource)
+//
+// The target is round-tripped through its JSON representation, so only json tagged fields are patchable
+func applyMergePatch(target any, patch []byte) error {
+	var p any
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return err
+	}
+	if _, ok := p.(map[string]any); !ok {
+		return errors.New("merge patch must be a JSON object")
+	}
+	data, err := json.Marshal(target)
+	if err != nil {
+		return err
+	}
+	var doc any
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(mergePatch(doc, p)); err != nil {
+		return err
+	}
+	// zero the target first so that members removed by the patch don't survive the unmarshal
+	reflect.ValueOf(target).Elem().SetZero()
+	return json.Unmarshal(data, target)
+}
+
+func mergePatch(target any, patch any) any {
+	pm, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]any)
+	if !ok {
+		tm = map[string]any{}
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = mergePatch(tm[k], v)
+		}
+	}
+	return tm
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5/middleware"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// contentTypeMetrics is the Prometheus text exposition format
+const contentTypeMetrics = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric is a metric family that can be written in the Prometheus text exposition format
+type metric interface {
+	write(w io.Writer)
+}
+
+// metricsRegistry is the set of metric families served at /metrics
+type metricsRegistry struct {
+	mutex   sync.Mutex
+	metrics []metric
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *metricsRegistry) write(w io.Writer) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// metricLabels are the label names of a metric family - label values are given in the same order
+type metricLabels []string
+
+func (l metricLabels) format(values []string, extra ...string) string {
+	if len(l) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(l)+1)
+	for i, name := range l {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// counterVec is a counter metric family partitioned by labels
+type counterVec struct {
+	name   string
+	help   string
+	labels metricLabels
+	mutex  sync.Mutex
+	values map[string]*labelledValue
+}
+
+type labelledValue struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(r *metricsRegistry, name string, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]*labelledValue{}}
+	r.register(c)
+	return c
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	lv, ok := c.values[key]
+	if !ok {
+		lv = &labelledValue{labels: labelValues}
+		c.values[key] = lv
+	}
+	lv.value += v
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		lv := c.values[key]
+		_, _ = fmt.Fprintf(w, "%s%s %s\n", c.name, c.labels.format(lv.labels), formatMetricValue(lv.value))
+	}
+}
+
+// histogramVec is a histogram metric family partitioned by labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  metricLabels
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // per bucket (not cumulative)
+	count  uint64
+	sum    float64
+}
+
+// defaultDurationBuckets are the histogram buckets (in seconds) for request and store latencies
+var defaultDurationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func newHistogramVec(r *metricsRegistry, name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogramValue{}}
+	r.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, key := range sortedKeys(h.values) {
+		hv := h.values[key]
+		cumulative := uint64(0)
+		for i, le := range h.buckets {
+			cumulative += hv.counts[i]
+			_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels.format(hv.labels, "le", formatMetricValue(le)), cumulative)
+		}
+		_, _ = fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels.format(hv.labels, "le", "+Inf"), hv.count)
+		_, _ = fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels.format(hv.labels), formatMetricValue(hv.sum))
+		_, _ = fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels.format(hv.labels), hv.count)
+	}
+}
+
+// gaugeFunc is an unlabelled gauge (or counter) whose value is read at scrape time
+type gaugeFunc struct {
+	name  string
+	help  string
+	kind  string
+	value func() float64
+}
+
+func newGaugeFunc(r *metricsRegistry, name string, help string, value func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, kind: "gauge", value: value})
+}
+
+func newCounterFunc(r *metricsRegistry, name string, help string, value func() float64) {
+	r.register(&gaugeFunc{name: name, help: help, kind: "counter", value: value})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", g.name, g.help, g.name, g.kind, g.name, formatMetricValue(g.value()))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// metrics is the registry of all the api metrics
+var metrics = &metricsRegistry{}
+
+var (
+	httpRequests = newCounterVec(metrics, "http_requests_total",
+		"Total http requests by method, chi route pattern and status code", "method", "route", "status")
+	httpRequestDuration = newHistogramVec(metrics, "http_request_duration_seconds",
+		"Http request latency by method and chi route pattern", defaultDurationBuckets, "method", "route")
+	httpRequestsInFlight atomic.Int64
+	storeOperations      = newCounterVec(metrics, "store_operations_total",
+		"Total store operations by collection, operation and result (ok, not_found, conflict or error)", "collection", "operation", "result")
+	storeOperationDuration = newHistogramVec(metrics, "store_operation_duration_seconds",
+		"Store operation latency by collection and operation", defaultDurationBuckets, "collection", "operation")
+)
+
+func init() {
+	newGaugeFunc(metrics, "http_requests_in_flight", "Http requests currently being served", func() float64 {
+		return float64(httpRequestsInFlight.Load())
+	})
+	registerRuntimeMetrics(metrics)
+}
+
+// registerRuntimeMetrics registers the Go runtime and process metrics
+func registerRuntimeMetrics(r *metricsRegistry) {
+	var (
+		mutex    sync.Mutex
+		stats    runtime.MemStats
+		readAt   time.Time
+		memStats = func() *runtime.MemStats {
+			// a scrape reads many stats - only stop the world once per scrape
+			mutex.Lock()
+			defer mutex.Unlock()
+			if time.Since(readAt) > time.Second {
+				runtime.ReadMemStats(&stats)
+				readAt = time.Now()
+			}
+			return &stats
+		}
+	)
+	newGaugeFunc(r, "go_goroutines", "Number of goroutines", func() float64 { return float64(runtime.NumGoroutine()) })
+	newGaugeFunc(r, "go_threads", "Number of OS threads created", func() float64 {
+		n, _ := runtime.ThreadCreateProfile(nil)
+		return float64(n)
+	})
+	newGaugeFunc(r, "go_memstats_alloc_bytes", "Bytes of allocated heap objects", func() float64 { return float64(memStats().HeapAlloc) })
+	newGaugeFunc(r, "go_memstats_heap_inuse_bytes", "Bytes in in-use heap spans", func() float64 { return float64(memStats().HeapInuse) })
+	newGaugeFunc(r, "go_memstats_sys_bytes", "Bytes of memory obtained from the OS", func() float64 { return float64(memStats().Sys) })
+	newCounterFunc(r, "go_memstats_mallocs_total", "Total heap objects allocated", func() float64 { return float64(memStats().Mallocs) })
+	newCounterFunc(r, "go_gc_cycles_total", "Completed GC cycles", func() float64 { return float64(memStats().NumGC) })
+	newCounterFunc(r, "go_gc_pause_seconds_total", "Total GC stop-the-world pause time", func() float64 {
+		return float64(memStats().PauseTotalNs) / float64(time.Second)
+	})
+	newGaugeFunc(r, "process_start_time_seconds", "Start time of the process since the unix epoch", func() float64 {
+		return float64(startedAt.UnixNano()) / float64(time.Second)
+	})
+}
+
+// MetricsPath serves the Prometheus metrics - hidden from the spec
+var MetricsPath = chioas.Path{
+	HideDocs: true,
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:          getMetrics,
+			OperationId:      "metrics",
+			OptionalSecurity: true,
+		},
+	},
+}
+
+func getMetrics(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", contentTypeMetrics)
+	writer.Header().Set("Cache-Control", "no-store")
+	metrics.write(writer)
+}
+
+// recordMetrics is middleware recording the http RED metrics - labelled by chi route pattern
+// (rather than the raw path) so that ids in paths don't create a metric series per resource
+func recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		httpRequestsInFlight.Add(1)
+		defer httpRequestsInFlight.Add(-1)
+		ww := middleware.NewWrapResponseWriter(writer, request.ProtoMajor)
+		next.ServeHTTP(ww, request)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routePattern(request)
+		httpRequests.inc(request.Method, route, strconv.Itoa(status))
+		httpRequestDuration.observe(time.Since(start).Seconds(), request.Method, route)
+	})
+}
+
+// observeStoreOp records the metrics of a finished store operation (see startStoreOp)
+func observeStoreOp(collection string, op string, start time.Time, err *error) {
+	result := "ok"
+	switch {
+	case *err == nil:
+	case errors.Is(*err, ErrNotFound):
+		result = "not_found"
+	case errors.Is(*err, ErrConflict):
+		result = "conflict"
+	default:
+		result = "error"
+	}
+	storeOperations.inc(collection, op, result)
+	storeOperationDuration.observe(time.Since(start).Seconds(), collection, op)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	r := &metricsRegistry{}
+	c := newCounterVec(r, "things_total", "Total things", "kind", "note")
+	c.inc("b", "plain")
+	c.add(2.5, "a", `say "hi"\`+"\n")
+	c.inc("b", "plain")
+	var sb strings.Builder
+	r.write(&sb)
+	want := `# HELP things_total Total things
+# TYPE things_total counter
+things_total{kind="a",note="say \"hi\"\\\n"} 2.5
+things_total{kind="b",note="plain"} 2
+`
+	if sb.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := &metricsRegistry{}
+	h := newHistogramVec(r, "latency_seconds", "Latency", []float64{0.1, 1}, "route")
+	// bucket bounds are inclusive - and values past the last bucket only count towards +Inf
+	for _, v := range []float64{0.05, 0.1, 0.5, 5} {
+		h.observe(v, "/things")
+	}
+	h.observe(1, "/other")
+	var sb strings.Builder
+	r.write(&sb)
+	want := `# HELP latency_seconds Latency
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/other",le="0.1"} 0
+latency_seconds_bucket{route="/other",le="1"} 1
+latency_seconds_bucket{route="/other",le="+Inf"} 1
+latency_seconds_sum{route="/other"} 1
+latency_seconds_count{route="/other"} 1
+latency_seconds_bucket{route="/things",le="0.1"} 2
+latency_seconds_bucket{route="/things",le="1"} 3
+latency_seconds_bucket{route="/things",le="+Inf"} 4
+latency_seconds_sum{route="/things"} 5.65
+latency_seconds_count{route="/things"} 4
+`
+	if sb.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := &metricsRegistry{}
+	v := 3.0
+	newGaugeFunc(r, "level", "Current level", func() float64 { return v })
+	newCounterFunc(r, "ticks_total", "Total ticks", func() float64 { return math.Inf(1) })
+	v = 4
+	var sb strings.Builder
+	r.write(&sb)
+	want := `# HELP level Current level
+# TYPE level gauge
+level 4
+# HELP ticks_total Total ticks
+# TYPE ticks_total counter
+ticks_total +Inf
+`
+	if sb.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", sb.String(), want)
+	}
+}
+
+var (
+	metricCommentLine = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) .+$`)
+	metricSampleLine  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*"(?:,[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*")*\})? (\S+)$`)
+)
+
+// scrapeMetrics gets /metrics - checking that it is in the text exposition format - and returns the
+// sample values by series
+func scrapeMetrics(t *testing.T, handler http.Handler) map[string]float64 {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != contentTypeMetrics {
+		t.Fatalf("/metrics responded %d %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	samples := map[string]float64{}
+	typed := map[string]string{}
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := metricCommentLine.FindStringSubmatch(line); m != nil {
+			if m[1] == "TYPE" {
+				typed[m[2]] = strings.Fields(line)[3]
+			}
+			continue
+		}
+		m := metricSampleLine.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("line %q is not in the text format", line)
+			continue
+		}
+		family := m[1]
+		if _, ok := typed[family]; !ok {
+			family = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(family, "_bucket"), "_sum"), "_count")
+		}
+		if _, ok := typed[family]; !ok {
+			t.Errorf("sample %q has no TYPE before it", line)
+		}
+		v, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			t.Errorf("sample %q has an invalid value", line)
+		}
+		samples[m[1]+m[2]] = v
+	}
+	return samples
+}
+
+func TestMetricsRoutePatterns(t *testing.T) {
+	handler := testRouter(t)
+	const series = `http_requests_total{method="GET",route="/users/{id}",status="401"}`
+	before := scrapeMetrics(t, handler)
+	for _, id := range []string{"000000000000000000000001", "000000000000000000000002"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/users/"+id, nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/no/such/path", nil))
+	after := scrapeMetrics(t, handler)
+	if got := after[series] - before[series]; got != 2 {
+		t.Errorf("%s went up by %v, want 2", series, got)
+	}
+	if got := after[`http_requests_total{method="GET",route="/*",status="404"}`]; got < 1 {
+		t.Errorf("requests for unknown paths counted %v times", got)
+	}
+	for s := range after {
+		if strings.Contains(s, "000000000000000000000001") || strings.Contains(s, "/no/such/path") {
+			t.Errorf("series %s is labelled with a raw path", s)
+		}
+	}
+	const count = `http_request_duration_seconds_count{method="GET",route="/users/{id}"}`
+	if got := after[count] - before[count]; got != 2 {
+		t.Errorf("%s went up by %v, want 2", count, got)
+	}
+	for _, name := range []string{"go_goroutines", "go_memstats_alloc_bytes", "http_requests_in_flight", "process_start_time_seconds"} {
+		if _, ok := after[name]; !ok {
+			t.Errorf("no %s sample", name)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// migration upgrades the data files in a data dir - migrations are applied in order
+// (each only once) before the stores are opened
+type migration struct {
+	name  string
+	apply func(dir string) error
+}
+
+// migrations are all the data migrations (append only - names must never change)
+var migrations = []migration{
+	{
+		// users created before roles existed become athletes
+		name: "0001-user-roles",
+		apply: func(dir string) error {
+			return migrateCollection(dir, "users", func(item map[string]any) error {
+				if item["roles"] == nil {
+					item["roles"] = []string{roleAthlete}
+				}
+				if item["coaches"] == nil {
+					item["coaches"] = []string{}
+				}
+				return nil
+			})
+		},
+	},
+	{
+		// activity samples move out of the activities collection into a file per activity
+		name: "0002-activity-samples",
+		apply: func(dir string) error {
+			samplesDir := filepath.Join(dir, activitySamplesName)
+			if err := os.MkdirAll(samplesDir, 0o755); err != nil {
+				return err
+			}
+			return migrateCollection(dir, "activities", func(item map[string]any) error {
+				samples := map[string]any{}
+				for _, name := range []string{"heartRate", "track"} {
+					if v, ok := item[name]; ok {
+						samples[name] = v
+						delete(item, name)
+					}
+				}
+				id, _ := item["_id"].(string)
+				if len(samples) == 0 || id == "" {
+					return nil
+				}
+				return writeJsonFile(filepath.Join(samplesDir, id+".json"), samples)
+			})
+		},
+	},
+}
+
+// appliedMigration is a record of migrations.json
+type appliedMigration struct {
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+const migrationsFile = "migrations.json"
+
+// migrate applies any pending migrations to the data dir
+func migrate(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(dir)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if slices.ContainsFunc(applied, func(a appliedMigration) bool { return a.Name == m.name }) {
+			continue
+		}
+		slog.Info("applying migration", "migration", m.name)
+		if err = m.apply(dir); err != nil {
+			return fmt.Errorf("migration %s: %w", m.name, err)
+		}
+		applied = append(applied, appliedMigration{Name: m.name, AppliedAt: time.Now().UTC()})
+		if err = writeJsonFile(filepath.Join(dir, migrationsFile), applied); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingMigrations returns the names of migrations not yet applied to the data dir
+func pendingMigrations(dir string) ([]string, error) {
+	applied, err := appliedMigrations(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]string, 0)
+	for _, m := range migrations {
+		if !slices.ContainsFunc(applied, func(a appliedMigration) bool { return a.Name == m.name }) {
+			result = append(result, m.name)
+		}
+	}
+	return result, nil
+}
+
+func appliedMigrations(dir string) ([]appliedMigration, error) {
+	result := make([]appliedMigration, 0)
+	data, err := os.ReadFile(filepath.Join(dir, migrationsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return result, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("%s: %w", migrationsFile, err)
+	}
+	return result, nil
+}
+
+// migrateCollection rewrites each item of a collection file (if it exists)
+func migrateCollection(dir string, name string, fn func(item map[string]any) error) error {
+	file := filepath.Join(dir, name+".json")
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var items []map[string]any
+	if err = json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	for _, item := range items {
+		if err = fn(item); err != nil {
+			return err
+		}
+	}
+	return writeJsonFile(file, items)
+}
+
+// writeJsonFile writes v as indented json - via a synced temp file and rename (then syncing the directory, so
+// that the rename itself is durable), so a crash never leaves a half-written or empty file
+func writeJsonFile(file string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err = errors.Join(err, f.Close()); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err = os.Rename(tmp, file); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(file))
+}
+
+// syncDir flushes a directory's entries (e.g. a rename within it) to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	return errors.Join(d.Sync(), d.Close())
+}
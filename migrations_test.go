@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteJsonFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "things.json")
+	for _, v := range [][]string{{"a", "b"}, {"c"}} {
+		if err := writeJsonFile(file, v); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		if data, err := os.ReadFile(file); err != nil || json.Unmarshal(data, &got) != nil || len(got) != len(v) || got[0] != v[0] {
+			t.Errorf("read back %v %v, want %v", got, err, v)
+		}
+	}
+	// the temp file is renamed over the file - never left behind
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files in the dir, want 1", len(entries))
+	}
+	if err := writeJsonFile(filepath.Join(dir, "missing", "things.json"), []string{}); err == nil {
+		t.Errorf("wrote into a missing dir")
+	}
+	if err := writeJsonFile(file, func() {}); err == nil {
+		t.Errorf("wrote an unencodable value")
+	}
+	if data, _ := os.ReadFile(file); string(data) != "[\n  \"c\"\n]" {
+		t.Errorf("failed writes changed the file to %q", data)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"net/http"
+)
+
+const contentTypeProblem = "application/problem+json"
+
+// Problem is an RFC 7807 problem details error response
+//
+// Problem implements error, so handlers (and stores) can return one to control exactly what the client sees
+type Problem struct {
+	Type     string       `json:"type" oas:"description: URI reference identifying the problem type"`
+	Title    string       `json:"title" oas:"description: short human-readable summary of the problem type"`
+	Status   int          `json:"status" oas:"description: the http status code"`
+	Detail   string       `json:"detail,omitempty" oas:"description: human-readable explanation specific to this occurrence"`
+	Instance string       `json:"instance,omitempty" oas:"description: URI reference identifying this occurrence (the request path)"`
+	Errors   []FieldError `json:"errors,omitempty" oas:"description: per-field errors (for validation problems)"`
+}
+
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Title + ": " + p.Detail
+	}
+	return p.Title
+}
+
+// newProblem creates a Problem for the status, with an optional formatted detail
+func newProblem(status int, format string, args ...any) *Problem {
+	p := &Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+	}
+	if format != "" {
+		p.Detail = fmt.Sprintf(format, args...)
+	}
+	return p
+}
+
+// asProblem maps any error to a Problem
+//
+// Internal errors are deliberately not described to the client
+func asProblem(err error) *Problem {
+	var p *Problem
+	switch {
+	case errors.As(err, &p):
+		cp := *p
+		return &cp
+	case errors.Is(err, ErrNotFound):
+		return newProblem(http.StatusNotFound, "%s", err.Error())
+	case errors.Is(err, ErrConflict):
+		return newProblem(http.StatusConflict, "%s", err.Error())
+	case errors.Is(err, ErrStoreClosed):
+		return newProblem(http.StatusServiceUnavailable, "server is shutting down")
+	}
+	return newProblem(http.StatusInternalServerError, "")
+}
+
+// writeError writes any error as an application/problem+json response
+func writeError(writer http.ResponseWriter, request *http.Request, err error) {
+	p := asProblem(err)
+	p.Instance = request.URL.Path
+	if p.Status == http.StatusInternalServerError {
+		loggerFrom(request.Context()).Error("internal error", "error", err)
+	}
+	data, mErr := json.Marshal(p)
+	if mErr != nil {
+		loggerFrom(request.Context()).Error("encoding problem", "error", mErr)
+		data = []byte(`{"type":"about:blank","title":"Internal Server Error","status":500}`)
+		p.Status = http.StatusInternalServerError
+	}
+	writer.Header().Set("Content-Type", contentTypeProblem)
+	writer.WriteHeader(p.Status)
+	if _, wErr := writer.Write(append(data, '\n')); wErr != nil {
+		loggerFrom(request.Context()).Warn("writing response", "error", wErr)
+	}
+}
+
+// writeJson writes a JSON response - encoding first, so that an encoding failure can still be reported as a problem
+func writeJson(writer http.ResponseWriter, request *http.Request, status int, result any) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(result); err != nil {
+		writeError(writer, request, fmt.Errorf("encoding response: %w", err))
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	if _, err := writer.Write(buf.Bytes()); err != nil {
+		loggerFrom(request.Context()).Warn("writing response", "error", err)
+	}
+}
+
+// decodeJson decodes a JSON request body into v - reporting failures as a 400 problem
+func decodeJson(request *http.Request, v any) error {
+	if err := json.NewDecoder(request.Body).Decode(v); err != nil {
+		return newProblem(http.StatusBadRequest, "invalid JSON body: %s", err.Error())
+	}
+	return nil
+}
+
+// recoverProblems is middleware that turns handler panics into a 500 problem response
+func recoverProblems(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		defer func() {
+			if rvr := recover(); rvr != nil {
+				if rvr == http.ErrAbortHandler {
+					panic(rvr)
+				}
+				writeError(writer, request, fmt.Errorf("panic: %v", rvr))
+			}
+		}()
+		next.ServeHTTP(writer, request)
+	})
+}
+
+func notFound(writer http.ResponseWriter, request *http.Request) {
+	writeError(writer, request, newProblem(http.StatusNotFound, "no such resource"))
+}
+
+func methodNotAllowed(writer http.ResponseWriter, request *http.Request) {
+	writeError(writer, request, newProblem(http.StatusMethodNotAllowed, "method %s not allowed", request.Method))
+}
+
+// ProblemResponses are the common (component) responses for problems
+var ProblemResponses = chioas.CommonResponses{
+	"BadRequest":          problemResponse("Malformed request (e.g. invalid JSON)"),
+	"Unauthorized":        problemResponse("Missing, invalid or expired bearer token"),
+	"Forbidden":           problemResponse("Caller is not granted access by the x-access rule of the method"),
+	"NotFound":            problemResponse("Resource not found"),
+	"Conflict":            problemResponse("Request conflicts with the current state (e.g. duplicate username)"),
+	"UnprocessableEntity": problemResponse("Request body failed validation - see errors for each failing field"),
+	"InternalServerError": problemResponse("Unexpected server error"),
+}
+
+// problemDefaultResponses is the DocOptions.DefaultResponses - referencing ProblemResponses
+var problemDefaultResponses = chioas.Responses{
+	http.StatusBadRequest:          {Ref: "BadRequest"},
+	http.StatusUnauthorized:        {Ref: "Unauthorized"},
+	http.StatusForbidden:           {Ref: "Forbidden"},
+	http.StatusNotFound:            {Ref: "NotFound"},
+	http.StatusConflict:            {Ref: "Conflict"},
+	http.StatusUnprocessableEntity: {Ref: "UnprocessableEntity"},
+	http.StatusInternalServerError: {Ref: "InternalServerError"},
+}
+
+func problemResponse(description string) chioas.Response {
+	return chioas.Response{
+		Description: description,
+		ContentType: contentTypeProblem,
+		SchemaRef:   "Problem",
+	}
+}
+
+var ProblemSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Problem",
+		Description: "An RFC 7807 problem details error",
+		Comment:     chioas.SourceComment(),
+	}).Must(Problem{}),
+}
+
+// applyDefaultResponses merges the DocOptions.DefaultResponses into the responses of every method
+//
+// chioas only documents DefaultResponses for methods that declare no responses at all - this makes
+// them apply across the whole spec (a method's own declaration for a status code takes precedence)
+func applyDefaultResponses(d *chioas.Definition) {
+	d.Methods = methodsWithResponses(d.Methods, d.DocOptions.DefaultResponses)
+	applyPathsDefaultResponses(d.Paths, d.DocOptions.DefaultResponses)
+}
+
+func applyPathsDefaultResponses(paths chioas.Paths, defaults chioas.Responses) {
+	for p, pDef := range paths {
+		pDef.Methods = methodsWithResponses(pDef.Methods, defaults)
+		applyPathsDefaultResponses(pDef.Paths, defaults)
+		paths[p] = pDef
+	}
+}
+
+func methodsWithResponses(methods chioas.Methods, defaults chioas.Responses) chioas.Methods {
+	for m, mDef := range methods {
+		responses := make(chioas.Responses, len(mDef.Responses)+len(defaults))
+		for status, r := range defaults {
+			responses[status] = r
+		}
+		for status, r := range mDef.Responses {
+			responses[status] = r
+		}
+		mDef.Responses = responses
+		methods[m] = mDef
+	}
+	return methods
+}
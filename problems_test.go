@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProblemResponses(t *testing.T) {
+	user, token := testUser(t, "problems")
+	for name, tc := range map[string]struct {
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		"unknown route":      {http.MethodGet, "/no/such/route", token, http.StatusNotFound},
+		"method not allowed": {http.MethodPatch, "/auth/register", "", http.StatusMethodNotAllowed},
+		"not found":          {http.MethodGet, "/workouts/0000000000000000000000ff", token, http.StatusNotFound},
+		"unauthorized":       {http.MethodGet, "/workouts/0000000000000000000000ff", "", http.StatusUnauthorized},
+		"bad query param":    {http.MethodGet, "/users/" + user.Id + "/load?tz=Nowhere/Place", token, http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got := call(t, tc.method, tc.path, tc.token, "")
+			p := problemOf(t, got)
+			if got.Code != tc.want || p.Status != tc.want || p.Type != "about:blank" || p.Title != http.StatusText(tc.want) || p.Instance != strings.Split(tc.path, "?")[0] {
+				t.Errorf("responded %d with %+v, want %d", got.Code, p, tc.want)
+			}
+		})
+	}
+}
+
+func TestAsProblem(t *testing.T) {
+	validation := newProblem(http.StatusUnprocessableEntity, "failed")
+	validation.Errors = []FieldError{{Path: "name", Message: "is required"}}
+	for name, tc := range map[string]struct {
+		err        error
+		want       int
+		wantDetail string
+	}{
+		"problem":         {validation, http.StatusUnprocessableEntity, "failed"},
+		"wrapped problem": {fmt.Errorf("checking: %w", validation), http.StatusUnprocessableEntity, "failed"},
+		"not found":       {fmt.Errorf("workout %q %w", "w1", ErrNotFound), http.StatusNotFound, `workout "w1" not found`},
+		"conflict":        {fmt.Errorf("username %w", ErrConflict), http.StatusConflict, "username conflict"},
+		"store closed":    {ErrStoreClosed, http.StatusServiceUnavailable, "server is shutting down"},
+		// internal errors aren't described to the client
+		"internal": {errors.New("disk on fire at /var/data"), http.StatusInternalServerError, ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := asProblem(tc.err)
+			if p.Status != tc.want || p.Title != http.StatusText(tc.want) || p.Detail != tc.wantDetail {
+				t.Errorf("problem %+v, want %d %q", p, tc.want, tc.wantDetail)
+			}
+		})
+	}
+	// the problem returned is a copy - writing it can't change the original
+	p := asProblem(validation)
+	p.Instance = "/somewhere"
+	if validation.Instance != "" || len(p.Errors) != 1 {
+		t.Errorf("original %+v copy %+v", validation, p)
+	}
+}
+
+func TestWriteProblems(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/things/1?x=1", nil)
+	rec := httptest.NewRecorder()
+	recoverProblems(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("boom")
+	})).ServeHTTP(rec, request)
+	if p := problemOf(t, rec); rec.Code != http.StatusInternalServerError || p.Status != http.StatusInternalServerError || p.Detail != "" || p.Instance != "/things/1" {
+		t.Errorf("panic responded %d with %+v", rec.Code, p)
+	}
+	// a response that can't be encoded is reported as a problem (rather than a half written response)
+	rec = httptest.NewRecorder()
+	writeJson(rec, request, http.StatusOK, map[string]float64{"value": math.NaN()})
+	if p := problemOf(t, rec); rec.Code != http.StatusInternalServerError || p.Status != http.StatusInternalServerError {
+		t.Errorf("unencodable response responded %d with %+v", rec.Code, p)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// ProgramStore is the persistence interface for programs and the enrolments of users in them
+type ProgramStore interface {
+	List(ctx context.Context, filter ProgramFilter) ([]Program, error)
+	Get(ctx context.Context, id string) (Program, error)
+	Create(ctx context.Context, program Program) (Program, error)
+	Update(ctx context.Context, program Program) (Program, error)
+	// Delete deletes a program - failing with ErrConflict while any user is enrolled in it
+	Delete(ctx context.Context, id string) error
+	ListEnrolments(ctx context.Context, filter EnrolmentFilter) ([]Enrolment, error)
+	GetEnrolment(ctx context.Context, id string) (Enrolment, error)
+	CreateEnrolment(ctx context.Context, enrolment Enrolment) (Enrolment, error)
+	DeleteEnrolment(ctx context.Context, id string) error
+	// DeleteUserEnrolments deletes all of a user's enrolments (e.g. when the user is deleted)
+	DeleteUserEnrolments(ctx context.Context, userId string) error
+	// DeleteUserPrograms deletes all of a user's programs - together with any (other user's) enrolments in them
+	DeleteUserPrograms(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// ProgramFilter filters listed programs - zero value fields are not filtered on
+type ProgramFilter struct {
+	// UserId includes the user's own programs (library programs are always included)
+	UserId string
+	// TemplateId only includes programs using the template
+	TemplateId string
+	// AllUsers includes every user's programs (ignoring UserId)
+	AllUsers bool
+}
+
+func (f ProgramFilter) matches(p Program) bool {
+	return (f.AllUsers || p.UserId == "" || p.UserId == f.UserId) &&
+		(f.TemplateId == "" || slices.ContainsFunc(p.Days, func(d ProgramDay) bool {
+			return d.TemplateId == f.TemplateId
+		}))
+}
+
+// EnrolmentFilter filters listed enrolments - zero value fields are not filtered on
+type EnrolmentFilter struct {
+	UserId    string
+	ProgramId string
+}
+
+func (f EnrolmentFilter) matches(e Enrolment) bool {
+	return (f.UserId == "" || e.UserId == f.UserId) &&
+		(f.ProgramId == "" || e.ProgramId == f.ProgramId)
+}
+
+// NewMemoryProgramStore creates a ProgramStore that is held in memory only
+func NewMemoryProgramStore() ProgramStore {
+	return &programStore{
+		programs:   newMemoryCollection[Program]("programs", programId),
+		enrolments: newMemoryCollection[Enrolment]("enrolments", enrolmentId),
+	}
+}
+
+// OpenFileProgramStore opens (or creates) a file-backed ProgramStore in the given directory
+func OpenFileProgramStore(dir string) (ProgramStore, error) {
+	programs, err := openFileCollection[Program](dir, "programs", programId)
+	if err != nil {
+		return nil, err
+	}
+	enrolments, err := openFileCollection[Enrolment](dir, "enrolments", enrolmentId)
+	if err != nil {
+		return nil, err
+	}
+	return &programStore{programs: programs, enrolments: enrolments}, nil
+}
+
+func programId(p *Program) *string {
+	return &p.Id
+}
+
+func enrolmentId(e *Enrolment) *string {
+	return &e.Id
+}
+
+type programStore struct {
+	programs   *collection[Program]
+	enrolments *collection[Enrolment]
+	// mutex serializes program deletes with enrolment creates - so no enrolment is left pointing at a deleted program
+	mutex sync.Mutex
+}
+
+func (s *programStore) List(ctx context.Context, filter ProgramFilter) ([]Program, error) {
+	return s.programs.list(ctx, filter.matches)
+}
+
+func (s *programStore) Get(ctx context.Context, id string) (Program, error) {
+	return s.programs.get(ctx, id)
+}
+
+func (s *programStore) Create(ctx context.Context, program Program) (Program, error) {
+	return s.programs.create(ctx, program, nil)
+}
+
+func (s *programStore) Update(ctx context.Context, program Program) (Program, error) {
+	return s.programs.update(ctx, program, nil)
+}
+
+func (s *programStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	enrolled, err := s.enrolments.list(ctx, EnrolmentFilter{ProgramId: id}.matches)
+	if err != nil {
+		return err
+	} else if len(enrolled) > 0 {
+		return fmt.Errorf("program %q has %d enrolments: %w", id, len(enrolled), ErrConflict)
+	}
+	return s.programs.delete(ctx, id)
+}
+
+func (s *programStore) ListEnrolments(ctx context.Context, filter EnrolmentFilter) ([]Enrolment, error) {
+	return s.enrolments.list(ctx, filter.matches)
+}
+
+func (s *programStore) GetEnrolment(ctx context.Context, id string) (Enrolment, error) {
+	return s.enrolments.get(ctx, id)
+}
+
+func (s *programStore) CreateEnrolment(ctx context.Context, enrolment Enrolment) (Enrolment, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.programs.get(ctx, enrolment.ProgramId); errors.Is(err, ErrNotFound) {
+		return enrolment, fmt.Errorf("program %q has been deleted: %w", enrolment.ProgramId, ErrConflict)
+	} else if err != nil {
+		return enrolment, err
+	}
+	return s.enrolments.create(ctx, enrolment, func(existing Enrolment) error {
+		if existing.UserId == enrolment.UserId && existing.ProgramId == enrolment.ProgramId && existing.StartDate == enrolment.StartDate {
+			return fmt.Errorf("user is already enrolled in program %q from %s: %w", enrolment.ProgramId, enrolment.StartDate, ErrConflict)
+		}
+		return nil
+	})
+}
+
+func (s *programStore) DeleteEnrolment(ctx context.Context, id string) error {
+	return s.enrolments.delete(ctx, id)
+}
+
+func (s *programStore) DeleteUserEnrolments(ctx context.Context, userId string) error {
+	_, err := s.enrolments.deleteWhere(ctx, func(existing Enrolment) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *programStore) DeleteUserPrograms(ctx context.Context, userId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	owned, err := s.programs.list(ctx, func(existing Program) bool {
+		return existing.UserId == userId
+	})
+	if err != nil || len(owned) == 0 {
+		return err
+	}
+	ids := make([]string, 0, len(owned))
+	for _, p := range owned {
+		ids = append(ids, p.Id)
+	}
+	if _, err = s.enrolments.deleteWhere(ctx, func(existing Enrolment) bool {
+		return slices.Contains(ids, existing.ProgramId)
+	}); err != nil {
+		return err
+	}
+	_, err = s.programs.deleteWhere(ctx, func(existing Program) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *programStore) Ping(ctx context.Context) error {
+	return errors.Join(s.programs.ping(ctx), s.enrolments.ping(ctx))
+}
+
+func (s *programStore) Close() error {
+	return errors.Join(s.programs.close(), s.enrolments.close())
+}
@@ -0,0 +1,803 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Program struct {
+	Id          string            `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId      string            `json:"userId,omitempty" oas:"description: db oid of the owning User (absent for library programs), pattern: '^[0-9a-f]{24}$'"`
+	Name        string            `json:"name" oas:"description: name of the program, required, minLength: 1, maxLength: 100"`
+	Description string            `json:"description,omitempty" oas:"description: free text description of the program, maxLength: 2000"`
+	Weeks       int               `json:"weeks" oas:"description: length of the program in weeks, required, minimum: 1, maximum: 52"`
+	Days        []ProgramDay      `json:"days" oas:"description: the training days of the program"`
+	Progression []ProgressionRule `json:"progression" oas:"description: rules adjusting the template loads as the program progresses"`
+}
+
+type ProgramDay struct {
+	Week       *int   `json:"week,omitempty" oas:"description: week of the program (absent for every week), minimum: 1, maximum: 52"`
+	Day        int    `json:"day" oas:"description: day of the program week (day 1 is the weekday of the enrolment start date), required, minimum: 1, maximum: 7"`
+	TemplateId string `json:"templateId" oas:"description: db oid of the Template to perform (from the library or of the owning User), required, pattern: '^[0-9a-f]{24}$'"`
+}
+
+type ProgressionRule struct {
+	Type       string   `json:"type" oas:"$ref: ProgressionType, required"`
+	ExerciseId string   `json:"exerciseId,omitempty" oas:"description: db oid of the only Exercise the rule applies to (absent for all exercises), pattern: '^[0-9a-f]{24}$'"`
+	Increment  *float64 `json:"increment,omitempty" oas:"description: increase per (non deload) week - kg (lb in imperial units) for linear and percentage points for percent_1rm"`
+	Weeks      []int    `json:"weeks,omitempty" oas:"description: the deload weeks of the program (for deload), type: array, itemType: integer"`
+	Percent    *float64 `json:"percent,omitempty" oas:"description: load in deload weeks as a percentage of the normal load (for deload), minimum: 0, maximum: 100"`
+}
+
+const (
+	progressionLinear     = "linear"
+	progressionPercent1rm = "percent_1rm"
+	progressionDeload     = "deload"
+)
+
+// ProgressionTypes are the types of progression rule
+var ProgressionTypes = []string{progressionDeload, progressionLinear, progressionPercent1rm}
+
+type Enrolment struct {
+	Id          string      `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId      string      `json:"userId" oas:"description: db oid of the enrolled User (from the path - ignored on input)"`
+	ProgramId   string      `json:"programId" oas:"description: db oid of the Program, required, pattern: '^[0-9a-f]{24}$'"`
+	StartDate   string      `json:"startDate" oas:"description: date (YYYY-MM-DD) of day 1 of week 1, required, pattern: '^[0-9]{4}-[0-9]{2}-[0-9]{2}$'"`
+	OneRepMaxes []OneRepMax `json:"oneRepMaxes" oas:"description: 1 rep maxes for percent1rm loads (exercises not listed use the current e1rm_epley record of the User)"`
+}
+
+type OneRepMax struct {
+	ExerciseId string  `json:"exerciseId" oas:"description: db oid of the Exercise, required, pattern: '^[0-9a-f]{24}$'"`
+	Weight     float64 `json:"weight" oas:"description: 1 rep max in kg (lb in imperial units), required, minimum: 0"`
+}
+
+type ProgramWorkout struct {
+	EnrolmentId string  `json:"enrolmentId" oas:"description: db oid of the Enrolment"`
+	ProgramId   string  `json:"programId" oas:"description: db oid of the Program"`
+	TemplateId  string  `json:"templateId" oas:"description: db oid of the Template the workout was generated from"`
+	Date        string  `json:"date" oas:"description: the date (YYYY-MM-DD) the workout is scheduled for"`
+	Week        int     `json:"week" oas:"description: week of the program"`
+	Day         int     `json:"day" oas:"description: day of the program week"`
+	Deload      bool    `json:"deload" oas:"description: whether a deload applies in the week"`
+	Workout     Workout `json:"workout" oas:"$ref: Workout, description: the Workout with computed target loads (POST it to /workouts once performed)"`
+}
+
+var ProgramPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getPrograms,
+			OperationId: "listPrograms",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerQueryUserId, Coach: true, Shared: true}),
+			QueryParams: programListing.queryParams(
+				unitsParam,
+				chioas.QueryParam{
+					Name:        "userId",
+					Description: "Include the programs of this User db oid (library programs are always included)",
+				},
+			),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of Programs",
+					IsArray:     true,
+					SchemaRef:   "Program",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postProgram,
+			OperationId: "createProgram",
+			Description: "Only admins may create library programs (without a userId)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerBodyUserId, Coach: true}),
+			QueryParams: chioas.QueryParams{unitsParam},
+			Request: &chioas.Request{
+				Description: "Program to create (any _id is ignored)",
+				Required:    true,
+				SchemaRef:   "Program",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created Program",
+					SchemaRef:   "Program",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{id}": {
+			PathParams: chioas.PathParams{
+				"id": {
+					Description: "Program db oid",
+					Example:     "66971add3abcef545e64400e",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getProgram,
+					OperationId: "getProgram",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathProgram, Coach: true, Shared: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Program",
+							SchemaRef:   "Program",
+						},
+					},
+				},
+				http.MethodPut: {
+					Handler:     putProgram,
+					OperationId: "replaceProgram",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathProgram, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Request: &chioas.Request{
+						Description: "Replacement Program (any _id and userId are ignored)",
+						Required:    true,
+						SchemaRef:   "Program",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Program",
+							SchemaRef:   "Program",
+						},
+					},
+				},
+				http.MethodPatch: {
+					Handler:     patchProgram,
+					OperationId: "updateProgram",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathProgram, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Request: &chioas.Request{
+						Description: "JSON Merge Patch (RFC 7396) to apply to the Program (any _id and userId are ignored)",
+						Required:    true,
+						ContentType: contentTypeMergePatch,
+						SchemaRef:   "Program",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Program",
+							SchemaRef:   "Program",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteProgram,
+					OperationId: "deleteProgram",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathProgram, Coach: true}),
+					Description: "Programs with enrolments cannot be deleted (409)",
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Program deleted",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+// EnrolmentsPath is the enrolments of a User in programs (nested under the user path)
+var EnrolmentsPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getEnrolments,
+			OperationId: "listEnrolments",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: enrolmentListing.queryParams(unitsParam),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of Enrolments",
+					IsArray:     true,
+					SchemaRef:   "Enrolment",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postEnrolment,
+			OperationId: "createEnrolment",
+			Description: "The Program must be from the library or owned by the User (or one of their coaches)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: chioas.QueryParams{unitsParam},
+			Request: &chioas.Request{
+				Description: "Enrolment to create (any _id and userId are ignored)",
+				Required:    true,
+				SchemaRef:   "Enrolment",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created Enrolment",
+					SchemaRef:   "Enrolment",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{enrolmentId}": {
+			PathParams: chioas.PathParams{
+				"enrolmentId": {
+					Description: "Enrolment db oid",
+					Example:     "66971add3abcef545e64400f",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getEnrolment,
+					OperationId: "getEnrolment",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Enrolment",
+							SchemaRef:   "Enrolment",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteEnrolment,
+					OperationId: "deleteEnrolment",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Enrolment deleted",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+// TodayPath is the workouts due today from the programs a User is enrolled in (nested under the user path)
+var TodayPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getToday,
+			OperationId: "getTodaysWorkouts",
+			Description: "The workouts (with target loads computed by the program progression rules) scheduled for the day by each of the User enrolments",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: chioas.QueryParams{
+				unitsParam,
+				{
+					Name:        "date",
+					Description: "The date (YYYY-MM-DD) to get the workouts for (defaults to today)",
+					Example:     "2024-07-01",
+				},
+				{
+					Name:        "tz",
+					Description: "IANA time zone of today and of the generated workout start times (defaults to UTC)",
+					Example:     "Europe/London",
+				},
+				{
+					Name:        "rounding",
+					Description: "Rounding of the target loads (plate rounds to loads that plates can make - the nearest 2.5 kg or 5 lb)",
+					SchemaRef:   "Rounding",
+				},
+			},
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of ProgramWorkouts",
+					IsArray:     true,
+					SchemaRef:   "ProgramWorkout",
+				},
+			},
+		},
+	},
+}
+
+var ProgramSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Program",
+		Description: "A multi-week training plan of Templates - either from the library or a User's own",
+		Comment:     chioas.SourceComment(),
+	}).Must(Program{}),
+	enumSchema("ProgressionType", "A type of progression rule (linear: add increment kg each week - percent_1rm: add increment percentage points to percent1rm loads each week - deload: reduce loads to percent in the deload weeks)", ProgressionTypes),
+	(&chioas.Schema{
+		Name:        "Enrolment",
+		Description: "The enrolment of a User in a Program",
+		Comment:     chioas.SourceComment(),
+	}).Must(Enrolment{}),
+	(&chioas.Schema{
+		Name:        "ProgramWorkout",
+		Description: "A Workout generated from a Program for an enrolled User",
+		Comment:     chioas.SourceComment(),
+	}).Must(ProgramWorkout{}),
+}
+
+var programListing = listing[Program]{
+	id: func(p Program) string { return p.Id },
+	fields: sortFields[Program]{
+		"_id":  func(p Program) string { return p.Id },
+		"name": func(p Program) string { return strings.ToLower(p.Name) },
+	},
+	defaultSort: "name",
+}
+
+var enrolmentListing = listing[Enrolment]{
+	id: func(e Enrolment) string { return e.Id },
+	fields: sortFields[Enrolment]{
+		"_id":       func(e Enrolment) string { return e.Id },
+		"startDate": func(e Enrolment) string { return e.StartDate },
+	},
+	defaultSort: "-startDate",
+}
+
+// programs is the store used by the program and enrolment handlers (replaced by a file-backed store in main)
+var programs = NewMemoryProgramStore()
+
+// templateUses serializes adding and removing uses of templates - program creates and updates hold it from
+// checking their templates until they are saved, and template deletes from checking that the template is
+// unused until it is deleted - so that no program is left using a deleted template
+var templateUses sync.Mutex
+
+func getPrograms(writer http.ResponseWriter, request *http.Request) {
+	result, err := programs.List(request.Context(), ProgramFilter{UserId: request.URL.Query().Get("userId")})
+	if err == nil {
+		result, err = programListing.paginate(writer, request, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().programs(result)
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postProgram(writer http.ResponseWriter, request *http.Request) {
+	var program Program
+	if err := decodeJson(request, &program); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u := unitsFrom(request.Context())
+	u.in().program(&program)
+	templateUses.Lock()
+	err := checkProgram(request.Context(), &program)
+	if err == nil {
+		program, err = programs.Create(request.Context(), program)
+	}
+	templateUses.Unlock()
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+program.Id)
+	u.out().program(&program)
+	writeJson(writer, request, http.StatusCreated, program)
+}
+
+func getProgram(writer http.ResponseWriter, request *http.Request) {
+	program, err := programs.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().program(&program)
+	writeJson(writer, request, http.StatusOK, program)
+}
+
+func putProgram(writer http.ResponseWriter, request *http.Request) {
+	existing, err := programs.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var program Program
+	if err = decodeJson(request, &program); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u := unitsFrom(request.Context())
+	u.in().program(&program)
+	program.Id, program.UserId = existing.Id, existing.UserId
+	templateUses.Lock()
+	err = checkProgram(request.Context(), &program)
+	if err == nil {
+		program, err = programs.Update(request.Context(), program)
+	}
+	templateUses.Unlock()
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u.out().program(&program)
+	writeJson(writer, request, http.StatusOK, program)
+}
+
+func patchProgram(writer http.ResponseWriter, request *http.Request) {
+	existing, err := programs.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		return
+	}
+	// the patch is in the request units - so it is applied to the program in those units
+	program := existing
+	u := unitsFrom(request.Context())
+	u.outExact().program(&program)
+	if err = applyMergePatch(&program, patch); err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "invalid merge patch: %s", err.Error()))
+		return
+	}
+	u.in().program(&program)
+	program.Id, program.UserId = existing.Id, existing.UserId
+	templateUses.Lock()
+	err = checkProgram(request.Context(), &program)
+	if err == nil {
+		program, err = programs.Update(request.Context(), program)
+	}
+	templateUses.Unlock()
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u.out().program(&program)
+	writeJson(writer, request, http.StatusOK, program)
+}
+
+func deleteProgram(writer http.ResponseWriter, request *http.Request) {
+	if err := programs.Delete(request.Context(), chi.URLParam(request, "id")); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// checkProgram performs the checks that can't be expressed in the Program schema (and normalizes absent lists)
+func checkProgram(ctx context.Context, program *Program) error {
+	if program.Days == nil {
+		program.Days = []ProgramDay{}
+	}
+	if program.Progression == nil {
+		program.Progression = []ProgressionRule{}
+	}
+	errs := make([]FieldError, 0)
+	if program.UserId != "" {
+		if _, err := users.Get(ctx, program.UserId); errors.Is(err, ErrNotFound) {
+			errs = append(errs, FieldError{Path: "userId", Message: "user does not exist"})
+		} else if err != nil {
+			return err
+		}
+	}
+	for i, day := range program.Days {
+		if day.Week != nil && *day.Week > program.Weeks {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("days[%d].week", i), Message: "must not be after the last week of the program"})
+		}
+		if t, err := templates.Get(ctx, day.TemplateId); errors.Is(err, ErrNotFound) || (err == nil && t.UserId != "" && t.UserId != program.UserId) {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("days[%d].templateId", i), Message: "template does not exist"})
+		} else if err != nil {
+			return err
+		}
+	}
+	for i, rule := range program.Progression {
+		path := fmt.Sprintf("progression[%d]", i)
+		if rule.ExerciseId != "" {
+			if e, err := exercises.Get(ctx, rule.ExerciseId); errors.Is(err, ErrNotFound) || (err == nil && e.UserId != "" && e.UserId != program.UserId) {
+				errs = append(errs, FieldError{Path: path + ".exerciseId", Message: "exercise does not exist"})
+			} else if err != nil {
+				return err
+			}
+		}
+		switch rule.Type {
+		case progressionLinear, progressionPercent1rm:
+			if rule.Increment == nil {
+				errs = append(errs, FieldError{Path: path + ".increment", Message: "is required for " + rule.Type + " rules"})
+			}
+		case progressionDeload:
+			if len(rule.Weeks) == 0 {
+				errs = append(errs, FieldError{Path: path + ".weeks", Message: "must have at least 1 items"})
+			}
+			for j, w := range rule.Weeks {
+				if w < 1 || w > program.Weeks {
+					errs = append(errs, FieldError{Path: fmt.Sprintf("%s.weeks[%d]", path, j), Message: "must be a week of the program"})
+				}
+			}
+			if rule.Percent == nil {
+				errs = append(errs, FieldError{Path: path + ".percent", Message: "is required for deload rules"})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "program failed validation")
+		p.Errors = errs
+		return p
+	}
+	return nil
+}
+
+func getEnrolments(writer http.ResponseWriter, request *http.Request) {
+	userId := chi.URLParam(request, "id")
+	if _, err := users.Get(request.Context(), userId); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result, err := programs.ListEnrolments(request.Context(), EnrolmentFilter{UserId: userId})
+	if err == nil {
+		result, err = enrolmentListing.paginate(writer, request, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().enrolments(result)
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postEnrolment(writer http.ResponseWriter, request *http.Request) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var enrolment Enrolment
+	if err = decodeJson(request, &enrolment); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u := unitsFrom(request.Context())
+	u.in().enrolment(&enrolment)
+	enrolment.UserId = user.Id
+	if err = checkEnrolment(request.Context(), user, &enrolment); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if enrolment, err = programs.CreateEnrolment(request.Context(), enrolment); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+enrolment.Id)
+	u.out().enrolment(&enrolment)
+	writeJson(writer, request, http.StatusCreated, enrolment)
+}
+
+func getEnrolment(writer http.ResponseWriter, request *http.Request) {
+	enrolment, err := userEnrolment(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().enrolment(&enrolment)
+	writeJson(writer, request, http.StatusOK, enrolment)
+}
+
+func deleteEnrolment(writer http.ResponseWriter, request *http.Request) {
+	enrolment, err := userEnrolment(request)
+	if err == nil {
+		err = programs.DeleteEnrolment(request.Context(), enrolment.Id)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// userEnrolment gets the path enrolment - which must be of the path user
+func userEnrolment(request *http.Request) (Enrolment, error) {
+	id := chi.URLParam(request, "enrolmentId")
+	enrolment, err := programs.GetEnrolment(request.Context(), id)
+	if err == nil && enrolment.UserId != chi.URLParam(request, "id") {
+		err = fmt.Errorf("enrolments %q %w", id, ErrNotFound)
+	}
+	return enrolment, err
+}
+
+// checkEnrolment performs the checks that can't be expressed in the Enrolment schema (and normalizes absent lists)
+func checkEnrolment(ctx context.Context, user User, enrolment *Enrolment) error {
+	if enrolment.OneRepMaxes == nil {
+		enrolment.OneRepMaxes = []OneRepMax{}
+	}
+	errs := make([]FieldError, 0)
+	if p, err := programs.Get(ctx, enrolment.ProgramId); errors.Is(err, ErrNotFound) {
+		errs = append(errs, FieldError{Path: "programId", Message: "program does not exist"})
+	} else if err != nil {
+		return err
+	} else if p.UserId != "" && p.UserId != user.Id && !slices.Contains(user.Coaches, p.UserId) {
+		errs = append(errs, FieldError{Path: "programId", Message: "program is not available to the user"})
+	}
+	if _, err := time.Parse(time.DateOnly, enrolment.StartDate); err != nil {
+		errs = append(errs, FieldError{Path: "startDate", Message: "must be a date (YYYY-MM-DD)"})
+	}
+	for i, orm := range enrolment.OneRepMaxes {
+		if e, err := exercises.Get(ctx, orm.ExerciseId); errors.Is(err, ErrNotFound) || (err == nil && e.UserId != "" && e.UserId != user.Id) {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("oneRepMaxes[%d].exerciseId", i), Message: "exercise does not exist"})
+		} else if err != nil {
+			return err
+		}
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "enrolment failed validation")
+		p.Errors = errs
+		return p
+	}
+	return nil
+}
+
+func getToday(writer http.ResponseWriter, request *http.Request) {
+	userId := chi.URLParam(request, "id")
+	if _, err := users.Get(request.Context(), userId); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	loc := time.UTC
+	if tz := request.URL.Query().Get("tz"); tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"tz\" is not a known time zone"))
+			return
+		}
+	}
+	date := time.Now().In(loc).Format(time.DateOnly)
+	if v := request.URL.Query().Get("date"); v != "" {
+		if _, err := time.Parse(time.DateOnly, v); err != nil {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "query param \"date\" must be a date (YYYY-MM-DD)"))
+			return
+		}
+		date = v
+	}
+	rounding, err := checkRounding(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	enrolments, err := programs.ListEnrolments(request.Context(), EnrolmentFilter{UserId: userId})
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result := make([]ProgramWorkout, 0)
+	for _, enrolment := range enrolments {
+		pws, err := programWorkouts(request.Context(), enrolment, date, loc)
+		if err != nil {
+			writeError(writer, request, err)
+			return
+		}
+		result = append(result, pws...)
+	}
+	u := unitsFrom(request.Context())
+	for i := range result {
+		u.out().workout(&result[i].Workout)
+		u.roundLoads(&result[i].Workout, rounding)
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+// programWorkouts generates the workouts the enrolment schedules on the date (none outside the program weeks)
+func programWorkouts(ctx context.Context, enrolment Enrolment, date string, loc *time.Location) ([]ProgramWorkout, error) {
+	program, err := programs.Get(ctx, enrolment.ProgramId)
+	if err != nil {
+		return nil, err
+	}
+	start, _ := time.Parse(time.DateOnly, enrolment.StartDate)
+	on, _ := time.Parse(time.DateOnly, date)
+	// both are UTC midnights - so whole days apart regardless of DST in loc
+	days := int(on.Sub(start).Hours() / 24)
+	if days < 0 || days >= program.Weeks*7 {
+		return nil, nil
+	}
+	week, day := days/7+1, days%7+1
+	startTime := time.Date(on.Year(), on.Month(), on.Day(), 0, 0, 0, 0, loc)
+	result := make([]ProgramWorkout, 0)
+	for _, pd := range program.Days {
+		if pd.Day != day || (pd.Week != nil && *pd.Week != week) {
+			continue
+		}
+		template, err := templates.Get(ctx, pd.TemplateId)
+		if err != nil {
+			return nil, err
+		}
+		pw := ProgramWorkout{
+			EnrolmentId: enrolment.Id,
+			ProgramId:   program.Id,
+			TemplateId:  template.Id,
+			Date:        date,
+			Week:        week,
+			Day:         day,
+			Deload:      program.deloadPercent(week, "") != nil,
+			Workout: Workout{
+				UserId:    enrolment.UserId,
+				StartTime: startTime,
+				Notes:     template.Notes,
+				Exercises: make([]WorkoutExercise, 0, len(template.Exercises)),
+			},
+		}
+		for _, te := range template.Exercises {
+			oneRepMax, err := enrolment.oneRepMax(ctx, te.ExerciseId)
+			if err != nil {
+				return nil, err
+			}
+			we := WorkoutExercise{ExerciseId: te.ExerciseId, Notes: te.Notes, Sets: make([]WorkoutSet, 0, len(te.Sets))}
+			missingOneRepMax := false
+			for _, set := range te.Sets {
+				missingOneRepMax = missingOneRepMax || (set.Percent1rm != nil && oneRepMax == nil)
+				we.Sets = append(we.Sets, WorkoutSet{
+					Reps:     set.Reps,
+					Weight:   program.targetLoad(week, te.ExerciseId, set, oneRepMax),
+					RPE:      set.RPE,
+					Duration: set.Duration,
+					Distance: set.Distance,
+				})
+			}
+			if missingOneRepMax {
+				we.Notes = strings.TrimSpace(we.Notes + "\nNo 1 rep max is known for this exercise - percent1rm loads could not be computed")
+			}
+			pw.Workout.Exercises = append(pw.Workout.Exercises, we)
+		}
+		result = append(result, pw)
+	}
+	return result, nil
+}
+
+// oneRepMax is the 1 rep max of the exercise for the enrolment - from the enrolment or else the
+// user's current e1rm_epley record (nil if neither is known)
+func (e Enrolment) oneRepMax(ctx context.Context, exerciseId string) (*float64, error) {
+	for _, orm := range e.OneRepMaxes {
+		if orm.ExerciseId == exerciseId {
+			return &orm.Weight, nil
+		}
+	}
+	found, err := records.List(ctx, RecordFilter{UserId: e.UserId, ExerciseId: exerciseId, Kind: recordE1rmEpley, CurrentOnly: true})
+	if err != nil || len(found) == 0 {
+		return nil, err
+	}
+	return &found[0].Value, nil
+}
+
+// targetLoad computes the load (kg) of a template set in the week of the program - nil when the
+// set has no load (or it is a percent1rm load and the 1 rep max is not known)
+//
+// Linear and percent_1rm increments accumulate over the preceding weeks that were not deloads
+// for the exercise, then any deload of the week is applied
+func (p Program) targetLoad(week int, exerciseId string, set TemplateSet, oneRepMax *float64) *float64 {
+	progressWeeks := 0
+	for w := 1; w < week; w++ {
+		if p.deloadPercent(w, exerciseId) == nil {
+			progressWeeks++
+		}
+	}
+	increment := func(ruleType string) (total float64) {
+		for _, rule := range p.Progression {
+			if rule.Type == ruleType && rule.Increment != nil && (rule.ExerciseId == "" || rule.ExerciseId == exerciseId) {
+				total += *rule.Increment * float64(progressWeeks)
+			}
+		}
+		return total
+	}
+	var load float64
+	switch {
+	case set.Weight != nil:
+		load = *set.Weight
+	case set.Percent1rm != nil && oneRepMax != nil:
+		load = (*set.Percent1rm + increment(progressionPercent1rm)) / 100 * *oneRepMax
+	default:
+		return nil
+	}
+	load += increment(progressionLinear)
+	if percent := p.deloadPercent(week, exerciseId); percent != nil {
+		load = load * *percent / 100
+	}
+	load = roundRecord(max(0, load))
+	return &load
+}
+
+// deloadPercent is the load percentage of the first deload rule for the week (and exercise - any
+// exercise when empty), or nil when the week is not a deload
+func (p Program) deloadPercent(week int, exerciseId string) *float64 {
+	for _, rule := range p.Progression {
+		if rule.Type == progressionDeload && rule.Percent != nil && slices.Contains(rule.Weeks, week) &&
+			(exerciseId == "" || rule.ExerciseId == "" || rule.ExerciseId == exerciseId) {
+			return rule.Percent
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTargetLoad(t *testing.T) {
+	const squat, bench = "000000000000000000000001", "000000000000000000000010"
+	linear := ProgressionRule{Type: progressionLinear, Increment: ptr(2.5)}
+	benchLinear := ProgressionRule{Type: progressionLinear, ExerciseId: bench, Increment: ptr(1.0)}
+	percent := ProgressionRule{Type: progressionPercent1rm, Increment: ptr(2.0)}
+	deload := ProgressionRule{Type: progressionDeload, Weeks: []int{4}, Percent: ptr(60.0)}
+	benchDeload := ProgressionRule{Type: progressionDeload, ExerciseId: bench, Weeks: []int{2}, Percent: ptr(50.0)}
+	for name, tc := range map[string]struct {
+		rules      []ProgressionRule
+		week       int
+		exerciseId string
+		set        TemplateSet
+		oneRepMax  *float64
+		want       *float64
+	}{
+		"fixed weight":           {nil, 3, squat, TemplateSet{Weight: ptr(100.0)}, nil, ptr(100.0)},
+		"no load":                {[]ProgressionRule{linear}, 3, squat, TemplateSet{Reps: ptr(5)}, nil, nil},
+		"linear week 1":          {[]ProgressionRule{linear}, 1, squat, TemplateSet{Weight: ptr(100.0)}, nil, ptr(100.0)},
+		"linear week 3":          {[]ProgressionRule{linear}, 3, squat, TemplateSet{Weight: ptr(100.0)}, nil, ptr(105.0)},
+		"rules add up":           {[]ProgressionRule{linear, benchLinear}, 3, bench, TemplateSet{Weight: ptr(60.0)}, nil, ptr(67.0)},
+		"rule of other exercise": {[]ProgressionRule{benchLinear}, 3, squat, TemplateSet{Weight: ptr(100.0)}, nil, ptr(100.0)},
+		"percent of 1rm":         {nil, 1, squat, TemplateSet{Percent1rm: ptr(75.0)}, ptr(200.0), ptr(150.0)},
+		"percent unknown 1rm":    {[]ProgressionRule{percent}, 2, squat, TemplateSet{Percent1rm: ptr(75.0)}, nil, nil},
+		"percent progression":    {[]ProgressionRule{percent}, 3, squat, TemplateSet{Percent1rm: ptr(75.0)}, ptr(200.0), ptr(158.0)},
+		// the deload week applies its percentage - and doesn't count as a week of progress afterwards
+		"deload week":  {[]ProgressionRule{linear, deload}, 4, squat, TemplateSet{Weight: ptr(100.0)}, nil, ptr(64.5)},
+		"after deload": {[]ProgressionRule{linear, deload}, 5, squat, TemplateSet{Weight: ptr(100.0)}, nil, ptr(107.5)},
+		// a deload of another exercise doesn't hold this one back
+		"other exercise deload": {[]ProgressionRule{linear, benchDeload}, 3, squat, TemplateSet{Weight: ptr(100.0)}, nil, ptr(105.0)},
+		"exercise deload":       {[]ProgressionRule{linear, benchDeload}, 3, bench, TemplateSet{Weight: ptr(60.0)}, nil, ptr(62.5)},
+		"never negative":        {[]ProgressionRule{{Type: progressionLinear, Increment: ptr(-50.0)}}, 3, squat, TemplateSet{Weight: ptr(60.0)}, nil, ptr(0.0)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := Program{Weeks: 8, Progression: tc.rules}
+			got := p.targetLoad(tc.week, tc.exerciseId, tc.set, tc.oneRepMax)
+			if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+				t.Errorf("load %v, want %v", deref(got), deref(tc.want))
+			}
+		})
+	}
+}
+
+func deref[T any](v *T) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func TestProgramHandlers(t *testing.T) {
+	coach, coachToken := testUser(t, "programs_coach", roleCoach)
+	athlete, athleteToken := testUser(t, "programs_athlete", roleAthlete)
+	created := func(path string, token string, body string) string {
+		t.Helper()
+		got := call(t, http.MethodPost, path, token, body)
+		if got.Code != http.StatusCreated {
+			t.Fatalf("post %s responded %d: %s", path, got.Code, got.Body)
+		}
+		var v struct {
+			Id string `json:"_id"`
+		}
+		_ = json.Unmarshal(got.Body.Bytes(), &v)
+		if got.Header().Get("Location") != path+"/"+v.Id {
+			t.Errorf("Location %q", got.Header().Get("Location"))
+		}
+		return v.Id
+	}
+	templateId := created("/templates", coachToken, `{"userId":"`+coach.Id+`","name":"Squat day","exercises":[
+		{"exerciseId":"000000000000000000000001","sets":[{"reps":5,"weight":100},{"reps":5,"percent1rm":80}]}]}`)
+	if got := call(t, http.MethodPost, "/programs", coachToken, `{"userId":"`+coach.Id+`","name":"Bad","weeks":2,"days":[{"day":1,"templateId":"0000000000000000000000ff"}]}`); got.Code != http.StatusUnprocessableEntity {
+		t.Errorf("program with a missing template responded %d", got.Code)
+	}
+	programId := created("/programs", coachToken, `{"userId":"`+coach.Id+`","name":"Squat more","weeks":4,
+		"days":[{"day":1,"templateId":"`+templateId+`"},{"week":2,"day":3,"templateId":"`+templateId+`"}],
+		"progression":[{"type":"linear","increment":5},{"type":"deload","weeks":[4],"percent":50}]}`)
+	if got := call(t, http.MethodDelete, "/templates/"+templateId, coachToken, ""); got.Code != http.StatusConflict {
+		t.Errorf("delete of a template used by a program responded %d, want 409", got.Code)
+	}
+
+	// the athlete is coached by the program's owner - so may enrol in it
+	if got := call(t, http.MethodPatch, "/users/"+athlete.Id, athleteToken, `{"coaches":["`+coach.Id+`"]}`, contentTypeMergePatch); got.Code != http.StatusOK {
+		t.Fatalf("patch coaches responded %d: %s", got.Code, got.Body)
+	}
+	enrolments := "/users/" + athlete.Id + "/enrolments"
+	enrolmentId := created(enrolments, athleteToken, `{"programId":"`+programId+`","startDate":"2024-01-01","oneRepMaxes":[{"exerciseId":"000000000000000000000001","weight":150}]}`)
+	for date, want := range map[string][]float64{
+		"2023-12-31": nil,          // before the program
+		"2024-01-02": nil,          // no training on day 2
+		"2024-01-01": {100, 120},   // week 1 day 1
+		"2024-01-10": {105, 125},   // week 2 day 3
+		"2024-01-15": {110, 130},   // week 3 day 1
+		"2024-01-22": {57.5, 67.5}, // week 4 day 1 - a 50% deload of the week 4 loads
+		"2024-01-29": nil,          // after the program
+	} {
+		got := call(t, http.MethodGet, "/users/"+athlete.Id+"/today?date="+date, athleteToken, "")
+		var today []ProgramWorkout
+		if err := json.Unmarshal(got.Body.Bytes(), &today); got.Code != http.StatusOK || err != nil {
+			t.Fatalf("today %s responded %d: %s", date, got.Code, got.Body)
+		}
+		if len(today) != min(len(want), 1) {
+			t.Errorf("%d workouts on %s", len(today), date)
+			continue
+		}
+		if len(want) == 0 {
+			continue
+		}
+		sets := today[0].Workout.Exercises[0].Sets
+		if *sets[0].Weight != want[0] || *sets[1].Weight != want[1] || today[0].Deload != (date == "2024-01-22") {
+			t.Errorf("on %s loads %v %v (deload %v), want %v", date, *sets[0].Weight, *sets[1].Weight, today[0].Deload, want)
+		}
+	}
+	if got := call(t, http.MethodGet, "/users/"+athlete.Id+"/today?date=2024-01-10&rounding=plate&units=imperial", athleteToken, ""); got.Code != http.StatusOK {
+		t.Errorf("today in plate rounded lb responded %d: %s", got.Code, got.Body)
+	}
+
+	if got := call(t, http.MethodDelete, "/programs/"+programId, coachToken, ""); got.Code != http.StatusConflict {
+		t.Errorf("delete of a program with enrolments responded %d, want 409", got.Code)
+	}
+	for _, path := range []string{enrolments + "/" + enrolmentId, "/programs/" + programId, "/templates/" + templateId} {
+		if got := call(t, http.MethodDelete, path, coachToken, ""); got.Code != http.StatusNoContent {
+			t.Errorf("delete %s responded %d: %s", path, got.Code, got.Body)
+		}
+	}
+}
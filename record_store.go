@@ -0,0 +1,122 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+)
+
+// RecordStore is the persistence interface for personal records
+//
+// Records are derived from a user's workouts - they are always replaced as a whole per user
+type RecordStore interface {
+	List(ctx context.Context, filter RecordFilter) ([]PersonalRecord, error)
+	// Replace replaces all of a user's records - a record keeps its id while it is still the record of
+	// the same exercise and kind (and reps or distance) set by the same workout (see recordKeys)
+	Replace(ctx context.Context, userId string, records []PersonalRecord) error
+	// DeleteUserRecords deletes all of a user's records (e.g. when the user is deleted)
+	DeleteUserRecords(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// RecordFilter filters listed records - zero value fields are not filtered on
+type RecordFilter struct {
+	UserId     string
+	ExerciseId string
+	Kind       string
+	// CurrentOnly excludes records that have since been beaten
+	CurrentOnly bool
+	// WorkoutIds only includes records set in any of these workouts
+	WorkoutIds []string
+}
+
+func (f RecordFilter) matches(r PersonalRecord) bool {
+	return (f.UserId == "" || r.UserId == f.UserId) &&
+		(f.ExerciseId == "" || r.ExerciseId == f.ExerciseId) &&
+		(f.Kind == "" || r.Kind == f.Kind) &&
+		(!f.CurrentOnly || r.Current) &&
+		(f.WorkoutIds == nil || slices.Contains(f.WorkoutIds, r.WorkoutId))
+}
+
+// NewMemoryRecordStore creates a RecordStore that is held in memory only
+func NewMemoryRecordStore() RecordStore {
+	return &recordStore{items: newMemoryCollection[PersonalRecord]("records", recordId)}
+}
+
+// OpenFileRecordStore opens (or creates) a file-backed RecordStore in the given directory
+func OpenFileRecordStore(dir string) (RecordStore, error) {
+	c, err := openFileCollection[PersonalRecord](dir, "records", recordId)
+	if err != nil {
+		return nil, err
+	}
+	return &recordStore{items: c}, nil
+}
+
+func recordId(r *PersonalRecord) *string {
+	return &r.Id
+}
+
+type recordStore struct {
+	items *collection[PersonalRecord]
+}
+
+func (s *recordStore) List(ctx context.Context, filter RecordFilter) ([]PersonalRecord, error) {
+	return s.items.list(ctx, filter.matches)
+}
+
+func (s *recordStore) Replace(ctx context.Context, userId string, records []PersonalRecord) error {
+	return s.items.replaceWhere(ctx, func(r PersonalRecord) bool {
+		return r.UserId == userId
+	}, recordKeys, records)
+}
+
+// recordKeys are what identify records across recomputes - the exercise, kind, reps or distance and workout
+// of each record, and which of the workout's records of those it is (as a workout can set the same record
+// more than once, with ever better sets)
+//
+// The positions of the exercise and set aren't part of the key - so that adding or removing other
+// exercises and sets of the workout doesn't give its records new ids
+func recordKeys(rs []PersonalRecord) []string {
+	order := make([]int, len(rs))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		return cmp.Or(cmp.Compare(rs[a].ExerciseIndex, rs[b].ExerciseIndex), cmp.Compare(rs[a].SetIndex, rs[b].SetIndex))
+	})
+	keys := make([]string, len(rs))
+	seen := map[string]int{}
+	for _, i := range order {
+		r := rs[i]
+		reps, distance := 0, 0.0
+		if r.Reps != nil {
+			reps = *r.Reps
+		}
+		if r.Distance != nil {
+			distance = *r.Distance
+		}
+		key := fmt.Sprintf("%s/%s/%d/%g/%s", r.ExerciseId, r.Kind, reps, distance, r.WorkoutId)
+		keys[i] = fmt.Sprintf("%s/%d", key, seen[key])
+		seen[key]++
+	}
+	return keys
+}
+
+func (s *recordStore) DeleteUserRecords(ctx context.Context, userId string) error {
+	_, err := s.items.deleteWhere(ctx, func(existing PersonalRecord) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *recordStore) Ping(ctx context.Context) error {
+	return s.items.ping(ctx)
+}
+
+func (s *recordStore) Close() error {
+	return s.items.close()
+}
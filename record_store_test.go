@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecordStoreReplaceKeepsIds(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryRecordStore()
+	const userId, otherId = "000000000000000000000001", "000000000000000000000002"
+	five, three := 5, 3
+	squat := func(workoutId string, reps *int, value float64) PersonalRecord {
+		return PersonalRecord{UserId: userId, ExerciseId: "000000000000000000000001", Kind: recordWeightAtReps, Reps: reps, WorkoutId: workoutId, Value: value}
+	}
+	if err := s.Replace(ctx, otherId, []PersonalRecord{{UserId: otherId, Kind: recordWeightAtReps}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Replace(ctx, userId, []PersonalRecord{squat("a", &five, 100), squat("a", &three, 110)}); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := s.List(ctx, RecordFilter{UserId: userId})
+	ids := map[int]string{}
+	for _, r := range first {
+		ids[*r.Reps] = r.Id
+	}
+
+	// the 5 rep record is edited and a later workout beats the 3 rep record
+	beaten := squat("a", &three, 110)
+	if err := s.Replace(ctx, userId, []PersonalRecord{squat("a", &five, 102.5), beaten, squat("b", &three, 115)}); err != nil {
+		t.Fatal(err)
+	}
+	second, _ := s.List(ctx, RecordFilter{UserId: userId})
+	if len(second) != 3 {
+		t.Fatalf("%d records, want 3", len(second))
+	}
+	for _, r := range second {
+		switch {
+		case *r.Reps == 5:
+			if r.Id != ids[5] || r.Value != 102.5 {
+				t.Errorf("5 rep record %s of %v, want id %s", r.Id, r.Value, ids[5])
+			}
+		case r.WorkoutId == "a":
+			if r.Id != ids[3] {
+				t.Errorf("beaten 3 rep record %s, want id %s", r.Id, ids[3])
+			}
+		case r.Id == ids[3] || r.Id == ids[5] || r.Id == "":
+			t.Errorf("new 3 rep record has id %q", r.Id)
+		}
+	}
+	if others, _ := s.List(ctx, RecordFilter{UserId: otherId}); len(others) != 1 {
+		t.Errorf("%d records of the other user, want 1", len(others))
+	}
+}
+
+func TestRecordKeys(t *testing.T) {
+	five := 5
+	record := func(workoutId string, exerciseIndex int, setIndex int, value float64) PersonalRecord {
+		return PersonalRecord{ExerciseId: "000000000000000000000001", Kind: recordWeightAtReps, Reps: &five, WorkoutId: workoutId, ExerciseIndex: exerciseIndex, SetIndex: setIndex, Value: value}
+	}
+	// a workout that sets the 5 rep record twice - and then has an exercise inserted before the squats
+	// and a warm up set added (in a list in another order)
+	before := recordKeys([]PersonalRecord{record("a", 0, 1, 100), record("a", 0, 3, 105), record("b", 0, 0, 110)})
+	after := recordKeys([]PersonalRecord{record("b", 0, 0, 110), record("a", 1, 4, 105), record("a", 1, 2, 100)})
+	if before[0] == before[1] || before[0] != after[2] || before[1] != after[1] || before[2] != after[0] {
+		t.Errorf("keys before %v after %v", before, after)
+	}
+}
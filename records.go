@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PersonalRecord struct {
+	Id            string    `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId        string    `json:"userId" oas:"description: db oid of the User holding the record"`
+	ExerciseId    string    `json:"exerciseId" oas:"description: db oid of the Exercise"`
+	Kind          string    `json:"kind" oas:"$ref: RecordKind"`
+	Reps          *int      `json:"reps,omitempty" oas:"description: the rep count (for weight_at_reps records)"`
+	Distance      *float64  `json:"distance,omitempty" oas:"description: the distance in metres - miles in imperial units (for fastest_time records)"`
+	Value         float64   `json:"value" oas:"description: the record value (kg for weights and 1RM estimates - metres for distances - seconds for times - lb and miles in imperial units)"`
+	PreviousValue *float64  `json:"previousValue,omitempty" oas:"description: the value of the record this one beat (absent for a first record)"`
+	WorkoutId     string    `json:"workoutId" oas:"description: db oid of the Workout the record was set in"`
+	ExerciseIndex int       `json:"exerciseIndex" oas:"description: index of the exercise in the Workout exercises"`
+	SetIndex      int       `json:"setIndex" oas:"description: index of the set in the Workout exercise sets"`
+	AchievedAt    time.Time `json:"achievedAt" oas:"description: start time of the Workout the record was set in"`
+	Current       bool      `json:"current" oas:"description: whether the record still stands"`
+	// Bodyweight and the relative strengths are not stored - they are computed when records are listed
+	Bodyweight       *float64 `json:"bodyweight,omitempty" oas:"description: bodyweight in kg (lb in imperial units) that relative strength is computed with - the latest measured - for 1 rep max estimates only"`
+	RelativeStrength *float64 `json:"relativeStrength,omitempty" oas:"description: the record value divided by the bodyweight"`
+	Wilks            *float64 `json:"wilks,omitempty" oas:"description: Wilks score of the record value (for users with a sex)"`
+	Dots             *float64 `json:"dots,omitempty" oas:"description: DOTS score of the record value (for users with a sex)"`
+}
+
+const (
+	recordE1rmEpley      = "e1rm_epley"
+	recordE1rmBrzycki    = "e1rm_brzycki"
+	recordWeightAtReps   = "weight_at_reps"
+	recordLongestDist    = "longest_distance"
+	recordFastestTime    = "fastest_time"
+	maxRepsForE1rm       = 12
+	maxRepsForWeightReps = 30
+)
+
+// RecordKinds are the kinds of personal record
+var RecordKinds = []string{recordE1rmBrzycki, recordE1rmEpley, recordFastestTime, recordLongestDist, recordWeightAtReps}
+
+var RecordsPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getRecords,
+			OperationId: "listRecords",
+			Description: "The personal records of the User that still stand",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: recordListing.queryParams(recordFilterParams...),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of PersonalRecords",
+					IsArray:     true,
+					SchemaRef:   "PersonalRecord",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/history": {
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getRecordHistory,
+					OperationId: "listRecordHistory",
+					Description: "Every personal record the User has set (including those since beaten)",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					QueryParams: recordListing.queryParams(recordFilterParams...),
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "List of PersonalRecords",
+							IsArray:     true,
+							SchemaRef:   "PersonalRecord",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var recordFilterParams = []chioas.QueryParam{
+	{
+		Name:        "exerciseId",
+		Description: "Only records for this Exercise db oid",
+	},
+	{
+		Name:        "kind",
+		Description: "Only records of this kind",
+		SchemaRef:   "RecordKind",
+	},
+	unitsParam,
+}
+
+var RecordSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "PersonalRecord",
+		Description: "A personal record - derived from the workouts of the User",
+		Comment:     chioas.SourceComment(),
+	}).Must(PersonalRecord{}),
+	enumSchema("RecordKind", "A kind of personal record (e1rm_* are 1 rep max estimates from sets of up to 12 reps)", RecordKinds),
+}
+
+var recordListing = listing[PersonalRecord]{
+	id: func(r PersonalRecord) string { return r.Id },
+	fields: sortFields[PersonalRecord]{
+		"_id":        func(r PersonalRecord) string { return r.Id },
+		"achievedAt": func(r PersonalRecord) string { return sortKeyTime(r.AchievedAt) },
+		"exerciseId": func(r PersonalRecord) string { return r.ExerciseId },
+	},
+	defaultSort: "-achievedAt",
+}
+
+// records is the store of personal records (replaced by a file-backed store in main)
+var records = NewMemoryRecordStore()
+
+func getRecords(writer http.ResponseWriter, request *http.Request) {
+	listRecords(writer, request, true)
+}
+
+func getRecordHistory(writer http.ResponseWriter, request *http.Request) {
+	listRecords(writer, request, false)
+}
+
+func listRecords(writer http.ResponseWriter, request *http.Request, currentOnly bool) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	q := request.URL.Query()
+	result, err := records.List(request.Context(), RecordFilter{
+		UserId:      user.Id,
+		ExerciseId:  q.Get("exerciseId"),
+		Kind:        q.Get("kind"),
+		CurrentOnly: currentOnly,
+	})
+	if err == nil {
+		result, err = recordListing.paginate(writer, request, result)
+	}
+	if err == nil {
+		err = weighRecords(request.Context(), user, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().records(result)
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+// Epley estimates a 1 rep max from a set of reps at a weight
+func Epley(weight float64, reps int) float64 {
+	if reps == 1 {
+		return weight
+	}
+	return weight * (1 + float64(reps)/30)
+}
+
+// Brzycki estimates a 1 rep max from a set of reps at a weight (only meaningful for fewer than 37 reps)
+func Brzycki(weight float64, reps int) float64 {
+	return weight * 36 / float64(37-reps)
+}
+
+// WilksCoefficient is the Wilks coefficient of a bodyweight in kg (the lifted weight times it is the Wilks score)
+func WilksCoefficient(sex string, bodyweight float64) float64 {
+	if sex == sexFemale {
+		x := min(max(bodyweight, 26.51), 154.53)
+		return 500 / polynomial(x, 594.31747775582, -27.23842536447, 0.82112226871, -0.00930733913, 4.731582e-05, -9.054e-08)
+	}
+	x := min(max(bodyweight, 40), 201.9)
+	return 500 / polynomial(x, -216.0475144, 16.2606339, -0.002388645, -0.00113732, 7.01863e-06, -1.291e-08)
+}
+
+// DotsCoefficient is the DOTS coefficient of a bodyweight in kg (the lifted weight times it is the DOTS score)
+func DotsCoefficient(sex string, bodyweight float64) float64 {
+	if sex == sexFemale {
+		x := min(max(bodyweight, 40), 150)
+		return 500 / polynomial(x, -57.96288, 13.6175032, -0.1126655495, 0.0005158568, -0.0000010706)
+	}
+	x := min(max(bodyweight, 40), 210)
+	return 500 / polynomial(x, -307.75076, 24.0900756, -0.1918759221, 0.0007391293, -0.000001093)
+}
+
+// polynomial evaluates the polynomial with the coefficients (lowest power first) at x
+func polynomial(x float64, coefficients ...float64) (result float64) {
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = result*x + coefficients[i]
+	}
+	return result
+}
+
+// roundRecord rounds an estimated value to 2 decimal places (so that float noise can't make a record)
+func roundRecord(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// recordCandidate is a value a set achieved that may be a personal record
+type recordCandidate struct {
+	kind     string
+	reps     int
+	distance float64
+	value    float64
+	// lowerIsBetter is set for times
+	lowerIsBetter bool
+}
+
+func setRecordCandidates(set WorkoutSet) []recordCandidate {
+	result := make([]recordCandidate, 0, 5)
+	if set.Reps != nil && set.Weight != nil && *set.Reps > 0 && *set.Weight > 0 {
+		if *set.Reps <= maxRepsForE1rm {
+			result = append(result,
+				recordCandidate{kind: recordE1rmEpley, value: roundRecord(Epley(*set.Weight, *set.Reps))},
+				recordCandidate{kind: recordE1rmBrzycki, value: roundRecord(Brzycki(*set.Weight, *set.Reps))},
+			)
+		}
+		if *set.Reps <= maxRepsForWeightReps {
+			result = append(result, recordCandidate{kind: recordWeightAtReps, reps: *set.Reps, value: *set.Weight})
+		}
+	}
+	if set.Distance != nil && *set.Distance > 0 {
+		result = append(result, recordCandidate{kind: recordLongestDist, value: *set.Distance})
+		if set.Duration != nil && *set.Duration > 0 {
+			result = append(result, recordCandidate{kind: recordFastestTime, distance: *set.Distance, value: *set.Duration, lowerIsBetter: true})
+		}
+	}
+	return result
+}
+
+// computeRecords derives all the personal records (history included) from a user's workouts
+//
+// Workouts are replayed in start time order - a set is a record if it beats the best so far
+// (the first performance of each kind is always a record)
+func computeRecords(userWorkouts []Workout) []PersonalRecord {
+	sorted := slices.Clone(userWorkouts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if !sorted[i].StartTime.Equal(sorted[j].StartTime) {
+			return sorted[i].StartTime.Before(sorted[j].StartTime)
+		}
+		return sorted[i].Id < sorted[j].Id
+	})
+	type recordKey struct {
+		exerciseId string
+		kind       string
+		reps       int
+		distance   float64
+	}
+	result := make([]PersonalRecord, 0)
+	best := map[recordKey]int{}
+	for _, w := range sorted {
+		for ei, we := range w.Exercises {
+			for si, set := range we.Sets {
+				for _, c := range setRecordCandidates(set) {
+					key := recordKey{exerciseId: we.ExerciseId, kind: c.kind, reps: c.reps, distance: c.distance}
+					var previous *float64
+					if i, ok := best[key]; ok {
+						prev := result[i].Value
+						if (c.lowerIsBetter && c.value >= prev) || (!c.lowerIsBetter && c.value <= prev) {
+							continue
+						}
+						result[i].Current = false
+						previous = &prev
+					}
+					r := PersonalRecord{
+						UserId:        w.UserId,
+						ExerciseId:    we.ExerciseId,
+						Kind:          c.kind,
+						Value:         c.value,
+						PreviousValue: previous,
+						WorkoutId:     w.Id,
+						ExerciseIndex: ei,
+						SetIndex:      si,
+						AchievedAt:    w.StartTime,
+						Current:       true,
+					}
+					if c.kind == recordWeightAtReps {
+						reps := c.reps
+						r.Reps = &reps
+					} else if c.kind == recordFastestTime {
+						distance := c.distance
+						r.Distance = &distance
+					}
+					best[key] = len(result)
+					result = append(result, r)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// recordUserLocks serialize the recomputes of each user's records (a *sync.Mutex by user id) - so that
+// a recompute from older workouts can't replace the records of a later one
+//
+// A user's lock is dropped when the user is deleted
+var recordUserLocks sync.Map
+
+// recomputeRecords re-derives a user's personal records from all their workouts
+//
+// Called whenever a workout is saved or deleted - so that back-dated, edited and deleted workouts
+// are reflected in the records
+func recomputeRecords(ctx context.Context, userId string) error {
+	lock, _ := recordUserLocks.LoadOrStore(userId, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+	userWorkouts, err := workouts.List(ctx, WorkoutFilter{UserId: userId})
+	if err != nil {
+		return err
+	}
+	return records.Replace(ctx, userId, computeRecords(userWorkouts))
+}
+
+// updateRecords recomputes the user's records after a workout change - a failure is logged
+// rather than failing the (already saved) workout change
+func updateRecords(ctx context.Context, userId string) {
+	if err := recomputeRecords(ctx, userId); err != nil && !errors.Is(err, context.Canceled) {
+		loggerFrom(ctx).Error("recomputing personal records", "userId", userId, "error", err)
+	}
+}
+
+// weighRecords sets the bodyweight and relative strengths of the 1 rep max estimate records - all weighed
+// with the latest measured bodyweight, so that they are relative to the user as they are now
+func weighRecords(ctx context.Context, user User, rs []PersonalRecord) error {
+	if !slices.ContainsFunc(rs, isE1rmRecord) {
+		return nil
+	}
+	bodyweights, err := measurements.List(ctx, MeasurementFilter{UserId: user.Id, Kind: measurementBodyweight})
+	if err != nil || len(bodyweights) == 0 {
+		return err
+	}
+	bw := slices.MaxFunc(bodyweights, func(a, b Measurement) int {
+		return a.MeasuredAt.Compare(b.MeasuredAt)
+	}).Value
+	for i := range rs {
+		if !isE1rmRecord(rs[i]) {
+			continue
+		}
+		relative := roundRecord(rs[i].Value / bw)
+		rs[i].Bodyweight, rs[i].RelativeStrength = &bw, &relative
+		if user.Sex != "" {
+			wilks := roundRecord(rs[i].Value * WilksCoefficient(user.Sex, bw))
+			dots := roundRecord(rs[i].Value * DotsCoefficient(user.Sex, bw))
+			rs[i].Wilks, rs[i].Dots = &wilks, &dots
+		}
+	}
+	return nil
+}
+
+func isE1rmRecord(r PersonalRecord) bool {
+	return r.Kind == recordE1rmEpley || r.Kind == recordE1rmBrzycki
+}
+
+// flagRecords sets the personalRecords of each workout set that set a personal record
+func flagRecords(ctx context.Context, ws []Workout) error {
+	if len(ws) == 0 {
+		return nil
+	}
+	ids := make([]string, len(ws))
+	for i, w := range ws {
+		ids[i] = w.Id
+	}
+	found, err := records.List(ctx, RecordFilter{WorkoutIds: ids})
+	if err != nil {
+		return err
+	}
+	byWorkout := map[string][]PersonalRecord{}
+	for _, r := range found {
+		byWorkout[r.WorkoutId] = append(byWorkout[r.WorkoutId], r)
+	}
+	for i := range ws {
+		for _, r := range byWorkout[ws[i].Id] {
+			if r.ExerciseIndex < len(ws[i].Exercises) && r.SetIndex < len(ws[i].Exercises[r.ExerciseIndex].Sets) {
+				set := &ws[i].Exercises[r.ExerciseIndex].Sets[r.SetIndex]
+				if !slices.Contains(set.PersonalRecords, r.Kind) {
+					set.PersonalRecords = append(set.PersonalRecords, r.Kind)
+				}
+			}
+		}
+	}
+	return nil
+}
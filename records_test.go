@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRelativeStrengthCoefficients(t *testing.T) {
+	// reference values from the published Wilks and DOTS coefficient tables
+	for _, tc := range []struct {
+		sex        string
+		bodyweight float64
+		wilks      float64
+		dots       float64
+	}{
+		{sexMale, 60, 0.8529, 0.8440},
+		{sexMale, 75, 0.7126, 0.7174},
+		{sexMale, 100, 0.6086, 0.6155},
+		{sexMale, 120, 0.5749, 0.5743},
+		{sexFemale, 60, 1.1149, 1.1085},
+		{sexFemale, 75, 0.9506, 0.9740},
+		{sexFemale, 90, 0.8641, 0.8915},
+		// bodyweights beyond the ranges of the formulas are clamped to them
+		{sexMale, 30, 1.3354, 1.2711},
+		{sexMale, 250, 0.5315, 0.4956},
+	} {
+		if got := WilksCoefficient(tc.sex, tc.bodyweight); math.Abs(got-tc.wilks) > 0.00005 {
+			t.Errorf("%s %v kg Wilks coefficient %.4f, want %v", tc.sex, tc.bodyweight, got, tc.wilks)
+		}
+		if got := DotsCoefficient(tc.sex, tc.bodyweight); math.Abs(got-tc.dots) > 0.00005 {
+			t.Errorf("%s %v kg DOTS coefficient %.4f, want %v", tc.sex, tc.bodyweight, got, tc.dots)
+		}
+	}
+}
+
+func TestWeighRecords(t *testing.T) {
+	ctx := context.Background()
+	user, _ := testUser(t, "weigh")
+	user.Sex = sexMale
+	at := func(d int) time.Time { return time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC).AddDate(0, 0, d) }
+	rs := []PersonalRecord{
+		{Kind: recordE1rmEpley, Value: 200, AchievedAt: at(0)},
+		{Kind: recordWeightAtReps, Value: 180, AchievedAt: at(0)},
+	}
+	if err := weighRecords(ctx, user, rs); err != nil || rs[0].Bodyweight != nil {
+		t.Fatalf("weighed without a bodyweight %v %v", rs[0].Bodyweight, err)
+	}
+	for d, bw := range map[int]float64{-10: 90, 10: 100, 5: 95} {
+		if _, err := measurements.Create(ctx, Measurement{UserId: user.Id, Kind: measurementBodyweight, MeasuredAt: at(d), Value: bw, Unit: unitKg}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := measurements.Create(ctx, Measurement{UserId: user.Id, Kind: "waist", MeasuredAt: at(20), Value: 90, Unit: unitCm}); err != nil {
+		t.Fatal(err)
+	}
+	if err := weighRecords(ctx, user, rs); err != nil {
+		t.Fatal(err)
+	}
+	// records are weighed with the latest bodyweight - even ones set before it was measured
+	if r := rs[0]; deref(r.Bodyweight) != 100.0 || deref(r.RelativeStrength) != 2.0 || deref(r.Wilks) != 121.72 || deref(r.Dots) != 123.1 {
+		t.Errorf("weighed %v %v %v %v", deref(r.Bodyweight), deref(r.RelativeStrength), deref(r.Wilks), deref(r.Dots))
+	}
+	if rs[1].Bodyweight != nil || rs[1].RelativeStrength != nil {
+		t.Errorf("weighed a weight at reps record")
+	}
+}
@@ -0,0 +1,528 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+type ScheduledWorkout struct {
+	Id           string      `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId       string      `json:"userId" oas:"description: db oid of the User (from the path - ignored on input)"`
+	Date         string      `json:"date" oas:"description: date (YYYY-MM-DD) of the session (the first occurrence of a recurring session), required, pattern: '^[0-9]{4}-[0-9]{2}-[0-9]{2}$'"`
+	StartTime    string      `json:"startTime,omitempty" oas:"description: time of day (HH:MM) the session starts (absent for an all day session), pattern: '^([01][0-9]|2[0-3]):[0-5][0-9]$'"`
+	Duration     int         `json:"duration,omitempty" oas:"description: planned length in minutes of a session with a startTime (defaults to 60), minimum: 1, maximum: 1440"`
+	TimeZone     string      `json:"timeZone,omitempty" oas:"description: IANA time zone of the date and startTime (defaults to UTC), maxLength: 64"`
+	TemplateId   string      `json:"templateId,omitempty" oas:"description: db oid of the Template to perform (from the library or of the User or of their coaches), pattern: '^[0-9a-f]{24}$'"`
+	Title        string      `json:"title,omitempty" oas:"description: title of the session (defaults to the Template name), maxLength: 100"`
+	Notes        string      `json:"notes,omitempty" oas:"description: free text notes for the session, maxLength: 2000"`
+	Status       string      `json:"status" oas:"$ref: ScheduleStatus"`
+	WorkoutId    string      `json:"workoutId,omitempty" oas:"description: db oid of the Workout logged for a done session, pattern: '^[0-9a-f]{24}$'"`
+	Recurrence   *Recurrence `json:"recurrence,omitempty" oas:"description: how the session recurs (absent for a one-off session)"`
+	SkippedDates []string    `json:"skippedDates" oas:"description: dates (YYYY-MM-DD) of occurrences of a recurring session that are skipped, type: array, itemType: string"`
+}
+
+type Recurrence struct {
+	Frequency string   `json:"frequency" oas:"$ref: RecurrenceFrequency, required"`
+	Interval  int      `json:"interval,omitempty" oas:"description: recur every interval days or weeks or months (defaults to 1), minimum: 1, maximum: 52"`
+	Weekdays  []string `json:"weekdays,omitempty" oas:"$ref: Weekday, type: array"`
+	Count     *int     `json:"count,omitempty" oas:"description: number of occurrences (not with until), minimum: 1, maximum: 1000"`
+	Until     string   `json:"until,omitempty" oas:"description: date (YYYY-MM-DD) of the last possible occurrence (not with count), pattern: '^[0-9]{4}-[0-9]{2}-[0-9]{2}$'"`
+}
+
+type CalendarFeed struct {
+	Token string `json:"token" oas:"description: the secret feed token (only ever shown when created)"`
+	Href  string `json:"href" oas:"description: path of the calendar feed (including the token) to subscribe to"`
+}
+
+const (
+	scheduleStatusPlanned = "planned"
+	scheduleStatusDone    = "done"
+	scheduleStatusSkipped = "skipped"
+)
+
+// ScheduleStatuses are the statuses of a scheduled workout
+var ScheduleStatuses = []string{scheduleStatusDone, scheduleStatusPlanned, scheduleStatusSkipped}
+
+// RecurrenceFrequencies are the frequencies a scheduled workout can recur at
+var RecurrenceFrequencies = []string{"daily", "monthly", "weekly"}
+
+// Weekdays are the RFC 5545 weekday codes (in week order)
+var Weekdays = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
+
+// SchedulePath is the scheduled workouts of a User (nested under the user path)
+var SchedulePath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getSchedule,
+			OperationId: "listScheduledWorkouts",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			QueryParams: scheduleListing.queryParams(
+				chioas.QueryParam{
+					Name:        "status",
+					Description: "Only scheduled workouts with this status",
+					SchemaRef:   "ScheduleStatus",
+				},
+			),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of ScheduledWorkouts",
+					IsArray:     true,
+					SchemaRef:   "ScheduledWorkout",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postScheduledWorkout,
+			OperationId: "createScheduledWorkout",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+			Request: &chioas.Request{
+				Description: "ScheduledWorkout to create (any _id and userId are ignored)",
+				Required:    true,
+				SchemaRef:   "ScheduledWorkout",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created ScheduledWorkout",
+					SchemaRef:   "ScheduledWorkout",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{scheduledId}": {
+			PathParams: chioas.PathParams{
+				"scheduledId": {
+					Description: "ScheduledWorkout db oid",
+					Example:     "66971add3abcef545e644010",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getScheduledWorkout,
+					OperationId: "getScheduledWorkout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "ScheduledWorkout",
+							SchemaRef:   "ScheduledWorkout",
+						},
+					},
+				},
+				http.MethodPut: {
+					Handler:     putScheduledWorkout,
+					OperationId: "replaceScheduledWorkout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					Request: &chioas.Request{
+						Description: "Replacement ScheduledWorkout (any _id and userId are ignored)",
+						Required:    true,
+						SchemaRef:   "ScheduledWorkout",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated ScheduledWorkout",
+							SchemaRef:   "ScheduledWorkout",
+						},
+					},
+				},
+				http.MethodPatch: {
+					Handler:     patchScheduledWorkout,
+					OperationId: "updateScheduledWorkout",
+					Description: "Mark a session done by patching its status (and the workoutId of the logged Workout)",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					Request: &chioas.Request{
+						Description: "JSON Merge Patch (RFC 7396) to apply to the ScheduledWorkout (any _id and userId are ignored)",
+						Required:    true,
+						ContentType: contentTypeMergePatch,
+						SchemaRef:   "ScheduledWorkout",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated ScheduledWorkout",
+							SchemaRef:   "ScheduledWorkout",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteScheduledWorkout,
+					OperationId: "deleteScheduledWorkout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser, Coach: true}),
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "ScheduledWorkout deleted",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+// CalendarPath is the iCalendar feed of a User's scheduled workouts (nested under the user path)
+//
+// Calendar apps can't send bearer tokens - so the feed is authorized by its own token query param
+var CalendarPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:          getCalendar,
+			OperationId:      "getCalendar",
+			Description:      "The scheduled workouts as an RFC 5545 iCalendar feed (for subscribing to from calendar apps)",
+			OptionalSecurity: true,
+			QueryParams: chioas.QueryParams{
+				{
+					Name:        "token",
+					Description: "The calendar feed token (see POST /users/{id}/calendar-token)",
+					Required:    true,
+				},
+			},
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "iCalendar feed",
+					ContentType: contentTypeCalendar,
+					Schema:      &chioas.Schema{Type: "string"},
+				},
+			},
+		},
+	},
+}
+
+// CalendarTokenPath manages the token of a User's calendar feed (nested under the user path)
+var CalendarTokenPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodPost: {
+			Handler:     postCalendarToken,
+			OperationId: "createCalendarToken",
+			Description: "Creates a new calendar feed token - revoking any previous token",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser}),
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "The calendar feed",
+					SchemaRef:   "CalendarFeed",
+				},
+			},
+		},
+		http.MethodDelete: {
+			Handler:     deleteCalendarToken,
+			OperationId: "deleteCalendarToken",
+			Description: "Revokes the calendar feed token",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser}),
+			Responses: chioas.Responses{
+				http.StatusNoContent: {
+					Description: "Calendar feed token revoked",
+				},
+			},
+		},
+	},
+}
+
+var ScheduleSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "ScheduledWorkout",
+		Description: "A planned (possibly recurring) workout session of a User",
+		Comment:     chioas.SourceComment(),
+	}).Must(ScheduledWorkout{}),
+	(&chioas.Schema{
+		Name:        "CalendarFeed",
+		Description: "The iCalendar feed of a User's scheduled workouts",
+		Comment:     chioas.SourceComment(),
+	}).Must(CalendarFeed{}),
+	enumSchema("ScheduleStatus", "The status of a scheduled workout (defaults to planned)", ScheduleStatuses),
+	enumSchema("RecurrenceFrequency", "How often a scheduled workout recurs", RecurrenceFrequencies),
+	enumSchema("Weekday", "A weekday (RFC 5545 code) that a weekly scheduled workout recurs on", Weekdays),
+}
+
+var scheduleListing = listing[ScheduledWorkout]{
+	id: func(s ScheduledWorkout) string { return s.Id },
+	fields: sortFields[ScheduledWorkout]{
+		"_id":  func(s ScheduledWorkout) string { return s.Id },
+		"date": func(s ScheduledWorkout) string { return s.Date + "T" + s.StartTime },
+	},
+	defaultSort: "date",
+}
+
+// schedule is the store used by the schedule and calendar handlers (replaced by a file-backed store in main)
+var schedule = NewMemoryScheduleStore()
+
+func getSchedule(writer http.ResponseWriter, request *http.Request) {
+	userId := chi.URLParam(request, "id")
+	if _, err := users.Get(request.Context(), userId); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result, err := schedule.List(request.Context(), ScheduleFilter{UserId: userId, Status: request.URL.Query().Get("status")})
+	if err == nil {
+		result, err = scheduleListing.paginate(writer, request, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postScheduledWorkout(writer http.ResponseWriter, request *http.Request) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var scheduled ScheduledWorkout
+	if err = decodeJson(request, &scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	scheduled.UserId = user.Id
+	if err = checkScheduledWorkout(request.Context(), user, &scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if scheduled, err = schedule.Create(request.Context(), scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+scheduled.Id)
+	writeJson(writer, request, http.StatusCreated, scheduled)
+}
+
+func getScheduledWorkout(writer http.ResponseWriter, request *http.Request) {
+	scheduled, err := userScheduledWorkout(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, scheduled)
+}
+
+func putScheduledWorkout(writer http.ResponseWriter, request *http.Request) {
+	existing, err := userScheduledWorkout(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user, err := users.Get(request.Context(), existing.UserId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var scheduled ScheduledWorkout
+	if err = decodeJson(request, &scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	scheduled.Id, scheduled.UserId = existing.Id, existing.UserId
+	if err = checkScheduledWorkout(request.Context(), user, &scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if scheduled, err = schedule.Update(request.Context(), scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, scheduled)
+}
+
+func patchScheduledWorkout(writer http.ResponseWriter, request *http.Request) {
+	existing, err := userScheduledWorkout(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user, err := users.Get(request.Context(), existing.UserId)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		return
+	}
+	scheduled := existing
+	if err = applyMergePatch(&scheduled, patch); err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "invalid merge patch: %s", err.Error()))
+		return
+	}
+	scheduled.Id, scheduled.UserId = existing.Id, existing.UserId
+	if err = checkScheduledWorkout(request.Context(), user, &scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if scheduled, err = schedule.Update(request.Context(), scheduled); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, scheduled)
+}
+
+func deleteScheduledWorkout(writer http.ResponseWriter, request *http.Request) {
+	scheduled, err := userScheduledWorkout(request)
+	if err == nil {
+		err = schedule.Delete(request.Context(), scheduled.Id)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// userScheduledWorkout gets the path scheduled workout - which must be of the path user
+func userScheduledWorkout(request *http.Request) (ScheduledWorkout, error) {
+	id := chi.URLParam(request, "scheduledId")
+	scheduled, err := schedule.Get(request.Context(), id)
+	if err == nil && scheduled.UserId != chi.URLParam(request, "id") {
+		err = fmt.Errorf("schedule %q %w", id, ErrNotFound)
+	}
+	return scheduled, err
+}
+
+// checkScheduledWorkout performs the checks that can't be expressed in the ScheduledWorkout schema (and normalizes defaults)
+func checkScheduledWorkout(ctx context.Context, user User, scheduled *ScheduledWorkout) error {
+	if scheduled.Status == "" {
+		scheduled.Status = scheduleStatusPlanned
+	}
+	if scheduled.SkippedDates == nil {
+		scheduled.SkippedDates = []string{}
+	}
+	slices.Sort(scheduled.SkippedDates)
+	scheduled.SkippedDates = slices.Compact(scheduled.SkippedDates)
+	if scheduled.StartTime != "" && scheduled.Duration == 0 {
+		scheduled.Duration = 60
+	}
+	errs := make([]FieldError, 0)
+	if _, err := time.Parse(time.DateOnly, scheduled.Date); err != nil {
+		errs = append(errs, FieldError{Path: "date", Message: "must be a date (YYYY-MM-DD)"})
+	}
+	if scheduled.TimeZone != "" {
+		if _, err := time.LoadLocation(scheduled.TimeZone); err != nil {
+			errs = append(errs, FieldError{Path: "timeZone", Message: "is not a known time zone"})
+		}
+	}
+	if scheduled.TemplateId != "" {
+		if t, err := templates.Get(ctx, scheduled.TemplateId); errors.Is(err, ErrNotFound) ||
+			(err == nil && t.UserId != "" && t.UserId != user.Id && !slices.Contains(user.Coaches, t.UserId)) {
+			errs = append(errs, FieldError{Path: "templateId", Message: "template does not exist"})
+		} else if err != nil {
+			return err
+		}
+	}
+	if scheduled.WorkoutId != "" {
+		if w, err := workouts.Get(ctx, scheduled.WorkoutId); errors.Is(err, ErrNotFound) || (err == nil && w.UserId != user.Id) {
+			errs = append(errs, FieldError{Path: "workoutId", Message: "workout does not exist"})
+		} else if err != nil {
+			return err
+		}
+	}
+	if r := scheduled.Recurrence; r != nil {
+		if r.Interval == 0 {
+			r.Interval = 1
+		}
+		if r.Count != nil && r.Until != "" {
+			errs = append(errs, FieldError{Path: "recurrence", Message: "must not have both count and until"})
+		}
+		if r.Until != "" {
+			if _, err := time.Parse(time.DateOnly, r.Until); err != nil {
+				errs = append(errs, FieldError{Path: "recurrence.until", Message: "must be a date (YYYY-MM-DD)"})
+			} else if r.Until < scheduled.Date {
+				errs = append(errs, FieldError{Path: "recurrence.until", Message: "must not be before date"})
+			}
+		}
+		if len(r.Weekdays) > 0 && r.Frequency != "weekly" {
+			errs = append(errs, FieldError{Path: "recurrence.weekdays", Message: "is only for weekly recurrences"})
+		}
+	} else if len(scheduled.SkippedDates) > 0 {
+		errs = append(errs, FieldError{Path: "skippedDates", Message: "is only for recurring sessions (use status for a one-off session)"})
+	}
+	for i, d := range scheduled.SkippedDates {
+		if _, err := time.Parse(time.DateOnly, d); err != nil {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("skippedDates[%d]", i), Message: "must be a date (YYYY-MM-DD)"})
+		}
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "scheduled workout failed validation")
+		p.Errors = errs
+		return p
+	}
+	return nil
+}
+
+func postCalendarToken(writer http.ResponseWriter, request *http.Request) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if err = auth.PutCalendarToken(request.Context(), CalendarToken{
+		UserId:    user.Id,
+		TokenHash: hashCalendarToken(token),
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusCreated, CalendarFeed{
+		Token: token,
+		Href:  "/users/" + user.Id + "/calendar.ics?" + url.Values{"token": {token}}.Encode(),
+	})
+}
+
+func deleteCalendarToken(writer http.ResponseWriter, request *http.Request) {
+	if err := auth.DeleteCalendarToken(request.Context(), chi.URLParam(request, "id")); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func hashCalendarToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func getCalendar(writer http.ResponseWriter, request *http.Request) {
+	userId := chi.URLParam(request, "id")
+	ct, err := auth.GetCalendarToken(request.Context(), userId)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		writeError(writer, request, err)
+		return
+	}
+	if err != nil || subtle.ConstantTimeCompare([]byte(ct.TokenHash), []byte(hashCalendarToken(request.URL.Query().Get("token")))) != 1 {
+		// same response for unknown users - so the feed doesn't reveal which users exist
+		writeError(writer, request, newProblem(http.StatusForbidden, "invalid calendar token"))
+		return
+	}
+	items, err := schedule.List(request.Context(), ScheduleFilter{UserId: userId})
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	data, err := scheduleCalendar(request.Context(), items, time.Now())
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Content-Type", contentTypeCalendar)
+	writer.Header().Set("Cache-Control", "private, no-cache")
+	writer.WriteHeader(http.StatusOK)
+	if _, err = writer.Write(data); err != nil {
+		loggerFrom(request.Context()).Warn("writing response", "error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+)
+
+// ScheduleStore is the persistence interface for scheduled workouts
+type ScheduleStore interface {
+	List(ctx context.Context, filter ScheduleFilter) ([]ScheduledWorkout, error)
+	Get(ctx context.Context, id string) (ScheduledWorkout, error)
+	Create(ctx context.Context, scheduled ScheduledWorkout) (ScheduledWorkout, error)
+	Update(ctx context.Context, scheduled ScheduledWorkout) (ScheduledWorkout, error)
+	Delete(ctx context.Context, id string) error
+	// DeleteUserSchedule deletes all of a user's scheduled workouts (e.g. when the user is deleted)
+	DeleteUserSchedule(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// ScheduleFilter filters listed scheduled workouts - zero value fields are not filtered on
+type ScheduleFilter struct {
+	UserId     string
+	Status     string
+	TemplateId string
+}
+
+func (f ScheduleFilter) matches(s ScheduledWorkout) bool {
+	return (f.UserId == "" || s.UserId == f.UserId) &&
+		(f.Status == "" || s.Status == f.Status) &&
+		(f.TemplateId == "" || s.TemplateId == f.TemplateId)
+}
+
+// NewMemoryScheduleStore creates a ScheduleStore that is held in memory only
+func NewMemoryScheduleStore() ScheduleStore {
+	return &scheduleStore{items: newMemoryCollection[ScheduledWorkout]("schedule", scheduledWorkoutId)}
+}
+
+// OpenFileScheduleStore opens (or creates) a file-backed ScheduleStore in the given directory
+func OpenFileScheduleStore(dir string) (ScheduleStore, error) {
+	c, err := openFileCollection[ScheduledWorkout](dir, "schedule", scheduledWorkoutId)
+	if err != nil {
+		return nil, err
+	}
+	return &scheduleStore{items: c}, nil
+}
+
+func scheduledWorkoutId(s *ScheduledWorkout) *string {
+	return &s.Id
+}
+
+type scheduleStore struct {
+	items *collection[ScheduledWorkout]
+}
+
+func (s *scheduleStore) List(ctx context.Context, filter ScheduleFilter) ([]ScheduledWorkout, error) {
+	return s.items.list(ctx, filter.matches)
+}
+
+func (s *scheduleStore) Get(ctx context.Context, id string) (ScheduledWorkout, error) {
+	return s.items.get(ctx, id)
+}
+
+func (s *scheduleStore) Create(ctx context.Context, scheduled ScheduledWorkout) (ScheduledWorkout, error) {
+	return s.items.create(ctx, scheduled, nil)
+}
+
+func (s *scheduleStore) Update(ctx context.Context, scheduled ScheduledWorkout) (ScheduledWorkout, error) {
+	return s.items.update(ctx, scheduled, nil)
+}
+
+func (s *scheduleStore) Delete(ctx context.Context, id string) error {
+	return s.items.delete(ctx, id)
+}
+
+func (s *scheduleStore) DeleteUserSchedule(ctx context.Context, userId string) error {
+	_, err := s.items.deleteWhere(ctx, func(existing ScheduledWorkout) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *scheduleStore) Ping(ctx context.Context) error {
+	return s.items.ping(ctx)
+}
+
+func (s *scheduleStore) Close() error {
+	return s.items.close()
+}
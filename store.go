@@ -0,0 +1,477 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by stores when the requested record does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned by stores when a write would violate a uniqueness constraint
+	ErrConflict = errors.New("conflict")
+	// ErrStoreClosed is returned by stores for writes after the store has been closed
+	ErrStoreClosed = errors.New("store is closed")
+)
+
+// collection is an embedded document collection keyed by id
+//
+// When file is empty the collection is held in memory only, otherwise every write
+// rewrites the whole collection to the file (via a temp file and rename, so a crash
+// never leaves a half-written file behind)
+type collection[T any] struct {
+	name   string
+	file   string
+	idOf   func(*T) *string
+	mutex  sync.RWMutex
+	items  map[string]T
+	closed bool
+}
+
+func newMemoryCollection[T any](name string, idOf func(*T) *string) *collection[T] {
+	return &collection[T]{
+		name:  name,
+		idOf:  idOf,
+		items: map[string]T{},
+	}
+}
+
+func openFileCollection[T any](dir string, name string, idOf func(*T) *string) (*collection[T], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	c := newMemoryCollection[T](name, idOf)
+	c.file = filepath.Join(dir, name+".json")
+	data, err := os.ReadFile(c.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var items []T
+	if err = json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		c.items[*c.idOf(&item)] = item
+	}
+	return c, nil
+}
+
+// list returns all items matching the (optional) filter, ordered by id
+func (c *collection[T]) list(ctx context.Context, filter func(T) bool) (result []T, err error) {
+	defer startStoreOp(ctx, c.name, "list")(&err)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.sorted(filter), nil
+}
+
+func (c *collection[T]) get(ctx context.Context, id string) (item T, err error) {
+	defer startStoreOp(ctx, c.name, "get")(&err)
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if item, ok := c.items[id]; ok {
+		return item, nil
+	}
+	return zero, c.notFound(id)
+}
+
+// create stores a new item - assigning it a new id
+//
+// The optional check is called (under the write lock) with the existing items so that
+// callers can enforce uniqueness constraints
+func (c *collection[T]) create(ctx context.Context, item T, check func(existing T) error) (_ T, err error) {
+	defer startStoreOp(ctx, c.name, "create")(&err)
+	if err := ctx.Err(); err != nil {
+		return item, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.check(check, ""); err != nil {
+		return item, err
+	}
+	id := newObjectId()
+	*c.idOf(&item) = id
+	c.items[id] = item
+	if err := c.save(); err != nil {
+		delete(c.items, id)
+		return item, err
+	}
+	return item, nil
+}
+
+// put stores an item under its own (caller assigned) id - inserting or replacing
+func (c *collection[T]) put(ctx context.Context, item T) (err error) {
+	defer startStoreOp(ctx, c.name, "put")(&err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	id := *c.idOf(&item)
+	prev, existed := c.items[id]
+	c.items[id] = item
+	if err := c.save(); err != nil {
+		if existed {
+			c.items[id] = prev
+		} else {
+			delete(c.items, id)
+		}
+		return err
+	}
+	return nil
+}
+
+// update replaces an existing item (identified by its id)
+func (c *collection[T]) update(ctx context.Context, item T, check func(existing T) error) (_ T, err error) {
+	defer startStoreOp(ctx, c.name, "update")(&err)
+	if err := ctx.Err(); err != nil {
+		return item, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	id := *c.idOf(&item)
+	prev, ok := c.items[id]
+	if !ok {
+		return item, c.notFound(id)
+	}
+	if err := c.check(check, id); err != nil {
+		return item, err
+	}
+	c.items[id] = item
+	if err := c.save(); err != nil {
+		c.items[id] = prev
+		return item, err
+	}
+	return item, nil
+}
+
+func (c *collection[T]) delete(ctx context.Context, id string) (err error) {
+	defer startStoreOp(ctx, c.name, "delete")(&err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	prev, ok := c.items[id]
+	if !ok {
+		return c.notFound(id)
+	}
+	delete(c.items, id)
+	if err := c.save(); err != nil {
+		c.items[id] = prev
+		return err
+	}
+	return nil
+}
+
+// deleteWhere deletes all items matching the predicate, returning how many were deleted
+func (c *collection[T]) deleteWhere(ctx context.Context, match func(T) bool) (_ int, err error) {
+	defer startStoreOp(ctx, c.name, "deleteWhere")(&err)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	deleted := map[string]T{}
+	for id, item := range c.items {
+		if match(item) {
+			deleted[id] = item
+			delete(c.items, id)
+		}
+	}
+	if len(deleted) > 0 {
+		if err := c.save(); err != nil {
+			for id, item := range deleted {
+				c.items[id] = item
+			}
+			return 0, err
+		}
+	}
+	return len(deleted), nil
+}
+
+// updateWhere atomically replaces each item matching the predicate with fn of it, returning how many were updated
+func (c *collection[T]) updateWhere(ctx context.Context, match func(T) bool, fn func(T) T) (_ int, err error) {
+	defer startStoreOp(ctx, c.name, "updateWhere")(&err)
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	prev := map[string]T{}
+	for id, item := range c.items {
+		if match(item) {
+			prev[id] = item
+			c.items[id] = fn(item)
+		}
+	}
+	if len(prev) > 0 {
+		if err := c.save(); err != nil {
+			for id, item := range prev {
+				c.items[id] = item
+			}
+			return 0, err
+		}
+	}
+	return len(prev), nil
+}
+
+// replaceWhere atomically replaces all items matching the predicate with the given items
+//
+// Items without an id keep the id of the replaced item with the same key (when keysOf is given - it gives
+// the keys of a list of items, so that a key may depend on the other items) - or are assigned a new one
+func (c *collection[T]) replaceWhere(ctx context.Context, match func(T) bool, keysOf func([]T) []string, items []T) (err error) {
+	defer startStoreOp(ctx, c.name, "replaceWhere")(&err)
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	prev := make(map[string]T, len(c.items))
+	var replaced []T
+	for id, item := range c.items {
+		prev[id] = item
+		if match(item) {
+			replaced = append(replaced, item)
+			delete(c.items, id)
+		}
+	}
+	replacedIds := map[string]string{}
+	var keys []string
+	if keysOf != nil {
+		for i, key := range keysOf(replaced) {
+			replacedIds[key] = *c.idOf(&replaced[i])
+		}
+		keys = keysOf(items)
+	}
+	for i, item := range items {
+		if *c.idOf(&item) == "" && keys != nil {
+			*c.idOf(&item) = replacedIds[keys[i]]
+		}
+		if *c.idOf(&item) == "" {
+			*c.idOf(&item) = newObjectId()
+		}
+		c.items[*c.idOf(&item)] = item
+	}
+	if err = c.save(); err != nil {
+		c.items = prev
+		return err
+	}
+	return nil
+}
+
+// ping checks that the collection is open and (if file-backed) that its directory is still there
+func (c *collection[T]) ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.closed {
+		return fmt.Errorf("%s: %w", c.name, ErrStoreClosed)
+	} else if c.file != "" {
+		if _, err := os.Stat(filepath.Dir(c.file)); err != nil {
+			return fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+	return nil
+}
+
+// close waits for any in-progress write to finish and then refuses further writes
+func (c *collection[T]) close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *collection[T]) notFound(id string) error {
+	return fmt.Errorf("%s %q %w", c.name, id, ErrNotFound)
+}
+
+func (c *collection[T]) check(check func(existing T) error, skipId string) error {
+	if check != nil {
+		for id, existing := range c.items {
+			if id != skipId {
+				if err := check(existing); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (c *collection[T]) sorted(filter func(T) bool) []T {
+	ids := make([]string, 0, len(c.items))
+	for id := range c.items {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := make([]T, 0, len(ids))
+	for _, id := range ids {
+		if item := c.items[id]; filter == nil || filter(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func (c *collection[T]) save() error {
+	if c.closed {
+		return fmt.Errorf("%s: %w", c.name, ErrStoreClosed)
+	} else if c.file == "" {
+		return nil
+	}
+	return writeJsonFile(c.file, c.sorted(nil))
+}
+
+// documents are items kept in a file each (rather than all in one collection file) - for items too big
+// to be held in memory or to be rewritten on every write of a collection
+//
+// When dir is empty the documents are held in memory only
+type documents[T any] struct {
+	name   string
+	dir    string
+	mutex  sync.RWMutex
+	items  map[string]T
+	closed bool
+}
+
+func newMemoryDocuments[T any](name string) *documents[T] {
+	return &documents[T]{
+		name:  name,
+		items: map[string]T{},
+	}
+}
+
+// openFileDocuments opens the documents in the name sub-directory of dir
+func openFileDocuments[T any](dir string, name string) (*documents[T], error) {
+	d := &documents[T]{name: name, dir: filepath.Join(dir, name)}
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *documents[T]) get(ctx context.Context, id string) (item T, err error) {
+	defer startStoreOp(ctx, d.name, "get")(&err)
+	var zero T
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.dir == "" {
+		if item, ok := d.items[id]; ok {
+			return item, nil
+		}
+		return zero, d.notFound(id)
+	}
+	data, err := os.ReadFile(d.file(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return zero, d.notFound(id)
+	} else if err != nil {
+		return zero, err
+	}
+	if err = json.Unmarshal(data, &item); err != nil {
+		return zero, fmt.Errorf("%s %q: %w", d.name, id, err)
+	}
+	return item, nil
+}
+
+// put stores a document under the id - inserting or replacing
+func (d *documents[T]) put(ctx context.Context, id string, item T) (err error) {
+	defer startStoreOp(ctx, d.name, "put")(&err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return fmt.Errorf("%s: %w", d.name, ErrStoreClosed)
+	} else if d.dir == "" {
+		d.items[id] = item
+		return nil
+	}
+	return writeJsonFile(d.file(id), item)
+}
+
+// delete deletes the documents of the ids - ids without a document are ignored
+func (d *documents[T]) delete(ctx context.Context, ids ...string) (err error) {
+	defer startStoreOp(ctx, d.name, "delete")(&err)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return fmt.Errorf("%s: %w", d.name, ErrStoreClosed)
+	}
+	for _, id := range ids {
+		if d.dir == "" {
+			delete(d.items, id)
+		} else if err := os.Remove(d.file(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// close waits for any in-progress write to finish and then refuses further writes
+func (d *documents[T]) close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.closed = true
+	return nil
+}
+
+func (d *documents[T]) file(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+func (d *documents[T]) notFound(id string) error {
+	return fmt.Errorf("%s %q %w", d.name, id, ErrNotFound)
+}
+
+var objectIdCounter atomic.Uint32
+var objectIdProcess = func() (b [5]byte) {
+	_, _ = rand.Read(b[:])
+	return
+}()
+
+func init() {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	objectIdCounter.Store(binary.BigEndian.Uint32(b[:]))
+}
+
+// newObjectId generates a 24 hex char id in the same layout as a MongoDB ObjectId
+// (4 byte timestamp, 5 byte process random, 3 byte counter) - so ids sort by creation time
+func newObjectId() string {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[0:4], uint32(time.Now().Unix()))
+	copy(b[4:9], objectIdProcess[:])
+	c := objectIdCounter.Add(1)
+	b[9], b[10], b[11] = byte(c>>16), byte(c>>8), byte(c)
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// tcxSports are the TCX sports (others are "other")
+var tcxSports = map[string]string{"running": "running", "biking": "cycling"}
+
+type tcxDatabase struct {
+	XMLName    xml.Name      `xml:"TrainingCenterDatabase"`
+	Activities []tcxActivity `xml:"Activities>Activity"`
+}
+
+type tcxActivity struct {
+	Sport string   `xml:"Sport,attr"`
+	Id    string   `xml:"Id"`
+	Laps  []tcxLap `xml:"Lap"`
+	Notes string   `xml:"Notes"`
+}
+
+type tcxLap struct {
+	StartTime        string          `xml:"StartTime,attr"`
+	TotalTimeSeconds float64         `xml:"TotalTimeSeconds"`
+	DistanceMeters   *float64        `xml:"DistanceMeters"`
+	AverageHeartRate *tcxValue       `xml:"AverageHeartRateBpm"`
+	MaximumHeartRate *tcxValue       `xml:"MaximumHeartRateBpm"`
+	Trackpoints      []tcxTrackpoint `xml:"Track>Trackpoint"`
+}
+
+type tcxTrackpoint struct {
+	Time           string       `xml:"Time"`
+	Position       *tcxPosition `xml:"Position"`
+	AltitudeMeters *float64     `xml:"AltitudeMeters"`
+	DistanceMeters *float64     `xml:"DistanceMeters"`
+	HeartRate      *tcxValue    `xml:"HeartRateBpm"`
+}
+
+type tcxPosition struct {
+	Lat float64 `xml:"LatitudeDegrees"`
+	Lon float64 `xml:"LongitudeDegrees"`
+}
+
+type tcxValue struct {
+	Value float64 `xml:"Value"`
+}
+
+func (v *tcxValue) bpm() *int {
+	if v == nil || v.Value <= 0 {
+		return nil
+	}
+	bpm := int(v.Value)
+	return &bpm
+}
+
+// isTcx is whether data looks like a TCX file (an XML document with a TrainingCenterDatabase)
+func isTcx(data []byte) bool {
+	head := data[:min(len(data), 1024)]
+	return bytes.Contains(head, []byte("<TrainingCenterDatabase"))
+}
+
+// parseTcx parses the first activity of a TCX file
+func parseTcx(data []byte) (Activity, error) {
+	var db tcxDatabase
+	if err := xml.Unmarshal(data, &db); err != nil {
+		return Activity{}, fmt.Errorf("invalid TCX: %w", err)
+	}
+	if len(db.Activities) == 0 {
+		return Activity{}, errors.New("TCX file has no activities")
+	}
+	ta := db.Activities[0]
+	a := Activity{Format: activityFormatTcx, Sport: sportOther, notes: strings.TrimSpace(ta.Notes), Laps: []ActivityLap{}}
+	if sport, ok := tcxSports[strings.ToLower(ta.Sport)]; ok {
+		a.Sport = sport
+	}
+	if t, err := time.Parse(time.RFC3339, strings.TrimSpace(ta.Id)); err == nil {
+		a.StartTime = t
+	}
+	var points []activityPoint
+	for i, tl := range ta.Laps {
+		start, err := time.Parse(time.RFC3339, tl.StartTime)
+		if err != nil {
+			return Activity{}, fmt.Errorf("TCX lap %d has an invalid StartTime %q", i+1, tl.StartTime)
+		}
+		a.Laps = append(a.Laps, ActivityLap{
+			StartTime:        start,
+			Duration:         tl.TotalTimeSeconds,
+			Distance:         tl.DistanceMeters,
+			AverageHeartRate: tl.AverageHeartRate.bpm(),
+			MaxHeartRate:     tl.MaximumHeartRate.bpm(),
+		})
+		a.Duration += tl.TotalTimeSeconds
+		if tl.DistanceMeters != nil {
+			d := *tl.DistanceMeters
+			if a.Distance != nil {
+				d += *a.Distance
+			}
+			a.Distance = &d
+		}
+		for _, tp := range tl.Trackpoints {
+			t, err := time.Parse(time.RFC3339, strings.TrimSpace(tp.Time))
+			if err != nil {
+				return Activity{}, fmt.Errorf("TCX lap %d has a trackpoint with an invalid Time %q", i+1, tp.Time)
+			}
+			p := activityPoint{time: t, heartRate: tp.HeartRate.bpm(), distance: tp.DistanceMeters, elevation: tp.AltitudeMeters}
+			if tp.Position != nil {
+				if !validPosition(tp.Position.Lat, tp.Position.Lon) {
+					return Activity{}, fmt.Errorf("TCX lap %d has a trackpoint position (%g, %g) that is out of range", i+1, tp.Position.Lat, tp.Position.Lon)
+				}
+				p.position, p.lat, p.lon = true, tp.Position.Lat, tp.Position.Lon
+			}
+			points = append(points, p)
+		}
+	}
+	if a.StartTime.IsZero() && len(a.Laps) > 0 {
+		a.StartTime = a.Laps[0].StartTime
+	}
+	if err := a.fromPoints(points); err != nil {
+		return Activity{}, err
+	}
+	return a, nil
+}
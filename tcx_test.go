@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTcx(t *testing.T) {
+	a, err := parseTcx(readFixture(t, "ride.tcx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 5, 6, 17, 30, 0, 0, time.UTC); !a.StartTime.Equal(want) {
+		t.Errorf("start time %v, want %v", a.StartTime, want)
+	}
+	if a.Format != activityFormatTcx || a.Sport != "cycling" {
+		t.Errorf("format %q sport %q, want tcx cycling", a.Format, a.Sport)
+	}
+	if a.Duration != 1200 || a.ElapsedTime != 1200 {
+		t.Errorf("duration %v elapsed %v, want 1200 1200", a.Duration, a.ElapsedTime)
+	}
+	if a.Distance == nil || *a.Distance != 8000 {
+		t.Errorf("distance %v, want 8000 (the sum of the laps)", a.Distance)
+	}
+	if len(a.Laps) != 2 {
+		t.Fatalf("%d laps, want 2", len(a.Laps))
+	}
+	for i, want := range []struct {
+		start    time.Time
+		avg, max int
+	}{
+		{time.Date(2024, 5, 6, 17, 30, 0, 0, time.UTC), 128, 140},
+		{time.Date(2024, 5, 6, 17, 40, 0, 0, time.UTC), 142, 156},
+	} {
+		lap := a.Laps[i]
+		if !lap.StartTime.Equal(want.start) || lap.Duration != 600 || lap.Distance == nil || *lap.Distance != 4000 {
+			t.Errorf("lap %d started %v for %vs and %v m", i, lap.StartTime, lap.Duration, lap.Distance)
+		}
+		if lap.AverageHeartRate == nil || *lap.AverageHeartRate != want.avg || lap.MaxHeartRate == nil || *lap.MaxHeartRate != want.max {
+			t.Errorf("lap %d heart rate %v/%v, want %d/%d", i, lap.AverageHeartRate, lap.MaxHeartRate, want.avg, want.max)
+		}
+	}
+	if len(a.HeartRate) != 41 {
+		t.Fatalf("%d heart rate samples, want 41", len(a.HeartRate))
+	}
+	if first, last := a.HeartRate[0], a.HeartRate[len(a.HeartRate)-1]; first != (HeartRateSample{Offset: 0, Bpm: 118}) || last != (HeartRateSample{Offset: 1200, Bpm: 156}) {
+		t.Errorf("heart rate samples from %v to %v", first, last)
+	}
+	if a.AverageHeartRate == nil || *a.AverageHeartRate != 137 || a.MaxHeartRate == nil || *a.MaxHeartRate != 156 {
+		t.Errorf("heart rate %v/%v, want 137/156", a.AverageHeartRate, a.MaxHeartRate)
+	}
+	if len(a.Track) != 1 || len(a.Track[0].Points) != 41 {
+		t.Fatalf("track %v, want 1 segment of 41 points", a.Track)
+	}
+	if p := a.Track[0].Points[0]; p.Lat != 51.5007 || p.Lon != -0.1246 || p.Elevation == nil || *p.Elevation != 12 {
+		t.Errorf("first track point %+v", p)
+	}
+	if a.ElevationGain == nil || *a.ElevationGain != 35 {
+		t.Errorf("elevation gain %v, want 35", a.ElevationGain)
+	}
+}
+
+func TestParseTcxRejects(t *testing.T) {
+	ride := string(readFixture(t, "ride.tcx"))
+	for name, tc := range map[string]struct {
+		data string
+		want string
+	}{
+		"not XML":         {"TrainingCenterDatabase", "invalid TCX"},
+		"no activities":   {`<TrainingCenterDatabase><Activities></Activities></TrainingCenterDatabase>`, "no activities"},
+		"bad lap start":   {strings.Replace(ride, `StartTime="2024-05-06T17:30:00Z"`, `StartTime="yesterday"`, 1), "invalid StartTime"},
+		"bad point time":  {strings.Replace(ride, "<Time>2024-05-06T17:30:30Z</Time>", "<Time>soon</Time>", 1), "invalid Time"},
+		"latitude range":  {strings.Replace(ride, "<LatitudeDegrees>51.500700", "<LatitudeDegrees>91.5", 1), "out of range"},
+		"longitude range": {strings.Replace(ride, "<LongitudeDegrees>-0.124600", "<LongitudeDegrees>-180.5", 1), "out of range"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseTcx([]byte(tc.data)); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
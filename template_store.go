@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+)
+
+// TemplateStore is the persistence interface for workout templates
+type TemplateStore interface {
+	List(ctx context.Context, filter TemplateFilter) ([]Template, error)
+	Get(ctx context.Context, id string) (Template, error)
+	Create(ctx context.Context, template Template) (Template, error)
+	Update(ctx context.Context, template Template) (Template, error)
+	Delete(ctx context.Context, id string) error
+	// DeleteUserTemplates deletes all of a user's templates (e.g. when the user is deleted)
+	DeleteUserTemplates(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// TemplateFilter filters listed templates - zero value fields are not filtered on
+type TemplateFilter struct {
+	// UserId includes the user's own templates (library templates are always included)
+	UserId string
+}
+
+func (f TemplateFilter) matches(t Template) bool {
+	return t.UserId == "" || t.UserId == f.UserId
+}
+
+// NewMemoryTemplateStore creates a TemplateStore that is held in memory only
+func NewMemoryTemplateStore() TemplateStore {
+	return &templateStore{items: newMemoryCollection[Template]("templates", templateId)}
+}
+
+// OpenFileTemplateStore opens (or creates) a file-backed TemplateStore in the given directory
+func OpenFileTemplateStore(dir string) (TemplateStore, error) {
+	c, err := openFileCollection[Template](dir, "templates", templateId)
+	if err != nil {
+		return nil, err
+	}
+	return &templateStore{items: c}, nil
+}
+
+func templateId(t *Template) *string {
+	return &t.Id
+}
+
+type templateStore struct {
+	items *collection[Template]
+}
+
+func (s *templateStore) List(ctx context.Context, filter TemplateFilter) ([]Template, error) {
+	return s.items.list(ctx, filter.matches)
+}
+
+func (s *templateStore) Get(ctx context.Context, id string) (Template, error) {
+	return s.items.get(ctx, id)
+}
+
+func (s *templateStore) Create(ctx context.Context, template Template) (Template, error) {
+	return s.items.create(ctx, template, nil)
+}
+
+func (s *templateStore) Update(ctx context.Context, template Template) (Template, error) {
+	return s.items.update(ctx, template, nil)
+}
+
+func (s *templateStore) Delete(ctx context.Context, id string) error {
+	return s.items.delete(ctx, id)
+}
+
+func (s *templateStore) DeleteUserTemplates(ctx context.Context, userId string) error {
+	_, err := s.items.deleteWhere(ctx, func(existing Template) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *templateStore) Ping(ctx context.Context) error {
+	return s.items.ping(ctx)
+}
+
+func (s *templateStore) Close() error {
+	return s.items.close()
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"strings"
+)
+
+type Template struct {
+	Id        string             `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId    string             `json:"userId,omitempty" oas:"description: db oid of the owning User (absent for library templates), pattern: '^[0-9a-f]{24}$'"`
+	Name      string             `json:"name" oas:"description: name of the template, required, minLength: 1, maxLength: 100"`
+	Notes     string             `json:"notes,omitempty" oas:"description: free text notes for the session, maxLength: 2000"`
+	Exercises []TemplateExercise `json:"exercises" oas:"description: exercises in the order they are to be performed"`
+}
+
+type TemplateExercise struct {
+	ExerciseId string        `json:"exerciseId" oas:"description: db oid of the Exercise (from the catalogue or a custom exercise of the owning User), required, pattern: '^[0-9a-f]{24}$'"`
+	Notes      string        `json:"notes,omitempty" oas:"description: free text notes for the exercise, maxLength: 1000"`
+	Sets       []TemplateSet `json:"sets" oas:"description: sets in the order they are to be performed"`
+}
+
+type TemplateSet struct {
+	Reps       *int     `json:"reps,omitempty" oas:"description: target repetitions, minimum: 0"`
+	Weight     *float64 `json:"weight,omitempty" oas:"description: target load in kg - lb in imperial units (not with percent1rm), minimum: 0"`
+	Percent1rm *float64 `json:"percent1rm,omitempty" oas:"description: target load as a percentage of the 1 rep max (not with weight), minimum: 0, maximum: 200"`
+	RPE        *float64 `json:"rpe,omitempty" oas:"description: target rate of perceived exertion (1-10), minimum: 1, maximum: 10"`
+	Duration   *float64 `json:"duration,omitempty" oas:"description: target duration in seconds, minimum: 0"`
+	Distance   *float64 `json:"distance,omitempty" oas:"description: target distance in metres (miles in imperial units), minimum: 0"`
+}
+
+var TemplatePath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getTemplates,
+			OperationId: "listTemplates",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerQueryUserId, Coach: true, Shared: true}),
+			QueryParams: templateListing.queryParams(
+				unitsParam,
+				chioas.QueryParam{
+					Name:        "userId",
+					Description: "Include the templates of this User db oid (library templates are always included)",
+				},
+			),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of Templates",
+					IsArray:     true,
+					SchemaRef:   "Template",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postTemplate,
+			OperationId: "createTemplate",
+			Description: "Only admins may create library templates (without a userId)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerBodyUserId, Coach: true}),
+			QueryParams: chioas.QueryParams{unitsParam},
+			Request: &chioas.Request{
+				Description: "Template to create (any _id is ignored)",
+				Required:    true,
+				SchemaRef:   "Template",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created Template",
+					SchemaRef:   "Template",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{id}": {
+			PathParams: chioas.PathParams{
+				"id": {
+					Description: "Template db oid",
+					Example:     "66971add3abcef545e64400d",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getTemplate,
+					OperationId: "getTemplate",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathTemplate, Coach: true, Shared: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Template",
+							SchemaRef:   "Template",
+						},
+					},
+				},
+				http.MethodPut: {
+					Handler:     putTemplate,
+					OperationId: "replaceTemplate",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathTemplate, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Request: &chioas.Request{
+						Description: "Replacement Template (any _id and userId are ignored)",
+						Required:    true,
+						SchemaRef:   "Template",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Template",
+							SchemaRef:   "Template",
+						},
+					},
+				},
+				http.MethodPatch: {
+					Handler:     patchTemplate,
+					OperationId: "updateTemplate",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathTemplate, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Request: &chioas.Request{
+						Description: "JSON Merge Patch (RFC 7396) to apply to the Template (any _id and userId are ignored)",
+						Required:    true,
+						ContentType: contentTypeMergePatch,
+						SchemaRef:   "Template",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Template",
+							SchemaRef:   "Template",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteTemplate,
+					OperationId: "deleteTemplate",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathTemplate, Coach: true}),
+					Description: "Templates used by a program cannot be deleted (409)",
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Template deleted",
+						},
+					},
+				},
+			},
+		},
+	},
+}
+
+var TemplateSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Template",
+		Description: "A reusable Workout skeleton - either from the library or a User's own",
+		Comment:     chioas.SourceComment(),
+	}).Must(Template{}),
+}
+
+var templateListing = listing[Template]{
+	id: func(t Template) string { return t.Id },
+	fields: sortFields[Template]{
+		"_id":  func(t Template) string { return t.Id },
+		"name": func(t Template) string { return strings.ToLower(t.Name) },
+	},
+	defaultSort: "name",
+}
+
+// templates is the store used by the template handlers (replaced by a file-backed store in main)
+var templates = NewMemoryTemplateStore()
+
+func getTemplates(writer http.ResponseWriter, request *http.Request) {
+	result, err := templates.List(request.Context(), TemplateFilter{UserId: request.URL.Query().Get("userId")})
+	if err == nil {
+		result, err = templateListing.paginate(writer, request, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().templates(result)
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postTemplate(writer http.ResponseWriter, request *http.Request) {
+	var template Template
+	if err := decodeJson(request, &template); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u := unitsFrom(request.Context())
+	u.in().template(&template)
+	if err := checkTemplate(request.Context(), &template); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	template, err := templates.Create(request.Context(), template)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+template.Id)
+	u.out().template(&template)
+	writeJson(writer, request, http.StatusCreated, template)
+}
+
+func getTemplate(writer http.ResponseWriter, request *http.Request) {
+	template, err := templates.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().template(&template)
+	writeJson(writer, request, http.StatusOK, template)
+}
+
+func putTemplate(writer http.ResponseWriter, request *http.Request) {
+	existing, err := templates.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var template Template
+	if err = decodeJson(request, &template); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u := unitsFrom(request.Context())
+	u.in().template(&template)
+	template.Id, template.UserId = existing.Id, existing.UserId
+	if err = checkTemplate(request.Context(), &template); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if template, err = templates.Update(request.Context(), template); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u.out().template(&template)
+	writeJson(writer, request, http.StatusOK, template)
+}
+
+func patchTemplate(writer http.ResponseWriter, request *http.Request) {
+	existing, err := templates.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		return
+	}
+	// the patch is in the request units - so it is applied to the template in those units
+	template := existing
+	u := unitsFrom(request.Context())
+	u.outExact().template(&template)
+	if err = applyMergePatch(&template, patch); err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "invalid merge patch: %s", err.Error()))
+		return
+	}
+	u.in().template(&template)
+	template.Id, template.UserId = existing.Id, existing.UserId
+	if err = checkTemplate(request.Context(), &template); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if template, err = templates.Update(request.Context(), template); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u.out().template(&template)
+	writeJson(writer, request, http.StatusOK, template)
+}
+
+func deleteTemplate(writer http.ResponseWriter, request *http.Request) {
+	id := chi.URLParam(request, "id")
+	templateUses.Lock()
+	defer templateUses.Unlock()
+	using, err := programs.List(request.Context(), ProgramFilter{TemplateId: id, AllUsers: true})
+	if err == nil && len(using) > 0 {
+		err = fmt.Errorf("template %q is used by program %q: %w", id, using[0].Id, ErrConflict)
+	}
+	if err == nil {
+		err = templates.Delete(request.Context(), id)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// checkTemplate performs the checks that can't be expressed in the Template schema (and normalizes absent lists)
+func checkTemplate(ctx context.Context, template *Template) error {
+	if template.Exercises == nil {
+		template.Exercises = []TemplateExercise{}
+	}
+	for i := range template.Exercises {
+		if template.Exercises[i].Sets == nil {
+			template.Exercises[i].Sets = []TemplateSet{}
+		}
+	}
+	errs := make([]FieldError, 0)
+	if template.UserId != "" {
+		if _, err := users.Get(ctx, template.UserId); errors.Is(err, ErrNotFound) {
+			errs = append(errs, FieldError{Path: "userId", Message: "user does not exist"})
+		} else if err != nil {
+			return err
+		}
+	}
+	for i, te := range template.Exercises {
+		if e, err := exercises.Get(ctx, te.ExerciseId); errors.Is(err, ErrNotFound) || (err == nil && e.UserId != "" && e.UserId != template.UserId) {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("exercises[%d].exerciseId", i), Message: "exercise does not exist"})
+		} else if err != nil {
+			return err
+		}
+		for j, set := range te.Sets {
+			if set.Weight != nil && set.Percent1rm != nil {
+				errs = append(errs, FieldError{Path: fmt.Sprintf("exercises[%d].sets[%d]", i, j), Message: "must not have both weight and percent1rm"})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "template failed validation")
+		p.Errors = errs
+		return p
+	}
+	return nil
+}
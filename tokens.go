@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token has expired")
+)
+
+// tokenClaims are the JWT claims of access and refresh tokens
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Id is the session id for refresh tokens
+	Id   string `json:"jti,omitempty"`
+	Type string `json:"typ"`
+}
+
+// tokenSigner signs and verifies HS256 JSON Web Tokens
+type tokenSigner struct {
+	secret     []byte
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func newTokenSigner(secret []byte) *tokenSigner {
+	if len(secret) == 0 {
+		// no configured secret - tokens won't survive a restart
+		secret = make([]byte, 32)
+		_, _ = rand.Read(secret)
+	}
+	return &tokenSigner{
+		secret:     secret,
+		accessTTL:  15 * time.Minute,
+		refreshTTL: 30 * 24 * time.Hour,
+	}
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (s *tokenSigner) sign(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(s.mac(unsigned)), nil
+}
+
+// verify checks the token signature, expiry and type - returning its claims
+func (s *tokenSigner) verify(token string, tokenType string) (tokenClaims, error) {
+	var claims tokenClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return claims, errInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, s.mac(parts[0]+"."+parts[1])) {
+		return claims, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &claims) != nil || claims.Type != tokenType || claims.Subject == "" {
+		return claims, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return claims, errExpiredToken
+	}
+	return claims, nil
+}
+
+func (s *tokenSigner) mac(unsigned string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(unsigned))
+	return h.Sum(nil)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	traceExporterNone   = "none"
+	traceExporterStdout = "stdout"
+	traceExporterOtlp   = "otlp"
+)
+
+// newSpanExporter creates the SpanExporter for the tracing config
+func newSpanExporter(cfg TracingConfig, stdout io.Writer) (SpanExporter, error) {
+	switch cfg.Exporter {
+	case traceExporterNone, "":
+		return noopExporter{}, nil
+	case traceExporterStdout:
+		return &writerExporter{w: stdout}, nil
+	case traceExporterOtlp:
+		return newOtlpExporter(cfg.Endpoint, cfg.ServiceName), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+}
+
+// writerExporter writes each span as a line of JSON
+type writerExporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (e *writerExporter) ExportSpan(span *Span) {
+	data, err := json.Marshal(span)
+	if err != nil {
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, _ = e.w.Write(append(data, '\n'))
+}
+
+func (e *writerExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+const (
+	otlpBatchSize     = 512
+	otlpQueueSize     = 4096
+	otlpFlushInterval = 5 * time.Second
+)
+
+// otlpExporter sends batches of spans to an OpenTelemetry collector using OTLP/HTTP with JSON encoding
+//
+// Spans are dropped (rather than blocking requests) if the queue is full
+type otlpExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	mutex       sync.RWMutex
+	closed      bool
+	queue       chan *Span
+	done        chan struct{}
+}
+
+func newOtlpExporter(endpoint string, serviceName string) *otlpExporter {
+	e := &otlpExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, otlpQueueSize),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) ExportSpan(span *Span) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- span:
+	default:
+	}
+}
+
+// Shutdown sends the queued spans (within the context deadline)
+func (e *otlpExporter) Shutdown(ctx context.Context) error {
+	e.mutex.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mutex.Unlock()
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, otlpBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			if err := e.send(batch); err != nil {
+				slog.Warn("exporting spans", "error", err, "spans", len(batch))
+			}
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case span, ok := <-e.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, span); len(batch) >= otlpBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (e *otlpExporter) send(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	res, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(io.Discard, res.Body)
+		_ = res.Body.Close()
+	}()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", res.Status)
+	}
+	return nil
+}
+
+// otlpRequest is the OTLP/JSON ExportTraceServiceRequest for the spans
+func otlpRequest(serviceName string, spans []*Span) map[string]any {
+	otlpSpans := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		otlpSpan := map[string]any{
+			"traceId":           s.TraceId,
+			"spanId":            s.SpanId,
+			"name":              s.Name,
+			"kind":              otlpSpanKinds[s.Kind],
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+			"status":            map[string]any{"code": otlpStatusCodes[s.Status], "message": s.StatusMessage},
+		}
+		if s.ParentSpanId != "" {
+			otlpSpan["parentSpanId"] = s.ParentSpanId
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+	return map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": otlpAttributes(map[string]any{"service.name": serviceName}),
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": "workyapi"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+}
+
+var otlpSpanKinds = map[string]int{spanKindInternal: 1, spanKindServer: 2}
+
+var otlpStatusCodes = map[string]int{spanStatusUnset: 0, spanStatusOk: 1, spanStatusError: 2}
+
+func otlpAttributes(attrs map[string]any) []any {
+	result := make([]any, 0, len(attrs))
+	for _, k := range sortedKeys(attrs) {
+		var value map[string]any
+		switch v := attrs[k].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]any{"key": k, "value": value})
+	}
+	return result
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/go-chi/chi/v5/middleware"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span is a finished (or in-progress) unit of work in a trace
+//
+// Spans follow the OpenTelemetry data model - trace and span ids are propagated using the
+// W3C Trace Context traceparent header
+type Span struct {
+	TraceId       string         `json:"traceId"`
+	SpanId        string         `json:"spanId"`
+	ParentSpanId  string         `json:"parentSpanId,omitempty"`
+	Name          string         `json:"name"`
+	Kind          string         `json:"kind"`
+	Start         time.Time      `json:"start"`
+	End           time.Time      `json:"end"`
+	Attributes    map[string]any `json:"attributes,omitempty"`
+	Status        string         `json:"status"`
+	StatusMessage string         `json:"statusMessage,omitempty"`
+
+	sampled bool
+	mutex   sync.Mutex
+}
+
+const (
+	spanKindServer   = "server"
+	spanKindInternal = "internal"
+
+	spanStatusUnset = "unset"
+	spanStatusOk    = "ok"
+	spanStatusError = "error"
+)
+
+// SpanExporter receives finished spans
+type SpanExporter interface {
+	ExportSpan(span *Span)
+	// Shutdown flushes any buffered spans
+	Shutdown(ctx context.Context) error
+}
+
+// spanExporter is where sampled spans are exported to (replaced in main according to the tracing config)
+var spanExporter SpanExporter = noopExporter{}
+
+type spanKey struct{}
+
+// spanFrom returns the current span of the context (if any)
+func spanFrom(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// startSpan starts a span as a child of the context's current span (or as a new trace root)
+func startSpan(ctx context.Context, name string, kind string) (context.Context, *Span) {
+	s := &Span{
+		SpanId:  newSpanId(),
+		Name:    name,
+		Kind:    kind,
+		Start:   time.Now(),
+		Status:  spanStatusUnset,
+		sampled: true,
+	}
+	if parent := spanFrom(ctx); parent != nil {
+		s.TraceId, s.ParentSpanId, s.sampled = parent.TraceId, parent.SpanId, parent.sampled
+	} else {
+		s.TraceId = newTraceId()
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func (s *Span) setName(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Name = name
+}
+
+func (s *Span) setAttributes(kvs ...any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]any{}
+	}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if k, ok := kvs[i].(string); ok {
+			s.Attributes[k] = kvs[i+1]
+		}
+	}
+}
+
+// end finishes the span (with an error status if err is not nil) and exports it if sampled
+func (s *Span) end(err error) {
+	s.mutex.Lock()
+	s.End = time.Now()
+	if err != nil {
+		s.Status, s.StatusMessage = spanStatusError, err.Error()
+	} else if s.Status == spanStatusUnset {
+		s.Status = spanStatusOk
+	}
+	s.mutex.Unlock()
+	if s.sampled {
+		spanExporter.ExportSpan(s)
+	}
+}
+
+// traceparent is the W3C Trace Context header value for the span
+func (s *Span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + s.TraceId + "-" + s.SpanId + "-" + flags
+}
+
+// parseTraceparent parses a W3C traceparent header - ok is false if it is absent or invalid
+func parseTraceparent(v string) (traceId string, parentId string, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return
+	}
+	traceId, parentId = parts[1], parts[2]
+	if !isLowerHex(parts[0]) || !isLowerHex(traceId) || len(traceId) != 32 || traceId == strings.Repeat("0", 32) ||
+		!isLowerHex(parentId) || len(parentId) != 16 || parentId == strings.Repeat("0", 16) ||
+		!isLowerHex(parts[3]) || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	flags, _ := hex.DecodeString(parts[3])
+	return traceId, parentId, flags[0]&1 == 1, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func newTraceId() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func newSpanId() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// traceRequests is middleware that starts a server span for each request - continuing the
+// caller's trace when the request has a valid traceparent header
+//
+// The span is named for the route (the handlerBuilder renames it to the method's operationId)
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		ctx := request.Context()
+		if traceId, parentId, sampled, ok := parseTraceparent(request.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, &Span{TraceId: traceId, SpanId: parentId, sampled: sampled})
+		}
+		ctx, span := startSpan(ctx, request.Method, spanKindServer)
+		writer.Header().Set("traceresponse", span.traceparent())
+		ww := middleware.NewWrapResponseWriter(writer, request.ProtoMajor)
+		request = request.WithContext(ctx)
+		next.ServeHTTP(ww, request)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		route := routePattern(request)
+		span.setAttributes(
+			"http.request.method", request.Method,
+			"http.route", route,
+			"url.path", request.URL.Path,
+			"http.response.status_code", status,
+		)
+		if span.Name == request.Method {
+			span.setName(request.Method + " " + route)
+		}
+		var err error
+		if status >= http.StatusInternalServerError {
+			err = errors.New(http.StatusText(status))
+		}
+		span.end(err)
+	})
+}
+
+// traceOperation names the request span for the operation (used by the handlerBuilder)
+func traceOperation(operationId string, next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if span := spanFrom(request.Context()); span != nil {
+			span.setName(operationId)
+			span.setAttributes("operationId", operationId)
+		}
+		next(writer, request)
+	}
+}
+
+// startStoreOp starts a child span for a store operation - the returned func ends
+// it (and records the store operation metrics), use as:
+//
+//	defer startStoreOp(ctx, c.name, "get")(&err)
+func startStoreOp(ctx context.Context, collection string, op string) func(err *error) {
+	start := time.Now()
+	_, span := startSpan(ctx, "store "+collection+"."+op, spanKindInternal)
+	span.setAttributes("db.collection.name", collection, "db.operation.name", op)
+	return func(err *error) {
+		observeStoreOp(collection, op, start, err)
+		if *err != nil && (errors.Is(*err, ErrNotFound) || errors.Is(*err, ErrConflict)) {
+			// expected outcomes rather than failures of the store
+			span.setAttributes("db.response.status", (*err).Error())
+			span.end(nil)
+			return
+		}
+		span.end(*err)
+	}
+}
+
+type noopExporter struct{}
+
+func (noopExporter) ExportSpan(*Span) {}
+
+func (noopExporter) Shutdown(context.Context) error {
+	return nil
+}
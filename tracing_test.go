@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memoryExporter keeps exported spans in memory
+type memoryExporter struct {
+	mutex sync.Mutex
+	spans []*Span
+}
+
+func (e *memoryExporter) ExportSpan(span *Span) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.spans = append(e.spans, span)
+}
+
+func (e *memoryExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// Spans returns the spans exported so far
+func (e *memoryExporter) Spans() []*Span {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*Span{}, e.spans...)
+}
+
+// exportToMemory exports the spans of the test to a memoryExporter
+func exportToMemory(t *testing.T) *memoryExporter {
+	e := &memoryExporter{}
+	prev := spanExporter
+	spanExporter = e
+	t.Cleanup(func() {
+		spanExporter = prev
+	})
+	return e
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const traceId, parentId = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	for name, tc := range map[string]struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		"sampled":           {"00-" + traceId + "-" + parentId + "-01", true, true},
+		"not sampled":       {"00-" + traceId + "-" + parentId + "-00", true, false},
+		"padded":            {" 00-" + traceId + "-" + parentId + "-01 ", true, true},
+		"future version":    {"01-" + traceId + "-" + parentId + "-01-more", true, true},
+		"absent":            {"", false, false},
+		"invalid version":   {"ff-" + traceId + "-" + parentId + "-01", false, false},
+		"version 00 extra":  {"00-" + traceId + "-" + parentId + "-01-more", false, false},
+		"upper case":        {"00-" + strings.ToUpper(traceId) + "-" + parentId + "-01", false, false},
+		"short trace id":    {"00-" + traceId[1:] + "-" + parentId + "-01", false, false},
+		"zero trace id":     {"00-" + strings.Repeat("0", 32) + "-" + parentId + "-01", false, false},
+		"zero parent id":    {"00-" + traceId + "-" + strings.Repeat("0", 16) + "-01", false, false},
+		"bad flags":         {"00-" + traceId + "-" + parentId + "-1", false, false},
+		"missing parent id": {"00-" + traceId + "-01", false, false},
+		"non hex parent id": {"00-" + traceId + "-00f067aa0ba902bz-01", false, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			gotTrace, gotParent, sampled, ok := parseTraceparent(tc.header)
+			if ok != tc.ok || sampled != tc.sampled {
+				t.Fatalf("ok %v sampled %v, want %v %v", ok, sampled, tc.ok, tc.sampled)
+			}
+			if ok && (gotTrace != traceId || gotParent != parentId) {
+				t.Errorf("trace %q parent %q", gotTrace, gotParent)
+			}
+		})
+	}
+}
+
+// register registers a new user - the username prefix is made unique, as the stores outlive each test
+func register(t *testing.T, handler http.Handler, prefix string, traceparent string) *httptest.ResponseRecorder {
+	t.Helper()
+	username := prefix + "_" + newObjectId()[16:]
+	request := httptest.NewRequest(http.MethodPost, "/auth/register", strings.NewReader(`{"username":"`+username+`","password":"password123"}`))
+	request.Header.Set("Content-Type", "application/json")
+	if traceparent != "" {
+		request.Header.Set("traceparent", traceparent)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("register responded %d: %s", recorder.Code, recorder.Body)
+	}
+	return recorder
+}
+
+func TestTraceRequests(t *testing.T) {
+	handler := testRouter(t)
+	exporter := exportToMemory(t)
+	const traceId, parentId = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	recorder := register(t, handler, "tracing_continued", "00-"+traceId+"-"+parentId+"-01")
+
+	spans := exporter.Spans()
+	var server *Span
+	for _, s := range spans {
+		if s.Kind == spanKindServer {
+			server = s
+		}
+		if s.TraceId != traceId {
+			t.Errorf("span %q is of trace %q, want %q", s.Name, s.TraceId, traceId)
+		}
+	}
+	if server == nil {
+		t.Fatalf("no server span in %d spans", len(spans))
+	}
+	if server.Name != "register" || server.ParentSpanId != parentId || server.Status != spanStatusOk {
+		t.Errorf("server span %q with parent %q and status %q", server.Name, server.ParentSpanId, server.Status)
+	}
+	if server.Attributes["http.route"] != "/auth/register" || server.Attributes["http.response.status_code"] != http.StatusCreated {
+		t.Errorf("server span attributes %v", server.Attributes)
+	}
+	if got, want := recorder.Header().Get("traceresponse"), "00-"+traceId+"-"+server.SpanId+"-01"; got != want {
+		t.Errorf("traceresponse %q, want %q", got, want)
+	}
+	stored := map[string]bool{}
+	for _, s := range spans {
+		if s.Kind == spanKindInternal {
+			stored[s.Name] = true
+			if s.ParentSpanId != server.SpanId {
+				t.Errorf("store span %q has parent %q, want the server span %q", s.Name, s.ParentSpanId, server.SpanId)
+			}
+		}
+	}
+	for _, name := range []string{"store users.create", "store credentials.put"} {
+		if !stored[name] {
+			t.Errorf("no %q span in %v", name, stored)
+		}
+	}
+}
+
+func TestTraceRequestsStartsTraces(t *testing.T) {
+	handler := testRouter(t)
+	exporter := exportToMemory(t)
+	register(t, handler, "tracing_new", "not a traceparent")
+	spans := exporter.Spans()
+	if len(spans) == 0 {
+		t.Fatal("no spans exported")
+	}
+	root := spans[len(spans)-1]
+	if root.Kind != spanKindServer || root.ParentSpanId != "" || len(root.TraceId) != 32 || len(root.SpanId) != 16 {
+		t.Errorf("root span %+v", root)
+	}
+
+	// the caller's decision not to sample is followed
+	before := len(exporter.Spans())
+	register(t, handler, "tracing_unsampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	if after := len(exporter.Spans()); after != before {
+		t.Errorf("%d spans exported for an unsampled trace", after-before)
+	}
+}
+
+func TestStoreOpSpans(t *testing.T) {
+	exporter := exportToMemory(t)
+	ctx, parent := startSpan(context.Background(), "test", spanKindInternal)
+	s := NewMemoryUserStore()
+	if _, err := s.Get(ctx, "000000000000000000000000"); err == nil {
+		t.Fatal("got a user from an empty store")
+	}
+	_ = s.Close()
+	if _, err := s.Create(ctx, User{Username: "closed"}); err == nil {
+		t.Fatal("created a user in a closed store")
+	}
+	spans := exporter.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans, want 2", len(spans))
+	}
+	get, create := spans[0], spans[1]
+	if get.Name != "store users.get" || get.ParentSpanId != parent.SpanId || get.TraceId != parent.TraceId {
+		t.Errorf("get span %q of %q/%q", get.Name, get.TraceId, get.ParentSpanId)
+	}
+	// not found is an expected outcome of a get - not a failure of the store
+	if get.Status != spanStatusOk || get.Attributes["db.response.status"] == nil {
+		t.Errorf("get span status %q attributes %v", get.Status, get.Attributes)
+	}
+	if create.Name != "store users.create" || create.Status != spanStatusError || !strings.Contains(create.StatusMessage, "closed") {
+		t.Errorf("create span %q status %q %q", create.Name, create.Status, create.StatusMessage)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type TrackSegment struct {
+	Points []TrackPoint `json:"points" oas:"description: the points of the segment in time order"`
+}
+
+type TrackPoint struct {
+	Lat       float64  `json:"lat" oas:"description: latitude in degrees (WGS 84), minimum: -90, maximum: 90"`
+	Lon       float64  `json:"lon" oas:"description: longitude in degrees (WGS 84), minimum: -180, maximum: 180"`
+	Elevation *float64 `json:"ele,omitempty" oas:"description: elevation in metres"`
+	Offset    float64  `json:"offset" oas:"description: seconds since the start of the activity"`
+}
+
+const (
+	activityFormatGpx  = "gpx"
+	contentTypeGpx     = "application/gpx+xml"
+	contentTypeGeoJson = "application/geo+json"
+	// earthRadius is the mean radius of the earth in metres (for haversine distances)
+	earthRadius = 6371008.8
+	// minMovingSpeed is the speed (m/s) below which a recording is taken to be stopped
+	minMovingSpeed = 0.5
+	// elevationNoise is the rise in metres that counts as a climb (smaller rises are GPS noise)
+	elevationNoise = 2.0
+)
+
+// gpxSports are the GPX track types that are sports we know (others are "other")
+var gpxSports = map[string]string{
+	"biking": "cycling", "cycling": "cycling", "hiking": "hiking", "road_biking": "cycling", "rowing": "rowing",
+	"running": "running", "swimming": "swimming", "trail_running": "running", "walking": "walking",
+}
+
+// TrackGpxPath is the GPS track of a Workout uploaded as an activity as GPX (nested under the workout path)
+var TrackGpxPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getWorkoutTrackGpx,
+			OperationId: "getWorkoutTrackGpx",
+			Description: "The GPS track as GPX 1.1 (404 when the workout has no track)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathWorkout, Coach: true}),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "GPX document",
+					ContentType: contentTypeGpx,
+					Schema:      &chioas.Schema{Type: "string"},
+				},
+			},
+		},
+	},
+}
+
+// TrackGeoJsonPath is the GPS track of a Workout uploaded as an activity as GeoJSON (nested under the workout path)
+var TrackGeoJsonPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getWorkoutTrackGeoJson,
+			OperationId: "getWorkoutTrackGeoJson",
+			Description: "The GPS track as a GeoJSON (RFC 7946) Feature - a LineString (or a MultiLineString for a track of several segments) of [lon, lat, ele] positions (404 when the workout has no track)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathWorkout, Coach: true}),
+			QueryParams: chioas.QueryParams{unitsParam},
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "GeoJSON Feature",
+					ContentType: contentTypeGeoJson,
+					Schema:      &chioas.Schema{Type: "object"},
+				},
+			},
+		},
+	},
+}
+
+var TrackSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "TrackSegment",
+		Description: "A continuous stretch of a GPS track",
+		Comment:     chioas.SourceComment(),
+	}).Must(TrackSegment{}),
+	(&chioas.Schema{
+		Name:        "TrackPoint",
+		Description: "A recorded position of a GPS track",
+		Comment:     chioas.SourceComment(),
+	}).Must(TrackPoint{}),
+}
+
+type gpxFile struct {
+	XMLName  xml.Name     `xml:"gpx"`
+	Version  string       `xml:"version,attr"`
+	Creator  string       `xml:"creator,attr"`
+	Xmlns    string       `xml:"xmlns,attr,omitempty"`
+	Metadata *gpxMetadata `xml:"metadata"`
+	Tracks   []gpxTrack   `xml:"trk"`
+}
+
+type gpxMetadata struct {
+	Name string `xml:"name,omitempty"`
+	Desc string `xml:"desc,omitempty"`
+	Time string `xml:"time,omitempty"`
+}
+
+type gpxTrack struct {
+	Name     string       `xml:"name,omitempty"`
+	Desc     string       `xml:"desc,omitempty"`
+	Type     string       `xml:"type,omitempty"`
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Lat  float64  `xml:"lat,attr"`
+	Lon  float64  `xml:"lon,attr"`
+	Ele  *float64 `xml:"ele"`
+	Time string   `xml:"time,omitempty"`
+	// HeartRate is read from the Garmin TrackPointExtension (not written)
+	HeartRate *float64 `xml:"extensions>TrackPointExtension>hr"`
+}
+
+// isGpx is whether data looks like a GPX file (an XML document with a gpx element)
+func isGpx(data []byte) bool {
+	head := data[:min(len(data), 1024)]
+	return bytes.Contains(head, []byte("<gpx"))
+}
+
+// parseGpx parses the tracks of a GPX file (as one activity) - the points must have times
+//
+// Distance, elevation gain and moving time are computed from the track
+func parseGpx(data []byte) (Activity, error) {
+	var gpx gpxFile
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return Activity{}, fmt.Errorf("invalid GPX: %w", err)
+	}
+	a := Activity{Format: activityFormatGpx, Sport: sportOther, Laps: []ActivityLap{}}
+	var points []activityPoint
+	segment := 0
+	for i, trk := range gpx.Tracks {
+		if i == 0 {
+			if sport, ok := gpxSports[strings.ToLower(strings.TrimSpace(trk.Type))]; ok {
+				a.Sport = sport
+			}
+			a.notes = joinNotes(trk.Name, trk.Desc)
+		}
+		for _, seg := range trk.Segments {
+			for _, p := range seg.Points {
+				if !validPosition(p.Lat, p.Lon) {
+					return Activity{}, fmt.Errorf("GPX track point (%g, %g) is out of range", p.Lat, p.Lon)
+				}
+				t, err := time.Parse(time.RFC3339, strings.TrimSpace(p.Time))
+				if err != nil {
+					return Activity{}, errors.New("GPX track points must have times (a planned route can't be uploaded as an activity)")
+				}
+				point := activityPoint{time: t, segment: segment, position: true, lat: p.Lat, lon: p.Lon, elevation: p.Ele}
+				if p.HeartRate != nil && *p.HeartRate > 0 {
+					bpm := int(*p.HeartRate)
+					point.heartRate = &bpm
+				}
+				points = append(points, point)
+			}
+			segment++
+		}
+	}
+	if len(points) == 0 {
+		return Activity{}, errors.New("GPX file has no track points")
+	}
+	if err := a.fromPoints(points); err != nil {
+		return Activity{}, err
+	}
+	return a, nil
+}
+
+// validPosition is whether a latitude and longitude (in degrees) are in range
+func validPosition(lat, lon float64) bool {
+	return lat >= -90 && lat <= 90 && lon >= -180 && lon <= 180
+}
+
+// haversine is the great circle distance in metres between two positions (in degrees)
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := math.Pi / 180
+	dLat := (lat2 - lat1) * toRad
+	dLon := (lon2 - lon1) * toRad
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(lat1*toRad)*math.Cos(lat2*toRad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// trackStats computes the distance (haversine), elevation gain and moving time of a track
+//
+// Time between points moving slower than minMovingSpeed doesn't count as moving - and climbs count
+// once they rise more than elevationNoise above the lowest point since the last climb
+func trackStats(track []TrackSegment) (distance float64, gain *float64, moving float64) {
+	for _, seg := range track {
+		var low *float64
+		for i, p := range seg.Points {
+			if p.Elevation != nil {
+				if gain == nil {
+					gain = new(float64)
+				}
+				switch {
+				case low == nil || *p.Elevation < *low:
+					e := *p.Elevation
+					low = &e
+				case *p.Elevation-*low > elevationNoise:
+					*gain += *p.Elevation - *low
+					e := *p.Elevation
+					low = &e
+				}
+			}
+			if i == 0 {
+				continue
+			}
+			prev := seg.Points[i-1]
+			d := haversine(prev.Lat, prev.Lon, p.Lat, p.Lon)
+			distance += d
+			if dt := p.Offset - prev.Offset; dt > 0 && d/dt >= minMovingSpeed {
+				moving += dt
+			}
+		}
+	}
+	return distance, gain, moving
+}
+
+// workoutTrack is the activity with a track of the workout of the request path
+func workoutTrack(request *http.Request) (Activity, error) {
+	id := chi.URLParam(request, "id")
+	list, err := activities.List(request.Context(), ActivityFilter{WorkoutId: id})
+	if err != nil {
+		return Activity{}, err
+	}
+	for _, summary := range list {
+		a, err := activities.Get(request.Context(), summary.Id)
+		if err != nil {
+			return Activity{}, err
+		}
+		if len(a.Track) > 0 {
+			return a, nil
+		}
+	}
+	return Activity{}, fmt.Errorf("track of workout %q %w", id, ErrNotFound)
+}
+
+func getWorkoutTrackGpx(writer http.ResponseWriter, request *http.Request) {
+	a, err := workoutTrack(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	gpx := gpxFile{
+		Version:  "1.1",
+		Creator:  "workyapi",
+		Xmlns:    "http://www.topografix.com/GPX/1/1",
+		Metadata: &gpxMetadata{Time: a.StartTime.UTC().Format(time.RFC3339)},
+		Tracks:   []gpxTrack{{Type: a.Sport}},
+	}
+	for _, seg := range a.Track {
+		gs := gpxSegment{Points: make([]gpxPoint, 0, len(seg.Points))}
+		for _, p := range seg.Points {
+			t := a.StartTime.Add(time.Duration(p.Offset * float64(time.Second)))
+			gs.Points = append(gs.Points, gpxPoint{Lat: p.Lat, Lon: p.Lon, Ele: p.Elevation, Time: t.UTC().Format(time.RFC3339Nano)})
+		}
+		gpx.Tracks[0].Segments = append(gpx.Tracks[0].Segments, gs)
+	}
+	data, err := xml.MarshalIndent(gpx, "", " ")
+	if err != nil {
+		writeError(writer, request, fmt.Errorf("encoding GPX: %w", err))
+		return
+	}
+	writer.Header().Set("Content-Type", contentTypeGpx)
+	writer.WriteHeader(http.StatusOK)
+	if _, err = writer.Write(append([]byte(xml.Header), data...)); err != nil {
+		loggerFrom(request.Context()).Warn("writing response", "error", err)
+	}
+}
+
+// geoJsonFeature is a GeoJSON (RFC 7946) Feature
+type geoJsonFeature struct {
+	Type       string          `json:"type"`
+	Geometry   geoJsonGeometry `json:"geometry"`
+	Properties map[string]any  `json:"properties"`
+}
+
+type geoJsonGeometry struct {
+	Type        string `json:"type"`
+	Coordinates any    `json:"coordinates"`
+}
+
+func getWorkoutTrackGeoJson(writer http.ResponseWriter, request *http.Request) {
+	a, err := workoutTrack(request)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	out := unitsFrom(request.Context()).out()
+	lines := make([][][]float64, 0, len(a.Track))
+	times := make([][]string, 0, len(a.Track))
+	for _, seg := range a.Track {
+		line := make([][]float64, 0, len(seg.Points))
+		segTimes := make([]string, 0, len(seg.Points))
+		for _, p := range seg.Points {
+			position := []float64{p.Lon, p.Lat}
+			if p.Elevation != nil {
+				position = append(position, *p.Elevation)
+			}
+			line = append(line, position)
+			segTimes = append(segTimes, a.StartTime.Add(time.Duration(p.Offset*float64(time.Second))).UTC().Format(time.RFC3339Nano))
+		}
+		lines = append(lines, line)
+		times = append(times, segTimes)
+	}
+	feature := geoJsonFeature{
+		Type: "Feature",
+		Properties: map[string]any{
+			"workoutId":     a.WorkoutId,
+			"activityId":    a.Id,
+			"sport":         a.Sport,
+			"startTime":     a.StartTime,
+			"distance":      out.scaled(a.Distance, out.distance),
+			"elevationGain": a.ElevationGain,
+			"movingTime":    a.Duration,
+		},
+	}
+	if len(lines) == 1 {
+		feature.Geometry = geoJsonGeometry{Type: "LineString", Coordinates: lines[0]}
+		feature.Properties["coordTimes"] = times[0]
+	} else {
+		feature.Geometry = geoJsonGeometry{Type: "MultiLineString", Coordinates: lines}
+		feature.Properties["coordTimes"] = times
+	}
+	data, err := json.Marshal(feature)
+	if err != nil {
+		writeError(writer, request, fmt.Errorf("encoding GeoJSON: %w", err))
+		return
+	}
+	writer.Header().Set("Content-Type", contentTypeGeoJson)
+	writer.WriteHeader(http.StatusOK)
+	if _, err = writer.Write(append(data, '\n')); err != nil {
+		loggerFrom(request.Context()).Warn("writing response", "error", err)
+	}
+}
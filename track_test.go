@@ -0,0 +1,161 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGpx(t *testing.T) {
+	a, err := parseGpx(readFixture(t, "hike.gpx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 6, 1, 9, 0, 0, 0, time.UTC); !a.StartTime.Equal(want) {
+		t.Errorf("start time %v, want %v", a.StartTime, want)
+	}
+	if a.Format != activityFormatGpx || a.Sport != "hiking" || a.notes != "Morning hike" {
+		t.Errorf("format %q sport %q notes %q, want gpx hiking Morning hike", a.Format, a.Sport, a.notes)
+	}
+	if len(a.Track) != 2 || len(a.Track[0].Points) != 31 || len(a.Track[1].Points) != 31 {
+		t.Fatalf("track %v, want 2 segments of 31 points", a.Track)
+	}
+	if p := a.Track[1].Points[0]; p.Offset != 2400 {
+		t.Errorf("second segment starts at %vs, want 2400s", p.Offset)
+	}
+	// the hike walks 80 m a minute for 30 minutes in each segment
+	if a.Distance == nil || *a.Distance != 4400 {
+		t.Errorf("distance %v, want 4400", a.Distance)
+	}
+	// the 15 minute stop and the 10 minute gap between segments aren't moving
+	if a.Duration != 3300 || a.ElapsedTime != 4200 {
+		t.Errorf("moving %vs elapsed %vs, want 3300s 4200s", a.Duration, a.ElapsedTime)
+	}
+	if a.ElevationGain == nil || *a.ElevationGain != 120 {
+		t.Errorf("elevation gain %v, want 120", a.ElevationGain)
+	}
+	if len(a.HeartRate) != 62 || a.AverageHeartRate == nil || *a.AverageHeartRate != 115 || a.MaxHeartRate == nil || *a.MaxHeartRate != 130 {
+		t.Errorf("%d heart rate samples of %v/%v, want 62 of 115/130", len(a.HeartRate), a.AverageHeartRate, a.MaxHeartRate)
+	}
+}
+
+func TestParseGpxRejects(t *testing.T) {
+	hike := string(readFixture(t, "hike.gpx"))
+	for name, tc := range map[string]struct {
+		data string
+		want string
+	}{
+		"not XML":         {"<gpx", "invalid GPX"},
+		"no points":       {`<gpx><trk><trkseg></trkseg></trk></gpx>`, "no track points"},
+		"latitude range":  {strings.Replace(hike, `lat="54.4609000"`, `lat="90.5"`, 1), "out of range"},
+		"longitude range": {strings.Replace(hike, `lon="-3.0886000"`, `lon="180.5"`, 1), "out of range"},
+		"route":           {strings.Replace(hike, "<time>2024-06-01T09:01:00Z</time>", "", 1), "must have times"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseGpx([]byte(tc.data)); err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("error %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestHaversine(t *testing.T) {
+	degree := earthRadius * math.Pi / 180
+	for name, tc := range map[string]struct {
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		"same point":         {54.46, -3.09, 54.46, -3.09, 0},
+		"degree of latitude": {10, 20, 11, 20, degree},
+		"degree on equator":  {0, 20, 0, 21, degree},
+		// the great circle is a little shorter than half a degree on the equator
+		"degree at 60 degrees": {60, 20, 60, 21, 55597.0},
+		"across the meridian":  {0, 179.5, 0, -179.5, degree},
+		"pole to pole":         {90, 0, -90, 0, 180 * degree},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := haversine(tc.lat1, tc.lon1, tc.lat2, tc.lon2); math.Abs(got-tc.want) > 0.1 {
+				t.Errorf("%v m, want %v m", got, tc.want)
+			}
+		})
+	}
+}
+
+// northTrack is a segment heading due north from the equator - a point every 10s at each of the
+// distances (in metres from the start) and elevations
+func northTrack(distances []float64, elevations []float64) TrackSegment {
+	seg := TrackSegment{}
+	for i, d := range distances {
+		p := TrackPoint{Lat: d / (earthRadius * math.Pi / 180), Offset: float64(10 * i)}
+		if elevations != nil {
+			e := elevations[i]
+			p.Elevation = &e
+		}
+		seg.Points = append(seg.Points, p)
+	}
+	return seg
+}
+
+func TestTrackStats(t *testing.T) {
+	for name, tc := range map[string]struct {
+		track    []TrackSegment
+		distance float64
+		gain     *float64
+		moving   float64
+	}{
+		"no elevations": {
+			track:    []TrackSegment{northTrack([]float64{0, 50, 100}, nil)},
+			distance: 100,
+			moving:   20,
+		},
+		"stopped": {
+			// 2 m in 10s is below minMovingSpeed
+			track:    []TrackSegment{northTrack([]float64{0, 50, 52, 52, 102}, []float64{10, 10, 10, 10, 10})},
+			distance: 102,
+			gain:     new(float64),
+			moving:   20,
+		},
+		"noise": {
+			// rises of up to elevationNoise don't count
+			track:    []TrackSegment{northTrack([]float64{0, 10, 20, 30, 40}, []float64{100, 101.5, 100.5, 102, 100})},
+			distance: 40,
+			gain:     new(float64),
+			moving:   40,
+		},
+		"climbs": {
+			// climbs count from the lowest point since the last climb
+			track:    []TrackSegment{northTrack([]float64{0, 10, 20, 30, 40, 50}, []float64{100, 103, 101, 99, 102, 110})},
+			distance: 50,
+			gain:     ptr(3.0 + 3 + 8),
+			moving:   50,
+		},
+		"segments": {
+			// nothing counts between segments
+			track: []TrackSegment{
+				northTrack([]float64{0, 100}, []float64{100, 110}),
+				northTrack([]float64{5000, 5100}, []float64{50, 60}),
+			},
+			distance: 200,
+			gain:     ptr(20.0),
+			moving:   20,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			distance, gain, moving := trackStats(tc.track)
+			if math.Abs(distance-tc.distance) > 0.01 {
+				t.Errorf("distance %v, want %v", distance, tc.distance)
+			}
+			if (gain == nil) != (tc.gain == nil) || (gain != nil && math.Abs(*gain-*tc.gain) > 1e-9) {
+				t.Errorf("gain %v, want %v", gain, tc.gain)
+			}
+			if moving != tc.moving {
+				t.Errorf("moving %v, want %v", moving, tc.moving)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
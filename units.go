@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"github.com/go-andiamo/chioas"
+	"math"
+	"net/http"
+	"slices"
+)
+
+const (
+	unitsMetric   = "metric"
+	unitsImperial = "imperial"
+	// headerUnits is the request header choosing the unit system (and the response header saying which was used)
+	headerUnits   = "Units"
+	roundingNone  = "none"
+	roundingPlate = "plate"
+	// plateKg and plateLb are the smallest load steps that plates can make (a pair of the smallest plates)
+	plateKg = 2.5
+	plateLb = 5.0
+)
+
+// UnitSystems are the unit systems that weights and distances are sent and received in
+var UnitSystems = []string{unitsImperial, unitsMetric}
+
+// RoundingModes are the roundings of computed target loads
+var RoundingModes = []string{roundingNone, roundingPlate}
+
+// unitsParam documents the units query param of the methods whose bodies have weights or distances
+var unitsParam = chioas.QueryParam{
+	Name:        "units",
+	Description: "Unit system of the weights and distances in the request and response bodies - the Units header does the same (defaults to the units of the caller)",
+	SchemaRef:   "UnitSystem",
+}
+
+var UnitSchemas = []chioas.Schema{
+	enumSchema("UnitSystem", "Unit system of weights and distances (metric: kg and metres as stored - imperial: lb and miles with inches for body circumferences)", UnitSystems),
+	enumSchema("Rounding", "Rounding of computed target loads (none: to 0.01 - plate: to the nearest 2.5 kg or 5 lb)", RoundingModes),
+}
+
+// units converts weights and distances between the stored (SI) units and the unit system of a request
+type units struct {
+	system string
+	// weight is kg per weight unit - distance is metres per distance unit - length is cm per length unit
+	weight   float64
+	distance float64
+	length   float64
+}
+
+var (
+	metricUnits   = units{system: unitsMetric, weight: 1, distance: 1, length: 1}
+	imperialUnits = units{system: unitsImperial, weight: kgPerLb, distance: metresPerMile, length: cmPerInch}
+)
+
+type unitsKey struct{}
+
+// unitsFrom returns the unit system of the request (metric when not resolved)
+func unitsFrom(ctx context.Context) units {
+	if u, ok := ctx.Value(unitsKey{}).(units); ok {
+		return u
+	}
+	return metricUnits
+}
+
+// resolveUnits is middleware that resolves the unit system of the request - from the units query param,
+// else the Units header, else the units preference of the caller
+func resolveUnits(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		system, from := request.URL.Query().Get("units"), "query param \"units\""
+		if system == "" {
+			system, from = request.Header.Get(headerUnits), "header \"Units\""
+		}
+		if system == "" {
+			if caller, ok := callerFrom(request.Context()); ok {
+				system = caller.User.Units
+			}
+		}
+		u := metricUnits
+		switch system {
+		case unitsMetric, "":
+		case unitsImperial:
+			u = imperialUnits
+		default:
+			writeError(writer, request, newProblem(http.StatusBadRequest, "%s must be one of: imperial, metric", from))
+			return
+		}
+		writer.Header().Set(headerUnits, u.system)
+		next.ServeHTTP(writer, request.WithContext(context.WithValue(request.Context(), unitsKey{}, u)))
+	})
+}
+
+// unitScale is a conversion of weights, distances and lengths (by multiplying with the factors)
+type unitScale struct {
+	weight   float64
+	distance float64
+	length   float64
+	round    func(float64) float64
+}
+
+// out is the conversion from the stored units to the request units
+func (u units) out() unitScale {
+	return unitScale{weight: 1 / u.weight, distance: 1 / u.distance, length: 1 / u.length, round: roundRecord}
+}
+
+// outExact is out without rounding - for patching stored values (that are converted back with in)
+func (u units) outExact() unitScale {
+	s := u.out()
+	s.round = func(v float64) float64 { return v }
+	return s
+}
+
+// in is the conversion from the request units to the stored units
+//
+// Stored values keep 4 decimal places - so that they convert back to what was sent
+func (u units) in() unitScale {
+	return unitScale{weight: u.weight, distance: u.distance, length: u.length, round: roundStored}
+}
+
+// plate is the load step of plate rounding in the units
+func (u units) plate() float64 {
+	if u.system == unitsImperial {
+		return plateLb
+	}
+	return plateKg
+}
+
+func roundStored(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
+
+// scaled is v converted by the factor - a new value, as the stores share nested values with their callers
+func (s unitScale) scaled(v *float64, factor float64) *float64 {
+	if v == nil || factor == 1 {
+		return v
+	}
+	c := s.round(*v * factor)
+	return &c
+}
+
+func (s unitScale) workouts(ws []Workout) {
+	for i := range ws {
+		s.workout(&ws[i])
+	}
+}
+
+func (s unitScale) workout(w *Workout) {
+	w.Exercises = slices.Clone(w.Exercises)
+	for i := range w.Exercises {
+		sets := slices.Clone(w.Exercises[i].Sets)
+		for j := range sets {
+			sets[j].Weight = s.scaled(sets[j].Weight, s.weight)
+			sets[j].Distance = s.scaled(sets[j].Distance, s.distance)
+		}
+		w.Exercises[i].Sets = sets
+	}
+}
+
+func (s unitScale) templates(ts []Template) {
+	for i := range ts {
+		s.template(&ts[i])
+	}
+}
+
+func (s unitScale) template(t *Template) {
+	t.Exercises = slices.Clone(t.Exercises)
+	for i := range t.Exercises {
+		sets := slices.Clone(t.Exercises[i].Sets)
+		for j := range sets {
+			sets[j].Weight = s.scaled(sets[j].Weight, s.weight)
+			sets[j].Distance = s.scaled(sets[j].Distance, s.distance)
+		}
+		t.Exercises[i].Sets = sets
+	}
+}
+
+func (s unitScale) programs(ps []Program) {
+	for i := range ps {
+		s.program(&ps[i])
+	}
+}
+
+// program converts the increments of linear progression rules (other increments are percentage points)
+func (s unitScale) program(p *Program) {
+	p.Progression = slices.Clone(p.Progression)
+	for i, rule := range p.Progression {
+		if rule.Type == progressionLinear {
+			p.Progression[i].Increment = s.scaled(rule.Increment, s.weight)
+		}
+	}
+}
+
+func (s unitScale) enrolments(es []Enrolment) {
+	for i := range es {
+		s.enrolment(&es[i])
+	}
+}
+
+func (s unitScale) enrolment(e *Enrolment) {
+	e.OneRepMaxes = slices.Clone(e.OneRepMaxes)
+	for i := range e.OneRepMaxes {
+		e.OneRepMaxes[i].Weight = *s.scaled(&e.OneRepMaxes[i].Weight, s.weight)
+	}
+}
+
+func (s unitScale) records(rs []PersonalRecord) {
+	for i := range rs {
+		r := &rs[i]
+		factor := s.weight
+		switch r.Kind {
+		case recordLongestDist:
+			factor = s.distance
+		case recordFastestTime:
+			// the value is a time
+			factor = 1
+			r.Distance = s.scaled(r.Distance, s.distance)
+		}
+		r.Value = *s.scaled(&r.Value, factor)
+		r.PreviousValue = s.scaled(r.PreviousValue, factor)
+		r.Bodyweight = s.scaled(r.Bodyweight, s.weight)
+	}
+}
+
+func (s unitScale) activities(as []Activity) {
+	for i := range as {
+		s.activity(&as[i])
+	}
+}
+
+// activity converts the distances of an activity (elevations stay in metres)
+func (s unitScale) activity(a *Activity) {
+	a.Distance = s.scaled(a.Distance, s.distance)
+	a.Laps = slices.Clone(a.Laps)
+	for i := range a.Laps {
+		a.Laps[i].Distance = s.scaled(a.Laps[i].Distance, s.distance)
+	}
+}
+
+func (u units) measurements(ms []Measurement) {
+	for i := range ms {
+		u.measurement(&ms[i])
+	}
+}
+
+// measurement converts a body measurement to the units - setting its unit
+func (u units) measurement(m *Measurement) {
+	s := u.out()
+	factor := s.length
+	switch m.Kind {
+	case measurementBodyweight:
+		factor = s.weight
+	case measurementBodyFat:
+		return
+	}
+	m.Value = *s.scaled(&m.Value, factor)
+	m.MovingAverage = s.scaled(m.MovingAverage, factor)
+	m.Unit = u.measurementUnit(m.Kind)
+}
+
+// measurementUnit is the unit of a kind of measurement in the units
+func (u units) measurementUnit(kind string) string {
+	kindUnits := measurementUnits(kind)
+	if u.system == unitsImperial {
+		return kindUnits[len(kindUnits)-1]
+	}
+	return kindUnits[0]
+}
+
+// roundLoads rounds the weights of a workout (already converted to the units) for the rounding mode
+func (u units) roundLoads(w *Workout, rounding string) {
+	if rounding != roundingPlate {
+		return
+	}
+	step := u.plate()
+	for _, we := range w.Exercises {
+		for j, set := range we.Sets {
+			if set.Weight != nil {
+				v := math.Round(*set.Weight/step) * step
+				we.Sets[j].Weight = &v
+			}
+		}
+	}
+}
+
+// checkRounding checks the rounding query param (defaulting to none)
+func checkRounding(request *http.Request) (string, error) {
+	rounding := request.URL.Query().Get("rounding")
+	if rounding == "" {
+		return roundingNone, nil
+	} else if !slices.Contains(RoundingModes, rounding) {
+		return "", newProblem(http.StatusBadRequest, "query param \"rounding\" must be one of: none, plate")
+	}
+	return rounding, nil
+}
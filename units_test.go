@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveUnits(t *testing.T) {
+	for name, tc := range map[string]struct {
+		query      string
+		header     string
+		preference string
+		want       string
+		wantStatus int
+	}{
+		"default":                 {"", "", "", unitsMetric, http.StatusOK},
+		"preference":              {"", "", unitsImperial, unitsImperial, http.StatusOK},
+		"header over preference":  {"", unitsMetric, unitsImperial, unitsMetric, http.StatusOK},
+		"query over header":       {unitsImperial, unitsMetric, "", unitsImperial, http.StatusOK},
+		"query over preference":   {unitsMetric, "", unitsImperial, unitsMetric, http.StatusOK},
+		"unknown query":           {"furlongs", unitsMetric, "", "", http.StatusBadRequest},
+		"unknown header":          {"", "furlongs", unitsMetric, "", http.StatusBadRequest},
+		"query over wrong header": {unitsMetric, "furlongs", "", unitsMetric, http.StatusOK},
+	} {
+		t.Run(name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/?units="+tc.query, nil)
+			if tc.header != "" {
+				request.Header.Set(headerUnits, tc.header)
+			}
+			if tc.preference != "" {
+				request = request.WithContext(context.WithValue(request.Context(), callerKey{}, Caller{User: User{Units: tc.preference}}))
+			}
+			var got string
+			rec := httptest.NewRecorder()
+			resolveUnits(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+				got = unitsFrom(request.Context()).system
+			})).ServeHTTP(rec, request)
+			if rec.Code != tc.wantStatus || got != tc.want {
+				t.Fatalf("responded %d with units %q, want %d with %q", rec.Code, got, tc.wantStatus, tc.want)
+			}
+			if tc.want != "" && rec.Header().Get(headerUnits) != tc.want {
+				t.Errorf("Units header %q", rec.Header().Get(headerUnits))
+			}
+		})
+	}
+}
+
+func TestUnitsRoundTrip(t *testing.T) {
+	// values sent in a unit system are stored to 4 decimal places - and come back out (to 2) as sent
+	for _, v := range []float64{0.01, 1, 2.5, 45, 100.25, 225, 315.55, 1000.99} {
+		for _, u := range []units{metricUnits, imperialUnits} {
+			w := Workout{Exercises: []WorkoutExercise{{Sets: []WorkoutSet{{Weight: ptr(v), Distance: ptr(v)}}}}}
+			u.in().workout(&w)
+			u.out().workout(&w)
+			if set := w.Exercises[0].Sets[0]; *set.Weight != v || *set.Distance != v {
+				t.Errorf("%s %v came back as %v and %v", u.system, v, *set.Weight, *set.Distance)
+			}
+		}
+	}
+	w := Workout{Exercises: []WorkoutExercise{{Sets: []WorkoutSet{{Weight: ptr(100.0), Distance: ptr(1.0)}}}}}
+	imperialUnits.in().workout(&w)
+	if set := w.Exercises[0].Sets[0]; *set.Weight != 45.3592 || *set.Distance != 1609.344 {
+		t.Errorf("100 lb and 1 mi stored as %v kg and %v m", *set.Weight, *set.Distance)
+	}
+}
+
+func TestRoundLoads(t *testing.T) {
+	for _, tc := range []struct {
+		u        units
+		rounding string
+		weight   float64
+		want     float64
+	}{
+		{metricUnits, roundingNone, 101.23, 101.23},
+		{metricUnits, roundingPlate, 101.25, 102.5},
+		{metricUnits, roundingPlate, 101.24, 100},
+		{metricUnits, roundingPlate, 1, 0},
+		{imperialUnits, roundingPlate, 222.4, 220},
+		{imperialUnits, roundingPlate, 222.5, 225},
+		{imperialUnits, roundingNone, 222.4, 222.4},
+	} {
+		w := Workout{Exercises: []WorkoutExercise{{Sets: []WorkoutSet{{Weight: ptr(tc.weight)}, {Reps: ptr(5)}}}}}
+		tc.u.roundLoads(&w, tc.rounding)
+		if got := w.Exercises[0].Sets[0].Weight; *got != tc.want || w.Exercises[0].Sets[1].Weight != nil {
+			t.Errorf("%s %s rounded %v to %v, want %v", tc.u.system, tc.rounding, tc.weight, *got, tc.want)
+		}
+	}
+}
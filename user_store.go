@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// UserStore is the persistence interface for users
+type UserStore interface {
+	List(ctx context.Context, filter UserFilter) ([]User, error)
+	Get(ctx context.Context, id string) (User, error)
+	// GetByUsername gets a user by (case-insensitive) username
+	GetByUsername(ctx context.Context, username string) (User, error)
+	Create(ctx context.Context, user User) (User, error)
+	Update(ctx context.Context, user User) (User, error)
+	Delete(ctx context.Context, id string) error
+	// RemoveCoach removes a coach from the coaches of every user (e.g. when the coach is deleted)
+	RemoveCoach(ctx context.Context, coachId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// UserFilter filters listed users - zero value fields are not filtered on
+type UserFilter struct {
+	// UsernamePrefix matches (case-insensitively) the start of the username
+	UsernamePrefix string
+}
+
+func (f UserFilter) matches(u User) bool {
+	return f.UsernamePrefix == "" || strings.HasPrefix(strings.ToLower(u.Username), strings.ToLower(f.UsernamePrefix))
+}
+
+// NewMemoryUserStore creates a UserStore that is held in memory only (used for tests)
+func NewMemoryUserStore() UserStore {
+	return &userStore{items: newMemoryCollection[User]("users", userId)}
+}
+
+// OpenFileUserStore opens (or creates) a file-backed UserStore in the given directory
+func OpenFileUserStore(dir string) (UserStore, error) {
+	c, err := openFileCollection[User](dir, "users", userId)
+	if err != nil {
+		return nil, err
+	}
+	return &userStore{items: c}, nil
+}
+
+func userId(u *User) *string {
+	return &u.Id
+}
+
+type userStore struct {
+	items *collection[User]
+}
+
+func (s *userStore) List(ctx context.Context, filter UserFilter) ([]User, error) {
+	return s.items.list(ctx, filter.matches)
+}
+
+func (s *userStore) Get(ctx context.Context, id string) (User, error) {
+	return s.items.get(ctx, id)
+}
+
+func (s *userStore) GetByUsername(ctx context.Context, username string) (User, error) {
+	found, err := s.items.list(ctx, func(u User) bool {
+		return strings.EqualFold(u.Username, username)
+	})
+	if err != nil {
+		return User{}, err
+	} else if len(found) == 0 {
+		return User{}, fmt.Errorf("username %q %w", username, ErrNotFound)
+	}
+	return found[0], nil
+}
+
+func (s *userStore) Create(ctx context.Context, user User) (User, error) {
+	return s.items.create(ctx, user, uniqueUsername(user))
+}
+
+func (s *userStore) Update(ctx context.Context, user User) (User, error) {
+	return s.items.update(ctx, user, uniqueUsername(user))
+}
+
+func (s *userStore) Delete(ctx context.Context, id string) error {
+	return s.items.delete(ctx, id)
+}
+
+func (s *userStore) RemoveCoach(ctx context.Context, coachId string) error {
+	_, err := s.items.updateWhere(ctx, func(existing User) bool {
+		return slices.Contains(existing.Coaches, coachId)
+	}, func(u User) User {
+		u.Coaches = slices.DeleteFunc(slices.Clone(u.Coaches), func(id string) bool { return id == coachId })
+		return u
+	})
+	return err
+}
+
+func uniqueUsername(user User) func(User) error {
+	return func(existing User) error {
+		if strings.EqualFold(existing.Username, user.Username) {
+			return fmt.Errorf("username %q is already taken: %w", user.Username, ErrConflict)
+		}
+		return nil
+	}
+}
+
+func (s *userStore) Ping(ctx context.Context) error {
+	return s.items.ping(ctx)
+}
+
+func (s *userStore) Close() error {
+	return s.items.close()
+}
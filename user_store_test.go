@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestUserStore(t *testing.T) {
+	for name, open := range map[string]func(t *testing.T) UserStore{
+		"memory": func(t *testing.T) UserStore {
+			return NewMemoryUserStore()
+		},
+		"file": func(t *testing.T) UserStore {
+			s, err := OpenFileUserStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := open(t)
+			alice, err := s.Create(ctx, User{Username: "Alice", Roles: []string{roleAthlete}})
+			if err != nil {
+				t.Fatal(err)
+			} else if len(alice.Id) != 24 {
+				t.Fatalf("id %q, want a 24 char oid", alice.Id)
+			}
+			bob, err := s.Create(ctx, User{Username: "bob"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, err := s.Get(ctx, alice.Id); err != nil || got.Username != "Alice" {
+				t.Errorf("get %+v %v", got, err)
+			}
+			if got, err := s.GetByUsername(ctx, "ALICE"); err != nil || got.Id != alice.Id {
+				t.Errorf("get by username %+v %v", got, err)
+			}
+			if got, err := s.List(ctx, UserFilter{UsernamePrefix: "b"}); err != nil || len(got) != 1 || got[0].Id != bob.Id {
+				t.Errorf("list %+v %v", got, err)
+			}
+
+			if _, err = s.Create(ctx, User{Username: "alice"}); !errors.Is(err, ErrConflict) {
+				t.Errorf("create with a taken username: %v, want ErrConflict", err)
+			}
+			bob.Username = "ALICE"
+			if _, err = s.Update(ctx, bob); !errors.Is(err, ErrConflict) {
+				t.Errorf("update to a taken username: %v, want ErrConflict", err)
+			}
+			alice.Username, alice.Name = "alice", "Alice A"
+			if _, err = s.Update(ctx, alice); err != nil {
+				t.Errorf("update of own username: %v", err)
+			}
+			if got, _ := s.Get(ctx, alice.Id); got.Username != "alice" || got.Name != "Alice A" {
+				t.Errorf("updated %+v", got)
+			}
+
+			if err = s.Delete(ctx, alice.Id); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = s.Get(ctx, alice.Id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("get deleted: %v, want ErrNotFound", err)
+			}
+			if _, err = s.GetByUsername(ctx, "alice"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("get deleted by username: %v, want ErrNotFound", err)
+			}
+			if _, err = s.Update(ctx, alice); !errors.Is(err, ErrNotFound) {
+				t.Errorf("update deleted: %v, want ErrNotFound", err)
+			}
+			if err = s.Delete(ctx, alice.Id); !errors.Is(err, ErrNotFound) {
+				t.Errorf("delete deleted: %v, want ErrNotFound", err)
+			}
+			if _, err = s.Create(ctx, User{Username: "alice"}); err != nil {
+				t.Errorf("create with the username of a deleted user: %v", err)
+			}
+
+			if err = s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = s.Create(ctx, User{Username: "carol"}); !errors.Is(err, ErrStoreClosed) {
+				t.Errorf("create after close: %v, want ErrStoreClosed", err)
+			}
+		})
+	}
+}
+
+func TestFileUserStoreReopens(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s, err := OpenFileUserStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created, err := s.Create(ctx, User{Username: "alice", Roles: []string{roleAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	if s, err = OpenFileUserStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Get(ctx, created.Id); err != nil || got.Username != "alice" || len(got.Roles) != 1 {
+		t.Errorf("reopened %+v %v", got, err)
+	}
+	if _, err = s.Create(ctx, User{Username: "Alice"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("create with a taken username after reopening: %v, want ErrConflict", err)
+	}
+}
@@ -1,21 +1,49 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
 	"net/http"
+	"slices"
+	"strings"
 )
 
 type User struct {
-	Id       string `json:"_id" oas:"description: db oid"`
-	Username string `json:"username" oas:"description: specific indexed username"`
-	Name     string `json:"name" oas:"description: Persons name to use"`
+	Id       string   `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	Username string   `json:"username" oas:"description: specific indexed username, required, minLength: 3, maxLength: 32, pattern: '^[a-zA-Z0-9_.-]+$'"`
+	Name     string   `json:"name" oas:"description: Persons name to use, maxLength: 100"`
+	Roles    []string `json:"roles" oas:"$ref: Role, type: array"`
+	Coaches  []string `json:"coaches" oas:"description: db oids of Users (with the coach role) who may manage this users training, type: array, itemType: string"`
+	Sex      string   `json:"sex,omitempty" oas:"$ref: Sex"`
+	Units    string   `json:"units,omitempty" oas:"$ref: UnitSystem, description: unit system of the weights and distances sent to and by the user (defaults to metric)"`
+	// HeartRate is needed for heart rate zones and training load
+	HeartRate *HeartRateSettings `json:"heartRate,omitempty" oas:"$ref: HeartRateSettings"`
 }
 
+const (
+	sexFemale = "female"
+	sexMale   = "male"
+)
+
+// Sexes are the sexes of users (used by formulas that differ by sex)
+var Sexes = []string{sexFemale, sexMale}
+
 var UserPath = chioas.Path{
 	Methods: chioas.Methods{
 		http.MethodGet: {
-			Handler: getUsers,
+			Handler:     getUsers,
+			OperationId: "listUsers",
+			QueryParams: userListing.queryParams(
+				chioas.QueryParam{
+					Name:        "username",
+					Description: "Only users whose username starts with this prefix (case-insensitive)",
+					Example:     "du",
+				},
+			),
 			Responses: chioas.Responses{
 				http.StatusOK: {
 					Description: "List of Users",
@@ -24,6 +52,104 @@ var UserPath = chioas.Path{
 				},
 			},
 		},
+		http.MethodPost: {
+			Handler:     postUser,
+			OperationId: "createUser",
+			Description: "Creates a User without login credentials (Users normally join via /auth/register)",
+			Extensions:  allow(access{Roles: []string{roleAdmin}}),
+			Request: &chioas.Request{
+				Description: "User to create (any _id is ignored, absent roles default to athlete)",
+				Required:    true,
+				SchemaRef:   "User",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created User",
+					SchemaRef:   "User",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{id}": {
+			PathParams: chioas.PathParams{
+				"id": {
+					Description: "User db oid",
+					Example:     "66971add3abcef545e64400b",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getUser,
+					OperationId: "getUser",
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "User",
+							SchemaRef:   "User",
+						},
+					},
+				},
+				http.MethodPut: {
+					Handler:     putUser,
+					OperationId: "replaceUser",
+					Description: "Only admins may change roles",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser}),
+					Request: &chioas.Request{
+						Description: "Replacement User (any _id is ignored, absent roles and coaches are left unchanged)",
+						Required:    true,
+						SchemaRef:   "User",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated User",
+							SchemaRef:   "User",
+						},
+					},
+				},
+				http.MethodPatch: {
+					Handler:     patchUser,
+					OperationId: "updateUser",
+					Description: "Only admins may change roles",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser}),
+					Request: &chioas.Request{
+						Description: "JSON Merge Patch (RFC 7396) to apply to the User",
+						Required:    true,
+						ContentType: contentTypeMergePatch,
+						SchemaRef:   "User",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated User",
+							SchemaRef:   "User",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteUser,
+					OperationId: "deleteUser",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathUser}),
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "User deleted",
+						},
+					},
+				},
+			},
+			Paths: chioas.Paths{
+				"/records":        RecordsPath,
+				"/analytics":      AnalyticsPath,
+				"/enrolments":     EnrolmentsPath,
+				"/today":          TodayPath,
+				"/schedule":       SchedulePath,
+				"/calendar.ics":   CalendarPath,
+				"/calendar-token": CalendarTokenPath,
+				"/imports":        ImportsPath,
+				"/exports":        ExportsPath,
+				"/activities":     ActivitiesPath,
+				"/load":           LoadPath,
+				"/measurements":   MeasurementsPath,
+			},
+		},
 	},
 }
 
@@ -36,18 +162,208 @@ var UserSchemas = []chioas.Schema{
 		Id:       "66971add3abcef545e64400b",
 		Name:     "Dug Somebody",
 		Username: "dug",
+		Roles:    []string{roleAthlete},
+		Coaches:  []string{},
 	}),
+	enumSchema("Role", "A role granting access (admin: everything, coach: the training of Users listing them as a coach, athlete: own training)", Roles),
+	enumSchema("Sex", "Sex of a User - used by formulas that differ by sex (e.g. the TRIMP weighting)", Sexes),
 }
 
+var userListing = listing[User]{
+	id: func(u User) string { return u.Id },
+	fields: sortFields[User]{
+		"_id":      func(u User) string { return u.Id },
+		"username": func(u User) string { return strings.ToLower(u.Username) },
+		"name":     func(u User) string { return strings.ToLower(u.Name) },
+	},
+	defaultSort: "_id",
+}
+
+// users is the store used by the user handlers (replaced by a file-backed store in main)
+var users = NewMemoryUserStore()
+
 func getUsers(writer http.ResponseWriter, request *http.Request) {
-	result := [1]map[string]string{
-		{
-			"_id":      "66971add3abcef545e641111",
-			"name":     "Jerry",
-			"username": "jerry",
-		},
+	result, err := users.List(request.Context(), UserFilter{UsernamePrefix: request.URL.Query().Get("username")})
+	if err == nil {
+		result, err = userListing.paginate(writer, request, result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postUser(writer http.ResponseWriter, request *http.Request) {
+	var user User
+	if err := decodeJson(request, &user); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if user.Roles == nil {
+		user.Roles = []string{roleAthlete}
+	}
+	if err := checkUser(request.Context(), User{}, &user); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user, err := users.Create(request.Context(), user)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+user.Id)
+	writeJson(writer, request, http.StatusCreated, user)
+}
+
+func getUser(writer http.ResponseWriter, request *http.Request) {
+	user, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, user)
+}
+
+func putUser(writer http.ResponseWriter, request *http.Request) {
+	existing, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var user User
+	if err = decodeJson(request, &user); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	user.Id = existing.Id
+	if user.Roles == nil {
+		user.Roles = slices.Clone(existing.Roles)
+	}
+	if user.Coaches == nil {
+		user.Coaches = existing.Coaches
+	}
+	if err = checkUser(request.Context(), existing, &user); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if user, err = users.Update(request.Context(), user); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, user)
+}
+
+func patchUser(writer http.ResponseWriter, request *http.Request) {
+	existing, err := users.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		return
+	}
+	user := existing
+	if err = applyMergePatch(&user, patch); err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "invalid merge patch: %s", err.Error()))
+		return
+	}
+	user.Id = existing.Id
+	if err = checkUser(request.Context(), existing, &user); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if user, err = users.Update(request.Context(), user); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writeJson(writer, request, http.StatusOK, user)
+}
+
+func deleteUser(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	id := chi.URLParam(request, "id")
+	if _, err := users.Get(ctx, id); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	ignoreNotFound := func(deleteFn func(context.Context, string) error) func(context.Context, string) error {
+		return func(ctx context.Context, id string) error {
+			if err := deleteFn(ctx, id); !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			return nil
+		}
+	}
+	// everything of the user is deleted before the user - so that a delete that fails part way can be retried
+	for _, deleteFn := range []func(context.Context, string) error{
+		ignoreNotFound(auth.DeleteCredential),
+		auth.DeleteUserSessions,
+		ignoreNotFound(auth.DeleteCalendarToken),
+		programs.DeleteUserEnrolments,
+		schedule.DeleteUserSchedule,
+		activities.DeleteUserActivities,
+		measurements.DeleteUserMeasurements,
+		workouts.DeleteUserWorkouts,
+		records.DeleteUserRecords,
+		programs.DeleteUserPrograms,
+		templates.DeleteUserTemplates,
+		exercises.DeleteUserExercises,
+		users.RemoveCoach,
+	} {
+		if err := deleteFn(ctx, id); err != nil {
+			writeError(writer, request, err)
+			return
+		}
+	}
+	if err := users.Delete(ctx, id); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	recordUserLocks.Delete(id)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// checkUser performs the checks that can't be expressed in the User schema (and normalizes absent lists)
+//
+// Only admins may change roles (existing is the zero User when creating)
+func checkUser(ctx context.Context, existing User, user *User) error {
+	if user.Roles == nil {
+		user.Roles = []string{}
+	}
+	if user.Coaches == nil {
+		user.Coaches = []string{}
+	}
+	slices.Sort(user.Roles)
+	user.Roles = slices.Compact(user.Roles)
+	if caller, _ := callerFrom(ctx); !caller.hasRole(roleAdmin) && !slices.Equal(user.Roles, existing.Roles) {
+		return newProblem(http.StatusForbidden, "only admins may change roles")
+	}
+	errs := make([]FieldError, 0)
+	for i, id := range user.Coaches {
+		if slices.Contains(existing.Coaches, id) {
+			// only added coaches are checked - a listed coach may since have been deleted or stopped coaching
+			continue
+		}
+		if coach, err := users.Get(ctx, id); errors.Is(err, ErrNotFound) {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("coaches[%d]", i), Message: "user does not exist"})
+		} else if err != nil {
+			return err
+		} else if !slices.Contains(coach.Roles, roleCoach) {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("coaches[%d]", i), Message: "user is not a coach"})
+		} else if id == user.Id {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("coaches[%d]", i), Message: "user cannot coach themselves"})
+		}
+	}
+	if user.HeartRate != nil {
+		errs = append(errs, user.HeartRate.check()...)
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "user failed validation")
+		p.Errors = errs
+		return p
 	}
-	enc := json.NewEncoder(writer)
-	writer.Header().Set("Content-Type", "application/json")
-	_ = enc.Encode(result)
+	return nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserHandlers(t *testing.T) {
+	_, adminToken := testUser(t, "users_admin", roleAdmin)
+	created := call(t, http.MethodPost, "/users", adminToken, `{"username":"users_created_`+newObjectId()[16:]+`","name":"Created","roles":["coach"]}`)
+	if created.Code != http.StatusCreated {
+		t.Fatalf("post responded %d: %s", created.Code, created.Body)
+	}
+	var user User
+	if err := json.Unmarshal(created.Body.Bytes(), &user); err != nil {
+		t.Fatal(err)
+	}
+	if got := created.Header().Get("Location"); got != "/users/"+user.Id {
+		t.Errorf("Location %q, want /users/%s", got, user.Id)
+	}
+	if user.Coaches == nil || len(user.Roles) != 1 {
+		t.Errorf("created %+v", user)
+	}
+	if got := call(t, http.MethodGet, "/users/0000000000000000000000ff", adminToken, ""); got.Code != http.StatusNotFound {
+		t.Errorf("get of a missing user responded %d", got.Code)
+	}
+
+	put := call(t, http.MethodPut, "/users/"+user.Id, adminToken, `{"username":"`+user.Username+`","name":"Put"}`)
+	if put.Code != http.StatusOK {
+		t.Fatalf("put responded %d: %s", put.Code, put.Body)
+	}
+	// absent roles are kept
+	if err := json.Unmarshal(put.Body.Bytes(), &user); err != nil || user.Name != "Put" || len(user.Roles) != 1 || user.Roles[0] != roleCoach {
+		t.Errorf("put %+v %v", user, err)
+	}
+	patched := call(t, http.MethodPatch, "/users/"+user.Id, adminToken, `{"sex":"female","name":null}`, contentTypeMergePatch)
+	if patched.Code != http.StatusOK {
+		t.Fatalf("patch responded %d: %s", patched.Code, patched.Body)
+	}
+	if err := json.Unmarshal(patched.Body.Bytes(), &user); err != nil || user.Sex != sexFemale || user.Name != "" || user.Username == "" {
+		t.Errorf("patched %+v %v", user, err)
+	}
+	if got := call(t, http.MethodPatch, "/users/"+user.Id, adminToken, `{"username":"x"}`, contentTypeMergePatch); got.Code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid patch responded %d", got.Code)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+	_, adminToken := testUser(t, "delete_admin", roleAdmin)
+	coach, coachToken := testUser(t, "delete_coach", roleCoach)
+	athlete, _ := testUser(t, "delete_athlete", roleAthlete)
+	athlete.Coaches = []string{coach.Id}
+	if _, err := users.Update(ctx, athlete); err != nil {
+		t.Fatal(err)
+	}
+	workout, err := workouts.Create(ctx, Workout{UserId: coach.Id, StartTime: time.Now(), Exercises: []WorkoutExercise{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = recomputeRecords(ctx, coach.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := call(t, http.MethodDelete, "/users/"+coach.Id, adminToken, ""); got.Code != http.StatusNoContent {
+		t.Fatalf("delete responded %d: %s", got.Code, got.Body)
+	}
+	if got := call(t, http.MethodGet, "/users/"+coach.Id, adminToken, ""); got.Code != http.StatusNotFound {
+		t.Errorf("get of the deleted user responded %d", got.Code)
+	}
+	if got := call(t, http.MethodDelete, "/users/"+coach.Id, adminToken, ""); got.Code != http.StatusNotFound {
+		t.Errorf("second delete responded %d", got.Code)
+	}
+	// the token of a deleted user no longer works
+	if got := call(t, http.MethodGet, "/users/"+athlete.Id+"/records", coachToken, ""); got.Code != http.StatusUnauthorized {
+		t.Errorf("deleted user's token responded %d", got.Code)
+	}
+	if _, err = workouts.Get(ctx, workout.Id); !errors.Is(err, ErrNotFound) {
+		t.Errorf("workout of the deleted user: %v", err)
+	}
+	if got, _ := users.Get(ctx, athlete.Id); len(got.Coaches) != 0 {
+		t.Errorf("athlete still coached by %v", got.Coaches)
+	}
+	if _, ok := recordUserLocks.Load(coach.Id); ok {
+		t.Errorf("records lock of the deleted user kept")
+	}
+}
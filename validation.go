@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-andiamo/chioas/yaml"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const maxRequestBodySize = 1 << 20
+
+// FieldError describes a single failing field in a request body
+type FieldError struct {
+	Path    string `json:"path" oas:"description: path of the failing field (e.g. username or exercises[0].sets[1].reps)"`
+	Message string `json:"message" oas:"description: why the field failed validation"`
+}
+
+// schemaValidator validates JSON request bodies against the chioas schemas used to document them,
+// so the served docs and the runtime behaviour cannot drift
+type schemaValidator struct {
+	schemas  map[string]chioas.Schema
+	patterns sync.Map // compiled patterns by pattern string
+}
+
+func newSchemaValidator(schemas chioas.Schemas) *schemaValidator {
+	v := &schemaValidator{schemas: map[string]chioas.Schema{}}
+	for _, s := range schemas {
+		v.schemas[s.Name] = s
+	}
+	return v
+}
+
+// middleware reads and validates the request body against the request schema before calling next
+//
+// Merge patch requests are validated partially - absent properties are fine, but present ones
+// must still be valid (and required properties may not be removed with null)
+func (v *schemaValidator) middleware(req *chioas.Request, next http.HandlerFunc) http.HandlerFunc {
+	partial := req.ContentType == contentTypeMergePatch
+	return func(writer http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxRequestBodySize))
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				writeError(writer, request, newProblem(http.StatusRequestEntityTooLarge, "request body exceeds %d bytes", mbe.Limit))
+			} else {
+				writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+			}
+			return
+		}
+		var value any
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err = dec.Decode(&value); err != nil {
+			writeError(writer, request, newProblem(http.StatusBadRequest, "invalid JSON body: %s", err.Error()))
+			return
+		}
+		if errs := v.validate(value, req.SchemaRef, req.IsArray, partial); len(errs) > 0 {
+			p := newProblem(http.StatusUnprocessableEntity, "request body failed validation")
+			p.Errors = errs
+			writeError(writer, request, p)
+			return
+		}
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		next(writer, request)
+	}
+}
+
+// validate validates a decoded JSON value against the named schema
+func (v *schemaValidator) validate(value any, schemaRef string, isArray bool, partial bool) []FieldError {
+	errs := make([]FieldError, 0)
+	if isArray {
+		items, ok := value.([]any)
+		if !ok {
+			return append(errs, FieldError{Message: "must be an array"})
+		}
+		for i, item := range items {
+			errs = v.validateRef(errs, fmt.Sprintf("[%d]", i), item, schemaRef, partial)
+		}
+		return errs
+	}
+	return v.validateRef(errs, "", value, schemaRef, partial)
+}
+
+func (v *schemaValidator) validateRef(errs []FieldError, path string, value any, schemaRef string, partial bool) []FieldError {
+	schema, ok := v.schemas[schemaRef]
+	if !ok {
+		// undocumented schema - nothing to validate against
+		return errs
+	}
+	if schema.Type != "" && schema.Type != "object" {
+		return v.validateValue(errs, path, value, chioas.Property{Type: schema.Type, Format: schema.Format, Enum: schema.Enum}, partial)
+	}
+	required := map[string]bool{}
+	for _, name := range schema.RequiredProperties {
+		required[name] = true
+	}
+	return v.validateObject(errs, path, value, schema.Properties, required, partial)
+}
+
+func (v *schemaValidator) validateObject(errs []FieldError, path string, value any, ptys chioas.Properties, required map[string]bool, partial bool) []FieldError {
+	obj, ok := value.(map[string]any)
+	if !ok {
+		return append(errs, FieldError{Path: path, Message: "must be an object"})
+	}
+	for _, pty := range ptys {
+		ptyPath := joinFieldPath(path, pty.Name)
+		isRequired := pty.Required || required[pty.Name]
+		pv, present := obj[pty.Name]
+		if !present {
+			if isRequired && !partial {
+				errs = append(errs, FieldError{Path: ptyPath, Message: "is required"})
+			}
+		} else if pv == nil {
+			if isRequired {
+				errs = append(errs, FieldError{Path: ptyPath, Message: "must not be null"})
+			} else if !partial && !pty.Constraints.Nullable {
+				errs = append(errs, FieldError{Path: ptyPath, Message: "must not be null"})
+			}
+		} else {
+			errs = v.validateValue(errs, ptyPath, pv, pty, partial)
+		}
+	}
+	return errs
+}
+
+func (v *schemaValidator) validateValue(errs []FieldError, path string, value any, pty chioas.Property, partial bool) []FieldError {
+	if pty.SchemaRef != "" {
+		if pty.Type == "array" {
+			items, ok := value.([]any)
+			if !ok {
+				return append(errs, FieldError{Path: path, Message: "must be an array"})
+			}
+			errs = v.validateItemCount(errs, path, items, pty.Constraints)
+			for i, item := range items {
+				errs = v.validateRef(errs, fmt.Sprintf("%s[%d]", path, i), item, pty.SchemaRef, false)
+			}
+			return errs
+		}
+		return v.validateRef(errs, path, value, pty.SchemaRef, partial)
+	}
+	switch pty.Type {
+	case "object":
+		if len(pty.Properties) > 0 {
+			return v.validateObject(errs, path, value, pty.Properties, nil, partial)
+		} else if _, ok := value.(map[string]any); !ok {
+			return append(errs, FieldError{Path: path, Message: "must be an object"})
+		}
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return append(errs, FieldError{Path: path, Message: "must be an array"})
+		}
+		errs = v.validateItemCount(errs, path, items, pty.Constraints)
+		itemPty := chioas.Property{Type: pty.ItemType, Properties: pty.Properties}
+		if itemPty.Type == "" {
+			itemPty.Type = "string"
+		}
+		for i, item := range items {
+			errs = v.validateValue(errs, fmt.Sprintf("%s[%d]", path, i), item, itemPty, false)
+		}
+	case "string", "":
+		s, ok := value.(string)
+		if !ok {
+			return append(errs, FieldError{Path: path, Message: "must be a string"})
+		}
+		errs = v.validateString(errs, path, s, pty)
+	case "integer", "number":
+		n, ok := value.(json.Number)
+		if !ok {
+			return append(errs, FieldError{Path: path, Message: "must be a " + pty.Type})
+		}
+		errs = v.validateNumber(errs, path, n, pty)
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return append(errs, FieldError{Path: path, Message: "must be a boolean"})
+		}
+	}
+	return v.validateEnum(errs, path, value, pty.Enum)
+}
+
+func (v *schemaValidator) validateString(errs []FieldError, path string, s string, pty chioas.Property) []FieldError {
+	c := pty.Constraints
+	l := uint(utf8.RuneCountInString(s))
+	if c.MinLength > 0 && l < c.MinLength {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must be at least %d characters", c.MinLength)})
+	}
+	if c.MaxLength > 0 && l > c.MaxLength {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must be at most %d characters", c.MaxLength)})
+	}
+	if c.Pattern != "" {
+		if re := v.pattern(c.Pattern); re != nil && !re.MatchString(s) {
+			errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must match pattern %s", c.Pattern)})
+		}
+	}
+	switch pty.Format {
+	case "date-time":
+		if _, err := time.Parse(time.RFC3339, s); err != nil {
+			errs = append(errs, FieldError{Path: path, Message: "must be an RFC 3339 date-time"})
+		}
+	case "date":
+		if _, err := time.Parse(time.DateOnly, s); err != nil {
+			errs = append(errs, FieldError{Path: path, Message: "must be a date (YYYY-MM-DD)"})
+		}
+	}
+	return errs
+}
+
+func (v *schemaValidator) validateNumber(errs []FieldError, path string, n json.Number, pty chioas.Property) []FieldError {
+	f, err := n.Float64()
+	if err != nil {
+		return append(errs, FieldError{Path: path, Message: "must be a " + pty.Type})
+	}
+	if pty.Type == "integer" {
+		if _, err = strconv.ParseInt(n.String(), 10, 64); err != nil {
+			return append(errs, FieldError{Path: path, Message: "must be an integer"})
+		}
+	}
+	c := pty.Constraints
+	if c.Minimum != "" {
+		if min, err := c.Minimum.Float64(); err == nil && (f < min || (c.ExclusiveMinimum && f == min)) {
+			errs = append(errs, FieldError{Path: path, Message: boundMessage("greater than", c.ExclusiveMinimum, c.Minimum)})
+		}
+	}
+	if c.Maximum != "" {
+		if max, err := c.Maximum.Float64(); err == nil && (f > max || (c.ExclusiveMaximum && f == max)) {
+			errs = append(errs, FieldError{Path: path, Message: boundMessage("less than", c.ExclusiveMaximum, c.Maximum)})
+		}
+	}
+	return errs
+}
+
+func boundMessage(cmp string, exclusive bool, bound json.Number) string {
+	if exclusive {
+		return fmt.Sprintf("must be %s %s", cmp, bound)
+	}
+	return fmt.Sprintf("must be %s or equal to %s", cmp, bound)
+}
+
+func (v *schemaValidator) validateItemCount(errs []FieldError, path string, items []any, c chioas.Constraints) []FieldError {
+	if c.MinItems > 0 && uint(len(items)) < c.MinItems {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must have at least %d items", c.MinItems)})
+	}
+	if c.MaxItems > 0 && uint(len(items)) > c.MaxItems {
+		errs = append(errs, FieldError{Path: path, Message: fmt.Sprintf("must have at most %d items", c.MaxItems)})
+	}
+	return errs
+}
+
+func (v *schemaValidator) validateEnum(errs []FieldError, path string, value any, enum []any) []FieldError {
+	if len(enum) == 0 {
+		return errs
+	}
+	s := fmt.Sprint(value)
+	allowed := make([]string, 0, len(enum))
+	for _, e := range enum {
+		es := fmt.Sprint(e)
+		if lv, ok := e.(yaml.LiteralValue); ok {
+			es = unquote(lv.Value)
+		}
+		if es == s {
+			return errs
+		}
+		allowed = append(allowed, es)
+	}
+	return append(errs, FieldError{Path: path, Message: "must be one of: " + strings.Join(allowed, ", ")})
+}
+
+func (v *schemaValidator) pattern(p string) *regexp.Regexp {
+	if re, ok := v.patterns.Load(p); ok {
+		return re.(*regexp.Regexp)
+	}
+	re, err := regexp.Compile(p)
+	if err != nil {
+		return nil
+	}
+	v.patterns.Store(p, re)
+	return re
+}
+
+func joinFieldPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
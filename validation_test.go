@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidation(t *testing.T) {
+	user, token := testUser(t, "validation")
+	workout := func(sets string) string {
+		return `{"userId":"` + user.Id + `","startTime":"2024-05-01T08:00:00Z","exercises":[{"exerciseId":"000000000000000000000001","sets":[` + sets + `]}]}`
+	}
+	for name, tc := range map[string]struct {
+		method      string
+		path        string
+		body        string
+		contentType string
+		want        int
+		wantPaths   []string
+	}{
+		"required":           {http.MethodPost, "/auth/register", `{}`, "", http.StatusUnprocessableEntity, []string{"password", "username"}},
+		"pattern":            {http.MethodPost, "/auth/register", `{"username":"bad name!","password":"password1"}`, "", http.StatusUnprocessableEntity, []string{"username"}},
+		"minLength":          {http.MethodPost, "/auth/register", `{"username":"ab","password":"password1"}`, "", http.StatusUnprocessableEntity, []string{"username"}},
+		"maxLength":          {http.MethodPost, "/auth/register", `{"username":"` + strings.Repeat("a", 33) + `","password":"password1"}`, "", http.StatusUnprocessableEntity, []string{"username"}},
+		"maxLength in runes": {http.MethodPut, "/users/" + user.Id, `{"username":"` + user.Username + `","name":"` + strings.Repeat("é", 100) + `"}`, "", http.StatusOK, nil},
+		"too many runes":     {http.MethodPut, "/users/" + user.Id, `{"username":"` + user.Username + `","name":"` + strings.Repeat("é", 101) + `"}`, "", http.StatusUnprocessableEntity, []string{"name"}},
+		"wrong type":         {http.MethodPost, "/auth/register", `{"username":123,"password":"password1"}`, "", http.StatusUnprocessableEntity, []string{"username"}},
+		"null required":      {http.MethodPost, "/auth/register", `{"username":null,"password":"password1"}`, "", http.StatusUnprocessableEntity, []string{"username"}},
+		"enum":               {http.MethodPut, "/users/" + user.Id, `{"username":"` + user.Username + `","units":"furlongs"}`, "", http.StatusUnprocessableEntity, []string{"units"}},
+		"nested":             {http.MethodPost, "/workouts", workout(`{"reps":5},{"reps":-1,"rpe":11}`), "", http.StatusUnprocessableEntity, []string{"exercises[0].sets[1].reps", "exercises[0].sets[1].rpe"}},
+		"integer":            {http.MethodPost, "/workouts", workout(`{"reps":5.5}`), "", http.StatusUnprocessableEntity, []string{"exercises[0].sets[0].reps"}},
+		"not an object":      {http.MethodPost, "/auth/register", `[]`, "", http.StatusUnprocessableEntity, []string{""}},
+		"invalid json":       {http.MethodPost, "/auth/register", `{"username":`, "", http.StatusBadRequest, nil},
+		// merge patches only validate what they patch - but can't remove required properties
+		"patch partial":          {http.MethodPatch, "/users/" + user.Id, `{"name":"Val"}`, contentTypeMergePatch, http.StatusOK, nil},
+		"patch invalid":          {http.MethodPatch, "/users/" + user.Id, `{"username":"bad name!"}`, contentTypeMergePatch, http.StatusUnprocessableEntity, []string{"username"}},
+		"patch removes required": {http.MethodPatch, "/users/" + user.Id, `{"username":null}`, contentTypeMergePatch, http.StatusUnprocessableEntity, []string{"username"}},
+		"patch removes optional": {http.MethodPatch, "/users/" + user.Id, `{"sex":null}`, contentTypeMergePatch, http.StatusOK, nil},
+		"patch nested":           {http.MethodPatch, "/users/" + user.Id, `{"heartRate":{"maxHeartRate":300}}`, contentTypeMergePatch, http.StatusUnprocessableEntity, []string{"heartRate.maxHeartRate"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var got *httptest.ResponseRecorder
+			if tc.contentType != "" {
+				got = call(t, tc.method, tc.path, token, tc.body, tc.contentType)
+			} else {
+				got = call(t, tc.method, tc.path, token, tc.body)
+			}
+			if got.Code != tc.want {
+				t.Fatalf("responded %d, want %d: %s", got.Code, tc.want, got.Body)
+			}
+			if tc.wantPaths == nil {
+				return
+			}
+			p := problemOf(t, got)
+			var paths []string
+			for _, e := range p.Errors {
+				paths = append(paths, e.Path)
+			}
+			slices.Sort(paths)
+			if !slices.Equal(paths, tc.wantPaths) {
+				t.Errorf("errors %v, want paths %v", p.Errors, tc.wantPaths)
+			}
+		})
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	user, token := testUser(t, "body_limit")
+	body := `{"userId":"` + user.Id + `","startTime":"2024-05-01T08:00:00Z","notes":"` + strings.Repeat("a", maxRequestBodySize) + `"}`
+	got := call(t, http.MethodPost, "/workouts", token, body)
+	if got.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("responded %d, want 413", got.Code)
+	}
+	if p := problemOf(t, got); p.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("problem %+v", p)
+	}
+}
+
+// problemOf decodes a problem response
+func problemOf(t *testing.T, got *httptest.ResponseRecorder) Problem {
+	t.Helper()
+	var p Problem
+	if got.Header().Get("Content-Type") != contentTypeProblem {
+		t.Errorf("content type %q, want %q", got.Header().Get("Content-Type"), contentTypeProblem)
+	}
+	if err := json.Unmarshal(got.Body.Bytes(), &p); err != nil {
+		t.Fatalf("decoding problem %v: %s", err, got.Body)
+	}
+	return p
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	contentTypeCsv = "text/csv; charset=utf-8"
+
+	importFormatHevy     = "hevy"
+	importFormatStrong   = "strong"
+	importFormatWorkyapi = "workyapi"
+
+	kgPerLb       = 0.45359237
+	metresPerMile = 1609.344
+)
+
+// ImportFormats are the CSV layouts that can be imported
+var ImportFormats = []string{importFormatHevy, importFormatStrong, importFormatWorkyapi}
+
+// workoutCsvColumns is the header of our own (round-trippable) CSV export
+//
+// There is a row per set - with a row with empty set columns for an exercise without sets and a row
+// with empty exercise columns for a workout without exercises
+var workoutCsvColumns = []string{
+	"workout_start", "workout_end", "workout_notes",
+	"exercise_index", "exercise_id", "exercise_name", "exercise_notes",
+	"set_index", "reps", "weight_kg", "rpe", "duration_seconds", "distance_m",
+}
+
+// importOptions are how values without units (or time zones) in an import are to be read
+type importOptions struct {
+	format   string
+	weightLb bool
+	distMile bool
+	loc      *time.Location
+}
+
+// importRow is a CSV row read into its workout, exercise and (optional) set
+type importRow struct {
+	line          int
+	workoutKey    string
+	start         time.Time
+	end           *time.Time
+	workoutNotes  string
+	exerciseKey   string
+	exerciseId    string
+	exerciseName  string
+	exerciseNotes string
+	set           *WorkoutSet
+}
+
+// csvRecord is a CSV row with its values by (lower case) column name
+type csvRecord struct {
+	line    int
+	columns map[string]int
+	values  []string
+}
+
+func (r csvRecord) get(name string) string {
+	if i, ok := r.columns[name]; ok && i < len(r.values) {
+		return strings.TrimSpace(r.values[i])
+	}
+	return ""
+}
+
+func (r csvRecord) has(name string) bool {
+	_, ok := r.columns[name]
+	return ok
+}
+
+// importRowError is a row that could not be read
+type importRowError struct {
+	line   int
+	name   string
+	reason string
+}
+
+func (e *importRowError) Error() string {
+	return fmt.Sprintf("row %d: %s", e.line, e.reason)
+}
+
+// readWorkoutCsv reads the rows of a CSV import - detecting the layout from the header (unless
+// opts.format is set)
+//
+// Rows that are not sets (e.g. Strong's rest timer rows) are left out. Rows that can't be read are
+// returned as importRowErrors rather than failing the whole import
+func readWorkoutCsv(data []byte, opts importOptions) (format string, rows []importRow, rowErrs []*importRowError, err error) {
+	data = bytes.TrimPrefix(data, []byte("\ufeff"))
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	r := csv.NewReader(bytes.NewReader(data))
+	// older Strong exports are semicolon separated
+	if bytes.Count(firstLine, []byte(";")) > bytes.Count(firstLine, []byte(",")) {
+		r.Comma = ';'
+	}
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if errors.Is(err, io.EOF) {
+		return "", nil, nil, newProblem(http.StatusBadRequest, "CSV is empty")
+	} else if err != nil {
+		return "", nil, nil, newProblem(http.StatusBadRequest, "invalid CSV: %s", err.Error())
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	format = opts.format
+	if format == "" {
+		if format = detectCsvFormat(columns); format == "" {
+			return "", nil, nil, newProblem(http.StatusBadRequest, "CSV header is not of a known format (%s)", strings.Join(ImportFormats, ", "))
+		}
+	} else if detectCsvFormat(columns) != format {
+		return "", nil, nil, newProblem(http.StatusBadRequest, "CSV header is not of the %s format", format)
+	}
+	for {
+		values, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return "", nil, nil, newProblem(http.StatusBadRequest, "invalid CSV: %s", err.Error())
+		}
+		line, _ := r.FieldPos(0)
+		rec := csvRecord{line: line, columns: columns, values: values}
+		if len(values) == 1 && strings.TrimSpace(values[0]) == "" {
+			continue
+		}
+		var row *importRow
+		switch format {
+		case importFormatStrong:
+			row, err = readStrongRow(rec, opts)
+		case importFormatHevy:
+			row, err = readHevyRow(rec, opts)
+		default:
+			row, err = readWorkyapiRow(rec)
+		}
+		var rowErr *importRowError
+		if errors.As(err, &rowErr) {
+			rowErrs = append(rowErrs, rowErr)
+		} else if err != nil {
+			return "", nil, nil, err
+		} else if row != nil {
+			rows = append(rows, *row)
+		}
+	}
+	return format, rows, rowErrs, nil
+}
+
+// detectCsvFormat is the format whose identifying columns are all in the header (or "")
+func detectCsvFormat(columns map[string]int) string {
+	has := func(names ...string) bool {
+		for _, name := range names {
+			if _, ok := columns[name]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	switch {
+	case has("workout_start", "exercise_id", "set_index"):
+		return importFormatWorkyapi
+	case has("exercise_title", "start_time", "set_index"):
+		return importFormatHevy
+	case has("date", "exercise name", "set order"):
+		return importFormatStrong
+	}
+	return ""
+}
+
+// readStrongRow reads a row of a Strong export - whose values are in the units chosen in the app
+// (given by the Weight Unit and Distance Unit columns of older exports - otherwise by the options)
+func readStrongRow(rec csvRecord, opts importOptions) (*importRow, error) {
+	order := rec.get("set order")
+	if _, err := strconv.Atoi(order); err != nil && !slices.Contains([]string{"W", "D", "F"}, strings.ToUpper(order)) {
+		// rest timer and note rows
+		return nil, nil
+	}
+	name := rec.get("exercise name")
+	start, err := parseImportTime(rec.get("date"), opts.loc, "2006-01-02 15:04:05", "2006-01-02 15:04")
+	if err != nil {
+		return nil, &importRowError{line: rec.line, name: name, reason: fmt.Sprintf("invalid Date %q", rec.get("date"))}
+	}
+	row := &importRow{
+		line:         rec.line,
+		workoutKey:   rec.get("date") + "\x00" + rec.get("workout name"),
+		start:        start,
+		workoutNotes: joinNotes(rec.get("workout name"), rec.get("workout notes")),
+		exerciseKey:  name,
+		exerciseName: name,
+		// Strong's notes are per set - gathered up as the exercise notes
+		exerciseNotes: rec.get("notes"),
+	}
+	duration := rec.get("duration")
+	if !rec.has("duration") {
+		duration = rec.get("workout duration")
+	}
+	if duration != "" {
+		d, err := parseStrongDuration(duration)
+		if err != nil {
+			return nil, &importRowError{line: rec.line, name: name, reason: fmt.Sprintf("invalid Duration %q", duration)}
+		}
+		if d > 0 {
+			end := start.Add(d)
+			row.end = &end
+		}
+	}
+	weightLb, distMile := opts.weightLb, opts.distMile
+	if rec.has("weight unit") {
+		weightLb = strings.HasPrefix(strings.ToLower(rec.get("weight unit")), "lb")
+	}
+	if rec.has("distance unit") {
+		distMile = strings.HasPrefix(strings.ToLower(rec.get("distance unit")), "mi")
+	}
+	set, err := readImportSet(rec, importSetColumns{
+		reps:     "reps",
+		weight:   "weight",
+		rpe:      "rpe",
+		duration: "seconds",
+		distance: "distance",
+	}, true, weightFactor(weightLb), distanceFactor(distMile))
+	if err != nil {
+		return nil, &importRowError{line: rec.line, name: name, reason: err.Error()}
+	}
+	row.set = set
+	return row, nil
+}
+
+// readHevyRow reads a row of a Hevy export - whose columns carry their units
+func readHevyRow(rec csvRecord, opts importOptions) (*importRow, error) {
+	name := rec.get("exercise_title")
+	start, err := parseImportTime(rec.get("start_time"), opts.loc, "2 Jan 2006, 15:04", "2 Jan 2006 15:04", "2006-01-02 15:04:05", "2006-01-02 15:04")
+	if err != nil {
+		return nil, &importRowError{line: rec.line, name: name, reason: fmt.Sprintf("invalid start_time %q", rec.get("start_time"))}
+	}
+	row := &importRow{
+		line:          rec.line,
+		workoutKey:    rec.get("start_time") + "\x00" + rec.get("title"),
+		start:         start,
+		workoutNotes:  joinNotes(rec.get("title"), rec.get("description")),
+		exerciseKey:   name + "\x00" + rec.get("superset_id"),
+		exerciseName:  name,
+		exerciseNotes: rec.get("exercise_notes"),
+	}
+	if v := rec.get("end_time"); v != "" {
+		end, err := parseImportTime(v, opts.loc, "2 Jan 2006, 15:04", "2 Jan 2006 15:04", "2006-01-02 15:04:05", "2006-01-02 15:04")
+		if err != nil {
+			return nil, &importRowError{line: rec.line, name: name, reason: fmt.Sprintf("invalid end_time %q", v)}
+		}
+		if !end.Before(start) {
+			row.end = &end
+		}
+	}
+	cols := importSetColumns{reps: "reps", weight: "weight_kg", rpe: "rpe", duration: "duration_seconds", distance: "distance_km"}
+	weightLb, distMile := false, false
+	if !rec.has("weight_kg") && rec.has("weight_lbs") {
+		cols.weight, weightLb = "weight_lbs", true
+	}
+	if !rec.has("distance_km") && rec.has("distance_miles") {
+		cols.distance, distMile = "distance_miles", true
+	}
+	set, err := readImportSet(rec, cols, true, weightFactor(weightLb), distanceFactor(distMile))
+	if err != nil {
+		return nil, &importRowError{line: rec.line, name: name, reason: err.Error()}
+	}
+	row.set = set
+	return row, nil
+}
+
+// readWorkyapiRow reads a row of our own export
+func readWorkyapiRow(rec csvRecord) (*importRow, error) {
+	name := rec.get("exercise_name")
+	start, err := time.Parse(time.RFC3339, rec.get("workout_start"))
+	if err != nil {
+		return nil, &importRowError{line: rec.line, name: name, reason: fmt.Sprintf("invalid workout_start %q", rec.get("workout_start"))}
+	}
+	row := &importRow{
+		line:          rec.line,
+		workoutKey:    rec.get("workout_start"),
+		start:         start,
+		workoutNotes:  rec.get("workout_notes"),
+		exerciseKey:   rec.get("exercise_index"),
+		exerciseId:    rec.get("exercise_id"),
+		exerciseName:  name,
+		exerciseNotes: rec.get("exercise_notes"),
+	}
+	if v := rec.get("workout_end"); v != "" {
+		end, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, &importRowError{line: rec.line, name: name, reason: fmt.Sprintf("invalid workout_end %q", v)}
+		}
+		row.end = &end
+	}
+	if row.exerciseKey == "" || rec.get("set_index") == "" {
+		return row, nil
+	}
+	set, err := readImportSet(rec, importSetColumns{
+		reps:     "reps",
+		weight:   "weight_kg",
+		rpe:      "rpe",
+		duration: "duration_seconds",
+		distance: "distance_m",
+	}, false, 1, 1)
+	if err != nil {
+		return nil, &importRowError{line: rec.line, name: name, reason: err.Error()}
+	}
+	row.set = set
+	return row, nil
+}
+
+// importSetColumns are the names of the set value columns of a format
+type importSetColumns struct {
+	reps, weight, rpe, duration, distance string
+}
+
+// readImportSet reads the set values of a row - converting weights to kg and distances to metres
+//
+// Other apps write 0 for values that weren't recorded - so with zeroIsEmpty zeros are left out
+func readImportSet(rec csvRecord, cols importSetColumns, zeroIsEmpty bool, toKg float64, toMetres float64) (*WorkoutSet, error) {
+	value := func(column string, factor float64) (*float64, error) {
+		s := rec.get(column)
+		if s == "" {
+			return nil, nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("invalid %s %q", column, s)
+		}
+		if f == 0 && zeroIsEmpty {
+			return nil, nil
+		}
+		f = roundStored(f * factor)
+		return &f, nil
+	}
+	var set WorkoutSet
+	var err error
+	reps, err := value(cols.reps, 1)
+	if err != nil {
+		return nil, err
+	} else if reps != nil {
+		if *reps != math.Trunc(*reps) {
+			return nil, fmt.Errorf("invalid %s %q", cols.reps, rec.get(cols.reps))
+		}
+		n := int(*reps)
+		set.Reps = &n
+	}
+	if set.Weight, err = value(cols.weight, toKg); err != nil {
+		return nil, err
+	}
+	if set.RPE, err = value(cols.rpe, 1); err != nil {
+		return nil, err
+	} else if set.RPE != nil && (*set.RPE < 1 || *set.RPE > 10) {
+		return nil, fmt.Errorf("invalid %s %q", cols.rpe, rec.get(cols.rpe))
+	}
+	if set.Duration, err = value(cols.duration, 1); err != nil {
+		return nil, err
+	}
+	if set.Distance, err = value(cols.distance, toMetres); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+func weightFactor(lb bool) float64 {
+	if lb {
+		return kgPerLb
+	}
+	return 1
+}
+
+func distanceFactor(mile bool) float64 {
+	if mile {
+		return metresPerMile
+	}
+	return 1000
+}
+
+// parseImportTime parses a local date-time in one of the layouts (or RFC 3339)
+func parseImportTime(v string, loc *time.Location, layouts ...string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	for _, layout := range layouts {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date-time %q", v)
+}
+
+// parseStrongDuration parses a Strong workout duration - e.g. "1h 5m", "45m" or "30s" (or seconds)
+func parseStrongDuration(v string) (time.Duration, error) {
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	return time.ParseDuration(strings.ReplaceAll(v, " ", ""))
+}
+
+func joinNotes(parts ...string) string {
+	nonEmpty := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			nonEmpty = append(nonEmpty, p)
+		}
+	}
+	return strings.Join(nonEmpty, "\n\n")
+}
+
+// writeWorkoutCsv writes workouts in our own CSV format (see workoutCsvColumns)
+func writeWorkoutCsv(w io.Writer, items []Workout, exerciseName func(id string) (string, error)) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(workoutCsvColumns); err != nil {
+		return err
+	}
+	num := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*v, 'f', -1, 64)
+	}
+	for _, wo := range items {
+		end := ""
+		if wo.EndTime != nil {
+			end = wo.EndTime.Format(time.RFC3339Nano)
+		}
+		workout := []string{wo.StartTime.Format(time.RFC3339Nano), end, wo.Notes}
+		if len(wo.Exercises) == 0 {
+			if err := cw.Write(append(workout, make([]string, len(workoutCsvColumns)-len(workout))...)); err != nil {
+				return err
+			}
+		}
+		for i, we := range wo.Exercises {
+			name, err := exerciseName(we.ExerciseId)
+			if err != nil {
+				return err
+			}
+			exercise := append(slices.Clone(workout), strconv.Itoa(i), we.ExerciseId, name, we.Notes)
+			if len(we.Sets) == 0 {
+				if err = cw.Write(append(exercise, make([]string, len(workoutCsvColumns)-len(exercise))...)); err != nil {
+					return err
+				}
+			}
+			for j, set := range we.Sets {
+				reps := ""
+				if set.Reps != nil {
+					reps = strconv.Itoa(*set.Reps)
+				}
+				row := append(slices.Clone(exercise), strconv.Itoa(j), reps, num(set.Weight), num(set.RPE), num(set.Duration), num(set.Distance))
+				if err = cw.Write(row); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
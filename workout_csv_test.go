@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWorkoutCsvRoundTrip(t *testing.T) {
+	start := time.Date(2024, 3, 2, 7, 15, 30, 123456789, time.UTC)
+	end := start.Add(time.Hour + 500*time.Millisecond)
+	reps := 5
+	written := []Workout{{
+		StartTime: start,
+		EndTime:   &end,
+		Notes:     "heavy, \"really\"",
+		Exercises: []WorkoutExercise{{
+			ExerciseId: "000000000000000000000001",
+			Sets: []WorkoutSet{
+				{Reps: &reps, Weight: ptr(100.1234)},
+				{Duration: ptr(90.5), Distance: ptr(1234.5678)},
+			},
+		}},
+	}}
+	var buf bytes.Buffer
+	if err := writeWorkoutCsv(&buf, written, func(string) (string, error) { return "Back Squat", nil }); err != nil {
+		t.Fatal(err)
+	}
+	format, rows, rowErrs, err := readWorkoutCsv(buf.Bytes(), importOptions{loc: time.UTC})
+	if err != nil || len(rowErrs) > 0 {
+		t.Fatalf("read %v %v", err, rowErrs)
+	}
+	if format != importFormatWorkyapi || len(rows) != 2 {
+		t.Fatalf("format %q with %d rows, want %q with 2", format, len(rows), importFormatWorkyapi)
+	}
+	// imports are deduplicated on the exact start time - so it must survive to the nanosecond
+	if row := rows[0]; !row.start.Equal(start) || row.end == nil || !row.end.Equal(end) || row.workoutNotes != written[0].Notes {
+		t.Errorf("workout %v to %v %q", row.start, row.end, row.workoutNotes)
+	}
+	// stored values keep 4 decimal places
+	if set := rows[0].set; set == nil || set.Reps == nil || *set.Reps != 5 || set.Weight == nil || *set.Weight != 100.1234 {
+		t.Errorf("first set %+v", set)
+	}
+	if set := rows[1].set; set == nil || set.Duration == nil || *set.Duration != 90.5 || set.Distance == nil || *set.Distance != 1234.5678 {
+		t.Errorf("second set %+v", set)
+	}
+}
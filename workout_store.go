@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// WorkoutStore is the persistence interface for workouts
+type WorkoutStore interface {
+	List(ctx context.Context, filter WorkoutFilter) ([]Workout, error)
+	Get(ctx context.Context, id string) (Workout, error)
+	Create(ctx context.Context, workout Workout) (Workout, error)
+	Update(ctx context.Context, workout Workout) (Workout, error)
+	Delete(ctx context.Context, id string) error
+	// DeleteUserWorkouts deletes all of a user's workouts (e.g. when the user is deleted)
+	DeleteUserWorkouts(ctx context.Context, userId string) error
+	// Ping checks that the store is usable
+	Ping(ctx context.Context) error
+	// Close closes the store - further writes fail with ErrStoreClosed
+	Close() error
+}
+
+// WorkoutFilter filters listed workouts - zero value fields are not filtered on
+type WorkoutFilter struct {
+	UserId string
+	// From is the inclusive lower bound of the workout start time
+	From time.Time
+	// To is the exclusive upper bound of the workout start time
+	To time.Time
+}
+
+func (f WorkoutFilter) matches(w Workout) bool {
+	return (f.UserId == "" || w.UserId == f.UserId) &&
+		(f.From.IsZero() || !w.StartTime.Before(f.From)) &&
+		(f.To.IsZero() || w.StartTime.Before(f.To))
+}
+
+// NewMemoryWorkoutStore creates a WorkoutStore that is held in memory only
+func NewMemoryWorkoutStore() WorkoutStore {
+	return &workoutStore{items: newMemoryCollection[Workout]("workouts", workoutId)}
+}
+
+// OpenFileWorkoutStore opens (or creates) a file-backed WorkoutStore in the given directory
+func OpenFileWorkoutStore(dir string) (WorkoutStore, error) {
+	c, err := openFileCollection[Workout](dir, "workouts", workoutId)
+	if err != nil {
+		return nil, err
+	}
+	return &workoutStore{items: c}, nil
+}
+
+func workoutId(w *Workout) *string {
+	return &w.Id
+}
+
+type workoutStore struct {
+	items *collection[Workout]
+}
+
+func (s *workoutStore) List(ctx context.Context, filter WorkoutFilter) ([]Workout, error) {
+	return s.items.list(ctx, filter.matches)
+}
+
+func (s *workoutStore) Get(ctx context.Context, id string) (Workout, error) {
+	return s.items.get(ctx, id)
+}
+
+func (s *workoutStore) Create(ctx context.Context, workout Workout) (Workout, error) {
+	return s.items.create(ctx, workout, nil)
+}
+
+func (s *workoutStore) Update(ctx context.Context, workout Workout) (Workout, error) {
+	return s.items.update(ctx, workout, nil)
+}
+
+func (s *workoutStore) Delete(ctx context.Context, id string) error {
+	return s.items.delete(ctx, id)
+}
+
+func (s *workoutStore) DeleteUserWorkouts(ctx context.Context, userId string) error {
+	_, err := s.items.deleteWhere(ctx, func(existing Workout) bool {
+		return existing.UserId == userId
+	})
+	return err
+}
+
+func (s *workoutStore) Ping(ctx context.Context) error {
+	return s.items.ping(ctx)
+}
+
+func (s *workoutStore) Close() error {
+	return s.items.close()
+}
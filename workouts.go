@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-andiamo/chioas"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"net/http"
+	"time"
+)
+
+type Workout struct {
+	Id        string            `json:"_id" oas:"description: db oid, pattern: '^[0-9a-f]{24}$'"`
+	UserId    string            `json:"userId" oas:"description: db oid of the owning User, required, pattern: '^[0-9a-f]{24}$'"`
+	StartTime time.Time         `json:"startTime" oas:"description: when the session started, required"`
+	EndTime   *time.Time        `json:"endTime,omitempty" oas:"description: when the session ended (absent while in progress)"`
+	Notes     string            `json:"notes,omitempty" oas:"description: free text notes for the session, maxLength: 2000"`
+	Exercises []WorkoutExercise `json:"exercises" oas:"description: exercises in the order they were performed"`
+}
+
+type WorkoutExercise struct {
+	ExerciseId string       `json:"exerciseId" oas:"description: db oid of the Exercise (from the catalogue or a custom exercise of the owning User), required, pattern: '^[0-9a-f]{24}$'"`
+	Notes      string       `json:"notes,omitempty" oas:"description: free text notes for the exercise, maxLength: 1000"`
+	Sets       []WorkoutSet `json:"sets" oas:"description: sets in the order they were performed"`
+}
+
+type WorkoutSet struct {
+	Reps     *int     `json:"reps,omitempty" oas:"description: repetitions performed, minimum: 0"`
+	Weight   *float64 `json:"weight,omitempty" oas:"description: load in kg (lb in imperial units), minimum: 0"`
+	RPE      *float64 `json:"rpe,omitempty" oas:"description: rate of perceived exertion (1-10), minimum: 1, maximum: 10"`
+	Duration *float64 `json:"duration,omitempty" oas:"description: duration in seconds, minimum: 0"`
+	Distance *float64 `json:"distance,omitempty" oas:"description: distance in metres (miles in imperial units), minimum: 0"`
+	// PersonalRecords is derived (see computeRecords) - never stored
+	PersonalRecords []string `json:"personalRecords,omitempty" oas:"description: read-only kinds of personal record this set achieved (ignored on input), $ref: RecordKind, type: array"`
+}
+
+var WorkoutPath = chioas.Path{
+	Methods: chioas.Methods{
+		http.MethodGet: {
+			Handler:     getWorkouts,
+			OperationId: "listWorkouts",
+			Description: "Non-admins must filter by a userId they may access",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerQueryUserId, Coach: true}),
+			QueryParams: workoutListing.queryParams(
+				unitsParam,
+				chioas.QueryParam{
+					Name:        "userId",
+					Description: "Only workouts owned by this User db oid",
+				},
+				chioas.QueryParam{
+					Name:        "from",
+					Description: "Only workouts starting at or after this date-time (or date)",
+					Example:     "2024-07-01T00:00:00Z",
+				},
+				chioas.QueryParam{
+					Name:        "to",
+					Description: "Only workouts starting before this date-time (or date)",
+					Example:     "2024-08-01T00:00:00Z",
+				},
+			),
+			Responses: chioas.Responses{
+				http.StatusOK: {
+					Description: "List of Workouts",
+					IsArray:     true,
+					SchemaRef:   "Workout",
+				},
+			},
+		},
+		http.MethodPost: {
+			Handler:     postWorkout,
+			OperationId: "createWorkout",
+			Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerBodyUserId, Coach: true}),
+			QueryParams: chioas.QueryParams{unitsParam},
+			Request: &chioas.Request{
+				Description: "Workout to create (any _id is ignored)",
+				Required:    true,
+				SchemaRef:   "Workout",
+			},
+			Responses: chioas.Responses{
+				http.StatusCreated: {
+					Description: "Created Workout",
+					SchemaRef:   "Workout",
+				},
+			},
+		},
+	},
+	Paths: chioas.Paths{
+		"/{id}": {
+			PathParams: chioas.PathParams{
+				"id": {
+					Description: "Workout db oid",
+					Example:     "66971add3abcef545e64400c",
+				},
+			},
+			Methods: chioas.Methods{
+				http.MethodGet: {
+					Handler:     getWorkout,
+					OperationId: "getWorkout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathWorkout, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Workout",
+							SchemaRef:   "Workout",
+						},
+					},
+				},
+				http.MethodPut: {
+					Handler:     putWorkout,
+					OperationId: "replaceWorkout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathWorkout, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Request: &chioas.Request{
+						Description: "Replacement Workout (any _id and userId are ignored)",
+						Required:    true,
+						SchemaRef:   "Workout",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Workout",
+							SchemaRef:   "Workout",
+						},
+					},
+				},
+				http.MethodPatch: {
+					Handler:     patchWorkout,
+					OperationId: "updateWorkout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathWorkout, Coach: true}),
+					QueryParams: chioas.QueryParams{unitsParam},
+					Request: &chioas.Request{
+						Description: "JSON Merge Patch (RFC 7396) to apply to the Workout (any _id and userId are ignored)",
+						Required:    true,
+						ContentType: contentTypeMergePatch,
+						SchemaRef:   "Workout",
+					},
+					Responses: chioas.Responses{
+						http.StatusOK: {
+							Description: "Updated Workout",
+							SchemaRef:   "Workout",
+						},
+					},
+				},
+				http.MethodDelete: {
+					Handler:     deleteWorkout,
+					OperationId: "deleteWorkout",
+					Extensions:  allow(access{Roles: []string{roleAdmin}, Owner: ownerPathWorkout, Coach: true}),
+					Responses: chioas.Responses{
+						http.StatusNoContent: {
+							Description: "Workout deleted",
+						},
+					},
+				},
+			},
+			Paths: chioas.Paths{
+				"/track.gpx":     TrackGpxPath,
+				"/track.geojson": TrackGeoJsonPath,
+				"/heart-rate":    WorkoutHeartRatePath,
+			},
+		},
+	},
+}
+
+var WorkoutSchemas = []chioas.Schema{
+	(&chioas.Schema{
+		Name:        "Workout",
+		Description: "A Workout session",
+		Comment:     chioas.SourceComment(),
+	}).Must(Workout{}),
+}
+
+var workoutListing = listing[Workout]{
+	id: func(w Workout) string { return w.Id },
+	fields: sortFields[Workout]{
+		"_id":       func(w Workout) string { return w.Id },
+		"startTime": func(w Workout) string { return sortKeyTime(w.StartTime) },
+	},
+	defaultSort: "-startTime",
+}
+
+// workouts is the store used by the workout handlers (replaced by a file-backed store in main)
+var workouts = NewMemoryWorkoutStore()
+
+func getWorkouts(writer http.ResponseWriter, request *http.Request) {
+	filter := WorkoutFilter{UserId: request.URL.Query().Get("userId")}
+	var err error
+	if filter.From, err = queryTime(request, "from"); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if filter.To, err = queryTime(request, "to"); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	result, err := workouts.List(request.Context(), filter)
+	if err == nil {
+		result, err = workoutListing.paginate(writer, request, result)
+	}
+	if err == nil {
+		err = flagRecords(request.Context(), result)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().workouts(result)
+	writeJson(writer, request, http.StatusOK, result)
+}
+
+func postWorkout(writer http.ResponseWriter, request *http.Request) {
+	var workout Workout
+	if err := decodeJson(request, &workout); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u := unitsFrom(request.Context())
+	u.in().workout(&workout)
+	if err := checkWorkout(request.Context(), &workout); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	workout, err := workouts.Create(request.Context(), workout)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	updateRecords(request.Context(), workout.UserId)
+	if err = flagRecords(request.Context(), []Workout{workout}); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	writer.Header().Set("Location", request.URL.Path+"/"+workout.Id)
+	u.out().workout(&workout)
+	writeJson(writer, request, http.StatusCreated, workout)
+}
+
+func getWorkout(writer http.ResponseWriter, request *http.Request) {
+	workout, err := workouts.Get(request.Context(), chi.URLParam(request, "id"))
+	if err == nil {
+		err = flagRecords(request.Context(), []Workout{workout})
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	unitsFrom(request.Context()).out().workout(&workout)
+	writeJson(writer, request, http.StatusOK, workout)
+}
+
+func putWorkout(writer http.ResponseWriter, request *http.Request) {
+	existing, err := workouts.Get(request.Context(), chi.URLParam(request, "id"))
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	var workout Workout
+	if err = decodeJson(request, &workout); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u := unitsFrom(request.Context())
+	u.in().workout(&workout)
+	workout.Id, workout.UserId = existing.Id, existing.UserId
+	if err = checkWorkout(request.Context(), &workout); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if workout, err = workouts.Update(request.Context(), workout); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	updateRecords(request.Context(), workout.UserId)
+	if err = flagRecords(request.Context(), []Workout{workout}); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u.out().workout(&workout)
+	writeJson(writer, request, http.StatusOK, workout)
+}
+
+func patchWorkout(writer http.ResponseWriter, request *http.Request) {
+	id := chi.URLParam(request, "id")
+	workout, err := workouts.Get(request.Context(), id)
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	patch, err := io.ReadAll(request.Body)
+	if err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "%s", err.Error()))
+		return
+	}
+	userId := workout.UserId
+	// the patch is in the request units - so it is applied to the workout in those units
+	u := unitsFrom(request.Context())
+	u.outExact().workout(&workout)
+	if err = applyMergePatch(&workout, patch); err != nil {
+		writeError(writer, request, newProblem(http.StatusBadRequest, "invalid merge patch: %s", err.Error()))
+		return
+	}
+	u.in().workout(&workout)
+	workout.Id, workout.UserId = id, userId
+	if err = checkWorkout(request.Context(), &workout); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	if workout, err = workouts.Update(request.Context(), workout); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	updateRecords(request.Context(), workout.UserId)
+	if err = flagRecords(request.Context(), []Workout{workout}); err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	u.out().workout(&workout)
+	writeJson(writer, request, http.StatusOK, workout)
+}
+
+func deleteWorkout(writer http.ResponseWriter, request *http.Request) {
+	workout, err := workouts.Get(request.Context(), chi.URLParam(request, "id"))
+	if err == nil {
+		err = workouts.Delete(request.Context(), workout.Id)
+	}
+	if err == nil {
+		err = activities.DeleteWorkoutActivities(request.Context(), workout.Id)
+	}
+	if err != nil {
+		writeError(writer, request, err)
+		return
+	}
+	updateRecords(request.Context(), workout.UserId)
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// checkWorkout performs the checks that can't be expressed in the Workout schema (and normalizes absent lists)
+func checkWorkout(ctx context.Context, workout *Workout) error {
+	if workout.Exercises == nil {
+		workout.Exercises = []WorkoutExercise{}
+	}
+	for i := range workout.Exercises {
+		if workout.Exercises[i].Sets == nil {
+			workout.Exercises[i].Sets = []WorkoutSet{}
+		}
+		for j := range workout.Exercises[i].Sets {
+			workout.Exercises[i].Sets[j].PersonalRecords = nil
+		}
+	}
+	errs := make([]FieldError, 0)
+	if _, err := users.Get(ctx, workout.UserId); errors.Is(err, ErrNotFound) {
+		errs = append(errs, FieldError{Path: "userId", Message: "user does not exist"})
+	} else if err != nil {
+		return err
+	}
+	for i, we := range workout.Exercises {
+		if e, err := exercises.Get(ctx, we.ExerciseId); errors.Is(err, ErrNotFound) || (err == nil && e.UserId != "" && e.UserId != workout.UserId) {
+			errs = append(errs, FieldError{Path: fmt.Sprintf("exercises[%d].exerciseId", i), Message: "exercise does not exist"})
+		} else if err != nil {
+			return err
+		}
+	}
+	if workout.EndTime != nil && workout.EndTime.Before(workout.StartTime) {
+		errs = append(errs, FieldError{Path: "endTime", Message: "must not be before startTime"})
+	}
+	if len(errs) > 0 {
+		p := newProblem(http.StatusUnprocessableEntity, "workout failed validation")
+		p.Errors = errs
+		return p
+	}
+	return nil
+}
+
+// queryTime parses an optional date-time (RFC 3339) or date (YYYY-MM-DD) query param
+func queryTime(request *http.Request, name string) (time.Time, error) {
+	v := request.URL.Query().Get(name)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, newProblem(http.StatusBadRequest, "query param %q must be a date-time or date", name)
+}